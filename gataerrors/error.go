@@ -13,7 +13,7 @@ func NewGataError(message string) *GataError {
 func (error *GataError) Error() string {
 	message := error.Message
 
-	if len(error.Underlying.Error()) > 0 {
+	if error.Underlying != nil && len(error.Underlying.Error()) > 0 {
 		message += "\nUnderlying: " + error.Underlying.Error()
 	}
 
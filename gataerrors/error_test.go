@@ -34,6 +34,10 @@ func TestGataError_Error(t *testing.T) {
 	if gataerror.Error() != errorString {
 		t.Error("failed to generate correct error message")
 	}
+
+	if NewGataError("message string").Error() != "message string" {
+		t.Error("failed to generate correct error message without an underlying error")
+	}
 }
 
 func TestGataError_IsSame(t *testing.T) {
@@ -5,11 +5,13 @@ import (
 )
 
 func main() {
-	_, err := storage.NewImmutableFile("/go/src/github.com/codingbeard/gatabase/data/test.txt")
+	file, err := storage.NewImmutableFile("/go/src/github.com/codingbeard/gatabase/data/test.txt")
 
 	if err != nil {
 		panic(err)
 	}
 
+	defer file.Close()
+
 
 }
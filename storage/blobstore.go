@@ -0,0 +1,285 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+const (
+	// The size of a blob's reference count, stored inline with its location
+	blobReferencesSize = 8
+)
+
+var (
+	BlobStoreNotFoundError      = gataerrors.NewGataError("no blob is stored with this hash")
+	BlobStoreCorruptError       = gataerrors.NewGataError("blob does not match its hash")
+	BlobStoreNotReferencedError = gataerrors.NewGataError("blob has no references left to release")
+	blobStoreWriteError         = gataerrors.NewGataError("unable to write blob")
+	blobStoreIndexError         = gataerrors.NewGataError("unable to read the blob index")
+)
+
+// The SHA-256 digest of a blob's contents, which identifies it in a BlobStore
+type BlobHash [sha256.Size]byte
+
+// A content addressed store of blobs on top of an append only data file. Each
+// Distinct blob is stored once however many times it is put and is reference
+// Counted so blobs nobody refers to can be left behind by Compact. The index
+// Maps each blob's hash to its location, with the reference count stored as
+// The element's inline value so both are written together and the count can
+// Be updated in place
+type BlobStore struct {
+	Data  *ImmutableFile
+	Index *BTree
+}
+
+// Construct a blob store appending blobs to data and indexing them in index,
+// Which should be empty or already hold a blob store's index. The index's
+// MaxInlineValueSize is raised to fit the reference counts if it is smaller
+func NewBlobStore(data *ImmutableFile, index *BTree) (*BlobStore) {
+	if index.MaxInlineValueSize < blobReferencesSize {
+		index.MaxInlineValueSize = blobReferencesSize
+	}
+
+	return &BlobStore{Data: data, Index: index}
+}
+
+// Hash a blob's contents
+func HashBlob(blob []byte) (BlobHash) {
+	return BlobHash(sha256.Sum256(blob))
+}
+
+// The hash as hex
+func (hash BlobHash) String() (string) {
+	return hex.EncodeToString(hash[:])
+}
+
+// Store a blob and take a reference to it, returning its hash. A blob which is
+// Already stored is not written again
+func (store *BlobStore) PutBlob(blob []byte) (BlobHash, error) {
+	hash := HashBlob(blob)
+
+	_, err := store.Index.Find(blobKey(hash))
+
+	if err == nil {
+		return hash, store.AddReference(hash)
+	}
+
+	if !BTreeKeyNotFoundError.IsSame(err) {
+		return hash, blobStoreIndexError.SetUnderlying(err)
+	}
+
+	location, err := store.Data.Append(blob)
+
+	if err != nil {
+		return hash, blobStoreWriteError.SetUnderlying(err)
+	}
+
+	err = store.Index.InsertWithValue(blobKey(hash), location, serialiseBlobReferences(1))
+
+	if err != nil {
+		return hash, blobStoreWriteError.SetUnderlying(err)
+	}
+
+	return hash, nil
+}
+
+// Read a blob back by its hash, checking its contents still match it
+func (store *BlobStore) GetBlob(hash BlobHash) ([]byte, error) {
+	location, err := store.location(hash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	blob, err := store.Data.ReadAt(location)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if HashBlob(blob) != hash {
+		return nil, BlobStoreCorruptError
+	}
+
+	return blob, nil
+}
+
+// Take another reference to a stored blob
+func (store *BlobStore) AddReference(hash BlobHash) (error) {
+	location, count, err := store.entry(hash)
+
+	if err != nil {
+		return err
+	}
+
+	return store.setReferences(hash, location, count+1)
+}
+
+// Release a reference to a blob, once none are left it is garbage and will
+// Not be copied by Compact
+func (store *BlobStore) Release(hash BlobHash) (error) {
+	location, count, err := store.entry(hash)
+
+	if err != nil {
+		return err
+	}
+
+	if count <= 0 {
+		return BlobStoreNotReferencedError
+	}
+
+	return store.setReferences(hash, location, count-1)
+}
+
+// The number of references held to a blob
+func (store *BlobStore) References(hash BlobHash) (int64, error) {
+	_, count, err := store.entry(hash)
+
+	return count, err
+}
+
+// The hashes of the blobs which have no references left
+func (store *BlobStore) Unreferenced() ([]BlobHash, error) {
+	unreferenced := make([]BlobHash, 0)
+
+	err := store.each(func(hash BlobHash, count int64) (error) {
+		if count <= 0 {
+			unreferenced = append(unreferenced, hash)
+		}
+
+		return nil
+	})
+
+	return unreferenced, err
+}
+
+// Copy every blob which is still referenced, along with its reference count,
+// Into destination, which should be empty. Unreferenced blobs are left behind
+// So the space they take up is reclaimed once the old store is removed
+func (store *BlobStore) Compact(destination *BlobStore) (error) {
+	return store.each(func(hash BlobHash, count int64) (error) {
+		if count <= 0 {
+			return nil
+		}
+
+		blob, err := store.GetBlob(hash)
+
+		if err != nil {
+			return err
+		}
+
+		newLocation, err := destination.Data.Append(blob)
+
+		if err != nil {
+			return blobStoreWriteError.SetUnderlying(err)
+		}
+
+		err = destination.Index.InsertWithValue(blobKey(hash), newLocation, serialiseBlobReferences(count))
+
+		if err != nil {
+			return blobStoreWriteError.SetUnderlying(err)
+		}
+
+		return nil
+	})
+}
+
+// The location of a stored blob
+func (store *BlobStore) location(hash BlobHash) (int64, error) {
+	location, err := store.Index.Find(blobKey(hash))
+
+	if BTreeKeyNotFoundError.IsSame(err) {
+		return 0, BlobStoreNotFoundError
+	}
+
+	if err != nil {
+		return 0, blobStoreIndexError.SetUnderlying(err)
+	}
+
+	return location, nil
+}
+
+// The location and reference count of a stored blob
+func (store *BlobStore) entry(hash BlobHash) (int64, int64, error) {
+	location, err := store.location(hash)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	value, err := store.Index.Get(blobKey(hash))
+
+	if err != nil {
+		return 0, 0, blobStoreIndexError.SetUnderlying(err)
+	}
+
+	return location, deserialiseBlobReferences(value), nil
+}
+
+// Replace the reference count of a stored blob
+func (store *BlobStore) setReferences(hash BlobHash, location int64, count int64) (error) {
+	err := store.Index.update(blobKey(hash), location, serialiseBlobReferences(count), true)
+
+	if err != nil {
+		return blobStoreWriteError.SetUnderlying(err)
+	}
+
+	return nil
+}
+
+// Call callback with the hash and reference count of every blob
+func (store *BlobStore) each(callback func(hash BlobHash, count int64) error) (error) {
+	hashes := make([]BlobHash, 0)
+	counts := make([]int64, 0)
+
+	err := store.Index.Range(nil, nil, func(key interface{}, value []byte) bool {
+		digest, ok := key.([]byte)
+
+		if ok && len(digest) == sha256.Size {
+			hash := BlobHash{}
+			copy(hash[:], digest)
+			hashes = append(hashes, hash)
+			counts = append(counts, deserialiseBlobReferences(value))
+		}
+
+		return true
+	})
+
+	if err != nil {
+		return blobStoreIndexError.SetUnderlying(err)
+	}
+
+	for i, hash := range hashes {
+		err = callback(hash, counts[i])
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The key a blob is indexed under
+func blobKey(hash BlobHash) ([]byte) {
+	return hash[:]
+}
+
+// Serialise a reference count to store inline with a blob's location
+func serialiseBlobReferences(count int64) ([]byte) {
+	serialised := make([]byte, blobReferencesSize)
+	binary.BigEndian.PutUint64(serialised, uint64(count))
+
+	return serialised
+}
+
+// Deserialise a reference count, an element without a whole count has none
+func deserialiseBlobReferences(serialised []byte) (int64) {
+	if len(serialised) != blobReferencesSize {
+		return 0
+	}
+
+	return int64(binary.BigEndian.Uint64(serialised))
+}
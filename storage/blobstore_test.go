@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"testing"
+)
+
+func newTestBlobStore(t *testing.T) (*BlobStore) {
+	data, err := NewMemoryImmutableFile(make([]byte, 0), make([]byte, 0))
+	if err != nil {
+		t.Error(err)
+	}
+
+	index, err := OpenBTree(&MemoryFileHandle{}, 32, true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	return NewBlobStore(&data, &index)
+}
+
+func TestBlobStore_PutGetBlob(t *testing.T) {
+	store := newTestBlobStore(t)
+	attachment := bytes.Repeat([]byte("attachment "), 100)
+
+	hash, err := store.PutBlob(attachment)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if hash != HashBlob(attachment) || len(hash.String()) != 64 {
+		t.Error("expected the blob to be identified by its SHA-256 hash, got:", hash)
+	}
+
+	size := len(store.Data.DataHandle.(*MemoryFileHandle).data)
+
+	// The same contents are only stored once
+	again, err := store.PutBlob(append([]byte{}, attachment...))
+	if err != nil || again != hash {
+		t.Error("expected the same hash putting the blob again, got:", again, err)
+	}
+
+	if len(store.Data.DataHandle.(*MemoryFileHandle).data) != size {
+		t.Error("blob was stored twice")
+	}
+
+	other, err := store.PutBlob([]byte("another attachment"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	for blob, hash := range map[string]BlobHash{string(attachment): hash, "another attachment": other} {
+		read, err := store.GetBlob(hash)
+		if err != nil || string(read) != blob {
+			t.Error("did not get back blob", hash, err)
+		}
+	}
+
+	_, err = store.GetBlob(HashBlob([]byte("never stored")))
+	if !BlobStoreNotFoundError.IsSame(err) {
+		t.Error("expected BlobStoreNotFoundError, got:", err)
+	}
+
+	// A blob whose contents no longer match its hash
+	data := store.Data.DataHandle.(*MemoryFileHandle)
+	data.data[len(data.data)-1] ^= 1
+	record := data.data[len(data.data)-len("another attachment")-immutableFileRecordHeaderLength:]
+	binary.BigEndian.PutUint32(record[5:9], immutableFileRecordChecksum(record, record[immutableFileRecordHeaderLength:]))
+
+	_, err = store.GetBlob(other)
+	if !BlobStoreCorruptError.IsSame(err) {
+		t.Error("expected BlobStoreCorruptError, got:", err)
+	}
+}
+
+func TestBlobStore_ManyBlobs(t *testing.T) {
+	data, err := NewMemoryImmutableFile(make([]byte, 0), make([]byte, 0))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// A small node size so the index has to grow past its root
+	index, err := OpenBTree(&MemoryFileHandle{}, 4, true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	store := NewBlobStore(&data, &index)
+	hashes := make([]BlobHash, 0)
+
+	for i := 0; i < 40; i++ {
+		hash, err := store.PutBlob([]byte("blob " + strconv.Itoa(i)))
+		if err != nil {
+			t.Error(err)
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	for i := 0; i < 10; i++ {
+		err = store.AddReference(hashes[0])
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	for i, hash := range hashes {
+		read, err := store.GetBlob(hash)
+		if err != nil || string(read) != "blob "+strconv.Itoa(i) {
+			t.Error("did not get back blob", i, err)
+		}
+	}
+
+	count, err := store.References(hashes[0])
+	if err != nil || count != 11 {
+		t.Error("expected 11 references, got:", count, err)
+	}
+}
+
+func TestBlobStore_References(t *testing.T) {
+	store := newTestBlobStore(t)
+
+	kept, err := store.PutBlob([]byte("kept"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = store.PutBlob([]byte("kept"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	released, err := store.PutBlob([]byte("released"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = store.AddReference(released)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = store.Release(released)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	err = store.Release(released)
+	if !BlobStoreNotReferencedError.IsSame(err) {
+		t.Error("expected BlobStoreNotReferencedError releasing an unreferenced blob, got:", err)
+	}
+
+	err = store.AddReference(HashBlob([]byte("never stored")))
+	if !BlobStoreNotFoundError.IsSame(err) {
+		t.Error("expected BlobStoreNotFoundError, got:", err)
+	}
+
+	for hash, expected := range map[BlobHash]int64{kept: 2, released: 0} {
+		count, err := store.References(hash)
+		if err != nil || count != expected {
+			t.Error("expected", expected, "references, got:", count, err)
+		}
+	}
+
+	// The reference count is stored with the location so a blob is one entry
+	entries := 0
+
+	err = store.Index.Range(nil, nil, func(key interface{}, value []byte) bool {
+		entries++
+		return true
+	})
+	if err != nil || entries != 2 {
+		t.Error("expected one index entry per blob, got:", entries, err)
+	}
+
+	unreferenced, err := store.Unreferenced()
+	if err != nil || len(unreferenced) != 1 || unreferenced[0] != released {
+		t.Error("expected only the released blob to be unreferenced, got:", unreferenced, err)
+	}
+
+	// Compacting leaves the garbage behind
+	destination := newTestBlobStore(t)
+
+	err = store.Compact(destination)
+	if err != nil {
+		t.Error(err)
+	}
+
+	read, err := destination.GetBlob(kept)
+	if err != nil || string(read) != "kept" {
+		t.Error("referenced blob was not copied", string(read), err)
+	}
+
+	count, err := destination.References(kept)
+	if err != nil || count != 2 {
+		t.Error("reference count was not copied, got:", count, err)
+	}
+
+	_, err = destination.GetBlob(released)
+	if !BlobStoreNotFoundError.IsSame(err) {
+		t.Error("expected the unreferenced blob to be left behind, got:", err)
+	}
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"math"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+const (
+	// Bit count, hash count, item count and target false positive rate
+	bloomFilterHeaderLength = 8 + 4 + 8 + 8
+)
+
+var (
+	DeserialiseBloomFilterReadError    = gataerrors.NewGataError("unable to read bloom filter from Reader")
+	DeserialiseBloomFilterInvalidError = gataerrors.NewGataError("bloom filter header does not match its contents")
+)
+
+// A bloom filter which can say a key is definitely not present
+type BloomFilter struct {
+	Bits              []uint64
+	BitCount          uint64
+	HashCount         uint32
+	ItemCount         uint64
+	FalsePositiveRate float64
+}
+
+// Construct a bloom filter sized to hold expectedItems keys while keeping false
+// Positives at or below falsePositiveRate
+func NewBloomFilter(expectedItems uint64, falsePositiveRate float64) (*BloomFilter) {
+	if expectedItems == 0 {
+		expectedItems = 1
+	}
+
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		falsePositiveRate = 0.01
+	}
+
+	bitCount := uint64(math.Ceil(-float64(expectedItems) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	bitCount = ((bitCount + 63) / 64) * 64
+
+	hashCount := uint32(math.Round(float64(bitCount) / float64(expectedItems) * math.Ln2))
+
+	if hashCount < 1 {
+		hashCount = 1
+	}
+
+	return &BloomFilter{
+		Bits:              make([]uint64, bitCount/64),
+		BitCount:          bitCount,
+		HashCount:         hashCount,
+		FalsePositiveRate: falsePositiveRate,
+	}
+}
+
+// Deserialise a bloom filter written by Serialise
+func DeserialiseBloomFilter(reader io.Reader) (*BloomFilter, error) {
+	header := make([]byte, bloomFilterHeaderLength)
+	_, err := io.ReadFull(reader, header)
+
+	if err != nil {
+		return nil, DeserialiseBloomFilterReadError.SetUnderlying(err)
+	}
+
+	filter := &BloomFilter{
+		BitCount:          binary.BigEndian.Uint64(header[0:8]),
+		HashCount:         binary.BigEndian.Uint32(header[8:12]),
+		ItemCount:         binary.BigEndian.Uint64(header[12:20]),
+		FalsePositiveRate: math.Float64frombits(binary.BigEndian.Uint64(header[20:28])),
+	}
+
+	if filter.BitCount == 0 || filter.BitCount%64 != 0 || filter.HashCount == 0 {
+		return nil, DeserialiseBloomFilterInvalidError
+	}
+
+	words := make([]byte, filter.BitCount/8)
+	_, err = io.ReadFull(reader, words)
+
+	if err != nil {
+		return nil, DeserialiseBloomFilterReadError.SetUnderlying(err)
+	}
+
+	filter.Bits = make([]uint64, filter.BitCount/64)
+
+	for i := range filter.Bits {
+		filter.Bits[i] = binary.BigEndian.Uint64(words[i*8:])
+	}
+
+	return filter, nil
+}
+
+// Add a key to the filter, returns the indexes of the words which changed so
+// A persisted copy can be updated in place
+func (filter *BloomFilter) Add(key []byte) ([]int) {
+	changed := make([]int, 0)
+
+	for _, bit := range filter.bitLocations(key) {
+		word := int(bit / 64)
+		mask := uint64(1) << (bit % 64)
+
+		if filter.Bits[word]&mask == 0 {
+			filter.Bits[word] |= mask
+			changed = append(changed, word)
+		}
+	}
+
+	filter.ItemCount++
+
+	return changed
+}
+
+// Whether the key may have been added, false means it definitely was not
+func (filter *BloomFilter) MayContain(key []byte) (bool) {
+	for _, bit := range filter.bitLocations(key) {
+		if filter.Bits[bit/64]&(uint64(1)<<(bit%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Estimate the current false positive rate from the number of items added
+func (filter *BloomFilter) EstimatedFalsePositiveRate() (float64) {
+	return math.Pow(
+		1-math.Exp(-float64(filter.HashCount)*float64(filter.ItemCount)/float64(filter.BitCount)),
+		float64(filter.HashCount),
+	)
+}
+
+// Serialise the filter as a fixed length header followed by the bit words
+// Word i is always found at bloomFilterHeaderLength + i*8
+func (filter *BloomFilter) Serialise() ([]byte) {
+	serialised := make([]byte, bloomFilterHeaderLength+len(filter.Bits)*8)
+
+	binary.BigEndian.PutUint64(serialised[0:8], filter.BitCount)
+	binary.BigEndian.PutUint32(serialised[8:12], filter.HashCount)
+	binary.BigEndian.PutUint64(serialised[12:20], filter.ItemCount)
+	binary.BigEndian.PutUint64(serialised[20:28], math.Float64bits(filter.FalsePositiveRate))
+
+	for i, word := range filter.Bits {
+		binary.BigEndian.PutUint64(serialised[bloomFilterHeaderLength+i*8:], word)
+	}
+
+	return serialised
+}
+
+// The bits a key maps to, using double hashing of a single 64 bit hash
+func (filter *BloomFilter) bitLocations(key []byte) ([]uint64) {
+	hash := fnv.New64a()
+	hash.Write(key)
+	sum := hash.Sum64()
+
+	first := sum & 0xffffffff
+	second := sum >> 32
+
+	locations := make([]uint64, filter.HashCount)
+
+	for i := range locations {
+		locations[i] = (first + uint64(i)*second) % filter.BitCount
+	}
+
+	return locations
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"testing"
+	"strconv"
+	"bytes"
+)
+
+func TestNewBloomFilter(t *testing.T) {
+	filter := NewBloomFilter(1000, 0.01)
+
+	if filter.BitCount < 9000 || filter.BitCount%64 != 0 {
+		t.Error("bloom filter was not sized correctly for 1000 items at 1%, got bits:", filter.BitCount)
+	}
+
+	if filter.HashCount != 7 {
+		t.Error("expected 7 hashes for a 1% false positive rate, got:", filter.HashCount)
+	}
+
+	if uint64(len(filter.Bits)*64) != filter.BitCount {
+		t.Error("bit words do not match the bit count")
+	}
+}
+
+func TestBloomFilter_AddMayContain(t *testing.T) {
+	filter := NewBloomFilter(1000, 0.01)
+
+	for i := 0; i < 1000; i++ {
+		filter.Add([]byte("key" + strconv.Itoa(i)))
+	}
+
+	for i := 0; i < 1000; i++ {
+		if !filter.MayContain([]byte("key" + strconv.Itoa(i))) {
+			t.Error("bloom filter returned a false negative for key", i)
+		}
+	}
+
+	falsePositives := 0
+
+	for i := 0; i < 10000; i++ {
+		if filter.MayContain([]byte("missing" + strconv.Itoa(i))) {
+			falsePositives++
+		}
+	}
+
+	if falsePositives > 300 {
+		t.Error("false positive rate is far above the configured 1%, got:", falsePositives, "in 10000")
+	}
+
+	if filter.ItemCount != 1000 {
+		t.Error("expected item count of 1000, got:", filter.ItemCount)
+	}
+
+	if filter.EstimatedFalsePositiveRate() > 0.02 {
+		t.Error("estimated false positive rate unexpectedly high:", filter.EstimatedFalsePositiveRate())
+	}
+}
+
+func TestDeserialiseBloomFilter(t *testing.T) {
+	filter := NewBloomFilter(100, 0.05)
+	filter.Add([]byte("a"))
+	filter.Add([]byte("b"))
+
+	deserialised, err := DeserialiseBloomFilter(bytes.NewReader(filter.Serialise()))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !bytes.Equal(deserialised.Serialise(), filter.Serialise()) {
+		t.Error("deserialised bloom filter does not match original")
+	}
+
+	if !deserialised.MayContain([]byte("a")) || !deserialised.MayContain([]byte("b")) {
+		t.Error("deserialised bloom filter lost keys")
+	}
+
+	_, err = DeserialiseBloomFilter(bytes.NewReader(make([]byte, bloomFilterHeaderLength)))
+
+	if !DeserialiseBloomFilterInvalidError.IsSame(err) {
+		t.Error("did not get expected error when deserialising an invalid header")
+	}
+}
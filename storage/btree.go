@@ -2,9 +2,7 @@ package storage
 
 import (
 	"io"
-	"strconv"
 	"github.com/codingbeard/gatabase/gataerrors"
-	"fmt"
 )
 
 const (
@@ -21,19 +19,60 @@ var (
 	btreeWriteNodeWriteError = gataerrors.NewGataError("unable to write to index readWriteSeeker")
 	btreeWriteError = gataerrors.NewGataError("unable to write to index readWriteSeeker")
 	btreeWriteRootWriteNodeError = gataerrors.NewGataError("unable to write root node to end of ReadWriteSeeker")
-	btreeWriteRootSeekStartIndexError = gataerrors.NewGataError("unable to seek to the start of the ReadWriteSeeker")
 	btreeWriteRootWriteRootLocationError = gataerrors.NewGataError("unable to write the location of the root in the ReadWriteSeeker")
 	BtreeFindGetRootError = gataerrors.NewGataError("error when attempting to find a key, the root could not be found")
 	btreeFindNodeByKeyNearestNodeFoundError = gataerrors.NewGataError("did not find the node containing the key but did find the nearest node")
 	BtreeIndexSeekError = gataerrors.NewGataError("error when seeking in index")
+	BTreeInlineValueTooLargeError = gataerrors.NewGataError("inline value is larger than the btree's MaxInlineValueSize")
+	BTreeNoInlineValueError = gataerrors.NewGataError("key does not have an inline value")
+	BTreeUnsupportedKeyTypeError = gataerrors.NewGataError("key must be an int64, string, time.Time, []byte, Tuple or registered Key")
 )
 
 // BTree index
 type BTree struct {
 	Index io.ReadWriteSeeker
+	// Optional handle nodes are read through instead of the Index, such as an
+	// MmapFileHandle of the index's file
+	ReadHandle io.ReadSeeker
 	cache map[int64]BTreeNode
 	MaxElementsPerNode int8
 	Unique bool
+	// The longest string key stored inside a node, the rest of a longer key
+	// Is moved into overflow records. Zero stores every key inline. Recorded
+	// In the page table when the first key is inserted
+	MaxInlineKeySize int
+	// The largest value which can be stored inline in an element alongside
+	// Its key. Zero disables inline values. Recorded in the page table when
+	// The first key is inserted
+	MaxInlineValueSize int
+	bloom *BloomFilter
+	bloomIndex io.ReadWriteSeeker
+	// The checksum of the bloom filter, kept up to date as keys are added
+	bloomChecksum uint64
+	// Whether writing to the persisted bloom filter failed, keys are then only
+	// Added to the filter in memory until it is rebuilt
+	bloomStale bool
+	bloomExpectedItems uint64
+	bloomFalsePositiveRate float64
+	stats BTreeStats
+	// Log size after which the write ahead log is checkpointed
+	WriteAheadLogCheckpointSize int64
+	wal *WriteAheadLog
+	walTransaction uint64
+	walInTransaction bool
+	// When the index and write ahead log are synced to stable storage
+	Durability SyncPolicy
+	durability durabilityState
+	// Limits how much the index, its write ahead log and its bloom filter can
+	// Grow, shared with the database's other files. It should be set before
+	// The log is enabled. Space already used by an existing index, log or
+	// Bloom filter should be counted with Quota.Use
+	Quota *Quota
+	// Encrypts nodes, overflow records and log records, nil if the index is
+	// Not encrypted
+	encryption *fileEncryption
+	// Where the newest copy of each node is, nil until it is first needed
+	pages *btreePageTable
 }
 
 // Construct a new btree index
@@ -42,129 +81,532 @@ func NewBTree(index io.ReadWriteSeeker, maxElementCount int8, unique bool) (BTre
 		Index:index,
 		MaxElementsPerNode:maxElementCount,
 		Unique:unique,
+		durability:newDurabilityState(),
 	}
 }
 
 // Insert a new key-location pair to the index
 func (tree *BTree) Insert(key interface{}, location int64) (error) {
+	return tree.insert(key, location, nil, false)
+}
+
+// Insert a new key-location pair to the index with a small value stored inline
+// In the element so it can be read with Get without touching the data file
+func (tree *BTree) InsertWithValue(key interface{}, location int64, value []byte) (error) {
+	if len(value) > tree.MaxInlineValueSize {
+		return BTreeInlineValueTooLargeError
+	}
+
+	return tree.insert(key, location, value, true)
+}
 
-	_, isInt := key.(int64)
-	_, isString := key.(int64)
-	_, isDate := key.(int64)
+// Insert a new element to the index
+func (tree *BTree) insert(key interface{}, location int64, value []byte, hasValue bool) (error) {
 
-	var keyType int8
+	keyType, ok := keyTypeOf(key)
 
-	if isInt {
-		keyType = btreeElementTypeInt
-	} else if isString {
-		keyType = btreeElementTypeString
-	} else if isDate {
-		keyType = btreeElementTypeDate
+	if !ok {
+		return BTreeUnsupportedKeyTypeError
 	}
 
-	node, err := tree.findNodeByKey(0, key)
+	path, err := tree.findPathByKey(0, key)
 	if err == nil {
 		return BTreeDuplicateKeyError
 	}
 
-	if int8(len(node.Elements)) < tree.MaxElementsPerNode {
-		node.AddElement(NewBTreeElement(keyType, key, location, btreeElementNoChildValue, btreeElementNoChildValue))
+	if !btreeFindNodeByKeyNearestNodeFoundError.IsSame(err) {
+		return err
+	}
+
+	element := NewBTreeElement(keyType, key, location, btreeElementNoChildValue, btreeElementNoChildValue)
+	element.Value = value
+	element.HasValue = hasValue
+
+	err = tree.beginTransaction(element)
+
+	if err != nil {
+		return err
+	}
+
+	err = tree.setKeyType(keyType)
+
+	if err != nil {
+		tree.endTransaction(true)
+		return err
+	}
+
+	table, err := tree.pageTable()
+
+	if err != nil {
+		tree.endTransaction(true)
+		return err
+	}
+
+	table.keys++
+
+	err = tree.insertElement(table, path, element)
+
+	if err == nil {
+		err = tree.commitPageTable()
+	}
+
+	if err != nil {
+		// Read the table back rather than keep the nodes and count of a
+		// Failed insert
+		tree.pages = nil
+		tree.endTransaction(true)
+		return err
+	}
+
+	err = tree.endTransaction(false)
+
+	if err != nil {
+		return err
+	}
+
+	// The key is in the index now so nothing which fails after this is
+	// Returned, as retrying the insert would find it. The persisted bloom
+	// Filter is rebuilt when it is next enabled as it will not match the number
+	// Of keys, and a failed sync is counted in SyncStats and tried again by
+	// The next write or Sync
+	tree.bloomAdd(key)
+	tree.durability.afterWrite(tree.Durability, tree.syncHandles()...)
+
+	return nil
+}
 
-		if node.ParentId == btreeNodeParentIdNoValue {
-			tree.writeRoot(node)
-		} else {
-			tree.writeNode(node)
+// Add an element to the last node of path, which findPathByKey found to be
+// Where its key belongs. A node left with more than MaxElementsPerNode
+// Elements is split around its middle element, which is added to the node
+// Above it in the same way, and a root which splits gets a new root above it.
+// The nodes are written but the page table is left for the caller to commit
+func (tree *BTree) insertElement(table *btreePageTable, path []BTreeNode, element BTreeElement) (error) {
+	for level := len(path) - 1; level >= 0; level-- {
+		node := path[level]
+		node.addLinkedElement(element)
+
+		// Both halves of a split need at least one element
+		if len(node.Elements) <= int(tree.MaxElementsPerNode) || len(node.Elements) < 3 {
+			id, err := tree.writeNode(node)
+
+			if err != nil {
+				return err
+			}
+
+			if level == 0 {
+				table.root = id
+			}
+
+			return nil
+		}
+
+		left, middle, right := node.split()
+
+		if level == 0 {
+			left.ParentId = table.allocate()
+			right.ParentId = left.ParentId
+		}
+
+		leftId, err := tree.writeNode(left)
+
+		if err != nil {
+			return err
+		}
+
+		rightId, err := tree.writeNode(right)
+
+		if err != nil {
+			return err
+		}
+
+		middle.LessLocation = int64(leftId)
+		middle.MoreLocation = int64(rightId)
+		element = middle
+
+		if level == 0 {
+			root := NewBTreeNode(false, btreeNodeParentIdNoValue, left.ParentId, []BTreeElement{middle}, make([]int32, 0))
+			_, err = tree.writeNode(root)
+
+			if err != nil {
+				return err
+			}
+
+			table.root = root.Id
 		}
 	}
 
 	return nil
 }
 
+// Change the location an existing key points at and the value stored inline
+// With it. Only the blob store updates keys, the public API is insert only
+func (tree *BTree) update(key interface{}, location int64, value []byte, hasValue bool) (error) {
+	if _, ok := keyTypeOf(key); !ok {
+		return BTreeUnsupportedKeyTypeError
+	}
+
+	if len(value) > tree.MaxInlineValueSize {
+		return BTreeInlineValueTooLargeError
+	}
+
+	node, err := tree.findNodeByKey(0, key)
+
+	if btreeFindNodeByKeyNearestNodeFoundError.IsSame(err) {
+		return BTreeKeyNotFoundError
+	}
+
+	if err != nil {
+		return err
+	}
+
+	element, err := node.GetElementByKey(key)
+
+	if err != nil {
+		return BTreeKeyNotFoundError
+	}
+
+	element.Location = location
+	element.Value = value
+	element.HasValue = hasValue
+
+	err = tree.checkInlineLimits()
+
+	if err != nil {
+		return err
+	}
+
+	err = tree.beginUpdate(*element)
+
+	if err != nil {
+		return err
+	}
+
+	err = tree.commitNode(node)
+
+	if err != nil {
+		tree.endTransaction(true)
+		return err
+	}
+
+	err = tree.endTransaction(false)
+
+	if err != nil {
+		return err
+	}
+
+	// The new location is in the index now, a failed sync is counted in
+	// SyncStats and tried again by the next write or Sync
+	tree.durability.afterWrite(tree.Durability, tree.syncHandles()...)
+
+	return nil
+}
+
 // Find the location of a key
 func (tree *BTree) Find(key interface{}) (int64, error) {
+	if tree.bloomExcludes(key) {
+		return 0, BTreeKeyNotFoundError
+	}
+
 	node, err := tree.findNodeByKey(0, key)
 
 	if err != nil && btreeFindNodeByKeyNearestNodeFoundError.IsSame(err) {
+		tree.bloomMissed()
 		return 0, BTreeKeyNotFoundError
 	}
 
 	element, err := node.GetElementByKey(key)
 
 	if err != nil {
+		tree.bloomMissed()
 		return 0, BTreeKeyNotFoundError
 	}
 
 	return element.Location, nil
 }
 
-// Find the node a key belongs to or the nearest node to it
-func (tree *BTree) findNodeByKey(location int64, key interface{}) (BTreeNode, error) {
-	// If we're starting from the root
-	if location == 0 {
-		node, err := tree.getRoot()
+// Get the value stored inline with a key
+func (tree *BTree) Get(key interface{}) ([]byte, error) {
+	if tree.bloomExcludes(key) {
+		return nil, BTreeKeyNotFoundError
+	}
 
-		if err != nil && !bTreeNoRootError.IsSame(err) {
-			return node, BtreeFindGetRootError.SetUnderlying(err)
+	node, err := tree.findNodeByKey(0, key)
+
+	if err != nil && btreeFindNodeByKeyNearestNodeFoundError.IsSame(err) {
+		tree.bloomMissed()
+		return nil, BTreeKeyNotFoundError
+	}
+
+	element, err := node.GetElementByKey(key)
+
+	if err != nil {
+		tree.bloomMissed()
+		return nil, BTreeKeyNotFoundError
+	}
+
+	if !element.HasValue {
+		return nil, BTreeNoInlineValueError
+	}
+
+	return element.Value, nil
+}
+
+// Call callback in key order with the key and inline value of every element
+// Between start and end inclusive, a nil start or end leaves that side open
+// Returning false from the callback stops the scan
+func (tree *BTree) Range(start interface{}, end interface{}, callback func(key interface{}, value []byte) bool) (error) {
+	root, err := tree.getRoot()
+
+	if bTreeNoRootError.IsSame(err) {
+		return nil
+	}
+
+	if err != nil {
+		return BtreeFindGetRootError.SetUnderlying(err)
+	}
+
+	_, err = tree.rangeNode(root, start, end, callback)
+
+	return err
+}
+
+// Scan a node and its children in key order, returns false once the callback
+// Has asked to stop
+func (tree *BTree) rangeNode(node BTreeNode, start interface{}, end interface{}, callback func(key interface{}, value []byte) bool) (bool, error) {
+	for i := range node.Elements {
+		element := &node.Elements[i]
+
+		// Children shared with the previous element have already been scanned
+		lessLocation := element.LessLocation
+		if i > 0 && node.Elements[i-1].MoreLocation == lessLocation {
+			lessLocation = btreeElementNoChildValue
 		}
 
-		// If the key is in the root, return that
-		if _, err = node.GetElementByKey(key); err == nil {
-			return node, nil
+		if lessLocation != btreeElementNoChildValue && (start == nil || element.CompareKey(start) > 0) {
+			child, err := tree.readNodeById(int32(lessLocation))
+
+			if err != nil {
+				return false, err
+			}
+
+			carryOn, err := tree.rangeNode(child, start, end, callback)
+
+			if err != nil || !carryOn {
+				return carryOn, err
+			}
 		}
 
-		nearestNodeLocation, err := node.GetNearestNodeLocationByKey(key)
+		if end != nil && element.CompareKey(end) > 0 {
+			return false, nil
+		}
 
-		if err != nil && NoNearestNodeFoundByKeyError.IsSame(err) {
-			return node, btreeFindNodeByKeyNearestNodeFoundError
+		if !element.IsSeparator() && (start == nil || element.CompareKey(start) >= 0) {
+			if !callback(element.GetKey(), element.Value) {
+				return false, nil
+			}
 		}
 
-		return tree.findNodeByKey(nearestNodeLocation, key)
+		if element.MoreLocation != btreeElementNoChildValue && (end == nil || element.CompareKey(end) < 0) {
+			child, err := tree.readNodeById(int32(element.MoreLocation))
+
+			if err != nil {
+				return false, err
+			}
+
+			carryOn, err := tree.rangeNode(child, start, end, callback)
+
+			if err != nil || !carryOn {
+				return carryOn, err
+			}
+		}
 	}
 
-	// We're now recursing
-	node, err := tree.readNode(location)
+	return true, nil
+}
+
+// Copy every node still reachable from the root into destination's index
+// Leaving behind superseded nodes and page tables, then rebuild destination's
+// Bloom filter. Destination should have an empty index
+func (tree *BTree) Compact(destination *BTree) (error) {
+	root, err := tree.getRoot()
+
+	if bTreeNoRootError.IsSame(err) {
+		return nil
+	}
 
 	if err != nil {
-		return BTreeNode{}, err
+		return BtreeFindGetRootError.SetUnderlying(err)
 	}
 
-	// If the key is in the node, return that
-	if _, err = node.GetElementByKey(key); err == nil {
-		return node, nil
+	table, err := tree.pageTable()
+
+	if err != nil {
+		return err
 	}
 
-	nearestNodeLocation, err := node.GetNearestNodeLocationByKey(key)
+	if table.keyType != btreeElementTypeUnset {
+		err = destination.setKeyType(table.keyType)
 
-	if NoNearestNodeFoundByKeyError.IsSame(err) {
-		return node, btreeFindNodeByKeyNearestNodeFoundError
+		if err != nil {
+			return err
+		}
 	}
 
-	return tree.findNodeByKey(nearestNodeLocation, key)
-}
+	root, err = tree.compactNode(destination, root, make(map[int64]int64))
+
+	if err != nil {
+		return err
+	}
+
+	_, err = destination.writeRoot(root)
 
-// Write a node to the index, return the location it wrote at
-func (tree *BTree) writeNode(node BTreeNode) (int64, error) {
+	if err != nil {
+		return err
+	}
 
-	// Seek to the end of the file
-	location, err := tree.Index.Seek(0, io.SeekEnd)
+	return destination.RebuildBloomFilter()
+}
+
+// Write the children of a node to destination, returning the node with its
+// Children pointing at their copies. Nodes keep their ids, copied maps the ids
+// Of children already copied so children shared between elements are only
+// Copied once
+func (tree *BTree) compactNode(destination *BTree, node BTreeNode, copied map[int64]int64) (BTreeNode, error) {
+	table, err := destination.pageTable()
 
 	if err != nil {
-		return 0, btreeWriteNodeSeekToEndError.SetUnderlying(err)
+		return node, err
+	}
+
+	for _, element := range node.Elements {
+		if !element.IsSeparator() {
+			table.keys++
+		}
+	}
+
+	elements := make([]BTreeElement, len(node.Elements))
+	copy(elements, node.Elements)
+
+	for i := range elements {
+		// Overflow records live in the old index and are rewritten by destination
+		elements[i].OverflowLocation = btreeElementNoOverflowValue
+
+		for _, child := range []*int64{&elements[i].LessLocation, &elements[i].MoreLocation} {
+			if *child == btreeElementNoChildValue {
+				continue
+			}
+
+			if id, ok := copied[*child]; ok {
+				*child = id
+				continue
+			}
+
+			childNode, err := tree.readNodeById(int32(*child))
+
+			if err != nil {
+				return node, err
+			}
+
+			childNode, err = tree.compactNode(destination, childNode, copied)
+
+			if err != nil {
+				return node, err
+			}
+
+			id, err := destination.writeNode(childNode)
+
+			if err != nil {
+				return node, err
+			}
+
+			copied[*child] = int64(id)
+			*child = int64(id)
+		}
+	}
+
+	node.Elements = elements
+	node.Location = btreeNodeNoLocationValue
+
+	return node, nil
+}
+
+// Find the node a key belongs to or the nearest node to it, starting from the
+// Root when child is 0
+func (tree *BTree) findNodeByKey(child int64, key interface{}) (BTreeNode, error) {
+	path, err := tree.findPathByKey(child, key)
+
+	if len(path) == 0 {
+		return BTreeNode{}, err
 	}
 
-	// If this is a new index file that does not yet have a root location
-	if location < btreeNodeLengthLocationPadLength {
-		_, err = tree.Index.Write([]byte(fmt.Sprintf("%0"+strconv.Itoa(btreeNodeLengthLocationPadLength)+"s")))
+	return path[len(path)-1], err
+}
+
+// Find the nodes leading from child, or the root when child is 0, down to the
+// Node a key belongs to or the nearest node to it
+func (tree *BTree) findPathByKey(child int64, key interface{}) ([]BTreeNode, error) {
+	var node BTreeNode
+	var err error
+
+	if child == 0 {
+		node, err = tree.getRoot()
+
+		if err != nil && !bTreeNoRootError.IsSame(err) {
+			return []BTreeNode{node}, BtreeFindGetRootError.SetUnderlying(err)
+		}
+	} else {
+		node, err = tree.readNodeById(int32(child))
 
 		if err != nil {
-			return 0, btreeWriteError.SetUnderlying(err)
+			return nil, err
 		}
+	}
 
-		location, err = tree.Index.Seek(btreeNodeLengthLocationPadLength, io.SeekStart)
+	path := []BTreeNode{node}
+
+	for {
+		// If the key is in the node, return that
+		if _, err = node.GetElementByKey(key); err == nil {
+			return path, nil
+		}
+
+		nearestChild, err := node.GetNearestNodeLocationByKey(key)
+
+		if NoNearestNodeFoundByKeyError.IsSame(err) {
+			return path, btreeFindNodeByKeyNearestNodeFoundError
+		}
+
+		node, err = tree.readNodeById(int32(nearestChild))
 
 		if err != nil {
-			return 0, btreeWriteNodeSeekToEndError.SetUnderlying(err)
+			return nil, err
 		}
+
+		path = append(path, node)
+	}
+}
+
+// Write a node to the index and record its new location in the page table,
+// Allocating it an id if it does not have one yet. Returns the node's id,
+// Which stays the same however many times the node is rewritten. The page
+// Table must be committed before the node can be found from the root
+func (tree *BTree) writeNode(node BTreeNode) (int32, error) {
+	table, err := tree.pageTable()
+
+	if err != nil {
+		return 0, err
+	}
+
+	if node.Id == btreeNodeNoIdValue {
+		node.Id = table.allocate()
+	}
+
+	// Move the tail of any oversized keys into overflow records first so the
+	// Node can point at them
+	node, err = tree.writeOverflowKeys(node)
+
+	if err != nil {
+		return 0, err
 	}
 
 	serialised, err := node.Serialise()
@@ -173,47 +615,110 @@ func (tree *BTree) writeNode(node BTreeNode) (int64, error) {
 		return 0, err
 	}
 
-	_, err = tree.Index.Write(serialised)
+	serialised, err = tree.sealNode(serialised)
 
 	if err != nil {
-		return 0, btreeWriteError.SetUnderlying(err)
+		return 0, err
 	}
 
-	// If the node we're writing was read from elsewhere in the index update
-	// The original location to point to the new one
-	if node.Location != btreeNodeNoLocationValue && node.ParentId != btreeNodeParentIdNoValue {
-		_, err = tree.Index.Seek(node.Location, io.SeekStart)
+	location, err := tree.appendIndex(serialised)
 
-		if err != nil {
-			return 0, BtreeIndexSeekError.SetUnderlying(err)
-		}
+	if err != nil {
+		return 0, err
+	}
 
-		_, err = tree.Index.Write([]byte(btreeNodeMoved))
+	err = tree.setNodeLocation(table, node.Id, location)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return node.Id, nil
+}
+
+// Append a record to the end of the index, returning its location. Returns
+// StorageFullError without writing anything if there is no room for it, and a
+// Record which fails part way through is cut off
+func (tree *BTree) appendIndex(data []byte) (int64, error) {
+	location, err := tree.initialiseIndex()
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = reserveSpace(tree.Quota, tree.Index, int64(len(data)))
+
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tree.Index.Write(data)
+
+	if err != nil {
+		rollbackAppend(tree.Quota, tree.Index, location, int64(len(data)))
+		return 0, wrapWriteError(err, btreeWriteError)
+	}
+
+	return location, nil
+}
+
+// Overwrite bytes already in the index at location. These are the only writes
+// Which are not appends, so they are logged to the write ahead log first
+func (tree *BTree) writeAt(location int64, data []byte) (error) {
+	// When syncing always, anything appended must be durable before an
+	// Overwrite can reference it and the overwrite must be durable in the log
+	// Before it is made
+	if tree.Durability.mode == syncModeAlways {
+		err := tree.durability.sync(tree.Index)
 
 		if err != nil {
-			return 0, btreeWriteError.SetUnderlying(err)
+			return err
 		}
+	}
 
-		tree.Index.Write([]byte(fmt.Sprintf("%0"+strconv.Itoa(btreeNodeLengthLocationPadLength)+"s", strconv.FormatInt(location, 10))))
+	err := tree.logWrite(location, data)
+
+	if err != nil {
+		return err
+	}
+
+	if tree.Durability.mode == syncModeAlways && tree.wal != nil && tree.walInTransaction {
+		err = tree.durability.sync(tree.wal.Handle)
 
 		if err != nil {
-			return 0, btreeWriteError.SetUnderlying(err)
+			return err
 		}
+	}
 
-		return node.Location, nil
-	} else {
-		return location, nil
+	_, err = tree.Index.Seek(location, io.SeekStart)
+
+	if err != nil {
+		return BtreeIndexSeekError.SetUnderlying(err)
 	}
+
+	_, err = tree.Index.Write(data)
+
+	if err != nil {
+		return wrapWriteError(err, btreeWriteError)
+	}
+
+	return nil
 }
 
 // Read the node at a specific location in the index
 func (tree *BTree) readNode(location int64) (BTreeNode, error) {
-	_, err := tree.Index.Seek(location, io.SeekStart)
+	reader := tree.reader()
+	_, err := reader.Seek(location, io.SeekStart)
 	if err != nil {
 		return BTreeNode{}, BtreeIndexSeekError.SetUnderlying(err)
 	}
 
-	node, err := DeserialiseBTreeNode(tree.Index, location)
+	node, err := deserialiseBTreeNode(reader, location, tree.encryption)
+	if err != nil {
+		return BTreeNode{}, err
+	}
+
+	err = tree.readOverflowKeys(&node)
 	if err != nil {
 		return BTreeNode{}, err
 	}
@@ -221,30 +726,35 @@ func (tree *BTree) readNode(location int64) (BTreeNode, error) {
 	return node, nil
 }
 
-// Write the root node and update the root reference
-func (tree *BTree) writeRoot(node BTreeNode) (int64, error) {
-	location, err := tree.writeNode(node)
+// Write the root node and commit the page table with it as the root, returning
+// The root's id
+func (tree *BTree) writeRoot(node BTreeNode) (int32, error) {
+	id, err := tree.writeNode(node)
 
 	if err != nil {
-		return 0, btreeWriteRootWriteNodeError.SetUnderlying(err)
+		return 0, wrapWriteError(err, btreeWriteRootWriteNodeError)
 	}
 
-	locationString := strconv.FormatInt(location, 10)
-	locationString = fmt.Sprintf("%0"+strconv.Itoa(btreeNodeLengthLocationPadLength)+"s", locationString)
+	tree.pages.root = id
 
-	_, err = tree.Index.Seek(0, io.SeekStart)
+	err = tree.commitPageTable()
 
 	if err != nil {
-		return 0, btreeWriteRootSeekStartIndexError.SetUnderlying(err)
+		return 0, wrapWriteError(err, btreeWriteRootWriteRootLocationError)
 	}
 
-	_, err = tree.Index.Write([]byte(locationString))
+	return id, nil
+}
+
+// Write a changed node and commit the page table with it
+func (tree *BTree) commitNode(node BTreeNode) (error) {
+	_, err := tree.writeNode(node)
 
 	if err != nil {
-		return 0, btreeWriteRootWriteRootLocationError.SetUnderlying(err)
+		return err
 	}
 
-	return location, nil
+	return tree.commitPageTable()
 }
 
 // Seek to and unserialise the root
@@ -253,17 +763,15 @@ func (tree *BTree) getRoot() (BTreeNode, error) {
 		return root, nil
 	}
 
-	// Get the location of the root node
-	_, err := tree.Index.Seek(0, io.SeekStart)
+	// Get the location of the page table naming the root
+	slot, found, err := tree.readRootSlot()
+
 	if err != nil {
-		return BTreeNode{}, BtreeIndexSeekError.SetUnderlying(err)
+		return BTreeNode{}, BtreeRootUnableToReadNodeLocation.SetUnderlying(err)
 	}
 
-	rootLocationString := make([]byte, 20)
-	_, err = tree.Index.Read(rootLocationString)
-
-	// If it is an empty index
-	if err == io.EOF {
+	// Nodes may have been written but none of them has become the root yet
+	if !found {
 		return NewBTreeNode(
 			false,
 			btreeNodeParentIdNoValue,
@@ -271,23 +779,36 @@ func (tree *BTree) getRoot() (BTreeNode, error) {
 			make([]BTreeElement, 0),
 			make([]int32, 0),
 		),
-			bTreeNoRootError.SetUnderlying(err)
+			bTreeNoRootError
+	}
+
+	table, err := tree.loadPageTable(slot)
+
+	if err != nil {
+		return BTreeNode{}, BtreeRootUnableToDeserialise.SetUnderlying(err)
 	}
 
+	rootLocation, err := tree.locateNode(table.root)
+
 	if err != nil {
-		BtreeRootUnableToReadNodeLocation.SetUnderlying(err)
+		return BTreeNode{}, BtreeRootUnableToDeserialise.SetUnderlying(err)
 	}
 
-	// Parse the root location
-	rootLocation, err := strconv.ParseInt(string(rootLocationString), 10, 64)
+	reader := tree.reader()
 
-	_, err = tree.Index.Seek(rootLocation, io.SeekStart)
+	_, err = reader.Seek(rootLocation, io.SeekStart)
 	if err != nil {
 		return BTreeNode{}, BtreeRootUnableToDeserialise.SetUnderlying(err)
 	}
 
 	// Deserialise the root
-	root, err := DeserialiseBTreeNode(tree.Index, 0)
+	root, err := deserialiseBTreeNode(reader, rootLocation, tree.encryption)
+
+	if err != nil {
+		return BTreeNode{}, BtreeRootUnableToDeserialise.SetUnderlying(err)
+	}
+
+	err = tree.readOverflowKeys(&root)
 
 	if err != nil {
 		return BTreeNode{}, BtreeRootUnableToDeserialise.SetUnderlying(err)
@@ -295,3 +816,46 @@ func (tree *BTree) getRoot() (BTreeNode, error) {
 
 	return root, nil
 }
+
+// The handle nodes are read through
+func (tree *BTree) reader() (io.ReadSeeker) {
+	if tree.ReadHandle != nil {
+		return tree.ReadHandle
+	}
+
+	return tree.Index
+}
+
+// Sync the write ahead log, index and bloom filter to stable storage
+// Regardless of the Durability policy
+func (tree *BTree) Sync() (error) {
+	return tree.durability.sync(tree.syncHandles()...)
+}
+
+// Sync any batched writes still waiting for the Durability interval to pass
+// And stop the timer which would sync them. The index and write ahead log
+// Handles belong to the caller, who should close them afterwards
+func (tree *BTree) Close() (error) {
+	return tree.durability.stop()
+}
+
+// Get the fsync latency metrics of the tree
+func (tree *BTree) SyncStats() (SyncStats) {
+	return tree.durability.syncStats()
+}
+
+// The handles to sync after a write, the log always goes before the index and
+// The bloom filter after it
+func (tree *BTree) syncHandles() ([]interface{}) {
+	handles := []interface{}{tree.Index}
+
+	if tree.wal != nil {
+		handles = append([]interface{}{tree.wal.Handle}, handles...)
+	}
+
+	if tree.bloomIndex != nil {
+		handles = append(handles, tree.bloomIndex)
+	}
+
+	return handles
+}
@@ -4,6 +4,7 @@ import (
 	"testing"
 	"reflect"
 	"io"
+	"math"
 	"strconv"
 )
 
@@ -95,17 +96,23 @@ func TestBtree_writeNode(t *testing.T) {
 	}
 
 	// Write the node
-	location, err := tree.writeNode(node)
+	id, err := tree.writeNode(node)
 
 	if err != nil {
 		t.Error(err)
 	}
 
-	if location != btreeNodeLengthLocationPadLength {
-		t.Error("expected to write after the root location, wrote at: ", location)
+	location, err := tree.locateNode(id)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if location != btreeSuperblockSize {
+		t.Error("expected to write after the superblock, wrote at: ", location)
 	}
 
-	_, err = tree.Index.Seek(btreeNodeLengthLocationPadLength, io.SeekStart)
+	_, err = tree.Index.Seek(btreeSuperblockSize, io.SeekStart)
 
 	if err != nil {
 		t.Error(err)
@@ -146,7 +153,12 @@ func TestBtree_writeNode(t *testing.T) {
 		t.Error(err)
 	}
 
-	location, err = tree.writeNode(node)
+	id, err = tree.writeNode(node)
+	if err != nil {
+		t.Error(err)
+	}
+
+	location, err = tree.locateNode(id)
 	if err != nil {
 		t.Error(err)
 	}
@@ -201,17 +213,23 @@ func TestBtree_readNode(t *testing.T) {
 	node := NewBTreeNode(false, parentId, 1, elements, path)
 
 	// Write the node
-	location, err := tree.writeNode(node)
+	id, err := tree.writeNode(node)
 
 	if err != nil {
 		t.Error(err)
 	}
 
-	if location != btreeNodeLengthLocationPadLength {
-		t.Error("expected to write after the root location, wrote at: ", location)
+	location, err := tree.locateNode(id)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if location != btreeSuperblockSize {
+		t.Error("expected to write after the superblock, wrote at: ", location)
 	}
 
-	read, err := tree.readNode(btreeNodeLengthLocationPadLength)
+	read, err := tree.readNode(btreeSuperblockSize)
 
 	if err != nil {
 		t.Error(err)
@@ -223,7 +241,7 @@ func TestBtree_readNode(t *testing.T) {
 		t.Error(err)
 	}
 
-	node.Location = 20
+	node.Location = btreeSuperblockSize
 
 	// Serialise the node so we can compare to it later
 	serialised, err := node.Serialise()
@@ -255,15 +273,24 @@ func TestBtree_writeReadNode(t *testing.T) {
 		btreeElementNoChildValue,
 	)
 
-	node := NewBTreeNode(false, parentId, 1, elements, path)
+	node := NewBTreeNode(false, parentId, btreeNodeNoIdValue, elements, path)
 
-	// Write the node
-	location, err := tree.writeNode(node)
+	// Write the node, which should be allocated an id
+	id, err := tree.writeNode(node)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if id != btreeNodeFirstId {
+		t.Error("did not allocate the first id to the first node, got:", id)
+	}
+
+	location, err := tree.locateNode(id)
 	if err != nil {
 		t.Error(err)
 	}
 
-	readNode, err := tree.readNode(location)
+	readNode, err := tree.readNodeById(id)
 	if err != nil {
 		t.Error(err)
 	}
@@ -284,15 +311,25 @@ func TestBtree_writeReadNode(t *testing.T) {
 	)
 
 	// Write the node
-	secondLocation, err := tree.writeNode(readNode)
+	secondId, err := tree.writeNode(readNode)
 	if err != nil {
 		t.Error(err)
 	}
 
-	if location != secondLocation {
-		t.Error("did not get back expected same location for written node expected:", location, "got:", secondLocation)
+	if id != secondId {
+		t.Error("did not get back expected same id for written node expected:", id, "got:", secondId)
+	}
+
+	secondLocation, err := tree.locateNode(id)
+	if err != nil {
+		t.Error(err)
 	}
 
+	if secondLocation == location {
+		t.Error("rewritten node was not moved to a new location")
+	}
+
+	// The original copy is left as it was rather than forwarded
 	deletionFlag := make([]byte, 1)
 
 	_, err = tree.Index.Seek(location, io.SeekStart)
@@ -305,8 +342,17 @@ func TestBtree_writeReadNode(t *testing.T) {
 		t.Error(err)
 	}
 
-	if string(deletionFlag) != btreeNodeMoved {
-		t.Error("did not find expected moved flag in location of initial node write, found:", string(deletionFlag))
+	if string(deletionFlag) != btreeNodeNotDeleted {
+		t.Error("expected the initial node write to be left in place, found flag:", string(deletionFlag))
+	}
+
+	readNode, err = tree.readNodeById(id)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(readNode.Elements) != 2 {
+		t.Error("did not read the rewritten node by its id, found elements:", len(readNode.Elements))
 	}
 }
 
@@ -355,30 +401,27 @@ func TestBtree_writeRoot(t *testing.T) {
 	node := NewBTreeNode(false, parentId, 1, elements, path)
 
 	// Write the root
-	location, err := tree.writeRoot(node)
+	id, err := tree.writeRoot(node)
 
 	if err != nil {
 		t.Error(err)
 	}
 
-	_, err = tree.Index.Seek(0, io.SeekStart)
-	if err != nil {
-		t.Error(err)
+	slot, found, err := tree.readRootSlot()
+	if err != nil || !found {
+		t.Error("root slot was not written", err)
 	}
 
-	rootLocationString := make([]byte, 20)
-	_, err = tree.Index.Read(rootLocationString)
+	table, err := tree.loadPageTable(slot)
 	if err != nil {
 		t.Error(err)
 	}
 
-	rootLocation, err := strconv.ParseInt(string(rootLocationString), 10, 64)
-
-	if location != rootLocation {
-		t.Error("mismatched root locations")
+	if id != table.root {
+		t.Error("mismatched root ids")
 	}
 
-	readRoot, err := tree.readNode(rootLocation)
+	readRoot, err := tree.readNodeById(table.root)
 	if err != nil {
 		t.Error(err)
 	}
@@ -414,7 +457,16 @@ func TestBTree_getRoot(t *testing.T) {
 		t.Error("did not get expected blank node when no root found")
 	}
 
-	tree.Index.Write([]byte("0000000000000010000"))
+	// Point the root past the end of the index
+	_, err = tree.initialiseIndex()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = tree.writeRootSlot(btreeRootSlot{Generation: 1, Location: 10000})
+	if err != nil {
+		t.Error(err)
+	}
 
 	root, err = tree.getRoot()
 
@@ -422,6 +474,9 @@ func TestBTree_getRoot(t *testing.T) {
 		t.Error("did not get expected error when unable to seek to root")
 	}
 
+	index = &MemoryFileHandle{}
+	tree = NewBTree(index, 4, true)
+
 	// Create the root
 	parentId := btreeNodeParentIdNoValue
 	path := make([]int32, 0)
@@ -499,9 +554,9 @@ func TestBtree_findNodeByKey(t *testing.T) {
 		btreeElementNoChildValue,
 	)
 
-	nodeOne := NewBTreeNode(false, parentId, 1, elements, path)
+	nodeOne := NewBTreeNode(false, parentId, 2, elements, path)
 
-	nodeOneLocation, err := tree.writeNode(nodeOne)
+	nodeOneId, err := tree.writeNode(nodeOne)
 	if err != nil {
 		t.Error(err)
 	}
@@ -519,9 +574,9 @@ func TestBtree_findNodeByKey(t *testing.T) {
 		btreeElementNoChildValue,
 	)
 
-	nodeTwo := NewBTreeNode(false, parentId, 1, elements, path)
+	nodeTwo := NewBTreeNode(false, parentId, 3, elements, path)
 
-	nodeTwoLocation, err := tree.writeNode(nodeTwo)
+	nodeTwoId, err := tree.writeNode(nodeTwo)
 	if err != nil {
 		t.Error(err)
 	}
@@ -535,8 +590,8 @@ func TestBtree_findNodeByKey(t *testing.T) {
 		btreeElementTypeInt,
 		int64(2),
 		int64(0),
-		nodeOneLocation,
-		nodeTwoLocation,
+		int64(nodeOneId),
+		int64(nodeTwoId),
 	)
 
 	root := NewBTreeNode(false, parentId, 1, elements, path)
@@ -608,9 +663,9 @@ func TestBTree_Find(t *testing.T) {
 		btreeElementNoChildValue,
 	)
 
-	nodeOne := NewBTreeNode(false, parentId, 1, elements, path)
+	nodeOne := NewBTreeNode(false, parentId, 2, elements, path)
 
-	nodeOneLocation, err := tree.writeNode(nodeOne)
+	nodeOneId, err := tree.writeNode(nodeOne)
 	if err != nil {
 		t.Error(err)
 	}
@@ -628,9 +683,9 @@ func TestBTree_Find(t *testing.T) {
 		btreeElementNoChildValue,
 	)
 
-	nodeTwo := NewBTreeNode(false, parentId, 1, elements, path)
+	nodeTwo := NewBTreeNode(false, parentId, 3, elements, path)
 
-	nodeTwoLocation, err := tree.writeNode(nodeTwo)
+	nodeTwoId, err := tree.writeNode(nodeTwo)
 	if err != nil {
 		t.Error(err)
 	}
@@ -644,8 +699,8 @@ func TestBTree_Find(t *testing.T) {
 		btreeElementTypeInt,
 		int64(2),
 		int64(20),
-		nodeOneLocation,
-		nodeTwoLocation,
+		int64(nodeOneId),
+		int64(nodeTwoId),
 	)
 
 	root := NewBTreeNode(false, parentId, 1, elements, path)
@@ -736,3 +791,471 @@ func TestBTree_Insert(t *testing.T) {
 		t.Error("did not find expected key value (1) and location (10) in element, found key:", root.Elements[0].KeyInt, "and location:", root.Elements[0].Location)
 	}
 }
+
+func TestBTree_InsertFullNode(t *testing.T) {
+	index := &MemoryFileHandle{}
+	tree := NewBTree(index, 4, true)
+
+	// Keys in an order which fills the root and then both ends and the middle
+	keys := []int64{50, 10, 90, 30, 70, 20, 80, 60, 40, 5, 95, 55, 1, 99, 45, 65}
+
+	for _, key := range keys {
+		err := tree.Insert(key, key*10)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	reopened, err := OpenBTree(index, 4, true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, key := range keys {
+		location, err := reopened.Find(key)
+		if err != nil || location != key*10 {
+			t.Error("did not find key", key, "inserted after its node was full, got:", location, err)
+		}
+	}
+
+	previous := int64(0)
+	count := 0
+
+	err = reopened.Range(nil, nil, func(key interface{}, value []byte) bool {
+		if key.(int64) <= previous {
+			t.Error("range was out of order at", key)
+		}
+
+		previous = key.(int64)
+		count++
+
+		return true
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if count != len(keys) {
+		t.Error("expected range to visit every key, visited:", count)
+	}
+
+	err = reopened.Insert(int64(45), int64(1))
+	if !BTreeDuplicateKeyError.IsSame(err) {
+		t.Error("expected BTreeDuplicateKeyError for a key in a child node, got:", err)
+	}
+}
+
+func TestBTree_InsertSequentialKeys(t *testing.T) {
+	index := &MemoryFileHandle{}
+	tree := NewBTree(index, 4, true)
+	count := 10000
+
+	for key := int64(0); key < int64(count); key++ {
+		err := tree.Insert(key, key*10)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root, err := tree.getRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every leaf is at the same depth, which only grows with the log of the
+	// Number of keys as nodes which are not the root are at least half full
+	depths := make(map[int]bool)
+	var walk func(node BTreeNode, depth int)
+
+	walk = func(node BTreeNode, depth int) {
+		children := make([]int64, 0)
+
+		for i, element := range node.Elements {
+			if i == 0 && element.LessLocation != btreeElementNoChildValue {
+				children = append(children, element.LessLocation)
+			}
+
+			if element.MoreLocation != btreeElementNoChildValue {
+				children = append(children, element.MoreLocation)
+			}
+		}
+
+		if len(children) == 0 {
+			depths[depth] = true
+			return
+		}
+
+		if len(children) != len(node.Elements)+1 {
+			t.Error("expected a child either side of every element, got", len(children), "for", len(node.Elements), "elements")
+		}
+
+		for _, child := range children {
+			childNode, err := tree.readNodeById(int32(child))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			walk(childNode, depth+1)
+		}
+	}
+
+	walk(root, 1)
+
+	maxDepth := int(math.Ceil(math.Log(float64(count))/math.Log(3))) + 1
+
+	for depth := range depths {
+		if len(depths) != 1 || depth > maxDepth {
+			t.Error("expected every leaf at one depth of at most", maxDepth, "got:", depths)
+		}
+	}
+
+	for _, key := range []int64{0, 1, 4999, 9998, 9999} {
+		location, err := tree.Find(key)
+		if err != nil || location != key*10 {
+			t.Error("did not find key", key, "got:", location, err)
+		}
+	}
+}
+
+func TestBTree_update(t *testing.T) {
+	index := &MemoryFileHandle{}
+	tree := NewBTree(index, 2, true)
+	tree.MaxInlineValueSize = 8
+
+	for key := int64(1); key <= 5; key++ {
+		err := tree.Insert(key, key*10)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Keys in the root and in a child node
+	for _, key := range []int64{1, 5} {
+		err := tree.update(key, key*100, nil, false)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	err := tree.update(int64(3), int64(30), []byte("three"), true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = tree.update(int64(3), int64(30), []byte("too large"), true)
+	if !BTreeInlineValueTooLargeError.IsSame(err) {
+		t.Error("expected BTreeInlineValueTooLargeError, got:", err)
+	}
+
+	reopened, err := OpenBTree(index, 2, true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for key, expected := range map[int64]int64{1: 100, 3: 30, 5: 500} {
+		location, err := reopened.Find(key)
+		if err != nil || location != expected {
+			t.Error("expected location", expected, "for key", key, "got:", location, err)
+		}
+	}
+
+	value, err := reopened.Get(int64(3))
+	if err != nil || string(value) != "three" {
+		t.Error("expected the updated inline value, got:", string(value), err)
+	}
+
+	err = reopened.update(int64(6), int64(60), nil, false)
+	if !BTreeKeyNotFoundError.IsSame(err) {
+		t.Error("expected BTreeKeyNotFoundError updating a missing key, got:", err)
+	}
+}
+
+func TestBTree_InsertStringKeys(t *testing.T) {
+	index := &MemoryFileHandle{}
+	tree := NewBTree(index, 4, true)
+
+	keys := []string{
+		"https://example.com/articles/1",
+		"https://example.com/articles/2",
+		"https://example.com/articles/3",
+	}
+
+	for i, key := range keys {
+		err := tree.Insert(key, int64(i*10))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	for i, key := range keys {
+		location, err := tree.Find(key)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if location != int64(i*10) {
+			t.Error("did not get expected location of", i*10, "for", key, "got:", location)
+		}
+	}
+}
+
+func TestBTree_InsertStringKeysSeparators(t *testing.T) {
+	index := &MemoryFileHandle{}
+	tree := NewBTree(index, 4, true)
+	keys := make([]string, 0)
+
+	for i := 0; i < 40; i++ {
+		keys = append(keys, "https://example.com/articles/"+strconv.Itoa(1000+i*7)+"/comments")
+	}
+
+	for i, key := range keys {
+		err := tree.Insert(key, int64(i*10))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// The root routes lookups with separators truncated to just enough of
+	// The first key of the child after them to tell the children apart
+	root, err := tree.getRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, element := range root.Elements {
+		if !element.IsSeparator() || len(element.KeyString) >= len(keys[0]) {
+			t.Error("expected the root to hold truncated separators, got:", element.KeyString, element.IsSeparator())
+		}
+	}
+
+	for i, key := range keys {
+		location, err := tree.Find(key)
+		if err != nil || location != int64(i*10) {
+			t.Error("did not find", key, "got:", location, err)
+		}
+	}
+
+	// A separator is not a key
+	_, err = tree.Find(root.Elements[0].KeyString)
+	if !BTreeKeyNotFoundError.IsSame(err) {
+		t.Error("expected BTreeKeyNotFoundError finding a separator, got:", err)
+	}
+
+	scanned := make([]string, 0)
+
+	err = tree.Range(nil, nil, func(key interface{}, value []byte) bool {
+		scanned = append(scanned, key.(string))
+		return true
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !reflect.DeepEqual(scanned, keys) {
+		t.Error("expected range to only visit the keys in order, got:", scanned)
+	}
+}
+
+func TestBTree_Get(t *testing.T) {
+	index := &MemoryFileHandle{}
+	tree := NewBTree(index, 4, true)
+	tree.MaxInlineValueSize = 8
+
+	err := tree.InsertWithValue(int64(1), int64(10), []byte("counter"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = tree.InsertWithValue(int64(2), int64(20), []byte("far too large"))
+	if !BTreeInlineValueTooLargeError.IsSame(err) {
+		t.Error("did not get expected error when inserting a value larger than MaxInlineValueSize")
+	}
+
+	err = tree.InsertWithValue(int64(3), int64(30), []byte{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = tree.Insert(int64(4), int64(40))
+	if err != nil {
+		t.Error(err)
+	}
+
+	value, err := tree.Get(int64(1))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(value) != "counter" {
+		t.Error("did not get expected inline value 'counter', got:", string(value))
+	}
+
+	value, err = tree.Get(int64(3))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(value) != 0 {
+		t.Error("expected an empty inline value, got:", value)
+	}
+
+	_, err = tree.Get(int64(4))
+	if !BTreeNoInlineValueError.IsSame(err) {
+		t.Error("did not get expected error when getting a key without an inline value")
+	}
+
+	_, err = tree.Get(int64(5))
+	if !BTreeKeyNotFoundError.IsSame(err) {
+		t.Error("did not get expected error when getting a non-existent key")
+	}
+}
+
+func TestBTree_Range(t *testing.T) {
+	index := &MemoryFileHandle{}
+	tree := NewBTree(index, 4, true)
+
+	// Build a root of 3 and 6 with children either side and between them
+	ids := make([]int64, 3)
+	childKeys := [][]int64{{1, 2}, {4, 5}, {7, 8}}
+
+	for i, keys := range childKeys {
+		elements := make([]BTreeElement, 0)
+
+		for _, key := range keys {
+			element := NewBTreeElement(btreeElementTypeInt, key, key*10, btreeElementNoChildValue, btreeElementNoChildValue)
+			element.Value = []byte(strconv.FormatInt(key, 10))
+			element.HasValue = true
+			elements = append(elements, element)
+		}
+
+		id, err := tree.writeNode(NewBTreeNode(false, 1, int32(i+2), elements, make([]int32, 0)))
+		if err != nil {
+			t.Error(err)
+		}
+
+		ids[i] = int64(id)
+	}
+
+	elements := make([]BTreeElement, 2)
+	elements[0] = NewBTreeElement(btreeElementTypeInt, int64(3), int64(30), ids[0], ids[1])
+	elements[1] = NewBTreeElement(btreeElementTypeInt, int64(6), int64(60), ids[1], ids[2])
+
+	_, err := tree.writeRoot(NewBTreeNode(false, btreeNodeParentIdNoValue, 1, elements, make([]int32, 0)))
+	if err != nil {
+		t.Error(err)
+	}
+
+	keys := make([]int64, 0)
+	values := make([]string, 0)
+
+	err = tree.Range(nil, nil, func(key interface{}, value []byte) bool {
+		keys = append(keys, key.(int64))
+		values = append(values, string(value))
+		return true
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !reflect.DeepEqual(keys, []int64{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Error("did not scan every key in order, got:", keys)
+	}
+
+	if values[0] != "1" || values[2] != "" {
+		t.Error("did not get expected inline values, got:", values)
+	}
+
+	keys = make([]int64, 0)
+
+	err = tree.Range(int64(2), int64(5), func(key interface{}, value []byte) bool {
+		keys = append(keys, key.(int64))
+		return true
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !reflect.DeepEqual(keys, []int64{2, 3, 4, 5}) {
+		t.Error("did not scan keys between 2 and 5, got:", keys)
+	}
+
+	keys = make([]int64, 0)
+
+	err = tree.Range(int64(4), nil, func(key interface{}, value []byte) bool {
+		keys = append(keys, key.(int64))
+		return len(keys) < 2
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !reflect.DeepEqual(keys, []int64{4, 5}) {
+		t.Error("did not stop scanning when the callback returned false, got:", keys)
+	}
+}
+
+func TestBTree_Compact(t *testing.T) {
+	index := &MemoryFileHandle{}
+	tree := NewBTree(index, 4, true)
+
+	// A child which gets rewritten leaves its superseded copy behind
+	elements := make([]BTreeElement, 1)
+	elements[0] = NewBTreeElement(btreeElementTypeInt, int64(1), int64(10), btreeElementNoChildValue, btreeElementNoChildValue)
+
+	childId, err := tree.writeNode(NewBTreeNode(false, 1, btreeNodeNoIdValue, elements, make([]int32, 0)))
+	if err != nil {
+		t.Error(err)
+	}
+
+	child, err := tree.readNodeById(childId)
+	if err != nil {
+		t.Error(err)
+	}
+
+	child.AddElement(NewBTreeElement(btreeElementTypeInt, int64(2), int64(20), btreeElementNoChildValue, btreeElementNoChildValue))
+
+	_, err = tree.writeNode(child)
+	if err != nil {
+		t.Error(err)
+	}
+
+	elements = make([]BTreeElement, 1)
+	elements[0] = NewBTreeElement(btreeElementTypeInt, int64(3), int64(30), int64(childId), btreeElementNoChildValue)
+
+	_, err = tree.writeRoot(NewBTreeNode(false, btreeNodeParentIdNoValue, btreeNodeNoIdValue, elements, make([]int32, 0)))
+	if err != nil {
+		t.Error(err)
+	}
+
+	destinationIndex := &MemoryFileHandle{}
+	destination := NewBTree(destinationIndex, 4, true)
+
+	err = destination.EnableBloomFilter(&MemoryFileHandle{}, 100, 0.01)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = tree.Compact(&destination)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(destinationIndex.data) >= len(index.data) {
+		t.Error("compacted index is not smaller than the original")
+	}
+
+	for _, key := range []int64{1, 2, 3} {
+		location, err := destination.Find(key)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if location != key*10 {
+			t.Error("did not find expected location", key*10, "for key", key, "got:", location)
+		}
+	}
+
+	if destination.Stats().BloomItemCount != 3 {
+		t.Error("bloom filter was not rebuilt on compaction, item count:", destination.Stats().BloomItemCount)
+	}
+}
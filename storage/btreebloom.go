@@ -0,0 +1,419 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"math"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+const (
+	// Version of the layout of a btree's bloom filter handle
+	btreeBloomFormatVersion = byte(1)
+	// The version and checksum written before the serialised filter
+	btreeBloomHeaderLength = 1 + 8
+	// Positions the header fields of a filter are checksummed at, clear of
+	// The positions of its words
+	btreeBloomChecksumItemCount         = -1
+	btreeBloomChecksumBitCount          = -2
+	btreeBloomChecksumHashCount         = -3
+	btreeBloomChecksumFalsePositiveRate = -4
+)
+
+var (
+	BTreeBloomRebuildError = gataerrors.NewGataError("unable to rebuild the bloom filter from the btree")
+	btreeBloomWriteError   = gataerrors.NewGataError("unable to write bloom filter to its ReadWriteSeeker")
+)
+
+// Statistics about a btree
+type BTreeStats struct {
+	BloomEnabled                    bool
+	BloomBitCount                   uint64
+	BloomHashCount                  uint32
+	BloomItemCount                  uint64
+	BloomFalsePositiveRate          float64
+	BloomEstimatedFalsePositiveRate float64
+	// Lookups answered by the bloom filter without walking the tree
+	BloomNegatives uint64
+	// Lookups the bloom filter let through for keys which were not in the tree
+	BloomFalsePositives uint64
+}
+
+// Enable a bloom filter, persisted in handle, which is consulted before walking
+// The tree for a key. A filter already in handle is loaded, otherwise a new one
+// Is built from the keys already in the tree. A filter which fails its
+// Checksum or holds a different number of keys to the tree, as a crash can
+// Leave it, is rebuilt as it could otherwise exclude keys which are present.
+// The filter of an encrypted index is encrypted with the index's key
+func (tree *BTree) EnableBloomFilter(handle io.ReadWriteSeeker, expectedItems uint64, falsePositiveRate float64) (error) {
+	tree.bloomIndex = handle
+	tree.bloomExpectedItems = expectedItems
+	tree.bloomFalsePositiveRate = falsePositiveRate
+
+	_, err := handle.Seek(0, io.SeekStart)
+
+	if err != nil {
+		return btreeBloomWriteError.SetUnderlying(err)
+	}
+
+	filter, checksum, ok := tree.readBloomFilter()
+
+	if !ok {
+		return tree.RebuildBloomFilter()
+	}
+
+	table, err := tree.pageTable()
+
+	if err != nil {
+		return err
+	}
+
+	if filter.ItemCount != uint64(table.keys) {
+		return tree.RebuildBloomFilter()
+	}
+
+	tree.bloom = filter
+	tree.bloomChecksum = checksum
+
+	return nil
+}
+
+// Build a new bloom filter from every key in the tree and persist it
+func (tree *BTree) RebuildBloomFilter() (error) {
+	if tree.bloomIndex == nil {
+		return nil
+	}
+
+	filter := NewBloomFilter(tree.bloomExpectedItems, tree.bloomFalsePositiveRate)
+
+	err := tree.Range(nil, nil, func(key interface{}, value []byte) bool {
+		filter.Add(bloomKey(key))
+		return true
+	})
+
+	if err != nil {
+		return BTreeBloomRebuildError.SetUnderlying(err)
+	}
+
+	checksum := bloomChecksum(filter)
+
+	header := make([]byte, btreeBloomHeaderLength)
+	header[0] = btreeBloomFormatVersion
+	binary.BigEndian.PutUint64(header[1:], checksum)
+
+	serialised := filter.Serialise()
+	sealed, err := tree.sealBloom(serialised[:bloomFilterHeaderLength])
+
+	if err != nil {
+		return err
+	}
+
+	header = append(header, sealed...)
+
+	for i := range filter.Bits {
+		sealed, err = tree.sealBloom(serialised[bloomFilterHeaderLength+i*8 : bloomFilterHeaderLength+i*8+8])
+
+		if err != nil {
+			return err
+		}
+
+		header = append(header, sealed...)
+	}
+
+	err = tree.writeBloom(0, header)
+
+	if err != nil {
+		return err
+	}
+
+	tree.bloom = filter
+	tree.bloomChecksum = checksum
+	tree.bloomStale = false
+
+	return nil
+}
+
+// Get statistics about the tree
+func (tree *BTree) Stats() (BTreeStats) {
+	stats := tree.stats
+
+	if tree.bloom != nil {
+		stats.BloomEnabled = true
+		stats.BloomBitCount = tree.bloom.BitCount
+		stats.BloomHashCount = tree.bloom.HashCount
+		stats.BloomItemCount = tree.bloom.ItemCount
+		stats.BloomFalsePositiveRate = tree.bloom.FalsePositiveRate
+		stats.BloomEstimatedFalsePositiveRate = tree.bloom.EstimatedFalsePositiveRate()
+	}
+
+	return stats
+}
+
+// Whether the bloom filter says the key is definitely not in the tree
+func (tree *BTree) bloomExcludes(key interface{}) (bool) {
+	if tree.bloom == nil || tree.bloom.MayContain(bloomKey(key)) {
+		return false
+	}
+
+	tree.stats.BloomNegatives++
+
+	return true
+}
+
+// Record a lookup which the bloom filter let through but was not found
+func (tree *BTree) bloomMissed() {
+	if tree.bloom != nil {
+		tree.stats.BloomFalsePositives++
+	}
+}
+
+// Add a key to the bloom filter, only writing the words which changed. The
+// Checksum is written last so a crash part way through is caught by it. Once
+// A write fails the persisted filter is left alone, as its checksum or item
+// Count no longer match, until it is rebuilt
+func (tree *BTree) bloomAdd(key interface{}) (error) {
+	if tree.bloom == nil {
+		return nil
+	}
+
+	if tree.bloomStale {
+		tree.bloom.Add(bloomKey(key))
+		return nil
+	}
+
+	err := tree.persistBloomAdd(key)
+
+	if err != nil {
+		tree.bloomStale = true
+	}
+
+	return err
+}
+
+// Add a key to the bloom filter and write the words it changed
+func (tree *BTree) persistBloomAdd(key interface{}) (error) {
+	previous := make(map[int]uint64)
+
+	for _, bit := range tree.bloom.bitLocations(bloomKey(key)) {
+		previous[int(bit/64)] = tree.bloom.Bits[bit/64]
+	}
+
+	tree.bloomChecksum ^= bloomChecksumWord(btreeBloomChecksumItemCount, tree.bloom.ItemCount)
+	tree.bloom.Add(bloomKey(key))
+	tree.bloomChecksum ^= bloomChecksumWord(btreeBloomChecksumItemCount, tree.bloom.ItemCount)
+
+	header, err := tree.sealBloom(tree.bloom.Serialise()[:bloomFilterHeaderLength])
+
+	if err != nil {
+		return err
+	}
+
+	err = tree.writeBloom(btreeBloomHeaderLength, header)
+
+	if err != nil {
+		return err
+	}
+
+	for word, before := range previous {
+		if tree.bloom.Bits[word] == before {
+			continue
+		}
+
+		tree.bloomChecksum ^= bloomChecksumWord(word, before) ^ bloomChecksumWord(word, tree.bloom.Bits[word])
+
+		bits := make([]byte, 8)
+		binary.BigEndian.PutUint64(bits, tree.bloom.Bits[word])
+
+		bits, err = tree.sealBloom(bits)
+
+		if err != nil {
+			return err
+		}
+
+		err = tree.writeBloom(tree.bloomWordLocation(word), bits)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	checksum := make([]byte, 8)
+	binary.BigEndian.PutUint64(checksum, tree.bloomChecksum)
+
+	return tree.writeBloom(1, checksum)
+}
+
+// Write bytes to the persisted bloom filter at location, reserving space in
+// The tree's Quota for any of them past the end of the handle
+func (tree *BTree) writeBloom(location int64, data []byte) (error) {
+	end, err := tree.bloomIndex.Seek(0, io.SeekEnd)
+
+	if err != nil {
+		return btreeBloomWriteError.SetUnderlying(err)
+	}
+
+	growth := location + int64(len(data)) - end
+
+	if growth > 0 {
+		err = reserveSpace(tree.Quota, tree.bloomIndex, growth)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tree.bloomIndex.Seek(location, io.SeekStart)
+
+	if err == nil {
+		_, err = tree.bloomIndex.Write(data)
+	}
+
+	if err != nil {
+		if growth > 0 {
+			rollbackAppend(tree.Quota, tree.bloomIndex, end, growth)
+		}
+
+		return wrapWriteError(err, btreeBloomWriteError)
+	}
+
+	return nil
+}
+
+// The bytes hashed into the bloom filter for a key
+func bloomKey(key interface{}) ([]byte) {
+	encoded, _ := EncodeKey(key)
+
+	return encoded
+}
+
+// Read the filter persisted in the bloom filter handle along with its
+// Checksum, false if it is missing, from another version or fails its checksum
+func (tree *BTree) readBloomFilter() (*BloomFilter, uint64, bool) {
+	header := make([]byte, btreeBloomHeaderLength+tree.bloomSealedSize(bloomFilterHeaderLength))
+	_, err := io.ReadFull(tree.bloomIndex, header)
+
+	if err != nil || header[0] != btreeBloomFormatVersion {
+		return nil, 0, false
+	}
+
+	serialised, err := tree.openBloom(header[btreeBloomHeaderLength:])
+
+	if err != nil {
+		return nil, 0, false
+	}
+
+	// The bit count is checked by DeserialiseBloomFilter, it only needs to be
+	// Small enough to size the read here
+	bitCount := binary.BigEndian.Uint64(serialised[0:8])
+	available, err := tree.bloomIndex.Seek(0, io.SeekEnd)
+
+	if err != nil || bitCount%64 != 0 || bitCount/64 > uint64(available)/uint64(tree.bloomSealedSize(8)) {
+		return nil, 0, false
+	}
+
+	_, err = tree.bloomIndex.Seek(int64(len(header)), io.SeekStart)
+
+	if err != nil {
+		return nil, 0, false
+	}
+
+	words := make([]byte, int(bitCount/64)*tree.bloomSealedSize(8))
+	_, err = io.ReadFull(tree.bloomIndex, words)
+
+	if err != nil {
+		return nil, 0, false
+	}
+
+	for i := 0; i < len(words); i += tree.bloomSealedSize(8) {
+		word, err := tree.openBloom(words[i : i+tree.bloomSealedSize(8)])
+
+		if err != nil {
+			return nil, 0, false
+		}
+
+		serialised = append(serialised, word...)
+	}
+
+	filter, err := DeserialiseBloomFilter(bytes.NewReader(serialised))
+
+	if err != nil {
+		return nil, 0, false
+	}
+
+	checksum := binary.BigEndian.Uint64(header[1:btreeBloomHeaderLength])
+
+	if bloomChecksum(filter) != checksum {
+		return nil, 0, false
+	}
+
+	return filter, checksum, true
+}
+
+// Encrypt part of the bloom filter with the index's key if it is encrypted.
+// The filter's header and each of its words are encrypted separately so a
+// Word can be changed without rewriting the rest
+func (tree *BTree) sealBloom(data []byte) ([]byte, error) {
+	if tree.encryption == nil {
+		return data, nil
+	}
+
+	sealed, err := tree.encryption.seal(data)
+
+	if err != nil {
+		return nil, btreeBloomWriteError.SetUnderlying(err)
+	}
+
+	return sealed, nil
+}
+
+// Decrypt part of the bloom filter written by sealBloom
+func (tree *BTree) openBloom(data []byte) ([]byte, error) {
+	if tree.encryption == nil {
+		return append([]byte{}, data...), nil
+	}
+
+	return tree.encryption.open(data)
+}
+
+// The size of part of the bloom filter once it has been through sealBloom
+func (tree *BTree) bloomSealedSize(size int) (int) {
+	if tree.encryption == nil {
+		return size
+	}
+
+	return size + encryptionOverhead
+}
+
+// Where a word of the bloom filter is in its handle
+func (tree *BTree) bloomWordLocation(word int) (int64) {
+	return int64(btreeBloomHeaderLength + tree.bloomSealedSize(bloomFilterHeaderLength) + word*tree.bloomSealedSize(8))
+}
+
+// Checksum a bloom filter so that changing one word only needs the old and
+// New word to update it, rather than reading the whole filter again
+func bloomChecksum(filter *BloomFilter) (uint64) {
+	checksum := bloomChecksumWord(btreeBloomChecksumItemCount, filter.ItemCount) ^
+		bloomChecksumWord(btreeBloomChecksumBitCount, filter.BitCount) ^
+		bloomChecksumWord(btreeBloomChecksumHashCount, uint64(filter.HashCount)) ^
+		bloomChecksumWord(btreeBloomChecksumFalsePositiveRate, math.Float64bits(filter.FalsePositiveRate))
+
+	for i, word := range filter.Bits {
+		checksum ^= bloomChecksumWord(i, word)
+	}
+
+	return checksum
+}
+
+// Hash a word of a bloom filter along with its position
+func bloomChecksumWord(position int, word uint64) (uint64) {
+	serialised := make([]byte, 16)
+	binary.BigEndian.PutUint64(serialised[0:8], uint64(position))
+	binary.BigEndian.PutUint64(serialised[8:16], word)
+
+	hash := fnv.New64a()
+	hash.Write(serialised)
+
+	return hash.Sum64()
+}
@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestBTree_EnableBloomFilter(t *testing.T) {
+	index := &MemoryFileHandle{}
+	tree := NewBTree(index, 4, true)
+
+	err := tree.Insert(int64(1), int64(10))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Enabling on an empty handle should build the filter from the tree
+	bloomIndex := &MemoryFileHandle{}
+
+	err = tree.EnableBloomFilter(bloomIndex, 100, 0.01)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !tree.bloom.MayContain(bloomKey(int64(1))) {
+		t.Error("bloom filter was not built from the existing keys")
+	}
+
+	// Inserts should be persisted to the handle
+	err = tree.Insert(int64(2), int64(20))
+	if err != nil {
+		t.Error(err)
+	}
+
+	reopened := NewBTree(index, 4, true)
+
+	err = reopened.EnableBloomFilter(bloomIndex, 100, 0.01)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !reopened.bloom.MayContain(bloomKey(int64(2))) {
+		t.Error("inserted key was not persisted to the bloom filter")
+	}
+
+	if reopened.bloom.ItemCount != 2 {
+		t.Error("expected persisted item count of 2, got:", reopened.bloom.ItemCount)
+	}
+}
+
+func TestBTree_FindWithBloomFilter(t *testing.T) {
+	index := &MemoryFileHandle{}
+	tree := NewBTree(index, 4, true)
+
+	err := tree.EnableBloomFilter(&MemoryFileHandle{}, 100, 0.01)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = tree.Insert("present", int64(10))
+	if err != nil {
+		t.Error(err)
+	}
+
+	location, err := tree.Find("present")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if location != 10 {
+		t.Error("did not get expected location of 10, got:", location)
+	}
+
+	_, err = tree.Find("absent")
+	if !BTreeKeyNotFoundError.IsSame(err) {
+		t.Error("did not get expected error when finding an absent key")
+	}
+
+	stats := tree.Stats()
+
+	if !stats.BloomEnabled || stats.BloomItemCount != 1 {
+		t.Error("bloom filter not reported in stats:", stats)
+	}
+
+	if stats.BloomNegatives+stats.BloomFalsePositives != 1 {
+		t.Error("absent key lookup was not counted in stats:", stats)
+	}
+}
+
+func TestBTree_EnableBloomFilterStale(t *testing.T) {
+	index := &MemoryFileHandle{}
+	bloomIndex := &MemoryFileHandle{}
+	tree := NewBTree(index, 4, true)
+
+	err := tree.EnableBloomFilter(bloomIndex, 100, 0.01)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = tree.Insert(int64(1), int64(10))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// A crash after the insert committed but before the filter was written
+	stale := append([]byte{}, bloomIndex.data...)
+
+	err = tree.Insert(int64(2), int64(20))
+	if err != nil {
+		t.Error(err)
+	}
+
+	reopened := NewBTree(index, 4, true)
+
+	err = reopened.EnableBloomFilter(&MemoryFileHandle{data: stale}, 100, 0.01)
+	if err != nil {
+		t.Error(err)
+	}
+
+	location, err := reopened.Find(int64(2))
+	if err != nil || location != 20 {
+		t.Error("bloom filter missing a key was not rebuilt, got:", location, err)
+	}
+
+	// A torn word which the item count does not catch
+	corrupt := append([]byte{}, bloomIndex.data...)
+	for i := btreeBloomHeaderLength + bloomFilterHeaderLength; i < len(corrupt); i++ {
+		corrupt[i] = 0
+	}
+
+	reopened = NewBTree(index, 4, true)
+
+	err = reopened.EnableBloomFilter(&MemoryFileHandle{data: corrupt}, 100, 0.01)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, key := range []int64{1, 2} {
+		_, err = reopened.Find(key)
+		if err != nil {
+			t.Error("bloom filter failing its checksum was not rebuilt, key:", key, err)
+		}
+	}
+
+	// A filter from another version of the layout
+	other := append([]byte{}, bloomIndex.data...)
+	other[0] = btreeBloomFormatVersion + 1
+
+	reopened = NewBTree(index, 4, true)
+
+	err = reopened.EnableBloomFilter(&MemoryFileHandle{data: other}, 100, 0.01)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if reopened.bloom.ItemCount != 2 {
+		t.Error("expected the filter to be rebuilt with 2 items, got:", reopened.bloom.ItemCount)
+	}
+}
+
+func TestBTree_BloomFilterWriteFails(t *testing.T) {
+	index := &MemoryFileHandle{}
+	bloomIndex := &MemoryFileHandle{}
+	tree := NewBTree(index, 4, true)
+
+	injector := &FaultInjector{}
+	faulty, err := injector.Wrap(bloomIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tree.EnableBloomFilter(faulty, 100, 0.01)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The filter's writes fail once the key is already in the index
+	injector.FailWrite = injector.Writes() + 2
+
+	for key := int64(1); key <= 3; key++ {
+		err = tree.Insert(key, key*10)
+		if err != nil {
+			t.Error("expected the insert to succeed when only the bloom filter could not be written, got:", err)
+		}
+	}
+
+	if !tree.bloomStale {
+		t.Error("expected the persisted filter to be left stale")
+	}
+
+	err = tree.Insert(int64(2), int64(20))
+	if !BTreeDuplicateKeyError.IsSame(err) {
+		t.Error("expected BTreeDuplicateKeyError inserting a key again, got:", err)
+	}
+
+	for key := int64(1); key <= 3; key++ {
+		location, err := tree.Find(key)
+		if err != nil || location != key*10 {
+			t.Error("did not find key", key, "after the bloom filter write failed, got:", location, err)
+		}
+	}
+
+	reopened := NewBTree(index, 4, true)
+
+	err = reopened.EnableBloomFilter(&MemoryFileHandle{data: append([]byte{}, bloomIndex.data...)}, 100, 0.01)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if reopened.bloom.ItemCount != 3 {
+		t.Error("expected the stale filter to be rebuilt with 3 items, got:", reopened.bloom.ItemCount)
+	}
+}
+
+func TestBTree_BloomFilterWriteAheadLogReplay(t *testing.T) {
+	index := &MemoryFileHandle{}
+	walHandle := &MemoryFileHandle{}
+	bloomIndex := &MemoryFileHandle{}
+	tree := NewBTree(index, 4, true)
+
+	err := tree.EnableBloomFilter(bloomIndex, 100, 0.01)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = tree.EnableWriteAheadLog(walHandle)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Log an insert but crash before touching the index or the filter
+	err = tree.beginTransaction(NewBTreeElement(btreeElementTypeInt, int64(1), int64(10), btreeElementNoChildValue, btreeElementNoChildValue))
+	if err != nil {
+		t.Error(err)
+	}
+
+	reopened := NewBTree(index, 4, true)
+
+	err = reopened.EnableBloomFilter(bloomIndex, 100, 0.01)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = reopened.EnableWriteAheadLog(walHandle)
+	if err != nil {
+		t.Error(err)
+	}
+
+	location, err := reopened.Find(int64(1))
+	if err != nil || location != 10 {
+		t.Error("replayed insert was excluded by the bloom filter, got:", location, err)
+	}
+
+	// The persisted filter was brought up to date too
+	checked := NewBTree(index, 4, true)
+
+	err = checked.EnableBloomFilter(bloomIndex, 100, 0.01)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !checked.bloom.MayContain(bloomKey(int64(1))) {
+		t.Error("replayed insert was not persisted to the bloom filter")
+	}
+}
+
+func TestBloomKey(t *testing.T) {
+	if string(bloomKey(int64(1))) == string(bloomKey("\x00\x00\x00\x00\x00\x00\x00\x01")) {
+		t.Error("bloom keys of different key types collided")
+	}
+}
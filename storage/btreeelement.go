@@ -2,7 +2,6 @@ package storage
 
 import (
 	"time"
-	"math/big"
 	"errors"
 )
 
@@ -15,22 +14,41 @@ const (
 	btreeElementTypeString   = int8(1)
 	// Key type date
 	btreeElementTypeDate     = int8(2)
+	// Key type byte slice
+	btreeElementTypeBytes    = int8(3)
+	// Key type Tuple, held in KeyBytes already encoded
+	btreeElementTypeTuple    = int8(4)
 	// Value which means the element has no children when used for the
 	// LessLocation or MoreLocation
 	btreeElementNoChildValue = int64(-1)
+	// OverflowLocation of an element whose key is stored entirely inline, the
+	// Start of the index holds the superblock so no record can live there
+	btreeElementNoOverflowValue = int64(0)
 )
 
 // A btree element which lives inside a btree node
 // Contains a key of variable type, byte/key location of the data attached to
-// The key, and byte/key locations of the node with keys more or less than this
+// The key, and the ids of the nodes with keys more or less than this.
+// OverflowLocation points at the overflow records holding the tail of a string
+// Key which was too long to store inline. Value holds a small value stored
+// Inline with the key when HasValue is set. Separator elements in interior
+// Nodes of string keyed trees only route lookups between their children
 type BTreeElement struct {
-	KeyType      int8
-	KeyInt       int64
-	KeyString    string
-	KeyDate      time.Time
-	Location     int64
-	LessLocation int64
-	MoreLocation int64
+	KeyType          int8
+	KeyInt           int64
+	KeyString        string
+	KeyDate          time.Time
+	KeyBytes         []byte
+	Location         int64
+	LessLocation     int64
+	MoreLocation     int64
+	OverflowLocation int64
+	Value            []byte
+	HasValue         bool
+	Separator        bool
+	// The key encoded with EncodeKey, kept the first time it is needed as
+	// Every comparison uses it
+	encodedKey []byte
 }
 
 // Construct a new BTreeElement
@@ -39,6 +57,9 @@ func NewBTreeElement(keyType int8, key interface{}, location int64, lessLocation
 	intKey, isInt := key.(int64)
 	stringKey, isString := key.(string)
 	dateKey, isDate := key.(time.Time)
+	bytesKey, isBytes := key.([]byte)
+	tupleKey, isTuple := key.(Tuple)
+	customKey, isCustom := key.(Key)
 
 	if keyType == btreeElementTypeInt && isInt {
 		return BTreeElement{
@@ -64,12 +85,144 @@ func NewBTreeElement(keyType int8, key interface{}, location int64, lessLocation
 			LessLocation: lessLocation,
 			MoreLocation: moreLocation,
 		}
+	} else if keyType == btreeElementTypeBytes && isBytes {
+		return BTreeElement{
+			KeyType:      keyType,
+			KeyBytes:     bytesKey,
+			Location:     location,
+			LessLocation: lessLocation,
+			MoreLocation: moreLocation,
+		}
+	} else if keyType == btreeElementTypeTuple && isTuple {
+		encoded, err := EncodeKey(tupleKey)
+
+		if err != nil {
+			panic(err)
+		}
+
+		return BTreeElement{
+			KeyType:      keyType,
+			KeyBytes:     encoded,
+			Location:     location,
+			LessLocation: lessLocation,
+			MoreLocation: moreLocation,
+		}
+	} else if isCustom && keyType == customKey.KeyTypeId() {
+		return BTreeElement{
+			KeyType:      keyType,
+			KeyBytes:     customKey.Encode(),
+			Location:     location,
+			LessLocation: lessLocation,
+			MoreLocation: moreLocation,
+		}
 	} else {
 		panic(errors.New("unknown element key type passed in"))
 	}
 
 }
 
+// Construct a separator element which routes lookups between two child nodes
+// The key is truncated to the shortest prefix of upper which still sorts after
+// Lower, so interior nodes only hold as much of a key as is needed to decide
+// Which child to descend into
+func NewBTreeSeparatorElement(lower string, upper string, lessLocation int64, moreLocation int64) (BTreeElement) {
+	return BTreeElement{
+		KeyType:      btreeElementTypeString,
+		KeyString:    shortestSeparator(lower, upper),
+		LessLocation: lessLocation,
+		MoreLocation: moreLocation,
+		Separator:    true,
+	}
+}
+
+// Whether the element is a separator which does not point at any data
+func (element *BTreeElement) IsSeparator() (bool) {
+	return element.Separator
+}
+
+// Get the element's key as whichever type it was constructed with
+func (element *BTreeElement) GetKey() (interface{}) {
+	switch element.KeyType {
+	case btreeElementTypeInt:
+		return element.KeyInt
+	case btreeElementTypeString:
+		return element.KeyString
+	case btreeElementTypeDate:
+		return element.KeyDate
+	case btreeElementTypeBytes:
+		return element.KeyBytes
+	case btreeElementTypeTuple:
+		key, _ := DecodeKey(element.KeyBytes)
+		return key
+	}
+
+	if element.KeyType >= MinCustomKeyTypeId {
+		key, err := decodeCustomKey(element.KeyType, element.KeyBytes)
+
+		if err == nil {
+			return key
+		}
+	}
+
+	return nil
+}
+
+// Get the element's key encoded with EncodeKey
+func (element *BTreeElement) EncodedKey() ([]byte) {
+	if element.KeyType == btreeElementTypeTuple {
+		return element.KeyBytes
+	}
+
+	if element.encodedKey == nil {
+		element.encodedKey, _ = EncodeKey(element.GetKey())
+	}
+
+	return element.encodedKey
+}
+
+// Compare the element's key with the supplied key, returns -1, 0 or 1 if the
+// Element's key is less than, equal to or more than the supplied key
+func (element *BTreeElement) CompareKey(key interface{}) (int) {
+	encoded, _ := EncodeKey(key)
+
+	return compareEncodedKeys(element.EncodedKey(), encoded)
+}
+
+// Get the element key type used for a key, false if it is not a supported type
+func keyTypeOf(key interface{}) (int8, bool) {
+	switch typed := key.(type) {
+	case int64:
+		return btreeElementTypeInt, true
+	case string:
+		return btreeElementTypeString, true
+	case time.Time:
+		return btreeElementTypeDate, true
+	case []byte:
+		return btreeElementTypeBytes, true
+	case Tuple:
+		if _, err := EncodeKey(typed); err != nil {
+			return btreeElementTypeUnset, false
+		}
+
+		return btreeElementTypeTuple, true
+	case Key:
+		if _, ok := registeredKeyType(typed.KeyTypeId()); ok {
+			return typed.KeyTypeId(), true
+		}
+	}
+
+	return btreeElementTypeUnset, false
+}
+
+// Compare two keys by their encodings, returns -1, 0 or 1 if a is less than
+// Equal to or more than b. Keys of different types sort by type
+func compareKeys(a interface{}, b interface{}) (int) {
+	encodedA, _ := EncodeKey(a)
+	encodedB, _ := EncodeKey(b)
+
+	return compareEncodedKeys(encodedA, encodedB)
+}
+
 // Whether the current element has children with keys larger or smaller than it
 func (element *BTreeElement) HasChildren() (bool) {
 	if element.LessLocation != btreeElementNoChildValue || element.MoreLocation != btreeElementNoChildValue {
@@ -78,20 +231,15 @@ func (element *BTreeElement) HasChildren() (bool) {
 	return false
 }
 
-// Return the distance between the supplied key and the element's key
-func (element *BTreeElement) GetDistanceFromIntKey(key int64) (int64) {
-	return key - element.KeyInt
-}
-
-// Return the distance between the supplied key and the element's key
-func (element *BTreeElement) GetDistanceFromStringKey(key string) (*big.Int) {
-	return new(big.Int).Sub(
-		new(big.Int).SetBytes([]byte(key)),
-		new(big.Int).SetBytes([]byte(element.KeyString)),
-	)
-}
+// Return the shortest prefix of upper which sorts after lower
+// Everything less than the result is <= lower and everything >= upper is >=
+// The result, so it still separates the two children
+func shortestSeparator(lower string, upper string) (string) {
+	for length := 1; length < len(upper); length++ {
+		if upper[:length] > lower {
+			return upper[:length]
+		}
+	}
 
-// Return the distance between the supplied key and the element's key
-func (element *BTreeElement) GetDistanceFromDateKey(key time.Time) (int64) {
-	return key.Unix() - element.KeyDate.Unix()
+	return upper
 }
@@ -3,7 +3,6 @@ package storage
 import (
 	"testing"
 	"time"
-	"math/big"
 )
 
 func TestNewBTreeElement(t *testing.T) {
@@ -108,75 +107,126 @@ func TestBTreeElement_HasChildren(t *testing.T) {
 	}
 }
 
-func TestBTreeElement_GetDistanceFromIntKey(t *testing.T) {
+func TestNewBTreeSeparatorElement(t *testing.T) {
+	element := NewBTreeSeparatorElement(
+		"https://example.com/apple",
+		"https://example.com/banana",
+		int64(1),
+		int64(2),
+	)
+
+	if element.KeyString != "https://example.com/b" {
+		t.Error("separator was not truncated to shortest distinguishing prefix, got:", element.KeyString)
+	}
+
+	if element.LessLocation != 1 || element.MoreLocation != 2 {
+		t.Error("child locations not injected correctly")
+	}
+
+	if !element.IsSeparator() {
+		t.Error("separator element is not reporting itself as a separator")
+	}
+
+	// Test when upper only differs from lower by being longer
+	element = NewBTreeSeparatorElement("abc", "abcd", int64(1), int64(2))
+
+	if element.KeyString != "abcd" {
+		t.Error("separator should be the whole upper key when no shorter prefix sorts after lower, got:", element.KeyString)
+	}
+}
+
+func TestBTreeElement_IsSeparator(t *testing.T) {
 	element := NewBTreeElement(
-		btreeElementTypeInt,
-		int64(123),
+		btreeElementTypeString,
+		"a",
 		int64(345),
 		btreeElementNoChildValue,
 		btreeElementNoChildValue,
 	)
 
-	if element.GetDistanceFromIntKey(124) != 1 {
-		t.Error(
-			"distance between keys is not expected 1, got: ",
-			element.GetDistanceFromIntKey(124))
+	if element.IsSeparator() {
+		t.Error("element with a location is reporting itself as a separator")
 	}
 }
 
-func TestBTreeElement_GetDistanceFromStringKey(t *testing.T) {
+func TestBTreeElement_CompareKey(t *testing.T) {
 	element := NewBTreeElement(
+		btreeElementTypeInt,
+		int64(5),
+		int64(345),
+		btreeElementNoChildValue,
+		btreeElementNoChildValue,
+	)
+
+	if element.CompareKey(int64(6)) != -1 || element.CompareKey(int64(5)) != 0 || element.CompareKey(int64(4)) != 1 {
+		t.Error("int keys did not compare correctly")
+	}
+
+	element = NewBTreeElement(
 		btreeElementTypeString,
-		"aaaaaa",
+		"b",
 		int64(345),
 		btreeElementNoChildValue,
 		btreeElementNoChildValue,
 	)
 
-	one, _ := new(big.Int).SetString("1", 10)
+	// Longer keys must not sort after shorter ones purely by length
+	if element.CompareKey("aa") != 1 || element.CompareKey("b") != 0 || element.CompareKey("ba") != -1 {
+		t.Error("string keys did not compare correctly")
+	}
+
+	date := time.Date(2018, 5, 26, 15, 31, 17, 0, &time.Location{})
+
+	element = NewBTreeElement(
+		btreeElementTypeDate,
+		date,
+		int64(345),
+		btreeElementNoChildValue,
+		btreeElementNoChildValue,
+	)
 
-	if element.GetDistanceFromStringKey("aaaaab").Cmp(one) != 0 {
-		t.Error(
-			"distance between keys is not expected",
-			one,
-			"got:",
-			element.GetDistanceFromStringKey("aaaaab"))
+	if element.CompareKey(date.Add(time.Second)) != -1 || element.CompareKey(date) != 0 || element.CompareKey(date.Add(-time.Second)) != 1 {
+		t.Error("date keys did not compare correctly")
+	}
+
+	// Dates compare exactly rather than to the second
+	if element.CompareKey(date.Add(time.Nanosecond)) != -1 || element.CompareKey(date.In(time.FixedZone("UTC+1", 3600))) != 0 {
+		t.Error("date keys did not compare exactly")
+	}
+
+	if element.GetKey() != date {
+		t.Error("GetKey did not return the date key, got:", element.GetKey())
 	}
 }
 
-func TestBTreeElement_GetDistanceFromDateKey(t *testing.T) {
+func TestBTreeElement_EncodedKey(t *testing.T) {
 	element := NewBTreeElement(
-		btreeElementTypeDate,
-		time.Date(
-			2018,
-			5,
-			26,
-			15,
-			31,
-			17,
-			0,
-			&time.Location{},
-		),
+		btreeElementTypeString,
+		"abc",
 		int64(345),
 		btreeElementNoChildValue,
 		btreeElementNoChildValue,
 	)
 
-	compare := time.Date(
-		2018,
-		5,
-		26,
-		15,
-		31,
-		18,
-		0,
-		&time.Location{},
-	)
+	encoded, err := EncodeKey("abc")
+	if err != nil {
+		t.Error(err)
+	}
 
-	if element.GetDistanceFromDateKey(compare) != 1 {
-		t.Error(
-			"distance between keys is not expected 1, got: ",
-			element.GetDistanceFromDateKey(compare))
+	if compareEncodedKeys(element.EncodedKey(), encoded) != 0 {
+		t.Error("did not encode the element's key")
 	}
-}
 
+	if element.encodedKey == nil {
+		t.Error("encoded key was not kept for the next comparison")
+	}
+
+	// Keys restored after deserialising must not compare by a stale encoding
+	node := NewBTreeNode(false, btreeNodeParentIdNoValue, 1, []BTreeElement{element, NewBTreeElement(btreeElementTypeString, "abd", int64(1), btreeElementNoChildValue, btreeElementNoChildValue)}, make([]int32, 0))
+	node.compressKeys()
+	node.decompressKeys()
+
+	if _, err := node.GetElementByKey("abc"); err != nil {
+		t.Error("did not find key after restoring the node's keys:", err)
+	}
+}
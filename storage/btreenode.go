@@ -7,9 +7,6 @@ import (
 	"fmt"
 	"io"
 	"sort"
-	"math/big"
-	"time"
-	"math"
 	"github.com/codingbeard/gatabase/gataerrors"
 )
 
@@ -18,19 +15,29 @@ const (
 	btreeNodeParentIdNoValue = int32(-1)
 	// When we create a new node and it has no location in the index yet
 	btreeNodeNoLocationValue = int64(-1)
+	// Id of a node which has not been written yet, one is allocated when it is
+	btreeNodeNoIdValue = int32(0)
+	// The id allocated to the first node written to an index
+	btreeNodeFirstId = int32(1)
 	// The padding applied to byte lengths/locations when serialising
 	btreeNodeLengthLocationPadLength = 20
-	// Deletion flags used prior to the length of the node in bytes
+	// Deletion flags used prior to the length of the node in bytes, flag 1
+	// Marked a moved node in indexes written before the superblock
 	btreeNodeNotDeleted = "0"
-	btreeNodeMoved      = "1"
 	btreeNodeDeleted    = "2"
+	// Flag used in place of the deletion flag for overflow records
+	btreeNodeOverflow   = "3"
+	// Flag of the record holding an encrypted index's salt and key check
+	btreeNodeEncryptionHeader = "4"
+	// Flags of the records holding a page of the page table and the directory
+	// Of its pages
+	btreeNodePageTablePage      = "5"
+	btreeNodePageTableDirectory = "6"
 )
 
 var (
 	SerialiseNodeError = gataerrors.NewGataError("unable to serialise node")
 	DeserialiseNodeReadDeletedError          = gataerrors.NewGataError("unable to read deleted flag from ReadSeeker")
-	DeserialiseNodeReadMovedLocationError    = gataerrors.NewGataError("unable to read moved to location from ReadSeeker")
-	DeserialiseNodeInvalidMovedLocationError = gataerrors.NewGataError("unable to parse new location of node from ReadSeeker")
 	DeserialiseNodeReadLengthError = gataerrors.NewGataError("unable to read length of the node from ReadSeeker")
 	DeserialiseNodeReadNodeError = gataerrors.NewGataError("unable to read the node from ReadSeaker")
 	DeserialiseNodeDeserialiseBytesError = gataerrors.NewGataError("unable to deserialise the binary node")
@@ -39,18 +46,21 @@ var (
 )
 
 // A btree node containing elements
+// String keys are stored with the prefix shared by every key in the node
+// Removed and held once in KeyPrefix, it is only set while serialised
 type BTreeNode struct {
-	Deleted  bool
-	Location int64
-	ParentId int32
-	Id       int32
-	Path     []int32
-	Elements []BTreeElement
+	Deleted   bool
+	Location  int64
+	ParentId  int32
+	Id        int32
+	Path      []int32
+	Elements  []BTreeElement
+	KeyPrefix string
 }
 
-// Construct a new BTreeNode
+// Construct a new BTreeNode, elements are sorted so they can be searched
 func NewBTreeNode(deleted bool, parentId int32, id int32, elements []BTreeElement, path []int32) (BTreeNode) {
-	return BTreeNode{
+	node := BTreeNode{
 		Deleted:  deleted,
 		Location: int64(btreeNodeNoLocationValue),
 		ParentId: parentId,
@@ -58,10 +68,19 @@ func NewBTreeNode(deleted bool, parentId int32, id int32, elements []BTreeElemen
 		Path:     path,
 		Elements: elements,
 	}
+
+	node.Sort()
+
+	return node
 }
 
 // Deserialise the node at the current pointer of the passed in ReadSeeker
 func DeserialiseBTreeNode(serialisedNode io.ReadSeeker, location int64) (BTreeNode, error) {
+	return deserialiseBTreeNode(serialisedNode, location, nil)
+}
+
+// Deserialise a node, decrypting it first if the index is encrypted
+func deserialiseBTreeNode(serialisedNode io.ReadSeeker, location int64, encryption *fileEncryption) (BTreeNode, error) {
 	// Check to see if the node is deleted
 	deleted := make([]byte, 1)
 	_, err := serialisedNode.Read(deleted)
@@ -70,25 +89,7 @@ func DeserialiseBTreeNode(serialisedNode io.ReadSeeker, location int64) (BTreeNo
 		return BTreeNode{}, DeserialiseNodeReadDeletedError.SetUnderlying(err)
 	}
 
-	if string(deleted) == btreeNodeMoved {
-		// seek to the new location and read that node
-		newNodeLocationString := make([]byte, 20)
-		_, err = serialisedNode.Read(newNodeLocationString)
-
-		if err != nil {
-			return BTreeNode{}, DeserialiseNodeReadMovedLocationError.SetUnderlying(err)
-		}
-
-		newNodeLocation, err := strconv.ParseInt(string(newNodeLocationString), 10, 64)
-
-		if err != nil {
-			return BTreeNode{}, DeserialiseNodeInvalidMovedLocationError.SetUnderlying(err)
-		}
-
-		serialisedNode.Seek(newNodeLocation, io.SeekStart)
-
-		return DeserialiseBTreeNode(serialisedNode, location)
-	} else if string(deleted) == btreeNodeDeleted {
+	if string(deleted) == btreeNodeDeleted {
 		return BTreeNode{Deleted: true}, nil
 	}
 
@@ -102,19 +103,32 @@ func DeserialiseBTreeNode(serialisedNode io.ReadSeeker, location int64) (BTreeNo
 
 	length, err := strconv.ParseInt(string(lengthString), 10, 64)
 
-	// Read the serialised node
-	serialisedBytes := make([]byte, length)
-	_, err = serialisedNode.Read(serialisedBytes)
+	// Read the serialised node, straight out of the mapping if the index is
+	// Memory mapped
+	var serialisedBytes []byte
+
+	if slicer, ok := serialisedNode.(sliceReader); ok {
+		serialisedBytes, err = slicer.Slice(length)
+	} else {
+		serialisedBytes = make([]byte, length)
+		_, err = serialisedNode.Read(serialisedBytes)
+	}
 
 	if err != nil {
 		return BTreeNode{}, DeserialiseNodeReadNodeError.SetUnderlying(err)
 	}
 
-	// Decode the node
+	if encryption != nil {
+		serialisedBytes, err = encryption.open(serialisedBytes)
+
+		if err != nil {
+			return BTreeNode{}, err
+		}
+	}
+
+	// Decode the node, gob copies everything out of the serialised bytes
 	node := BTreeNode{}
-	buffer := bytes.Buffer{}
-	buffer.Write(serialisedBytes)
-	decoder := gob.NewDecoder(&buffer)
+	decoder := gob.NewDecoder(bytes.NewReader(serialisedBytes))
 	err = decoder.Decode(&node)
 
 	if err != nil {
@@ -122,6 +136,7 @@ func DeserialiseBTreeNode(serialisedNode io.ReadSeeker, location int64) (BTreeNo
 	}
 
 	node.Location = location
+	node.decompressKeys()
 
 	return node, nil
 }
@@ -137,27 +152,12 @@ func (node *BTreeNode) GetKeyType() (int8) {
 	return node.Elements[0].KeyType
 }
 
-// Sort the elements by key depending on type
+// Sort the elements by their encoded keys, elements with equal keys keep their
+// Order
 func (node *BTreeNode) Sort() {
-	if len(node.Elements) == 0 {
-		return
-	}
-
-	if node.GetKeyType() == btreeElementTypeInt {
-		sort.Slice(node.Elements, func(i, j int) bool {
-			return node.Elements[i].KeyInt < node.Elements[j].KeyInt
-		})
-	} else if node.GetKeyType() == btreeElementTypeString {
-		sort.Slice(node.Elements, func(i, j int) bool {
-			zero, _ := new(big.Int).SetString("0", 10)
-
-			return node.Elements[i].GetDistanceFromStringKey(node.Elements[j].KeyString).Cmp(zero) == 1
-		})
-	} else if node.GetKeyType() == btreeElementTypeDate {
-		sort.Slice(node.Elements, func(i, j int) bool {
-			return node.Elements[i].KeyDate.Unix() < node.Elements[j].KeyDate.Unix()
-		})
-	}
+	sort.SliceStable(node.Elements, func(i, j int) bool {
+		return compareEncodedKeys(node.Elements[i].EncodedKey(), node.Elements[j].EncodedKey()) < 0
+	})
 }
 
 // Add a new element and then sort
@@ -172,177 +172,128 @@ func (node *BTreeNode) AddElement(element BTreeElement) {
 	node.Sort()
 }
 
-// Remove an element by key
+// Add an element between the children of its neighbours, pointing the more
+// Child of the element before it at its less child and the less child of the
+// Element after it at its more child so neighbours keep sharing children
+func (node *BTreeNode) addLinkedElement(element BTreeElement) {
+	encoded := element.EncodedKey()
+
+	i := sort.Search(len(node.Elements), func(i int) bool {
+		return compareEncodedKeys(node.Elements[i].EncodedKey(), encoded) > 0
+	})
+
+	node.Elements = append(node.Elements, BTreeElement{})
+	copy(node.Elements[i+1:], node.Elements[i:])
+	node.Elements[i] = element
+
+	if i > 0 {
+		node.Elements[i-1].MoreLocation = element.LessLocation
+	}
+
+	if i+1 < len(node.Elements) {
+		node.Elements[i+1].LessLocation = element.MoreLocation
+	}
+}
+
+// Split a node around its middle element. The left half keeps the node's id
+// And the right half needs one allocating, the middle element's children are
+// Left as the last child of the left half and the first of the right. A leaf
+// Of string keys keeps the middle element in its right half and returns a
+// Separator truncated to just enough of it to tell the halves apart instead
+func (node BTreeNode) split() (BTreeNode, BTreeElement, BTreeNode) {
+	middle := len(node.Elements) / 2
+	separator := node.Elements[middle]
+	rightStart := middle + 1
+
+	if node.GetKeyType() == btreeElementTypeString && !separator.HasChildren() {
+		separator = NewBTreeSeparatorElement(node.Elements[middle-1].KeyString, separator.KeyString, btreeElementNoChildValue, btreeElementNoChildValue)
+		rightStart = middle
+	}
+
+	left := node
+	left.Elements = append([]BTreeElement{}, node.Elements[:middle]...)
+
+	right := NewBTreeNode(false, node.ParentId, btreeNodeNoIdValue, append([]BTreeElement{}, node.Elements[rightStart:]...), make([]int32, 0))
+
+	return left, separator, right
+}
+
+// Remove an element by key, keeping the rest in order
 func (node *BTreeNode) RemoveElement(key interface{}) {
-	if len(node.Elements) == 0 {
+	if !node.hasKeyType(key) {
 		return
 	}
 
-	_, isInt := key.(int64)
-	_, isString := key.(string)
-	_, isDate := key.(time.Time)
+	encoded, _ := EncodeKey(key)
+	i := node.searchElements(encoded)
 
-	if node.Elements[0].KeyType == btreeElementTypeInt && isInt {
-		for i, element := range node.Elements {
-			if element.KeyInt == key {
-				node.Elements[i] = node.Elements[len(node.Elements)-1]
-				node.Elements = node.Elements[:len(node.Elements)-1]
-			}
-		}
-	} else if node.Elements[0].KeyType == btreeElementTypeString && isString {
-		for i, element := range node.Elements {
-			if element.KeyString == key {
-				node.Elements[i] = node.Elements[len(node.Elements)-1]
-				node.Elements = node.Elements[:len(node.Elements)-1]
-			}
-		}
-	} else if node.Elements[0].KeyType == btreeElementTypeDate && isDate {
-		for i, element := range node.Elements {
-			if element.KeyDate == key {
-				node.Elements[i] = node.Elements[len(node.Elements)-1]
-				node.Elements = node.Elements[:len(node.Elements)-1]
-			}
-		}
+	for i < len(node.Elements) && compareEncodedKeys(node.Elements[i].EncodedKey(), encoded) == 0 {
+		node.Elements = append(node.Elements[:i], node.Elements[i+1:]...)
 	}
 }
 
 // Get an element by its key
 func (node *BTreeNode) GetElementByKey(key interface{}) (*BTreeElement, error) {
-	if len(node.Elements) == 0 {
+	if !node.hasKeyType(key) {
 		return &BTreeElement{}, ElementNotFoundByKeyError
 	}
 
-	keyInt, isInt := key.(int64)
-	keyString, isString := key.(string)
-	keyDate, isDate := key.(time.Time)
+	encoded, _ := EncodeKey(key)
 
-	if node.Elements[0].KeyType == btreeElementTypeInt && isInt {
-		for i := range node.Elements {
-			if node.Elements[i].KeyInt == keyInt {
-				return &node.Elements[i], nil
-			}
-		}
-	} else if node.Elements[0].KeyType == btreeElementTypeString && isString {
-		for i := range node.Elements {
-			if node.Elements[i].KeyString == keyString {
-				return &node.Elements[i], nil
-			}
-		}
-	} else if node.Elements[0].KeyType == btreeElementTypeDate && isDate {
-		for i := range node.Elements {
-			if node.Elements[i].KeyDate.Unix() == keyDate.Unix() {
-				return &node.Elements[i], nil
-			}
-		}
+	i := node.searchElements(encoded)
+
+	// Separators only route lookups, they do not hold the key's data
+	if i < len(node.Elements) && compareEncodedKeys(node.Elements[i].EncodedKey(), encoded) == 0 && !node.Elements[i].IsSeparator() {
+		return &node.Elements[i], nil
 	}
 
 	return &BTreeElement{}, ElementNotFoundByKeyError
 }
 
-// Get the location (in bytes) of the next node to check if GetElementByKey
-// Didn't have the key we were looking for
+// Get the id of the next node to check if GetElementByKey didn't have the key
+// We were looking for. This is the less child of the first element with a
+// Larger key, or failing that the more child of the element before it
 func (node *BTreeNode) GetNearestNodeLocationByKey(key interface{}) (int64, error) {
-	if len(node.Elements) == 0 {
+	if !node.hasKeyType(key) {
 		return 0, NoNearestNodeFoundByKeyError
 	}
 
-	keyInt, isInt := key.(int64)
-	keyString, isString := key.(string)
-	keyDate, isDate := key.(time.Time)
-
-	closestKeySet := false
-	var closestElement BTreeElement
-
-	if node.Elements[0].KeyType == btreeElementTypeInt && isInt {
-		var closestKey int64
-		for _, element := range node.Elements {
-			distanceInt := int64(
-				math.Abs(
-					float64(
-						element.GetDistanceFromIntKey(keyInt),
-					),
-				),
-			)
-
-			if !closestKeySet {
-				closestKey = distanceInt
-				closestKeySet = true
-				closestElement = element
-			}
-
-			if distanceInt < closestKey {
-				closestKey = distanceInt
-				closestElement = element
-			}
-		}
-
-		if closestElement.GetDistanceFromIntKey(keyInt) < 0 && closestElement.LessLocation != btreeElementNoChildValue {
-			return closestElement.LessLocation, nil
-		} else if closestElement.MoreLocation != btreeElementNoChildValue {
-			return closestElement.MoreLocation, nil
-		}
-	} else if node.Elements[0].KeyType == btreeElementTypeString && isString {
-		var closestKey *big.Int
-		for _, element := range node.Elements {
-			distanceBigInt := new(big.Int).Abs(
-				element.GetDistanceFromStringKey(keyString),
-			)
-
-			if !closestKeySet {
-				closestKey = distanceBigInt
-				closestKeySet = true
-				closestElement = element
-			}
-
-			if distanceBigInt.Cmp(closestKey) == -1 {
-				closestKey = distanceBigInt
-				closestElement = element
-			}
-		}
+	encoded, _ := EncodeKey(key)
 
-		zero, _ := new(big.Int).SetString("0", 10)
+	i := sort.Search(len(node.Elements), func(i int) bool {
+		return compareEncodedKeys(node.Elements[i].EncodedKey(), encoded) > 0
+	})
 
-		if closestElement.GetDistanceFromStringKey(keyString).Cmp(zero) == -1 && closestElement.LessLocation != btreeElementNoChildValue {
-			return closestElement.LessLocation, nil
-		} else if closestElement.MoreLocation != btreeElementNoChildValue {
-			return closestElement.MoreLocation, nil
-		}
-	} else if node.Elements[0].KeyType == btreeElementTypeDate && isDate {
-		var closestKey int64
-		for _, element := range node.Elements {
-			distanceInt := int64(
-				math.Abs(
-					float64(
-						element.GetDistanceFromDateKey(keyDate),
-					),
-				),
-			)
-
-			if !closestKeySet {
-				closestKey = distanceInt
-				closestKeySet = true
-				closestElement = element
-			}
-
-			if distanceInt < closestKey {
-				closestKey = distanceInt
-				closestElement = element
-			}
-		}
+	if i < len(node.Elements) && node.Elements[i].LessLocation != btreeElementNoChildValue {
+		return node.Elements[i].LessLocation, nil
+	}
 
-		if closestElement.GetDistanceFromDateKey(keyDate) < 0 && closestElement.LessLocation != btreeElementNoChildValue {
-			return closestElement.LessLocation, nil
-		} else if closestElement.MoreLocation != btreeElementNoChildValue {
-			return closestElement.MoreLocation, nil
-		}
+	if i > 0 && node.Elements[i-1].MoreLocation != btreeElementNoChildValue {
+		return node.Elements[i-1].MoreLocation, nil
 	}
 
 	return 0, NoNearestNodeFoundByKeyError
 }
 
+// The index of the first element whose encoded key is not less than encoded
+func (node *BTreeNode) searchElements(encoded []byte) (int) {
+	return sort.Search(len(node.Elements), func(i int) bool {
+		return compareEncodedKeys(node.Elements[i].EncodedKey(), encoded) >= 0
+	})
+}
+
+// Whether the node has elements with the same type of key as key
+func (node *BTreeNode) hasKeyType(key interface{}) (bool) {
+	keyType, ok := keyTypeOf(key)
+
+	return ok && len(node.Elements) != 0 && node.GetKeyType() == keyType
+}
+
 // Serialise the node and return the byte slice representing it
 // Along with a deletion flag and the length of the serialised node
 func (node BTreeNode) Serialise() ([]byte, error) {
+	node.compressKeys()
+
 	// Serialise the node
 	buffer := bytes.Buffer{}
 	encoder := gob.NewEncoder(&buffer)
@@ -365,3 +316,63 @@ func (node BTreeNode) Serialise() ([]byte, error) {
 
 	return serialised, nil
 }
+
+// Move the prefix shared by every string key into KeyPrefix so it is only
+// Stored once. Elements are copied so the caller's node is left untouched
+func (node *BTreeNode) compressKeys() {
+	if node.GetKeyType() != btreeElementTypeString || len(node.Elements) < 2 {
+		return
+	}
+
+	prefix := node.Elements[0].KeyString
+
+	for _, element := range node.Elements[1:] {
+		prefix = commonStringPrefix(prefix, element.KeyString)
+	}
+
+	if len(prefix) == 0 {
+		return
+	}
+
+	elements := make([]BTreeElement, len(node.Elements))
+	copy(elements, node.Elements)
+
+	for i := range elements {
+		elements[i].KeyString = elements[i].KeyString[len(prefix):]
+		elements[i].encodedKey = nil
+	}
+
+	node.Elements = elements
+	node.KeyPrefix = prefix
+}
+
+// Restore the full string keys after deserialising a prefix compressed node
+func (node *BTreeNode) decompressKeys() {
+	if len(node.KeyPrefix) == 0 {
+		return
+	}
+
+	for i := range node.Elements {
+		node.Elements[i].KeyString = node.KeyPrefix + node.Elements[i].KeyString
+		node.Elements[i].encodedKey = nil
+	}
+
+	node.KeyPrefix = ""
+}
+
+// Return the longest prefix shared by both strings
+func commonStringPrefix(a string, b string) (string) {
+	length := len(a)
+
+	if len(b) < length {
+		length = len(b)
+	}
+
+	for i := 0; i < length; i++ {
+		if a[i] != b[i] {
+			return a[:i]
+		}
+	}
+
+	return a[:length]
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"testing"
+	"bytes"
 	"reflect"
 	"time"
 	"strconv"
@@ -969,3 +970,147 @@ func TestBTreeNode_GetNearestNodeLocationByKey(t *testing.T) {
 		t.Error("did not get expected no nearest node found error")
 	}
 }
+
+func TestBTreeNode_SerialisePrefixCompression(t *testing.T) {
+	prefix := "https://example.com/articles/"
+	elements := make([]BTreeElement, 3)
+
+	elements[0] = NewBTreeElement(
+		btreeElementTypeString,
+		prefix+"a",
+		int64(1),
+		btreeElementNoChildValue,
+		btreeElementNoChildValue,
+	)
+
+	elements[1] = NewBTreeElement(
+		btreeElementTypeString,
+		prefix+"b",
+		int64(2),
+		btreeElementNoChildValue,
+		btreeElementNoChildValue,
+	)
+
+	elements[2] = NewBTreeElement(
+		btreeElementTypeString,
+		prefix,
+		int64(3),
+		btreeElementNoChildValue,
+		btreeElementNoChildValue,
+	)
+
+	node := NewBTreeNode(false, btreeNodeParentIdNoValue, 1, elements, make([]int32, 0))
+
+	serialised, err := node.Serialise()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if bytes.Count(serialised, []byte(prefix)) != 1 {
+		t.Error("expected the shared prefix to be serialised once, found:", bytes.Count(serialised, []byte(prefix)))
+	}
+
+	// The bare prefix sorts first
+	if node.Elements[0].KeyString != prefix || node.Elements[1].KeyString != prefix+"a" || len(node.KeyPrefix) != 0 {
+		t.Error("serialising modified the original node")
+	}
+
+	deserialised, err := DeserialiseBTreeNode(NewMemoryFileHandle(serialised), 0)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(deserialised.KeyPrefix) != 0 {
+		t.Error("key prefix was not cleared after deserialising")
+	}
+
+	for i, element := range deserialised.Elements {
+		if element.KeyString != elements[i].KeyString {
+			t.Error("did not restore key", elements[i].KeyString, "got:", element.KeyString)
+		}
+	}
+}
+
+func TestBTreeNode_GetNearestNodeLocationByKeyLargeInts(t *testing.T) {
+	// These differ by less than a float64 can represent
+	low := int64(1<<62) + 1
+	high := int64(1<<62) + 3
+
+	elements := []BTreeElement{
+		NewBTreeElement(btreeElementTypeInt, high, int64(2), int64(20), int64(30)),
+		NewBTreeElement(btreeElementTypeInt, low, int64(1), int64(10), int64(20)),
+	}
+
+	node := NewBTreeNode(false, btreeNodeParentIdNoValue, 1, elements, make([]int32, 0))
+
+	if node.Elements[0].KeyInt != low {
+		t.Error("elements were not sorted on construction")
+	}
+
+	expected := map[int64]int64{
+		low - 1:      10,
+		low + 1:      20,
+		high + 1:     30,
+		1<<63 - 1:    30,
+		-1 << 63:     10,
+	}
+
+	for key, location := range expected {
+		got, err := node.GetNearestNodeLocationByKey(key)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if got != location {
+			t.Error("expected location", location, "for key", key, "got:", got)
+		}
+	}
+
+	element, err := node.GetElementByKey(high)
+	if err != nil || element.Location != 2 {
+		t.Error("did not find element by large key", err)
+	}
+
+	_, err = node.GetElementByKey(high - 1)
+	if !ElementNotFoundByKeyError.IsSame(err) {
+		t.Error("found an element for a key which differs only past float64 precision")
+	}
+}
+
+func TestBTreeNode_GetNearestNodeLocationByKeyWideNode(t *testing.T) {
+	elements := make([]BTreeElement, 0)
+
+	// Every even number as a string key, each element's more child is the next element's less
+	for i := int64(1000); i > 0; i-- {
+		elements = append(elements, NewBTreeElement(btreeElementTypeString, strconv.FormatInt(i*2, 10), i, i*2-1, i*2+1))
+	}
+
+	node := NewBTreeNode(false, btreeNodeParentIdNoValue, 1, elements, make([]int32, 0))
+
+	for i := int64(1); i <= 1000; i++ {
+		key := strconv.FormatInt(i*2, 10)
+
+		element, err := node.GetElementByKey(key)
+		if err != nil || element.Location != i {
+			t.Error("did not find key", key, err)
+		}
+
+		// Sorts directly after key and before any longer key with the same start
+		between := key + "!"
+		location, err := node.GetNearestNodeLocationByKey(between)
+		if err != nil {
+			t.Error(err)
+		}
+
+		encoded, _ := EncodeKey(between)
+		next := node.searchElements(encoded)
+
+		if next < len(node.Elements) && location != node.Elements[next].LessLocation {
+			t.Error("expected the less child of the next element for", between, "got:", location)
+		}
+
+		if next == len(node.Elements) && location != node.Elements[next-1].MoreLocation {
+			t.Error("expected the more child of the last element for", between, "got:", location)
+		}
+	}
+}
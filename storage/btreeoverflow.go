@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"io"
+	"strconv"
+	"fmt"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+const (
+	// The maximum number of key bytes stored in a single overflow record
+	btreeOverflowPageSize = 4096
+	// Next location of the last overflow record in a chain
+	btreeOverflowNoNextValue = int64(0)
+)
+
+var (
+	BtreeOverflowReadError          = gataerrors.NewGataError("unable to read overflow record from index")
+	BtreeOverflowInvalidRecordError = gataerrors.NewGataError("expected to find an overflow record at location")
+	btreeOverflowWriteError         = gataerrors.NewGataError("unable to write overflow record to index")
+)
+
+// Move the part of each string key longer than MaxInlineKeySize into a chain
+// Of overflow records. The returned node holds the truncated keys and should
+// Only be used for serialising, the passed in node is left untouched
+func (tree *BTree) writeOverflowKeys(node BTreeNode) (BTreeNode, error) {
+	if tree.MaxInlineKeySize <= 0 || node.GetKeyType() != btreeElementTypeString {
+		return node, nil
+	}
+
+	elements := make([]BTreeElement, len(node.Elements))
+	copy(elements, node.Elements)
+
+	for i := range elements {
+		if len(elements[i].KeyString) <= tree.MaxInlineKeySize {
+			continue
+		}
+
+		// Keys never change so a chain written for an earlier version of the
+		// Node can be reused
+		if elements[i].OverflowLocation == btreeElementNoOverflowValue {
+			location, err := tree.writeOverflow([]byte(elements[i].KeyString[tree.MaxInlineKeySize:]))
+
+			if err != nil {
+				return node, err
+			}
+
+			elements[i].OverflowLocation = location
+		}
+
+		elements[i].KeyString = elements[i].KeyString[:tree.MaxInlineKeySize]
+		elements[i].encodedKey = nil
+	}
+
+	node.Elements = elements
+
+	return node, nil
+}
+
+// Append the tail of the keys stored in overflow records to the inline part
+func (tree *BTree) readOverflowKeys(node *BTreeNode) (error) {
+	for i := range node.Elements {
+		if node.Elements[i].OverflowLocation == btreeElementNoOverflowValue {
+			continue
+		}
+
+		overflow, err := tree.readOverflow(node.Elements[i].OverflowLocation)
+
+		if err != nil {
+			return err
+		}
+
+		node.Elements[i].KeyString += string(overflow)
+		node.Elements[i].encodedKey = nil
+	}
+
+	return nil
+}
+
+// Write data as a chain of overflow records, returning the location of the first
+// The chain is written back to front so each record knows where the next is
+func (tree *BTree) writeOverflow(data []byte) (int64, error) {
+	next := btreeOverflowNoNextValue
+
+	for start := ((len(data) - 1) / btreeOverflowPageSize) * btreeOverflowPageSize; start >= 0; start -= btreeOverflowPageSize {
+		end := start + btreeOverflowPageSize
+
+		if end > len(data) {
+			end = len(data)
+		}
+
+		chunk := data[start:end]
+
+		if tree.encryption != nil {
+			sealed, err := tree.encryption.seal(chunk)
+
+			if err != nil {
+				return 0, err
+			}
+
+			chunk = sealed
+		}
+
+		location, err := tree.appendIndex(serialiseOverflowRecord(next, chunk))
+
+		if err != nil {
+			return 0, wrapWriteError(err, btreeOverflowWriteError)
+		}
+
+		next = location
+	}
+
+	return next, nil
+}
+
+// Follow a chain of overflow records from location and return their contents
+func (tree *BTree) readOverflow(location int64) ([]byte, error) {
+	data := make([]byte, 0)
+	reader := tree.reader()
+
+	for location != btreeOverflowNoNextValue {
+		_, err := reader.Seek(location, io.SeekStart)
+
+		if err != nil {
+			return nil, BtreeIndexSeekError.SetUnderlying(err)
+		}
+
+		// Flag, length and next location
+		header := make([]byte, 1+btreeNodeLengthLocationPadLength*2)
+		_, err = io.ReadFull(reader, header)
+
+		if err != nil {
+			return nil, BtreeOverflowReadError.SetUnderlying(err)
+		}
+
+		if string(header[0]) != btreeNodeOverflow {
+			return nil, BtreeOverflowInvalidRecordError.SetUnderlying(
+				fmt.Errorf("found flag %q at location %d", header[0], location),
+			)
+		}
+
+		length, err := strconv.ParseInt(string(header[1:1+btreeNodeLengthLocationPadLength]), 10, 64)
+
+		if err != nil {
+			return nil, BtreeOverflowInvalidRecordError.SetUnderlying(err)
+		}
+
+		next, err := strconv.ParseInt(string(header[1+btreeNodeLengthLocationPadLength:]), 10, 64)
+
+		if err != nil {
+			return nil, BtreeOverflowInvalidRecordError.SetUnderlying(err)
+		}
+
+		chunk := make([]byte, length)
+		_, err = io.ReadFull(reader, chunk)
+
+		if err != nil {
+			return nil, BtreeOverflowReadError.SetUnderlying(err)
+		}
+
+		if tree.encryption != nil {
+			chunk, err = tree.encryption.open(chunk)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		data = append(data, chunk...)
+		location = next
+	}
+
+	return data, nil
+}
+
+// Serialise an overflow record as the overflow flag, the padded length of the
+// Data, the padded location of the next record in the chain and the data
+func serialiseOverflowRecord(next int64, data []byte) ([]byte) {
+	serialised := []byte(btreeNodeOverflow)
+	serialised = append(serialised, []byte(fmt.Sprintf("%0"+strconv.Itoa(btreeNodeLengthLocationPadLength)+"d", len(data)))...)
+	serialised = append(serialised, []byte(fmt.Sprintf("%0"+strconv.Itoa(btreeNodeLengthLocationPadLength)+"d", next))...)
+	serialised = append(serialised, data...)
+
+	return serialised
+}
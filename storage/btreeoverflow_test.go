@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"testing"
+	"strings"
+	"bytes"
+	"io"
+)
+
+func TestBTree_writeReadOverflow(t *testing.T) {
+	index := &MemoryFileHandle{}
+	tree := NewBTree(index, 4, true)
+
+	// Spans three overflow records
+	data := []byte(strings.Repeat("abcdefgh", btreeOverflowPageSize/4))
+
+	location, err := tree.writeOverflow(data)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if location < btreeNodeLengthLocationPadLength {
+		t.Error("overflow record was written over the root location, at:", location)
+	}
+
+	read, err := tree.readOverflow(location)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !bytes.Equal(read, data) {
+		t.Error("did not read back the data written to the overflow chain")
+	}
+
+	// Test reading something which is not an overflow record
+	_, err = tree.readOverflow(1)
+
+	if !BtreeOverflowInvalidRecordError.IsSame(err) {
+		t.Error("did not get expected error when reading a non-overflow record")
+	}
+}
+
+func TestBTree_InsertOversizedKeys(t *testing.T) {
+	index := &MemoryFileHandle{}
+	tree := NewBTree(index, 4, true)
+	tree.MaxInlineKeySize = 16
+
+	longKey := "https://example.com/" + strings.Repeat("a", btreeOverflowPageSize*2)
+	shortKey := "https://a.com"
+
+	err := tree.Insert(longKey, int64(10))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = tree.Insert(shortKey, int64(20))
+	if err != nil {
+		t.Error(err)
+	}
+
+	location, err := tree.Find(longKey)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if location != 10 {
+		t.Error("did not get expected location of 10 for the oversized key, got:", location)
+	}
+
+	location, err = tree.Find(shortKey)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if location != 20 {
+		t.Error("did not get expected location of 20 for the short key, got:", location)
+	}
+
+	// The root should hold the truncated key with a pointer to the overflow
+	_, err = tree.Index.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Error(err)
+	}
+
+	root, err := tree.getRoot()
+	if err != nil {
+		t.Error(err)
+	}
+
+	element, err := root.GetElementByKey(longKey)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if element.OverflowLocation == btreeElementNoOverflowValue {
+		t.Error("oversized key was not moved into an overflow record")
+	}
+
+	rootLocation := root.Location
+	_, err = tree.Index.Seek(rootLocation, io.SeekStart)
+	if err != nil {
+		t.Error(err)
+	}
+
+	serialisedRoot, err := DeserialiseBTreeNode(tree.Index, rootLocation)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, element := range serialisedRoot.Elements {
+		if len(element.KeyString) > tree.MaxInlineKeySize {
+			t.Error("key stored inline is longer than MaxInlineKeySize:", len(element.KeyString))
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+const (
+	// The number of node locations held in each page of the page table
+	btreePageTableEntriesPerPage = 512
+	// Location of a node or page which has not been written, the superblock
+	// Lives at the start of the index so no record can
+	btreePageTableNoLocationValue = int64(0)
+	// Root id, next id, key count, key type and inline key and value sizes at
+	// The start of a page table directory
+	btreePageTableDirectoryHeaderLength = 4 + 4 + 8 + 1 + 4 + 4
+)
+
+var (
+	BTreeNodeIdNotFoundError         = gataerrors.NewGataError("no node has been written with this id")
+	BtreePageTableInvalidRecordError = gataerrors.NewGataError("expected to find a page table record at location")
+	btreePageTableReadError          = gataerrors.NewGataError("unable to read the btree page table")
+	btreePageTableWriteError         = gataerrors.NewGataError("unable to write the btree page table")
+)
+
+// Maps the stable id of each node to the location its newest copy was written
+// At, so a node can be rewritten without touching the nodes which point at it.
+// The table is split into pages, committing appends the pages changed since
+// The last commit and a directory of every page's location, then switches the
+// Root slot to the new directory
+type btreePageTable struct {
+	// The directory the table was read from or last committed to and the
+	// Generation of the root slot pointing at it
+	location   int64
+	generation uint64
+	root     int32
+	nextId   int32
+	// The number of keys in the tree, so a bloom filter which missed some can
+	// Be spotted
+	keys int64
+	// The type of every key in the tree and the inline limits they were
+	// Written with, committed with the root so they cannot be torn from it
+	keyType         int8
+	inlineKeySize   int
+	inlineValueSize int
+	// Where each page was last written in the index
+	pageLocations []int64
+	// Pages which have been read or changed, by page number
+	pages map[int][]int64
+	dirty map[int]bool
+}
+
+// Construct the table of an index with no nodes
+func newBTreePageTable() (*btreePageTable) {
+	return &btreePageTable{
+		location:      btreePageTableNoLocationValue,
+		root:          btreeNodeNoIdValue,
+		keyType:       btreeElementTypeUnset,
+		nextId:        btreeNodeFirstId,
+		pageLocations: make([]int64, 0),
+		pages:         make(map[int][]int64),
+		dirty:         make(map[int]bool),
+	}
+}
+
+// Pick the next unused node id
+func (table *btreePageTable) allocate() (int32) {
+	id := table.nextId
+	table.nextId++
+
+	return id
+}
+
+// The table to look nodes up in and record new nodes to. The root slot is only
+// Read when there is no table in memory, as it is after a failed commit
+func (tree *BTree) pageTable() (*btreePageTable, error) {
+	if tree.pages != nil {
+		return tree.pages, nil
+	}
+
+	slot, found, err := tree.readRootSlot()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		tree.pages = newBTreePageTable()
+
+		return tree.pages, nil
+	}
+
+	return tree.loadPageTable(slot)
+}
+
+// Read the page table directory the root slot points at, reusing the table in
+// Memory if it is the same one
+func (tree *BTree) loadPageTable(slot btreeRootSlot) (*btreePageTable, error) {
+	location := slot.Location
+
+	if tree.pages != nil && tree.pages.location == location {
+		return tree.pages, nil
+	}
+
+	directory, err := tree.readPageTableRecord(location, btreeNodePageTableDirectory)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(directory) < btreePageTableDirectoryHeaderLength || (len(directory)-btreePageTableDirectoryHeaderLength)%8 != 0 {
+		return nil, BtreePageTableInvalidRecordError.SetUnderlying(
+			fmt.Errorf("directory at location %d has invalid length %d", location, len(directory)),
+		)
+	}
+
+	table := newBTreePageTable()
+	table.location = location
+	table.generation = slot.Generation
+	table.root = int32(binary.BigEndian.Uint32(directory[0:4]))
+	table.nextId = int32(binary.BigEndian.Uint32(directory[4:8]))
+	table.keys = int64(binary.BigEndian.Uint64(directory[8:16]))
+	table.keyType = int8(directory[16])
+	table.inlineKeySize = int(binary.BigEndian.Uint32(directory[17:21]))
+	table.inlineValueSize = int(binary.BigEndian.Uint32(directory[21:25]))
+
+	for i := btreePageTableDirectoryHeaderLength; i < len(directory); i += 8 {
+		table.pageLocations = append(table.pageLocations, int64(binary.BigEndian.Uint64(directory[i:i+8])))
+	}
+
+	tree.pages = table
+
+	return table, nil
+}
+
+// The location of the newest copy of the node with id
+func (tree *BTree) locateNode(id int32) (int64, error) {
+	table := tree.pages
+
+	if table == nil {
+		var err error
+		table, err = tree.pageTable()
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	page := int(id / btreePageTableEntriesPerPage)
+
+	if id < btreeNodeFirstId || page >= len(table.pageLocations) {
+		return 0, BTreeNodeIdNotFoundError
+	}
+
+	entries, err := tree.loadPageTablePage(table, page)
+
+	if err != nil {
+		return 0, err
+	}
+
+	location := entries[id%btreePageTableEntriesPerPage]
+
+	if location == btreePageTableNoLocationValue {
+		return 0, BTreeNodeIdNotFoundError
+	}
+
+	return location, nil
+}
+
+// Record that the node with id was written at location, the change is kept in
+// Memory until the table is committed
+func (tree *BTree) setNodeLocation(table *btreePageTable, id int32, location int64) (error) {
+	page := int(id / btreePageTableEntriesPerPage)
+
+	for len(table.pageLocations) <= page {
+		table.pageLocations = append(table.pageLocations, btreePageTableNoLocationValue)
+	}
+
+	entries, err := tree.loadPageTablePage(table, page)
+
+	if err != nil {
+		return err
+	}
+
+	if id >= table.nextId {
+		table.nextId = id + 1
+	}
+
+	entries[id%btreePageTableEntriesPerPage] = location
+	table.dirty[page] = true
+
+	return nil
+}
+
+// The locations held in a page, read from the index the first time the page
+// Is needed
+func (tree *BTree) loadPageTablePage(table *btreePageTable, page int) ([]int64, error) {
+	if entries, ok := table.pages[page]; ok {
+		return entries, nil
+	}
+
+	entries := make([]int64, btreePageTableEntriesPerPage)
+
+	if table.pageLocations[page] != btreePageTableNoLocationValue {
+		serialised, err := tree.readPageTableRecord(table.pageLocations[page], btreeNodePageTablePage)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for i := 0; i < len(serialised)/8 && i < len(entries); i++ {
+			entries[i] = int64(binary.BigEndian.Uint64(serialised[i*8 : i*8+8]))
+		}
+	}
+
+	table.pages[page] = entries
+
+	return entries, nil
+}
+
+// Read the newest copy of the node with id
+func (tree *BTree) readNodeById(id int32) (BTreeNode, error) {
+	location, err := tree.locateNode(id)
+
+	if err != nil {
+		return BTreeNode{}, err
+	}
+
+	return tree.readNode(location)
+}
+
+// Append the pages changed since the last commit and a new directory, then
+// Switch the root slot to it. The table in memory is thrown away if anything
+// Fails so it is read back from the index next time
+func (tree *BTree) commitPageTable() (error) {
+	table, err := tree.pageTable()
+
+	if err != nil {
+		return err
+	}
+
+	for page := range table.pageLocations {
+		if !table.dirty[page] {
+			continue
+		}
+
+		location, err := tree.appendPageTableRecord(btreeNodePageTablePage, serialisePageTablePage(table.pages[page]))
+
+		if err != nil {
+			tree.pages = nil
+			return err
+		}
+
+		table.pageLocations[page] = location
+	}
+
+	directory := make([]byte, btreePageTableDirectoryHeaderLength, btreePageTableDirectoryHeaderLength+len(table.pageLocations)*8)
+	binary.BigEndian.PutUint32(directory[0:4], uint32(table.root))
+	binary.BigEndian.PutUint32(directory[4:8], uint32(table.nextId))
+	binary.BigEndian.PutUint64(directory[8:16], uint64(table.keys))
+	directory[16] = byte(table.keyType)
+	binary.BigEndian.PutUint32(directory[17:21], uint32(table.inlineKeySize))
+	binary.BigEndian.PutUint32(directory[21:25], uint32(table.inlineValueSize))
+
+	for _, pageLocation := range table.pageLocations {
+		location := make([]byte, 8)
+		binary.BigEndian.PutUint64(location, uint64(pageLocation))
+		directory = append(directory, location...)
+	}
+
+	location, err := tree.appendPageTableRecord(btreeNodePageTableDirectory, directory)
+
+	if err != nil {
+		tree.pages = nil
+		return err
+	}
+
+	slot := btreeRootSlot{Generation: table.generation + 1, Location: location}
+	err = tree.writeRootSlot(slot)
+
+	if err != nil {
+		tree.pages = nil
+		return err
+	}
+
+	table.location = location
+	table.generation = slot.Generation
+	table.dirty = make(map[int]bool)
+
+	return nil
+}
+
+// Append a page table record as its flag, the padded length of the data and
+// The data, encrypting the data first if the index is encrypted
+func (tree *BTree) appendPageTableRecord(flag string, data []byte) (int64, error) {
+	if tree.encryption != nil {
+		sealed, err := tree.encryption.seal(data)
+
+		if err != nil {
+			return 0, err
+		}
+
+		data = sealed
+	}
+
+	serialised := []byte(flag)
+	serialised = append(serialised, []byte(fmt.Sprintf("%0"+strconv.Itoa(btreeNodeLengthLocationPadLength)+"d", len(data)))...)
+	serialised = append(serialised, data...)
+
+	location, err := tree.appendIndex(serialised)
+
+	if err != nil {
+		return 0, wrapWriteError(err, btreePageTableWriteError)
+	}
+
+	return location, nil
+}
+
+// Read the data of the page table record with flag at location
+func (tree *BTree) readPageTableRecord(location int64, flag string) ([]byte, error) {
+	reader := tree.reader()
+	end, err := reader.Seek(0, io.SeekEnd)
+
+	if err != nil {
+		return nil, BtreeIndexSeekError.SetUnderlying(err)
+	}
+
+	_, err = reader.Seek(location, io.SeekStart)
+
+	if err != nil {
+		return nil, BtreeIndexSeekError.SetUnderlying(err)
+	}
+
+	header := make([]byte, 1+btreeNodeLengthLocationPadLength)
+	_, err = io.ReadFull(reader, header)
+
+	if err != nil {
+		return nil, btreePageTableReadError.SetUnderlying(err)
+	}
+
+	if string(header[0]) != flag {
+		return nil, BtreePageTableInvalidRecordError.SetUnderlying(
+			fmt.Errorf("found flag %q at location %d", header[0], location),
+		)
+	}
+
+	length, err := strconv.ParseInt(string(header[1:]), 10, 64)
+
+	if err != nil {
+		return nil, BtreePageTableInvalidRecordError.SetUnderlying(err)
+	}
+
+	// A corrupt length must not be trusted to size the read
+	if length < 0 || length > end-location-int64(len(header)) {
+		return nil, BtreePageTableInvalidRecordError.SetUnderlying(
+			fmt.Errorf("record at location %d has length %d past the end of the index", location, length),
+		)
+	}
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(reader, data)
+
+	if err != nil {
+		return nil, btreePageTableReadError.SetUnderlying(err)
+	}
+
+	if tree.encryption != nil {
+		return tree.encryption.open(data)
+	}
+
+	return data, nil
+}
+
+// Serialise the locations in a page, leaving off the unused ids at the end so
+// A small tree only writes small pages
+func serialisePageTablePage(entries []int64) ([]byte) {
+	used := len(entries)
+
+	for used > 0 && entries[used-1] == btreePageTableNoLocationValue {
+		used--
+	}
+
+	serialised := make([]byte, used*8)
+
+	for i := 0; i < used; i++ {
+		binary.BigEndian.PutUint64(serialised[i*8:i*8+8], uint64(entries[i]))
+	}
+
+	return serialised
+}
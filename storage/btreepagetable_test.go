@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestBTree_pageTableAllocatesIds(t *testing.T) {
+	index := &MemoryFileHandle{}
+	tree := NewBTree(index, 4, true)
+
+	for key := int64(1); key <= 3; key++ {
+		err := tree.Insert(key, key*10)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	root, err := tree.getRoot()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if root.Id != btreeNodeFirstId {
+		t.Error("root was not allocated the first id, got:", root.Id)
+	}
+
+	// The next id is persisted so a reopened tree does not reuse one
+	reopened := NewBTree(index, 4, true)
+
+	elements := make([]BTreeElement, 1)
+	elements[0] = NewBTreeElement(btreeElementTypeInt, int64(5), int64(50), btreeElementNoChildValue, btreeElementNoChildValue)
+
+	id, err := reopened.writeNode(NewBTreeNode(false, root.Id, btreeNodeNoIdValue, elements, make([]int32, 0)))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if id != btreeNodeFirstId+1 {
+		t.Error("did not allocate the id after the root's, got:", id)
+	}
+}
+
+func TestBTree_pageTableSpansPages(t *testing.T) {
+	index := &MemoryFileHandle{}
+	tree := NewBTree(index, 4, true)
+
+	// Children on the first and a later page of the page table
+	ids := []int32{2, btreePageTableEntriesPerPage*2 + 7}
+
+	for i, id := range ids {
+		elements := make([]BTreeElement, 1)
+		elements[0] = NewBTreeElement(btreeElementTypeInt, int64(i*4+1), int64(i*4+1)*10, btreeElementNoChildValue, btreeElementNoChildValue)
+
+		_, err := tree.writeNode(NewBTreeNode(false, 1, id, elements, make([]int32, 0)))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	elements := make([]BTreeElement, 1)
+	elements[0] = NewBTreeElement(btreeElementTypeInt, int64(3), int64(30), int64(ids[0]), int64(ids[1]))
+
+	_, err := tree.writeRoot(NewBTreeNode(false, btreeNodeParentIdNoValue, 1, elements, make([]int32, 0)))
+	if err != nil {
+		t.Error(err)
+	}
+
+	reopened := NewBTree(index, 4, true)
+
+	for _, key := range []int64{1, 3, 5} {
+		location, err := reopened.Find(key)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if location != key*10 {
+			t.Error("did not find expected location", key*10, "for key", key, "got:", location)
+		}
+	}
+
+	_, err = reopened.readNodeById(ids[1] + 1)
+	if !BTreeNodeIdNotFoundError.IsSame(err) {
+		t.Error("expected BTreeNodeIdNotFoundError for an id never written, got:", err)
+	}
+
+	// Ids never written get the next one allocated after the highest
+	id, err := reopened.writeNode(NewBTreeNode(false, 1, btreeNodeNoIdValue, elements, make([]int32, 0)))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if id != ids[1]+1 {
+		t.Error("did not allocate the id after the highest written, got:", id)
+	}
+}
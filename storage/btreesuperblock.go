@@ -0,0 +1,468 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+const (
+	// Identifies a file as a btree index
+	BTreeMagic = "GATABTRE"
+	// The index format this package reads and writes, version 3 references
+	// Children by node id through a page table and version 4 keeps the key
+	// Type and inline limits in the page table directory
+	BTreeFormatVersion = uint16(4)
+	// Magic, version, padding, unique, max elements, encrypted, padding, page
+	// Size, padding and the checksum of everything before it
+	btreeSuperblockConfigSize = 32
+	// Generation, root location and the checksum of both
+	btreeRootSlotSize = 20
+	// The two root slots follow the configuration, alternating by generation
+	btreeRootSlotOffset = int64(32)
+	btreeRootSlotStride = int64(32)
+	// Nodes and overflow records are written after the superblock
+	btreeSuperblockSize = int64(96)
+	// An encrypted index's header record follows the superblock
+	btreeEncryptionHeaderSize = int64(1 + encryptionHeaderSize)
+)
+
+var (
+	BTreeSuperblockInvalidError        = gataerrors.NewGataError("index does not begin with a valid btree superblock")
+	BTreeUnsupportedFormatVersionError = gataerrors.NewGataError("index was written by a format version this package cannot read")
+	BTreeUnversionedFormatError        = gataerrors.NewGataError("index was written before btree indexes had a superblock, convert it with ConvertUnversionedBTree")
+	BTreeConfigurationMismatchError    = gataerrors.NewGataError("index was created with a different configuration")
+	BTreeKeyTypeMismatchError          = gataerrors.NewGataError("key type does not match the keys already in the btree")
+	btreeSuperblockReadError           = gataerrors.NewGataError("unable to read the btree superblock")
+	btreeSuperblockWriteError          = gataerrors.NewGataError("unable to write the btree superblock")
+)
+
+// The configuration an index was created with, stored at the start of the
+// Index so it can be validated when the index is reopened. It is only written
+// When the index is created, the key type and inline limits fixed by the first
+// Insert are kept in the page table directory so they switch with the root
+type btreeSuperblock struct {
+	Version            uint16
+	Unique             bool
+	MaxElementsPerNode int8
+	Encrypted          bool
+	PageSize           uint32
+}
+
+// One of the two places the location of the page table directory naming the
+// Root is kept. The root is switched by writing the slot not holding the current root, so a torn
+// Write leaves the previous root intact
+type btreeRootSlot struct {
+	Generation uint64
+	Location   int64
+}
+
+// Open a btree index, validating an existing index was created with the same
+// Configuration or writing the superblock of a new one. An index which already
+// Has keys keeps the MaxInlineKeySize and MaxInlineValueSize they were written
+// With, writing to it after changing them returns
+// BTreeConfigurationMismatchError
+func OpenBTree(index io.ReadWriteSeeker, maxElementCount int8, unique bool) (BTree, error) {
+	return openBTree(index, maxElementCount, unique, nil)
+}
+
+// Open a btree index encrypted with key, or create a new one. Returns
+// EncryptionWrongKeyError if the index was encrypted with a different key.
+// Compacting into an index opened with a new key rotates the key
+func OpenEncryptedBTree(index io.ReadWriteSeeker, maxElementCount int8, unique bool, key []byte) (BTree, error) {
+	if key == nil {
+		return NewBTree(index, maxElementCount, unique), EncryptionKeyInvalidError
+	}
+
+	return openBTree(index, maxElementCount, unique, key)
+}
+
+// Open a btree index, encrypted with key unless it is nil
+func openBTree(index io.ReadWriteSeeker, maxElementCount int8, unique bool, key []byte) (BTree, error) {
+	tree := NewBTree(index, maxElementCount, unique)
+
+	superblock, found, err := tree.readSuperblock()
+
+	if err != nil {
+		return tree, err
+	}
+
+	if !found {
+		if key != nil {
+			tree.encryption, err = newFileEncryption(key)
+
+			if err != nil {
+				return tree, err
+			}
+		}
+
+		_, err = tree.initialiseIndex()
+
+		return tree, err
+	}
+
+	if superblock.Unique != unique || superblock.MaxElementsPerNode != maxElementCount || superblock.PageSize != btreeOverflowPageSize {
+		return tree, BTreeConfigurationMismatchError
+	}
+
+	if superblock.Encrypted && key == nil {
+		return tree, EncryptionKeyRequiredError
+	}
+
+	if !superblock.Encrypted && key != nil {
+		return tree, EncryptionNotEnabledError
+	}
+
+	if superblock.Encrypted {
+		tree.encryption, err = tree.readEncryptionHeader(key)
+
+		if err != nil {
+			return tree, err
+		}
+	}
+
+	table, err := tree.pageTable()
+
+	if err != nil {
+		return tree, err
+	}
+
+	// Keys of a custom type cannot be read without their decoder
+	if table.keyType >= MinCustomKeyTypeId {
+		if _, ok := registeredKeyType(table.keyType); !ok {
+			return tree, KeyTypeNotRegisteredError
+		}
+	}
+
+	if table.keyType != btreeElementTypeUnset {
+		tree.MaxInlineKeySize = table.inlineKeySize
+		tree.MaxInlineValueSize = table.inlineValueSize
+	}
+
+	return tree, nil
+}
+
+// The superblock describing the tree's current configuration
+func (tree *BTree) superblock() (btreeSuperblock) {
+	return btreeSuperblock{
+		Version:            BTreeFormatVersion,
+		Unique:             tree.Unique,
+		MaxElementsPerNode: tree.MaxElementsPerNode,
+		Encrypted:          tree.encryption != nil,
+		PageSize:           btreeOverflowPageSize,
+	}
+}
+
+// Where nodes start, after the superblock and any encryption header
+func (tree *BTree) dataStart() (int64) {
+	if tree.encryption != nil {
+		return btreeSuperblockSize + btreeEncryptionHeaderSize
+	}
+
+	return btreeSuperblockSize
+}
+
+// Read the encryption header following the superblock and check it matches key
+func (tree *BTree) readEncryptionHeader(key []byte) (*fileEncryption, error) {
+	_, err := tree.Index.Seek(btreeSuperblockSize, io.SeekStart)
+
+	if err != nil {
+		return nil, BtreeIndexSeekError.SetUnderlying(err)
+	}
+
+	header := make([]byte, btreeEncryptionHeaderSize)
+	_, err = io.ReadFull(tree.Index, header)
+
+	if err != nil {
+		return nil, btreeSuperblockReadError.SetUnderlying(err)
+	}
+
+	if string(header[0]) != btreeNodeEncryptionHeader {
+		return nil, BTreeSuperblockInvalidError
+	}
+
+	return openFileEncryption(key, header[1:])
+}
+
+// Encrypt the payload of a serialised node if the index is encrypted
+func (tree *BTree) sealNode(serialised []byte) ([]byte, error) {
+	if tree.encryption == nil {
+		return serialised, nil
+	}
+
+	payload, err := tree.encryption.seal(serialised[1+btreeNodeLengthLocationPadLength:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := []byte(serialised[0:1])
+	sealed = append(sealed, []byte(fmt.Sprintf("%0"+strconv.Itoa(btreeNodeLengthLocationPadLength)+"d", len(payload)))...)
+
+	return append(sealed, payload...), nil
+}
+
+// Seek to the end of the index to append a record, writing the superblock
+// First if the index is new. An index too short to hold a superblock can only
+// Be one whose creation was interrupted, so it is started again
+func (tree *BTree) initialiseIndex() (int64, error) {
+	location, err := tree.Index.Seek(0, io.SeekEnd)
+
+	if err != nil {
+		return 0, btreeWriteNodeSeekToEndError.SetUnderlying(err)
+	}
+
+	if location >= tree.dataStart() {
+		return location, nil
+	}
+
+	_, err = tree.Index.Seek(0, io.SeekStart)
+
+	if err != nil {
+		return 0, btreeWriteNodeSeekToEndError.SetUnderlying(err)
+	}
+
+	header := make([]byte, btreeSuperblockSize)
+	copy(header, tree.superblock().serialise())
+
+	if tree.encryption != nil {
+		header = append(header, []byte(btreeNodeEncryptionHeader)...)
+		header = append(header, tree.encryption.header()...)
+	}
+
+	err = reserveSpace(tree.Quota, tree.Index, int64(len(header)))
+
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tree.Index.Write(header)
+
+	if err != nil {
+		rollbackAppend(tree.Quota, tree.Index, 0, int64(len(header)))
+		return 0, wrapWriteError(err, btreeSuperblockWriteError)
+	}
+
+	return int64(len(header)), nil
+}
+
+// Read the superblock, found is false if the index is new
+func (tree *BTree) readSuperblock() (btreeSuperblock, bool, error) {
+	header, err := tree.readHeader()
+
+	if err != nil || header == nil {
+		return btreeSuperblock{}, false, err
+	}
+
+	superblock, err := deserialiseBTreeSuperblock(header[:btreeSuperblockConfigSize])
+
+	if err != nil {
+		return btreeSuperblock{}, false, err
+	}
+
+	return superblock, true, nil
+}
+
+// Read the newest root slot with a valid checksum, found is false if the tree
+// Does not have a root yet
+func (tree *BTree) readRootSlot() (btreeRootSlot, bool, error) {
+	header, err := tree.readHeader()
+
+	if err != nil || header == nil {
+		return btreeRootSlot{}, false, err
+	}
+
+	_, err = deserialiseBTreeSuperblock(header[:btreeSuperblockConfigSize])
+
+	if err != nil {
+		return btreeRootSlot{}, false, err
+	}
+
+	newest := btreeRootSlot{}
+	found := false
+
+	for i := int64(0); i < 2; i++ {
+		start := btreeRootSlotOffset + i*btreeRootSlotStride
+		slot, ok := deserialiseBTreeRootSlot(header[start : start+btreeRootSlotSize])
+
+		if ok && (!found || slot.Generation > newest.Generation) {
+			newest = slot
+			found = true
+		}
+	}
+
+	return newest, found, nil
+}
+
+// Switch the root by writing slot, which should have the generation after the
+// Current one's so it goes in the other place
+func (tree *BTree) writeRootSlot(slot btreeRootSlot) (error) {
+	return tree.writeAt(btreeRootSlotOffset+int64(slot.Generation%2)*btreeRootSlotStride, slot.serialise())
+}
+
+// Record the type of the tree's keys and the inline limits in the page table
+// The first time a key is inserted, every later key must have the same type
+// And be written with the same limits. They are only written with the
+// Directory the insert commits, so a failed insert does not fix them
+func (tree *BTree) setKeyType(keyType int8) (error) {
+	err := tree.checkInlineLimits()
+
+	if err != nil {
+		return err
+	}
+
+	table, err := tree.pageTable()
+
+	if err != nil {
+		return err
+	}
+
+	if table.keyType == keyType {
+		return nil
+	}
+
+	if table.keyType != btreeElementTypeUnset {
+		return BTreeKeyTypeMismatchError
+	}
+
+	table.keyType = keyType
+	table.inlineKeySize = tree.MaxInlineKeySize
+	table.inlineValueSize = tree.MaxInlineValueSize
+
+	return nil
+}
+
+// Refuse to write with inline limits other than the ones the keys already in
+// The index were written with, as their overflow chains were split at them
+func (tree *BTree) checkInlineLimits() (error) {
+	table, err := tree.pageTable()
+
+	if err != nil {
+		return err
+	}
+
+	if table.keyType == btreeElementTypeUnset {
+		return nil
+	}
+
+	if tree.MaxInlineKeySize != table.inlineKeySize || tree.MaxInlineValueSize != table.inlineValueSize {
+		return BTreeConfigurationMismatchError
+	}
+
+	return nil
+}
+
+// Read the whole superblock, returns nil if the index is too short to have one
+func (tree *BTree) readHeader() ([]byte, error) {
+	_, err := tree.Index.Seek(0, io.SeekStart)
+
+	if err != nil {
+		return nil, BtreeIndexSeekError.SetUnderlying(err)
+	}
+
+	header := make([]byte, btreeSuperblockSize)
+	read, err := io.ReadFull(tree.Index, header)
+
+	// A short index written before the superblock must not be mistaken for a
+	// New one, as initialiseIndex would write over it
+	if (err == io.EOF || err == io.ErrUnexpectedEOF) && isUnversionedBTreeIndex(header[:read]) {
+		return nil, BTreeUnversionedFormatError
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, btreeSuperblockReadError.SetUnderlying(err)
+	}
+
+	return header, nil
+}
+
+// Serialise the configuration followed by its checksum
+func (superblock btreeSuperblock) serialise() ([]byte) {
+	serialised := make([]byte, btreeSuperblockConfigSize)
+	copy(serialised[0:8], BTreeMagic)
+	binary.BigEndian.PutUint16(serialised[8:10], superblock.Version)
+	if superblock.Unique {
+		serialised[11] = 1
+	}
+
+	serialised[12] = byte(superblock.MaxElementsPerNode)
+
+	if superblock.Encrypted {
+		serialised[13] = 1
+	}
+
+	binary.BigEndian.PutUint32(serialised[16:20], superblock.PageSize)
+	binary.BigEndian.PutUint32(serialised[28:32], crc32.ChecksumIEEE(serialised[0:28]))
+
+	return serialised
+}
+
+// Deserialise and validate a configuration written by serialise
+func deserialiseBTreeSuperblock(serialised []byte) (btreeSuperblock, error) {
+	if isUnversionedBTreeIndex(serialised) {
+		return btreeSuperblock{}, BTreeUnversionedFormatError
+	}
+
+	if string(serialised[0:8]) != BTreeMagic || crc32.ChecksumIEEE(serialised[0:28]) != binary.BigEndian.Uint32(serialised[28:32]) {
+		return btreeSuperblock{}, BTreeSuperblockInvalidError
+	}
+
+	superblock := btreeSuperblock{
+		Version:            binary.BigEndian.Uint16(serialised[8:10]),
+		Unique:             serialised[11] == 1,
+		MaxElementsPerNode: int8(serialised[12]),
+		Encrypted:          serialised[13] == 1,
+		PageSize:           binary.BigEndian.Uint32(serialised[16:20]),
+	}
+
+	if superblock.Version != BTreeFormatVersion {
+		return superblock, BTreeUnsupportedFormatVersionError
+	}
+
+	return superblock, nil
+}
+
+// Whether an index begins with the padded location of its root, as indexes
+// Written before the superblock do
+func isUnversionedBTreeIndex(header []byte) (bool) {
+	if len(header) < btreeNodeLengthLocationPadLength {
+		return false
+	}
+
+	for _, digit := range header[:btreeNodeLengthLocationPadLength] {
+		if digit < '0' || digit > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Serialise the slot followed by its checksum
+func (slot btreeRootSlot) serialise() ([]byte) {
+	serialised := make([]byte, btreeRootSlotSize)
+	binary.BigEndian.PutUint64(serialised[0:8], slot.Generation)
+	binary.BigEndian.PutUint64(serialised[8:16], uint64(slot.Location))
+	binary.BigEndian.PutUint32(serialised[16:20], crc32.ChecksumIEEE(serialised[0:16]))
+
+	return serialised
+}
+
+// Deserialise a slot, ok is false if it was never written or is torn
+func deserialiseBTreeRootSlot(serialised []byte) (btreeRootSlot, bool) {
+	if crc32.ChecksumIEEE(serialised[0:16]) != binary.BigEndian.Uint32(serialised[16:20]) {
+		return btreeRootSlot{}, false
+	}
+
+	return btreeRootSlot{
+		Generation: binary.BigEndian.Uint64(serialised[0:8]),
+		Location:   int64(binary.BigEndian.Uint64(serialised[8:16])),
+	}, true
+}
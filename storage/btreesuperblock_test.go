@@ -0,0 +1,291 @@
+package storage
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestOpenBTree(t *testing.T) {
+	index := &MemoryFileHandle{}
+
+	tree, err := OpenBTree(index, 4, true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if int64(len(index.data)) != btreeSuperblockSize || string(index.data[0:8]) != BTreeMagic {
+		t.Error("superblock was not written to the new index")
+	}
+
+	err = tree.Insert("one", int64(10))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = tree.Insert(int64(2), int64(20))
+	if !BTreeKeyTypeMismatchError.IsSame(err) {
+		t.Error("expected BTreeKeyTypeMismatchError inserting an int into a string tree, got:", err)
+	}
+
+	reopened, err := OpenBTree(index, 4, true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	table, err := reopened.pageTable()
+	if err != nil || table.keyType != btreeElementTypeString {
+		t.Error("key type was not read from the page table, got:", table, err)
+	}
+
+	location, err := reopened.Find("one")
+	if err != nil || location != 10 {
+		t.Error("did not find key after reopening, got:", location, err)
+	}
+
+	_, err = OpenBTree(index, 4, false)
+	if !BTreeConfigurationMismatchError.IsSame(err) {
+		t.Error("expected BTreeConfigurationMismatchError reopening with a different unique flag, got:", err)
+	}
+
+	_, err = OpenBTree(index, 8, true)
+	if !BTreeConfigurationMismatchError.IsSame(err) {
+		t.Error("expected BTreeConfigurationMismatchError reopening with a different MaxElementsPerNode, got:", err)
+	}
+}
+
+func TestOpenBTree_inlineLimits(t *testing.T) {
+	index := &MemoryFileHandle{}
+
+	tree, err := OpenBTree(index, 4, true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	tree.MaxInlineKeySize = 8
+	tree.MaxInlineValueSize = 16
+
+	longKey := "a key long enough to need an overflow record"
+
+	err = tree.Insert(longKey, int64(10))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Reopening adopts the limits the keys were written with
+	reopened, err := OpenBTree(index, 4, true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if reopened.MaxInlineKeySize != 8 || reopened.MaxInlineValueSize != 16 {
+		t.Error("inline limits were not read from the page table, got:", reopened.MaxInlineKeySize, reopened.MaxInlineValueSize)
+	}
+
+	err = reopened.Insert("another key long enough to need one", int64(20))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Writing with different limits would split reused overflow chains in
+	// The wrong place
+	reopened.MaxInlineKeySize = 4
+
+	err = reopened.Insert("b", int64(30))
+	if !BTreeConfigurationMismatchError.IsSame(err) {
+		t.Error("expected BTreeConfigurationMismatchError inserting with a different MaxInlineKeySize, got:", err)
+	}
+
+	err = reopened.update(longKey, int64(40), nil, false)
+	if !BTreeConfigurationMismatchError.IsSame(err) {
+		t.Error("expected BTreeConfigurationMismatchError updating with a different MaxInlineKeySize, got:", err)
+	}
+
+	unopened := NewBTree(index, 4, true)
+
+	err = unopened.Insert("c", int64(50))
+	if !BTreeConfigurationMismatchError.IsSame(err) {
+		t.Error("expected BTreeConfigurationMismatchError writing without the recorded limits, got:", err)
+	}
+
+	checked, err := OpenBTree(index, 4, true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for key, expected := range map[string]int64{longKey: 10, "another key long enough to need one": 20} {
+		location, err := checked.Find(key)
+		if err != nil || location != expected {
+			t.Error("did not find key", key, "got:", location, err)
+		}
+	}
+}
+
+func TestOpenBTree_invalidSuperblock(t *testing.T) {
+	index := &MemoryFileHandle{}
+
+	_, err := OpenBTree(index, 4, true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// A newer version with a valid checksum
+	superblock := btreeSuperblock{Version: BTreeFormatVersion + 1, Unique: true, MaxElementsPerNode: 4, PageSize: btreeOverflowPageSize}
+	copy(index.data, superblock.serialise())
+
+	_, err = OpenBTree(index, 4, true)
+	if !BTreeUnsupportedFormatVersionError.IsSame(err) {
+		t.Error("expected BTreeUnsupportedFormatVersionError, got:", err)
+	}
+
+	// An older version whose children are referenced by location
+	superblock.Version = BTreeFormatVersion - 1
+	copy(index.data, superblock.serialise())
+
+	_, err = OpenBTree(index, 4, true)
+	if !BTreeUnsupportedFormatVersionError.IsSame(err) {
+		t.Error("expected BTreeUnsupportedFormatVersionError for an older version, got:", err)
+	}
+
+	copy(index.data, []byte("NOTABTRE"))
+
+	_, err = OpenBTree(index, 4, true)
+	if !BTreeSuperblockInvalidError.IsSame(err) {
+		t.Error("expected BTreeSuperblockInvalidError for a bad magic number, got:", err)
+	}
+
+	// A flipped bit in the configuration fails the checksum
+	superblock.Version = BTreeFormatVersion
+	copy(index.data, superblock.serialise())
+	index.data[12] ^= 1
+
+	_, err = OpenBTree(index, 4, true)
+	if !BTreeSuperblockInvalidError.IsSame(err) {
+		t.Error("expected BTreeSuperblockInvalidError for a bad checksum, got:", err)
+	}
+}
+
+func TestOpenBTree_unversionedFormat(t *testing.T) {
+	// An index written before the superblock, starting with its root location
+	elements := make([]BTreeElement, 1)
+	elements[0] = NewBTreeElement(btreeElementTypeInt, int64(1), int64(10), btreeElementNoChildValue, btreeElementNoChildValue)
+
+	root, err := NewBTreeNode(false, btreeNodeParentIdNoValue, 0, elements, make([]int32, 0)).Serialise()
+	if err != nil {
+		t.Error(err)
+	}
+
+	data := append([]byte("00000000000000000020"), root...)
+	index := NewMemoryFileHandle(append([]byte{}, data...))
+
+	_, err = OpenBTree(index, 4, true)
+	if !BTreeUnversionedFormatError.IsSame(err) {
+		t.Error("expected BTreeUnversionedFormatError, got:", err)
+	}
+
+	// One too short to be mistaken for a superblock is not written over
+	index = NewMemoryFileHandle(append([]byte{}, data[:40]...))
+
+	_, err = OpenBTree(index, 4, true)
+	if !BTreeUnversionedFormatError.IsSame(err) {
+		t.Error("expected BTreeUnversionedFormatError for a short index, got:", err)
+	}
+
+	if string(index.data) != string(data[:40]) {
+		t.Error("short index was written over")
+	}
+}
+
+func TestBTree_writeRootSlot(t *testing.T) {
+	index := &MemoryFileHandle{}
+	tree := NewBTree(index, 4, true)
+
+	err := tree.Insert(int64(1), int64(10))
+	if err != nil {
+		t.Error(err)
+	}
+
+	first, found, err := tree.readRootSlot()
+	if err != nil || !found {
+		t.Error("root slot was not written", err)
+	}
+
+	err = tree.Insert(int64(2), int64(20))
+	if err != nil {
+		t.Error(err)
+	}
+
+	second, _, err := tree.readRootSlot()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if second.Generation != first.Generation+1 || second.Location == first.Location {
+		t.Error("root switch did not advance the generation, first:", first, "second:", second)
+	}
+
+	// Tearing the newest slot falls back to the previous root
+	slotLocation := btreeRootSlotOffset + int64(second.Generation%2)*btreeRootSlotStride
+	binary.BigEndian.PutUint64(index.data[slotLocation+8:], 0)
+
+	slot, found, err := tree.readRootSlot()
+	if err != nil || !found || slot != first {
+		t.Error("did not fall back to the previous root slot, got:", slot, found, err)
+	}
+
+	_, err = tree.Find(int64(1))
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = tree.Find(int64(2))
+	if !BTreeKeyNotFoundError.IsSame(err) {
+		t.Error("expected the previous root not to contain the second key, got:", err)
+	}
+}
+
+func TestBTree_setKeyType(t *testing.T) {
+	index := &MemoryFileHandle{}
+
+	tree, err := OpenBTree(index, 4, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	superblock := append([]byte{}, index.data[:btreeSuperblockConfigSize]...)
+
+	err = tree.Insert("one", int64(10))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The key type is committed with the root rather than written over the
+	// Superblock, which is never rewritten once the index is created
+	if string(index.data[:btreeSuperblockConfigSize]) != string(superblock) {
+		t.Error("inserting the first key rewrote the superblock")
+	}
+
+	// Tearing the root slot the first insert switched to also loses the key
+	// Type it fixed, so the index is left empty rather than unopenable
+	slot, _, err := tree.readRootSlot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slotLocation := btreeRootSlotOffset + int64(slot.Generation%2)*btreeRootSlotStride
+	binary.BigEndian.PutUint64(index.data[slotLocation+8:], 0)
+
+	reopened, err := OpenBTree(index, 4, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = reopened.Insert(int64(2), int64(20))
+	if err != nil {
+		t.Error("expected an int key to fix the key type of the empty index, got:", err)
+	}
+
+	err = reopened.Insert("three", int64(30))
+	if !BTreeKeyTypeMismatchError.IsSame(err) {
+		t.Error("expected BTreeKeyTypeMismatchError inserting a string into an int tree, got:", err)
+	}
+}
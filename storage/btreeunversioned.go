@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"io"
+	"strconv"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+const (
+	// Flag of the record left where a node of an unversioned index was
+	// Rewritten, followed by the padded location of the new copy
+	btreeUnversionedNodeMoved = "1"
+)
+
+var (
+	BTreeUnversionedIndexInvalidError = gataerrors.NewGataError("index does not begin with the location of its root or a node could not be followed")
+	btreeUnversionedReadError         = gataerrors.NewGataError("unable to read the unversioned btree index")
+)
+
+// Copy every key of an index written before btree indexes had a superblock
+// Into destination, which should be empty. Such an index begins with the
+// Padded location of its root, references children by their location and
+// Leaves a forwarding record behind wherever a node was rewritten. The legacy
+// Index is only read, so it can be removed once the conversion has succeeded
+func ConvertUnversionedBTree(legacy io.ReadSeeker, destination *BTree) (error) {
+	_, err := legacy.Seek(0, io.SeekStart)
+
+	if err != nil {
+		return BtreeIndexSeekError.SetUnderlying(err)
+	}
+
+	header := make([]byte, btreeNodeLengthLocationPadLength)
+	_, err = io.ReadFull(legacy, header)
+
+	// Nothing was ever inserted
+	if err == io.EOF {
+		return nil
+	}
+
+	if err != nil {
+		return btreeUnversionedReadError.SetUnderlying(err)
+	}
+
+	if !isUnversionedBTreeIndex(header) {
+		return BTreeUnversionedIndexInvalidError
+	}
+
+	root, err := strconv.ParseInt(string(header), 10, 64)
+
+	if err != nil {
+		return BTreeUnversionedIndexInvalidError.SetUnderlying(err)
+	}
+
+	// Neighbouring elements share children so each is only copied once
+	pending := []int64{root}
+	visited := make(map[int64]bool)
+
+	for len(pending) > 0 {
+		location := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		if visited[location] {
+			continue
+		}
+
+		visited[location] = true
+
+		node, err := readUnversionedBTreeNode(legacy, location)
+
+		if err != nil {
+			return err
+		}
+
+		if node.Deleted {
+			continue
+		}
+
+		for _, element := range node.Elements {
+			err = destination.Insert(element.GetKey(), element.Location)
+
+			if err != nil {
+				return err
+			}
+
+			if element.LessLocation != btreeElementNoChildValue {
+				pending = append(pending, element.LessLocation)
+			}
+
+			if element.MoreLocation != btreeElementNoChildValue {
+				pending = append(pending, element.MoreLocation)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Read the node of an unversioned index at location, following the forwarding
+// Records left wherever it was rewritten to its newest copy
+func readUnversionedBTreeNode(legacy io.ReadSeeker, location int64) (BTreeNode, error) {
+	followed := make(map[int64]bool)
+
+	for !followed[location] {
+		followed[location] = true
+
+		_, err := legacy.Seek(location, io.SeekStart)
+
+		if err != nil {
+			return BTreeNode{}, BtreeIndexSeekError.SetUnderlying(err)
+		}
+
+		record := make([]byte, 1+btreeNodeLengthLocationPadLength)
+		_, err = io.ReadFull(legacy, record[:1])
+
+		if err != nil {
+			return BTreeNode{}, btreeUnversionedReadError.SetUnderlying(err)
+		}
+
+		if string(record[0]) != btreeUnversionedNodeMoved {
+			_, err = legacy.Seek(location, io.SeekStart)
+
+			if err != nil {
+				return BTreeNode{}, BtreeIndexSeekError.SetUnderlying(err)
+			}
+
+			return deserialiseBTreeNode(legacy, location, nil)
+		}
+
+		_, err = io.ReadFull(legacy, record[1:])
+
+		if err != nil {
+			return BTreeNode{}, btreeUnversionedReadError.SetUnderlying(err)
+		}
+
+		location, err = strconv.ParseInt(string(record[1:]), 10, 64)
+
+		if err != nil {
+			return BTreeNode{}, BTreeUnversionedIndexInvalidError.SetUnderlying(err)
+		}
+	}
+
+	// The forwarding records loop back on themselves
+	return BTreeNode{}, BTreeUnversionedIndexInvalidError
+}
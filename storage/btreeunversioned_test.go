@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// The elements and nodes as indexes written before the superblock encoded them
+type unversionedBTreeElement struct {
+	KeyType      int8
+	KeyInt       int64
+	KeyString    string
+	KeyDate      time.Time
+	Location     int64
+	LessLocation int64
+	MoreLocation int64
+}
+
+type unversionedBTreeNode struct {
+	Deleted  bool
+	Location int64
+	ParentId int32
+	Id       int32
+	Path     []int32
+	Elements []unversionedBTreeElement
+}
+
+// Append a node as an unversioned index stored it, returning its location
+func appendUnversionedBTreeNode(t *testing.T, index *[]byte, elements ...unversionedBTreeElement) (int64) {
+	buffer := bytes.Buffer{}
+
+	err := gob.NewEncoder(&buffer).Encode(unversionedBTreeNode{ParentId: -1, Path: make([]int32, 0), Elements: elements})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	location := int64(len(*index))
+	*index = append(*index, []byte(fmt.Sprintf("%s%020d", btreeNodeNotDeleted, buffer.Len()))...)
+	*index = append(*index, buffer.Bytes()...)
+
+	return location
+}
+
+func TestConvertUnversionedBTree(t *testing.T) {
+	index := []byte(fmt.Sprintf("%020d", 0))
+	leaf := func(key int64, location int64) (unversionedBTreeElement) {
+		return unversionedBTreeElement{KeyInt: key, Location: location, LessLocation: -1, MoreLocation: -1}
+	}
+
+	// A leaf which was rewritten, leaving a forwarding record at its first
+	// Location for the elements pointing at it
+	moved := appendUnversionedBTreeNode(t, &index, leaf(1, 10), leaf(2, 20))
+	rewritten := appendUnversionedBTreeNode(t, &index, leaf(1, 10), leaf(2, 20), leaf(3, 30))
+	copy(index[moved:], fmt.Sprintf("%s%020d", btreeUnversionedNodeMoved, rewritten))
+
+	more := appendUnversionedBTreeNode(t, &index, leaf(7, 70), leaf(8, 80))
+
+	deleted := appendUnversionedBTreeNode(t, &index, leaf(99, 990))
+	copy(index[deleted:], btreeNodeDeleted)
+
+	root := appendUnversionedBTreeNode(
+		t,
+		&index,
+		unversionedBTreeElement{KeyInt: 5, Location: 50, LessLocation: moved, MoreLocation: more},
+		unversionedBTreeElement{KeyInt: 9, Location: 90, LessLocation: more, MoreLocation: deleted},
+	)
+	copy(index, fmt.Sprintf("%020d", root))
+
+	legacy := NewMemoryFileHandle(index)
+
+	_, err := OpenBTree(legacy, 4, true)
+	if !BTreeUnversionedFormatError.IsSame(err) {
+		t.Error("expected BTreeUnversionedFormatError opening the unversioned index, got:", err)
+	}
+
+	destination, err := OpenBTree(&MemoryFileHandle{}, 4, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ConvertUnversionedBTree(legacy, &destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[int64]int64{1: 10, 2: 20, 3: 30, 5: 50, 7: 70, 8: 80, 9: 90}
+
+	for key, location := range expected {
+		found, err := destination.Find(key)
+		if err != nil || found != location {
+			t.Error("did not convert key", key, "got:", found, err)
+		}
+	}
+
+	_, err = destination.Find(int64(99))
+	if !BTreeKeyNotFoundError.IsSame(err) {
+		t.Error("expected the deleted node not to be converted, got:", err)
+	}
+
+	count := 0
+	err = destination.Range(nil, nil, func(key interface{}, value []byte) bool {
+		count++
+		return true
+	})
+	if err != nil || count != len(expected) {
+		t.Error("expected each key to be converted once, got:", count, err)
+	}
+
+	// Forwarding records which loop back on themselves are not followed forever
+	copy(index[moved:], fmt.Sprintf("%s%020d", btreeUnversionedNodeMoved, moved))
+
+	looped := NewBTree(&MemoryFileHandle{}, 4, true)
+
+	err = ConvertUnversionedBTree(NewMemoryFileHandle(index), &looped)
+	if !BTreeUnversionedIndexInvalidError.IsSame(err) {
+		t.Error("expected BTreeUnversionedIndexInvalidError for a forwarding loop, got:", err)
+	}
+
+	err = ConvertUnversionedBTree(NewMemoryFileHandle([]byte(BTreeMagic+"not a root location")), &destination)
+	if !BTreeUnversionedIndexInvalidError.IsSame(err) {
+		t.Error("expected BTreeUnversionedIndexInvalidError for an index which does not begin with a root location, got:", err)
+	}
+}
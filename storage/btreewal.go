@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+const (
+	// A logical insert, logged before the tree is touched
+	btreeWalInsert = int8(0)
+	// An overwrite of bytes already in the index, logged before it is made
+	btreeWalWrite = int8(1)
+	// The insert and all of its writes have been applied
+	btreeWalCommit = int8(2)
+	// The insert failed, its writes are still redone but it is not retried
+	btreeWalAbort = int8(3)
+	// A change to the location of a key already in the tree, logged before the
+	// Tree is touched
+	btreeWalUpdate = int8(4)
+	// Log size after which a commit triggers a checkpoint
+	btreeDefaultWalCheckpointSize = int64(1 << 20)
+)
+
+var (
+	BTreeWalReplayError  = gataerrors.NewGataError("unable to replay the btree write ahead log")
+	btreeWalLogError     = gataerrors.NewGataError("unable to log btree mutation to the write ahead log")
+	btreeCheckpointError = gataerrors.NewGataError("unable to make the index durable before checkpointing")
+)
+
+// A mutation recorded in the btree's write ahead log
+type btreeWalRecord struct {
+	Type        int8
+	Transaction uint64
+	Element     BTreeElement
+	Location    int64
+	Data        []byte
+}
+
+// Enable a write ahead log stored in handle, which should sit next to the index
+// At the index's path + WriteAheadLogExtension. Any mutations left in the log
+// By a crash are replayed before returning
+func (tree *BTree) EnableWriteAheadLog(handle io.ReadWriteSeeker) (error) {
+	tree.wal = NewWriteAheadLog(handle)
+	tree.wal.Quota = tree.Quota
+
+	if tree.WriteAheadLogCheckpointSize == 0 {
+		tree.WriteAheadLogCheckpointSize = btreeDefaultWalCheckpointSize
+	}
+
+	return tree.replayWriteAheadLog()
+}
+
+// Make the index durable and then empty the write ahead log
+func (tree *BTree) Checkpoint() (error) {
+	if tree.wal == nil {
+		return nil
+	}
+
+	err := tree.durability.sync(tree.Index)
+
+	if err != nil {
+		return btreeCheckpointError.SetUnderlying(err)
+	}
+
+	return tree.wal.Truncate()
+}
+
+// Log an insert before any of its changes are made to the index
+func (tree *BTree) beginTransaction(element BTreeElement) (error) {
+	return tree.logBegin(btreeWalInsert, element)
+}
+
+// Log an update before any of its changes are made to the index
+func (tree *BTree) beginUpdate(element BTreeElement) (error) {
+	return tree.logBegin(btreeWalUpdate, element)
+}
+
+// Start a transaction with an insert or update record
+func (tree *BTree) logBegin(recordType int8, element BTreeElement) (error) {
+	if tree.wal == nil {
+		return nil
+	}
+
+	tree.walTransaction++
+	tree.walInTransaction = true
+
+	return tree.logRecord(btreeWalRecord{
+		Type:        recordType,
+		Transaction: tree.walTransaction,
+		Element:     element,
+	})
+}
+
+// Log the end of an insert or update, checkpointing once the log has grown large enough
+func (tree *BTree) endTransaction(failed bool) (error) {
+	if tree.wal == nil || !tree.walInTransaction {
+		return nil
+	}
+
+	tree.walInTransaction = false
+
+	recordType := btreeWalCommit
+
+	if failed {
+		recordType = btreeWalAbort
+	}
+
+	err := tree.logRecord(btreeWalRecord{Type: recordType, Transaction: tree.walTransaction})
+
+	if err != nil {
+		return err
+	}
+
+	size, err := tree.wal.Size()
+
+	if err != nil {
+		return err
+	}
+
+	if size >= tree.WriteAheadLogCheckpointSize {
+		return tree.Checkpoint()
+	}
+
+	return nil
+}
+
+// Log an overwrite of bytes already in the index
+func (tree *BTree) logWrite(location int64, data []byte) (error) {
+	if tree.wal == nil || !tree.walInTransaction {
+		return nil
+	}
+
+	return tree.logRecord(btreeWalRecord{
+		Type:        btreeWalWrite,
+		Transaction: tree.walTransaction,
+		Location:    location,
+		Data:        data,
+	})
+}
+
+// Encode and append a record to the write ahead log
+func (tree *BTree) logRecord(record btreeWalRecord) (error) {
+	buffer := bytes.Buffer{}
+	err := gob.NewEncoder(&buffer).Encode(record)
+
+	if err != nil {
+		return btreeWalLogError.SetUnderlying(err)
+	}
+
+	serialised := buffer.Bytes()
+
+	if tree.encryption != nil {
+		serialised, err = tree.encryption.seal(serialised)
+
+		if err != nil {
+			return btreeWalLogError.SetUnderlying(err)
+		}
+	}
+
+	err = tree.wal.Append(serialised)
+
+	if err != nil {
+		return wrapWriteError(err, btreeWalLogError)
+	}
+
+	return nil
+}
+
+// Redo every overwrite in the log so none are left torn, then retry in order
+// Any insert which was not aborted and is missing from the tree and any update
+// Which was not aborted. Committed ones are retried too as the index may not
+// Have been synced when they committed
+func (tree *BTree) replayWriteAheadLog() (error) {
+	serialised, err := tree.wal.ReadAll()
+
+	if err != nil {
+		return BTreeWalReplayError.SetUnderlying(err)
+	}
+
+	if len(serialised) == 0 {
+		return nil
+	}
+
+	records := make([]btreeWalRecord, 0, len(serialised))
+	aborted := make(map[uint64]bool)
+
+	for _, data := range serialised {
+		record := btreeWalRecord{}
+
+		if tree.encryption != nil {
+			data, err = tree.encryption.open(data)
+
+			if err != nil {
+				break
+			}
+		}
+
+		// A record which made it past the checksum but will not decode or
+		// Decrypt is treated the same as a torn record
+		if gob.NewDecoder(bytes.NewReader(data)).Decode(&record) != nil {
+			break
+		}
+
+		if record.Type == btreeWalAbort {
+			aborted[record.Transaction] = true
+		}
+
+		if record.Transaction > tree.walTransaction {
+			tree.walTransaction = record.Transaction
+		}
+
+		records = append(records, record)
+	}
+
+	// Replayed changes should not be logged again
+	wal := tree.wal
+	tree.wal = nil
+
+	// Every overwrite is redone before any insert is retried, as the index
+	// Cannot be read while an overwrite is torn
+	for _, record := range records {
+		if record.Type != btreeWalWrite {
+			continue
+		}
+
+		err = tree.writeAt(record.Location, record.Data)
+
+		if err != nil {
+			tree.wal = wal
+			return BTreeWalReplayError.SetUnderlying(err)
+		}
+	}
+
+	for _, record := range records {
+		if aborted[record.Transaction] {
+			continue
+		}
+
+		key := record.Element.GetKey()
+
+		// Updates set the location and value outright so redoing one is
+		// Harmless
+		if record.Type == btreeWalUpdate {
+			err = tree.update(key, record.Element.Location, record.Element.Value, record.Element.HasValue)
+
+			if err != nil && !BTreeKeyNotFoundError.IsSame(err) {
+				tree.wal = wal
+				return BTreeWalReplayError.SetUnderlying(err)
+			}
+
+			continue
+		}
+
+		if record.Type != btreeWalInsert {
+			continue
+		}
+
+		if _, findErr := tree.Find(key); findErr == nil {
+			continue
+		}
+
+		err = tree.insert(key, record.Element.Location, record.Element.Value, record.Element.HasValue)
+
+		if err != nil {
+			tree.wal = wal
+			return BTreeWalReplayError.SetUnderlying(err)
+		}
+	}
+
+	tree.wal = wal
+
+	// The redone writes may hold keys the bloom filter never had added
+	err = tree.RebuildBloomFilter()
+
+	if err != nil {
+		return BTreeWalReplayError.SetUnderlying(err)
+	}
+
+	return tree.Checkpoint()
+}
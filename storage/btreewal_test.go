@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestBTree_EnableWriteAheadLog(t *testing.T) {
+	index := &MemoryFileHandle{}
+	walHandle := &MemoryFileHandle{}
+	tree := NewBTree(index, 4, true)
+	tree.WriteAheadLogCheckpointSize = 1 << 30
+
+	err := tree.EnableWriteAheadLog(walHandle)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = tree.Insert(int64(1), int64(10))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(walHandle.data) == 0 {
+		t.Error("insert was not logged to the write ahead log")
+	}
+
+	err = tree.Checkpoint()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(walHandle.data) != 0 {
+		t.Error("checkpoint did not truncate the write ahead log")
+	}
+
+	// A small checkpoint size should checkpoint after every insert
+	tree.WriteAheadLogCheckpointSize = 1
+
+	err = tree.Insert(int64(2), int64(20))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(walHandle.data) != 0 {
+		t.Error("write ahead log was not checkpointed once it grew past WriteAheadLogCheckpointSize")
+	}
+}
+
+func TestBTree_replayWriteAheadLogTornRoot(t *testing.T) {
+	index := &MemoryFileHandle{}
+	walHandle := &MemoryFileHandle{}
+	tree := NewBTree(index, 4, true)
+	tree.WriteAheadLogCheckpointSize = 1 << 30
+
+	err := tree.EnableWriteAheadLog(walHandle)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = tree.Insert(int64(1), int64(10))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = tree.Insert(int64(2), int64(20))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Tear the newest root slot as if we crashed half way through writing it
+	slot, _, err := tree.readRootSlot()
+	if err != nil {
+		t.Error(err)
+	}
+
+	slotLocation := btreeRootSlotOffset + int64(slot.Generation%2)*btreeRootSlotStride
+	copy(index.data[slotLocation:], []byte("0000000000"))
+
+	reopened := NewBTree(index, 4, true)
+
+	err = reopened.EnableWriteAheadLog(walHandle)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, key := range []int64{1, 2} {
+		location, err := reopened.Find(key)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if location != key*10 {
+			t.Error("did not find expected location", key*10, "for key", key, "after replay, got:", location)
+		}
+	}
+
+	if len(walHandle.data) != 0 {
+		t.Error("write ahead log was not checkpointed after replaying")
+	}
+}
+
+func TestBTree_replayWriteAheadLogTornPageTable(t *testing.T) {
+	index := &MemoryFileHandle{}
+	walHandle := &MemoryFileHandle{}
+	tree := NewBTree(index, 4, true)
+
+	err := tree.EnableWriteAheadLog(walHandle)
+	if err != nil {
+		t.Error(err)
+	}
+
+	elements := make([]BTreeElement, 1)
+	elements[0] = NewBTreeElement(btreeElementTypeInt, int64(1), int64(10), btreeElementNoChildValue, btreeElementNoChildValue)
+
+	childId, err := tree.writeNode(NewBTreeNode(false, 1, btreeNodeNoIdValue, elements, make([]int32, 0)))
+	if err != nil {
+		t.Error(err)
+	}
+
+	elements = make([]BTreeElement, 1)
+	elements[0] = NewBTreeElement(btreeElementTypeInt, int64(3), int64(30), int64(childId), btreeElementNoChildValue)
+
+	_, err = tree.writeRoot(NewBTreeNode(false, btreeNodeParentIdNoValue, btreeNodeNoIdValue, elements, make([]int32, 0)))
+	if err != nil {
+		t.Error(err)
+	}
+
+	child, err := tree.readNodeById(childId)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Rewrite the child inside a transaction, then tear the root slot pointing
+	// At the page table which records its new location
+	element := NewBTreeElement(btreeElementTypeInt, int64(2), int64(20), btreeElementNoChildValue, btreeElementNoChildValue)
+
+	err = tree.beginTransaction(element)
+	if err != nil {
+		t.Error(err)
+	}
+
+	child.AddElement(element)
+
+	_, err = tree.writeNode(child)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = tree.commitPageTable()
+	if err != nil {
+		t.Error(err)
+	}
+
+	slot, _, err := tree.readRootSlot()
+	if err != nil {
+		t.Error(err)
+	}
+
+	slotLocation := btreeRootSlotOffset + int64(slot.Generation%2)*btreeRootSlotStride
+	copy(index.data[slotLocation:], []byte("xxxx"))
+
+	reopened := NewBTree(index, 4, true)
+
+	err = reopened.EnableWriteAheadLog(walHandle)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = reopened.getRoot()
+	if err != nil {
+		t.Error(err)
+	}
+
+	moved, err := reopened.readNodeById(childId)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(moved.Elements) != 2 {
+		t.Error("page table was not repaired by replay, found elements:", len(moved.Elements))
+	}
+}
+
+func TestBTree_replayWriteAheadLogUncommittedInsert(t *testing.T) {
+	index := &MemoryFileHandle{}
+	walHandle := &MemoryFileHandle{}
+	tree := NewBTree(index, 4, true)
+
+	err := tree.EnableWriteAheadLog(walHandle)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Log an insert but crash before touching the index
+	err = tree.beginTransaction(NewBTreeElement(btreeElementTypeInt, int64(1), int64(10), btreeElementNoChildValue, btreeElementNoChildValue))
+	if err != nil {
+		t.Error(err)
+	}
+
+	reopened := NewBTree(index, 4, true)
+
+	err = reopened.EnableWriteAheadLog(walHandle)
+	if err != nil {
+		t.Error(err)
+	}
+
+	location, err := reopened.Find(int64(1))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if location != 10 {
+		t.Error("uncommitted insert was not replayed, got location:", location)
+	}
+}
+
+func TestBTree_replayWriteAheadLogUncommittedUpdate(t *testing.T) {
+	index := &MemoryFileHandle{}
+	walHandle := &MemoryFileHandle{}
+	tree := NewBTree(index, 4, true)
+
+	err := tree.EnableWriteAheadLog(walHandle)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = tree.Insert(int64(1), int64(10))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Log an update but crash before touching the index
+	err = tree.beginUpdate(NewBTreeElement(btreeElementTypeInt, int64(1), int64(20), btreeElementNoChildValue, btreeElementNoChildValue))
+	if err != nil {
+		t.Error(err)
+	}
+
+	reopened := NewBTree(index, 4, true)
+
+	err = reopened.EnableWriteAheadLog(walHandle)
+	if err != nil {
+		t.Error(err)
+	}
+
+	location, err := reopened.Find(int64(1))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if location != 20 {
+		t.Error("uncommitted update was not replayed, got location:", location)
+	}
+}
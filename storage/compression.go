@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+const (
+	// Compresses with DEFLATE
+	DeflateCodecId = byte(1)
+	// Compresses with gzip, DEFLATE with a header and checksum
+	GzipCodecId = byte(2)
+	// Codec ids below this are reserved for the built in codecs
+	MinCustomCodecId = byte(8)
+	// The highest codec id which fits in a record's flags
+	MaxCodecId = byte(15)
+)
+
+var (
+	CodecIdReservedError        = gataerrors.NewGataError("custom codec ids must be between MinCustomCodecId and MaxCodecId")
+	CodecAlreadyRegisteredError = gataerrors.NewGataError("a different codec is already registered with this codec id")
+	CodecNotRegisteredError     = gataerrors.NewGataError("no codec is registered with this codec id")
+	CodecCompressError          = gataerrors.NewGataError("unable to compress record")
+	CodecDecompressError        = gataerrors.NewGataError("unable to decompress record")
+	codecsMutex                 = sync.RWMutex{}
+	codecs                      = map[byte]Codec{
+		DeflateCodecId: DeflateCodec{},
+		GzipCodecId:    GzipCodec{},
+	}
+)
+
+// A compression algorithm for the records of an ImmutableFile. The codec id is
+// Stored in the flags of every record it compresses so must never change
+type Codec interface {
+	// The id registered for the codec
+	CodecId() byte
+	// Compress a record
+	Compress(record []byte) ([]byte, error)
+	// Decompress a record compressed by Compress
+	Decompress(compressed []byte) ([]byte, error)
+}
+
+// Compresses records with DEFLATE at the default level
+type DeflateCodec struct{}
+
+// Compresses records with gzip at the default level
+type GzipCodec struct{}
+
+// Register a custom codec so records it compressed can be read. Registering
+// The same codec again does nothing
+func RegisterCodec(codec Codec) (error) {
+	id := codec.CodecId()
+
+	if id < MinCustomCodecId || id > MaxCodecId {
+		return CodecIdReservedError
+	}
+
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+
+	if registered, ok := codecs[id]; ok && reflect.TypeOf(registered) != reflect.TypeOf(codec) {
+		return CodecAlreadyRegisteredError
+	}
+
+	codecs[id] = codec
+
+	return nil
+}
+
+// Get the codec registered for an id
+func registeredCodec(id byte) (Codec, bool) {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+
+	codec, ok := codecs[id]
+
+	return codec, ok
+}
+
+// The id of the DEFLATE codec
+func (codec DeflateCodec) CodecId() (byte) {
+	return DeflateCodecId
+}
+
+// Compress a record with DEFLATE
+func (codec DeflateCodec) Compress(record []byte) ([]byte, error) {
+	buffer := bytes.Buffer{}
+	writer, err := flate.NewWriter(&buffer, flate.DefaultCompression)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = writer.Write(record)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = writer.Close()
+
+	return buffer.Bytes(), err
+}
+
+// Decompress a record compressed with DEFLATE
+func (codec DeflateCodec) Decompress(compressed []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(compressed))
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+// The id of the gzip codec
+func (codec GzipCodec) CodecId() (byte) {
+	return GzipCodecId
+}
+
+// Compress a record with gzip
+func (codec GzipCodec) Compress(record []byte) ([]byte, error) {
+	buffer := bytes.Buffer{}
+	writer := gzip.NewWriter(&buffer)
+
+	_, err := writer.Write(record)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = writer.Close()
+
+	return buffer.Bytes(), err
+}
+
+// Decompress a record compressed with gzip
+func (codec GzipCodec) Decompress(compressed []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
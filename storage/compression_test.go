@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Compresses runs of a repeated byte as the byte and the length of the run
+type testRunLengthCodec struct{}
+
+func (codec testRunLengthCodec) CodecId() (byte) {
+	return MinCustomCodecId
+}
+
+func (codec testRunLengthCodec) Compress(record []byte) ([]byte, error) {
+	compressed := make([]byte, 0)
+
+	for i := 0; i < len(record); {
+		run := 1
+
+		for i+run < len(record) && record[i+run] == record[i] && run < 255 {
+			run++
+		}
+
+		compressed = append(compressed, record[i], byte(run))
+		i += run
+	}
+
+	return compressed, nil
+}
+
+func (codec testRunLengthCodec) Decompress(compressed []byte) ([]byte, error) {
+	record := make([]byte, 0)
+
+	for i := 0; i+1 < len(compressed); i += 2 {
+		record = append(record, bytes.Repeat(compressed[i:i+1], int(compressed[i+1]))...)
+	}
+
+	return record, nil
+}
+
+// A codec registered with the same id as testRunLengthCodec
+type testOtherCodec struct {
+	testRunLengthCodec
+}
+
+func TestCodecs(t *testing.T) {
+	record := bytes.Repeat([]byte(`{"name":"gatabase","tags":["a","b"]}`), 50)
+
+	for _, codec := range []Codec{DeflateCodec{}, GzipCodec{}} {
+		compressed, err := codec.Compress(record)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if len(compressed) >= len(record) {
+			t.Error("codec", codec.CodecId(), "did not make a repetitive record smaller")
+		}
+
+		decompressed, err := codec.Decompress(compressed)
+		if err != nil || !bytes.Equal(decompressed, record) {
+			t.Error("codec", codec.CodecId(), "did not decompress the record it compressed", err)
+		}
+
+		_, err = codec.Decompress([]byte("not compressed"))
+		if err == nil {
+			t.Error("codec", codec.CodecId(), "decompressed invalid data without an error")
+		}
+	}
+}
+
+func TestRegisterCodec(t *testing.T) {
+	err := RegisterCodec(DeflateCodec{})
+	if !CodecIdReservedError.IsSame(err) {
+		t.Error("expected CodecIdReservedError registering a built in id, got:", err)
+	}
+
+	err = RegisterCodec(testRunLengthCodec{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = RegisterCodec(testRunLengthCodec{})
+	if err != nil {
+		t.Error("registering the same codec again should do nothing, got:", err)
+	}
+
+	err = RegisterCodec(testOtherCodec{})
+	if !CodecAlreadyRegisteredError.IsSame(err) {
+		t.Error("expected CodecAlreadyRegisteredError, got:", err)
+	}
+
+	codec, ok := registeredCodec(MinCustomCodecId)
+	if !ok || codec.CodecId() != MinCustomCodecId {
+		t.Error("did not get the registered codec back")
+	}
+}
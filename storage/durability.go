@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"sync"
+	"time"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+const (
+	syncModeNever   = int8(0)
+	syncModeAlways  = int8(1)
+	syncModeBatched = int8(2)
+)
+
+var (
+	// Never sync, leaving it to the operating system to write data back
+	SyncNever = SyncPolicy{mode: syncModeNever}
+	// Sync after every write before it is acknowledged
+	SyncAlways = SyncPolicy{mode: syncModeAlways}
+
+	SyncError = gataerrors.NewGataError("unable to sync handle to stable storage")
+
+	// Guards creating the shared state of a file or tree which was not made
+	// By its constructor
+	durabilityStateMutex sync.Mutex
+)
+
+// A handle which can flush written data to stable storage, *os.File is one
+type Syncer interface {
+	Sync() error
+}
+
+// How often written data is synced to stable storage
+// Only SyncAlways orders writes, with the others a power failure can lose the
+// Writes made since the last sync and leave what they were changing torn
+type SyncPolicy struct {
+	mode     int8
+	Interval time.Duration
+}
+
+// Sync on the first write after interval has passed since the last sync, or
+// Once it has passed if no write comes along to do it, so at most interval
+// Worth of acknowledged writes can be lost. Close the file or tree to stop the
+// Timer which syncs them
+func SyncBatched(interval time.Duration) (SyncPolicy) {
+	return SyncPolicy{mode: syncModeBatched, Interval: interval}
+}
+
+// Sync latency metrics
+type SyncStats struct {
+	Count        uint64
+	Failures     uint64
+	TotalLatency time.Duration
+	MaxLatency   time.Duration
+	LastLatency  time.Duration
+}
+
+// The average latency of a sync
+func (stats SyncStats) AverageLatency() (time.Duration) {
+	if stats.Count == 0 {
+		return 0
+	}
+
+	return stats.TotalLatency / time.Duration(stats.Count)
+}
+
+// Applies a SyncPolicy to handles and records how long syncing takes
+type durabilityState struct {
+	// Shared with the timer which syncs batched writes and with every copy of
+	// The file or tree, so it is created by their constructors
+	shared *durabilityShared
+}
+
+// The sync state the timer and the writes both update
+type durabilityShared struct {
+	mutex    sync.Mutex
+	lastSync time.Time
+	stats    SyncStats
+	// Syncs the handles of batched writes once the interval has passed in case
+	// No later write comes along to do it, nil when no sync is waiting
+	timer   *time.Timer
+	handles []interface{}
+	stopped bool
+}
+
+// Construct the state of a new file or tree, copies of it made before the
+// First write still share the same state
+func newDurabilityState() (durabilityState) {
+	return durabilityState{shared: &durabilityShared{}}
+}
+
+// The shared state, a file or tree built without its constructor creates it
+// The first time it is needed
+func (state *durabilityState) get() (*durabilityShared) {
+	durabilityStateMutex.Lock()
+	defer durabilityStateMutex.Unlock()
+
+	if state.shared == nil {
+		state.shared = &durabilityShared{}
+	}
+
+	return state.shared
+}
+
+// Sync the handles if the policy says it is time to, handles which are not a
+// Syncer are skipped. A batched write which is not yet due is synced by a
+// Timer once the interval has passed since the last sync
+func (state *durabilityState) afterWrite(policy SyncPolicy, handles ...interface{}) (error) {
+	shared := state.get()
+	shared.mutex.Lock()
+	defer shared.mutex.Unlock()
+
+	if shared.due(policy) {
+		return shared.sync(handles...)
+	}
+
+	if policy.mode == syncModeBatched {
+		shared.handles = handles
+
+		if shared.timer == nil && !shared.stopped {
+			shared.timer = time.AfterFunc(policy.Interval-time.Since(shared.lastSync), shared.flush)
+		}
+	}
+
+	return nil
+}
+
+// Whether the policy says a write should be synced now
+func (state *durabilityState) due(policy SyncPolicy) (bool) {
+	shared := state.get()
+	shared.mutex.Lock()
+	defer shared.mutex.Unlock()
+
+	return shared.due(policy)
+}
+
+// Sync the handles in order regardless of policy
+func (state *durabilityState) sync(handles ...interface{}) (error) {
+	shared := state.get()
+	shared.mutex.Lock()
+	defer shared.mutex.Unlock()
+
+	return shared.sync(handles...)
+}
+
+// The sync latency metrics so far
+func (state *durabilityState) syncStats() (SyncStats) {
+	shared := state.get()
+	shared.mutex.Lock()
+	defer shared.mutex.Unlock()
+
+	return shared.stats
+}
+
+// Sync any batched writes still waiting for the timer and stop it, called when
+// The handles are closed
+func (state *durabilityState) stop() (error) {
+	shared := state.get()
+	shared.mutex.Lock()
+	defer shared.mutex.Unlock()
+
+	shared.stopped = true
+
+	if shared.timer == nil {
+		return nil
+	}
+
+	shared.timer.Stop()
+	shared.timer = nil
+
+	return shared.sync(shared.handles...)
+}
+
+// Sync the handles of the batched writes made since the last sync, run by the
+// Timer. A failure is counted in the stats as there is no write to return it to
+func (shared *durabilityShared) flush() {
+	shared.mutex.Lock()
+	defer shared.mutex.Unlock()
+
+	if shared.timer == nil {
+		return
+	}
+
+	shared.timer = nil
+	shared.sync(shared.handles...)
+}
+
+// Whether the policy says a write should be synced now, the mutex must be held
+func (shared *durabilityShared) due(policy SyncPolicy) (bool) {
+	switch policy.mode {
+	case syncModeAlways:
+		return true
+	case syncModeBatched:
+		return time.Since(shared.lastSync) >= policy.Interval
+	}
+
+	return false
+}
+
+// Sync the handles in order, the mutex must be held
+func (shared *durabilityShared) sync(handles ...interface{}) (error) {
+	for _, handle := range handles {
+		syncer, ok := handle.(Syncer)
+
+		if !ok {
+			continue
+		}
+
+		start := time.Now()
+		err := syncer.Sync()
+		latency := time.Since(start)
+
+		if err != nil {
+			shared.stats.Failures++
+			return SyncError.SetUnderlying(err)
+		}
+
+		shared.stats.Count++
+		shared.stats.TotalLatency += latency
+		shared.stats.LastLatency = latency
+
+		if latency > shared.stats.MaxLatency {
+			shared.stats.MaxLatency = latency
+		}
+	}
+
+	shared.lastSync = time.Now()
+
+	return nil
+}
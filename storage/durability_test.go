@@ -0,0 +1,360 @@
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A memory handle which keeps a copy of its data each time it is synced
+// Handles sharing a clock can be ordered against each other by sequence
+type syncRecordingHandle struct {
+	MemoryFileHandle
+	snapshots [][]byte
+	sequences []int
+	clock     *int
+	err       error
+}
+
+func (handle *syncRecordingHandle) Sync() (error) {
+	if handle.err != nil {
+		return handle.err
+	}
+
+	snapshot := make([]byte, len(handle.data))
+	copy(snapshot, handle.data)
+	handle.snapshots = append(handle.snapshots, snapshot)
+
+	if handle.clock != nil {
+		*handle.clock++
+		handle.sequences = append(handle.sequences, *handle.clock)
+	}
+
+	return nil
+}
+
+// The data which was durable at a point on the clock
+func (handle *syncRecordingHandle) durableAt(sequence int) ([]byte) {
+	durable := make([]byte, 0)
+
+	for i, synced := range handle.sequences {
+		if synced <= sequence {
+			durable = handle.snapshots[i]
+		}
+	}
+
+	return append([]byte{}, durable...)
+}
+
+func TestDurabilityState_afterWrite(t *testing.T) {
+	handle := &syncRecordingHandle{}
+	state := durabilityState{}
+
+	err := state.afterWrite(SyncNever, handle)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(handle.snapshots) != 0 {
+		t.Error("SyncNever synced the handle")
+	}
+
+	for i := 0; i < 2; i++ {
+		err = state.afterWrite(SyncAlways, handle)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	if len(handle.snapshots) != 2 {
+		t.Error("SyncAlways did not sync after every write, synced:", len(handle.snapshots))
+	}
+
+	// The last sync was just now so a batch is not yet due
+	err = state.afterWrite(SyncBatched(time.Hour), handle)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(handle.snapshots) != 2 {
+		t.Error("SyncBatched synced before its interval had passed")
+	}
+
+	err = state.afterWrite(SyncBatched(0), handle)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(handle.snapshots) != 3 {
+		t.Error("SyncBatched did not sync once its interval had passed")
+	}
+
+	// Handles which cannot be synced are skipped, memory handles can
+	err = state.afterWrite(SyncAlways, 1, &MemoryFileHandle{}, handle)
+	if err != nil {
+		t.Error(err)
+	}
+
+	stats := state.syncStats()
+
+	if stats.Count != 5 || stats.Failures != 0 {
+		t.Error("unexpected sync stats:", stats)
+	}
+
+	if stats.MaxLatency < stats.LastLatency || stats.TotalLatency < stats.MaxLatency || stats.AverageLatency() > stats.MaxLatency {
+		t.Error("inconsistent sync latencies:", stats)
+	}
+}
+
+func TestDurabilityState_syncError(t *testing.T) {
+	handle := &syncRecordingHandle{err: errors.New("disk on fire")}
+	state := durabilityState{}
+
+	err := state.sync(handle)
+
+	if !SyncError.IsSame(err) {
+		t.Error("expected SyncError, got:", err)
+	}
+
+	if state.syncStats().Failures != 1 || state.syncStats().Count != 0 {
+		t.Error("failed sync was not counted as a failure:", state.syncStats())
+	}
+}
+
+func TestBTree_Durability(t *testing.T) {
+	index := &syncRecordingHandle{}
+	tree := NewBTree(index, 4, true)
+
+	err := tree.Insert(int64(1), int64(10))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(index.snapshots) != 0 {
+		t.Error("index was synced with the default SyncNever policy")
+	}
+
+	tree.Durability = SyncAlways
+
+	err = tree.Insert(int64(2), int64(20))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if tree.SyncStats().Count == 0 || string(index.snapshots[len(index.snapshots)-1]) != string(index.data) {
+		t.Error("insert was acknowledged before the index was synced")
+	}
+}
+
+func TestNewBTree_DurabilityShared(t *testing.T) {
+	tree := NewBTree(&syncRecordingHandle{}, 4, true)
+	tree.Durability = SyncAlways
+
+	// A copy made before the first write still shares the sync state
+	copied := tree
+
+	err := tree.Insert(int64(1), int64(10))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if copied.SyncStats().Count == 0 || copied.SyncStats() != tree.SyncStats() {
+		t.Error("copy of the tree did not share its sync stats, got:", copied.SyncStats(), tree.SyncStats())
+	}
+
+	// Built without the constructor the state is still only created once when
+	// First used from several goroutines
+	file := &ImmutableFile{}
+	done := make(chan *durabilityShared)
+
+	for i := 0; i < 8; i++ {
+		go func() {
+			done <- file.durability.get()
+		}()
+	}
+
+	first := <-done
+
+	for i := 1; i < 8; i++ {
+		if <-done != first {
+			t.Error("shared sync state was created more than once")
+		}
+	}
+}
+
+func TestBTree_DurabilityWriteAheadLogRecovery(t *testing.T) {
+	clock := 0
+	index := &syncRecordingHandle{clock: &clock}
+	walHandle := &syncRecordingHandle{clock: &clock}
+	tree := NewBTree(index, 4, true)
+	tree.WriteAheadLogCheckpointSize = 1 << 30
+	tree.Durability = SyncAlways
+
+	err := tree.EnableWriteAheadLog(walHandle)
+	if err != nil {
+		t.Error(err)
+	}
+
+	keys := []int64{1, 2, 3}
+	acknowledgedAt := make([]int, 0)
+
+	for _, key := range keys {
+		err = tree.Insert(key, key*10)
+		if err != nil {
+			t.Error(err)
+		}
+
+		acknowledgedAt = append(acknowledgedAt, clock)
+	}
+
+	// Losing power after any sync must recover every insert acknowledged by then
+	for sequence := 1; sequence <= clock; sequence++ {
+		recoveredIndex := &MemoryFileHandle{data: index.durableAt(sequence)}
+		recoveredWal := &MemoryFileHandle{data: walHandle.durableAt(sequence)}
+		recovered := NewBTree(recoveredIndex, 4, true)
+
+		err = recovered.EnableWriteAheadLog(recoveredWal)
+		if err != nil {
+			t.Error("sync", sequence, err)
+			continue
+		}
+
+		for i, key := range keys {
+			location, err := recovered.Find(key)
+
+			if acknowledgedAt[i] <= sequence && (err != nil || location != key*10) {
+				t.Error("sync", sequence, "lost acknowledged key", key, err)
+			}
+		}
+	}
+}
+
+func TestImmutableFile_Sync(t *testing.T) {
+	directory, err := ioutil.TempDir("", "gatabase-durability")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	dataHandle, err := os.Create(filepath.Join(directory, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dataHandle.Close()
+
+	indexHandle, err := os.Create(filepath.Join(directory, "data.index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer indexHandle.Close()
+
+	file := ImmutableFile{DataHandle: dataHandle, IndexHandle: indexHandle, Durability: SyncAlways}
+
+	_, err = file.Write([]byte("durable"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if file.SyncStats().Count != 1 {
+		t.Error("write was not synced, syncs:", file.SyncStats().Count)
+	}
+
+	err = file.Sync()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if file.SyncStats().Count != 3 {
+		t.Error("Sync did not sync both handles, syncs:", file.SyncStats().Count)
+	}
+
+	memoryFile, err := NewMemoryImmutableFile(make([]byte, 0), make([]byte, 0))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = memoryFile.Sync()
+	if err != nil {
+		t.Error("syncing memory handles should be a no-op, got:", err)
+	}
+}
+
+func TestLSMTree_Durability(t *testing.T) {
+	manifest := &syncRecordingHandle{}
+	tree, err := NewLSMTree(manifest, NewMemoryLSMRunStore())
+	if err != nil {
+		t.Error(err)
+	}
+
+	tree.Durability = SyncAlways
+
+	err = tree.Insert(int64(1), int64(10))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = tree.Flush()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The run's data and index are synced before the manifest
+	if len(manifest.snapshots) != 1 || tree.SyncStats().Count != 3 {
+		t.Error("flush was not synced, syncs:", tree.SyncStats().Count)
+	}
+}
+
+func TestDurabilityState_batchedTimer(t *testing.T) {
+	handle := &syncRecordingHandle{}
+	state := durabilityState{}
+	policy := SyncBatched(20 * time.Millisecond)
+
+	// The first write is due, the second waits for the timer
+	for i := 0; i < 2; i++ {
+		err := state.afterWrite(policy, handle)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	if state.syncStats().Count != 1 {
+		t.Error("expected only the first batched write to be synced straight away, synced:", state.syncStats().Count)
+	}
+
+	deadline := time.Now().Add(time.Second)
+
+	for state.syncStats().Count != 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if state.syncStats().Count != 2 {
+		t.Error("idle batched write was not synced once the interval passed")
+	}
+
+	// Stopping syncs a write still waiting for the timer
+	err := state.afterWrite(SyncBatched(time.Hour), handle)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = state.stop()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if state.syncStats().Count != 3 {
+		t.Error("waiting batched write was not synced when stopped, synced:", state.syncStats().Count)
+	}
+
+	err = state.afterWrite(SyncBatched(time.Hour), handle)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if state.get().timer != nil {
+		t.Error("timer was started after the state was stopped")
+	}
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+const (
+	// Random bytes mixed into the key so every file is encrypted differently
+	encryptionSaltSize = 16
+	// Bytes derived from the key used to check the right key was supplied
+	encryptionKeyCheckSize = 16
+	// The salt followed by the key check, stored in the file's header
+	encryptionHeaderSize = encryptionSaltSize + encryptionKeyCheckSize
+	// Each encrypted payload is prefixed with a random nonce
+	encryptionNonceSize = 12
+	// The nonce and the GCM authentication tag added to every payload
+	encryptionOverhead = encryptionNonceSize + 16
+)
+
+var (
+	EncryptionKeyInvalidError  = gataerrors.NewGataError("encryption key must be 16, 24 or 32 bytes")
+	EncryptionWrongKeyError    = gataerrors.NewGataError("file was encrypted with a different key")
+	EncryptionKeyRequiredError = gataerrors.NewGataError("file is encrypted and no key was supplied")
+	EncryptionNotEnabledError  = gataerrors.NewGataError("file was not created with encryption")
+	EncryptionDecryptError     = gataerrors.NewGataError("unable to decrypt, the data is corrupt or was encrypted with a different key")
+	encryptionError            = gataerrors.NewGataError("unable to encrypt")
+)
+
+// AES-GCM encryption of the payloads in a single file. The key used is
+// Derived from the supplied key and the file's salt
+type fileEncryption struct {
+	aead     cipher.AEAD
+	salt     []byte
+	keyCheck []byte
+}
+
+// Set up encryption for a new file with a random salt
+func newFileEncryption(key []byte) (*fileEncryption, error) {
+	salt := make([]byte, encryptionSaltSize)
+	_, err := rand.Read(salt)
+
+	if err != nil {
+		return nil, encryptionError.SetUnderlying(err)
+	}
+
+	return deriveFileEncryption(key, salt)
+}
+
+// Set up encryption for an existing file from its header, returning
+// EncryptionWrongKeyError if the file was encrypted with a different key
+func openFileEncryption(key []byte, header []byte) (*fileEncryption, error) {
+	if len(header) != encryptionHeaderSize {
+		return nil, EncryptionDecryptError
+	}
+
+	encryption, err := deriveFileEncryption(key, header[:encryptionSaltSize])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal(encryption.keyCheck, header[encryptionSaltSize:]) {
+		return nil, EncryptionWrongKeyError
+	}
+
+	return encryption, nil
+}
+
+// Derive the file's key and key check from the supplied key and salt
+func deriveFileEncryption(key []byte, salt []byte) (*fileEncryption, error) {
+	if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+		return nil, EncryptionKeyInvalidError
+	}
+
+	derive := hmac.New(sha256.New, key)
+	derive.Write([]byte("gatabase file key"))
+	derive.Write(salt)
+	fileKey := derive.Sum(nil)[:len(key)]
+
+	check := hmac.New(sha256.New, fileKey)
+	check.Write([]byte("gatabase key check"))
+
+	block, err := aes.NewCipher(fileKey)
+
+	if err != nil {
+		return nil, encryptionError.SetUnderlying(err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+
+	if err != nil {
+		return nil, encryptionError.SetUnderlying(err)
+	}
+
+	return &fileEncryption{
+		aead:     aead,
+		salt:     append([]byte{}, salt...),
+		keyCheck: check.Sum(nil)[:encryptionKeyCheckSize],
+	}, nil
+}
+
+// The salt and key check to store in the file's header
+func (encryption *fileEncryption) header() ([]byte) {
+	return append(append([]byte{}, encryption.salt...), encryption.keyCheck...)
+}
+
+// Encrypt a payload, prefixing it with a random nonce
+func (encryption *fileEncryption) seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, encryptionNonceSize, encryptionOverhead+len(plaintext))
+	_, err := rand.Read(nonce)
+
+	if err != nil {
+		return nil, encryptionError.SetUnderlying(err)
+	}
+
+	return encryption.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decrypt and authenticate a payload encrypted by seal
+func (encryption *fileEncryption) open(sealed []byte) ([]byte, error) {
+	if len(sealed) < encryptionOverhead {
+		return nil, EncryptionDecryptError
+	}
+
+	plaintext, err := encryption.aead.Open(nil, sealed[:encryptionNonceSize], sealed[encryptionNonceSize:], nil)
+
+	if err != nil {
+		return nil, EncryptionDecryptError.SetUnderlying(err)
+	}
+
+	return plaintext, nil
+}
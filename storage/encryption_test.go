@@ -0,0 +1,485 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+var (
+	testEncryptionKey      = []byte("0123456789abcdef0123456789abcdef")
+	testEncryptionOtherKey = []byte("fedcba9876543210fedcba9876543210")
+)
+
+func TestFileEncryption(t *testing.T) {
+	_, err := newFileEncryption([]byte("short"))
+	if !EncryptionKeyInvalidError.IsSame(err) {
+		t.Error("expected EncryptionKeyInvalidError for a short key, got:", err)
+	}
+
+	encryption, err := newFileEncryption(testEncryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext := []byte("customer@example.com")
+
+	sealed, err := encryption.seal(plaintext)
+	if err != nil {
+		t.Error(err)
+	}
+
+	again, err := encryption.seal(plaintext)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(sealed) != len(plaintext)+encryptionOverhead || bytes.Contains(sealed, plaintext) || bytes.Equal(sealed, again) {
+		t.Error("expected the plaintext to be hidden behind a random nonce")
+	}
+
+	// The header opens the same encryption with the right key
+	reopened, err := openFileEncryption(testEncryptionKey, encryption.header())
+	if err != nil {
+		t.Error(err)
+	}
+
+	opened, err := reopened.open(sealed)
+	if err != nil || !bytes.Equal(opened, plaintext) {
+		t.Error("did not decrypt what was encrypted, got:", string(opened), err)
+	}
+
+	_, err = openFileEncryption(testEncryptionOtherKey, encryption.header())
+	if !EncryptionWrongKeyError.IsSame(err) {
+		t.Error("expected EncryptionWrongKeyError, got:", err)
+	}
+
+	// Files encrypted with the same key use different file keys
+	other, err := newFileEncryption(testEncryptionKey)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = other.open(sealed)
+	if !EncryptionDecryptError.IsSame(err) {
+		t.Error("expected EncryptionDecryptError decrypting another file's payload, got:", err)
+	}
+
+	sealed[len(sealed)-1] ^= 1
+
+	_, err = encryption.open(sealed)
+	if !EncryptionDecryptError.IsSame(err) {
+		t.Error("expected EncryptionDecryptError for a tampered payload, got:", err)
+	}
+}
+
+func TestImmutableFile_Encrypt(t *testing.T) {
+	data := NewMemoryFileHandle(make([]byte, 0))
+	file := ImmutableFile{DataHandle: data, Codec: GzipCodec{}}
+
+	err := file.Encrypt(testEncryptionKey)
+	if err != nil {
+		t.Error(err)
+	}
+
+	record := bytes.Repeat([]byte(`{"email":"customer@example.com"}`), 20)
+
+	location, err := file.Append(record)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if location != file.dataStart() || bytes.Contains(data.data, []byte("customer")) {
+		t.Error("expected the record to be encrypted after the header")
+	}
+
+	read, err := file.ReadAt(location)
+	if err != nil || !bytes.Equal(read, record) {
+		t.Error("did not read back the encrypted record", err)
+	}
+
+	// Reopening the file
+	reopened := ImmutableFile{DataHandle: data}
+
+	_, err = reopened.ReadAt(location)
+	if !EncryptionKeyRequiredError.IsSame(err) {
+		t.Error("expected EncryptionKeyRequiredError reading without a key, got:", err)
+	}
+
+	err = reopened.Encrypt(testEncryptionOtherKey)
+	if !EncryptionWrongKeyError.IsSame(err) {
+		t.Error("expected EncryptionWrongKeyError, got:", err)
+	}
+
+	err = reopened.Encrypt(testEncryptionKey)
+	if err != nil {
+		t.Error(err)
+	}
+
+	read, err = reopened.ReadAt(location)
+	if err != nil || !bytes.Equal(read, record) {
+		t.Error("did not read back the encrypted record after reopening", err)
+	}
+
+	plain, err := NewMemoryImmutableFile(make([]byte, 0), make([]byte, 0))
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = plain.Append(record)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = plain.Encrypt(testEncryptionKey)
+	if !EncryptionNotEnabledError.IsSame(err) {
+		t.Error("expected EncryptionNotEnabledError encrypting a file with unencrypted records, got:", err)
+	}
+}
+
+func TestBTree_Encryption(t *testing.T) {
+	index := &MemoryFileHandle{}
+	wal := &MemoryFileHandle{}
+
+	tree, err := OpenEncryptedBTree(index, 16, true, testEncryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree.MaxInlineKeySize = 8
+	// Keep the log around to check it is encrypted too
+	tree.WriteAheadLogCheckpointSize = 1 << 30
+
+	err = tree.EnableWriteAheadLog(wal)
+	if err != nil {
+		t.Error(err)
+	}
+
+	keys := make([]string, 0)
+
+	for i := 0; i < 8; i++ {
+		keys = append(keys, fmt.Sprintf("secret-customer-%d@example.com", i))
+
+		err = tree.Insert(keys[i], int64(i))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	if bytes.Contains(index.data, []byte("secret")) || bytes.Contains(wal.data, []byte("secret")) || len(wal.data) == 0 {
+		t.Error("expected the index and write ahead log to be encrypted")
+	}
+
+	reopened, err := OpenEncryptedBTree(index, 16, true, testEncryptionKey)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i, key := range keys {
+		location, err := reopened.Find(key)
+		if err != nil || location != int64(i) {
+			t.Error("did not find key in the reopened encrypted index", key, location, err)
+		}
+	}
+
+	_, err = OpenEncryptedBTree(index, 16, true, testEncryptionOtherKey)
+	if !EncryptionWrongKeyError.IsSame(err) {
+		t.Error("expected EncryptionWrongKeyError, got:", err)
+	}
+
+	_, err = OpenBTree(index, 16, true)
+	if !EncryptionKeyRequiredError.IsSame(err) {
+		t.Error("expected EncryptionKeyRequiredError opening without a key, got:", err)
+	}
+
+	_, err = OpenEncryptedBTree(&MemoryFileHandle{}, 16, true, nil)
+	if !EncryptionKeyInvalidError.IsSame(err) {
+		t.Error("expected EncryptionKeyInvalidError for a nil key, got:", err)
+	}
+
+	plainIndex := &MemoryFileHandle{}
+
+	_, err = OpenBTree(plainIndex, 16, true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = OpenEncryptedBTree(plainIndex, 16, true, testEncryptionKey)
+	if !EncryptionNotEnabledError.IsSame(err) {
+		t.Error("expected EncryptionNotEnabledError opening an unencrypted index with a key, got:", err)
+	}
+
+	// Rotate the key by compacting into an index encrypted with a new key
+	rotatedIndex := &MemoryFileHandle{}
+
+	rotated, err := OpenEncryptedBTree(rotatedIndex, 16, true, testEncryptionOtherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated.MaxInlineKeySize = 8
+
+	err = reopened.Compact(&rotated)
+	if err != nil {
+		t.Error(err)
+	}
+
+	rotated, err = OpenEncryptedBTree(rotatedIndex, 16, true, testEncryptionOtherKey)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i, key := range keys {
+		location, err := rotated.Find(key)
+		if err != nil || location != int64(i) {
+			t.Error("did not find key in the index after rotating the key", key, location, err)
+		}
+	}
+
+	_, err = OpenEncryptedBTree(rotatedIndex, 16, true, testEncryptionKey)
+	if !EncryptionWrongKeyError.IsSame(err) {
+		t.Error("expected the old key to no longer open the rotated index, got:", err)
+	}
+}
+
+func TestSegmentedFile_Encrypt(t *testing.T) {
+	store := NewMemorySegmentStore()
+
+	file, err := OpenSegmentedFile(store, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := make(map[int64]string)
+
+	appendRecords := func(prefix string) {
+		for i := 0; i < 3; i++ {
+			record := fmt.Sprintf("%s-customer-%d", prefix, i)
+
+			location, err := file.Append([]byte(record))
+			if err != nil {
+				t.Error(err)
+			}
+
+			records[location] = record
+		}
+	}
+
+	appendRecords("plain")
+
+	// The unencrypted segment is rolled over so new records are encrypted
+	err = file.Encrypt(testEncryptionKey)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if file.ActiveSegment() != 1 || !file.segments[1].IsEncrypted() {
+		t.Error("expected to roll over to an encrypted segment, active:", file.ActiveSegment())
+	}
+
+	appendRecords("first")
+
+	// Rotate the key, the old key is still needed until compaction
+	err = file.Encrypt(testEncryptionOtherKey, testEncryptionKey)
+	if err != nil {
+		t.Error(err)
+	}
+
+	appendRecords("second")
+
+	if file.ActiveSegment() != 2 {
+		t.Error("expected to roll over when rotating the key, active:", file.ActiveSegment())
+	}
+
+	for _, id := range []int64{0, 1} {
+		moved, err := file.CompactSegment(id, func(location int64) bool { return true })
+		if err != nil {
+			t.Error(err)
+		}
+
+		for from, to := range moved {
+			records[to] = records[from]
+			delete(records, from)
+		}
+
+		err = file.RemoveSegment(id)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	for _, segment := range store.segments {
+		data := segment.DataHandle.(*MemoryFileHandle)
+
+		if bytes.Contains(data.data, []byte("customer")) {
+			t.Error("expected every record to be encrypted after compacting")
+		}
+	}
+
+	// Only the new key is needed now
+	reopened, err := OpenSegmentedFile(store, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = reopened.Encrypt(testEncryptionOtherKey)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(records) != 9 {
+		t.Error("expected 9 records, got:", len(records))
+	}
+
+	for location, record := range records {
+		read, err := reopened.ReadAt(location)
+		if err != nil || string(read) != record {
+			t.Error("did not read back record", record, "got:", string(read), err)
+		}
+	}
+
+	reopened, err = OpenSegmentedFile(store, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = reopened.Encrypt(testEncryptionKey)
+	if !EncryptionWrongKeyError.IsSame(err) {
+		t.Error("expected EncryptionWrongKeyError with the rotated out key, got:", err)
+	}
+}
+
+func TestBTree_EncryptBloomFilter(t *testing.T) {
+	index := &MemoryFileHandle{}
+	bloomIndex := &MemoryFileHandle{}
+
+	tree, err := OpenEncryptedBTree(index, 16, true, testEncryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tree.EnableBloomFilter(bloomIndex, 100, 0.01)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := int64(0); i < 10; i++ {
+		err = tree.Insert(fmt.Sprintf("customer-%d@example.com", i), i)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Neither the filter's header nor any word which has bits set is stored
+	// In the clear
+	serialised := tree.bloom.Serialise()
+
+	if bytes.Contains(bloomIndex.data, serialised[:bloomFilterHeaderLength]) {
+		t.Error("bloom filter header was written in plaintext")
+	}
+
+	for i, word := range tree.bloom.Bits {
+		if word != 0 && bytes.Contains(bloomIndex.data, serialised[bloomFilterHeaderLength+i*8:bloomFilterHeaderLength+i*8+8]) {
+			t.Error("bloom filter word was written in plaintext:", i)
+		}
+	}
+
+	reopened, err := OpenEncryptedBTree(index, 16, true, testEncryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The filter cannot be read without the index's key
+	unencrypted := NewBTree(&MemoryFileHandle{}, 16, true)
+	unencrypted.bloomIndex = bloomIndex
+
+	_, err = bloomIndex.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, _, ok := unencrypted.readBloomFilter()
+	if ok {
+		t.Error("read the encrypted bloom filter without the key")
+	}
+
+	reopened.bloomIndex = bloomIndex
+
+	_, err = bloomIndex.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Error(err)
+	}
+
+	filter, _, ok := reopened.readBloomFilter()
+	if !ok || filter.ItemCount != 10 || !filter.MayContain(bloomKey("customer-3@example.com")) {
+		t.Error("did not read back the encrypted bloom filter")
+	}
+}
+
+func TestLSMRun_Encrypt(t *testing.T) {
+	store := NewMemoryLSMRunStore()
+
+	file, err := store.Create(1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = file.Encrypt(testEncryptionKey)
+	if err != nil {
+		t.Error(err)
+	}
+
+	writer := newLSMRunWriter(1, file, 10, 3, 0.01)
+
+	for i := int64(0); i < 10; i++ {
+		err = writer.Add(NewLSMEntry(fmt.Sprintf("customer-%d@example.com", i), i, false))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	_, err = writer.Finish()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The sparse index holds the first key of every block and the last key
+	indexData := file.IndexHandle.(*MemoryFileHandle).data
+
+	if bytes.Contains(indexData, []byte("customer-0@example.com")) || bytes.Contains(indexData, []byte("customer-9@example.com")) {
+		t.Error("sparse index was written in plaintext")
+	}
+
+	file, err = store.Open(1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = openLSMRun(1, file)
+	if err == nil {
+		t.Error("expected an error opening an encrypted run without its key")
+	}
+
+	file, err = store.Open(1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = file.Encrypt(testEncryptionKey)
+	if err != nil {
+		t.Error(err)
+	}
+
+	opened, err := openLSMRun(1, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(0); i < 10; i++ {
+		entry, found, err := opened.Get(fmt.Sprintf("customer-%d@example.com", i))
+		if err != nil || !found || entry.Location != i {
+			t.Error("did not find entry", i, "in the encrypted run", err)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+var (
+	FaultInjectedError                       = gataerrors.NewGataError("fault injected into file handle")
+	FaultyFileHandleTruncateUnsupportedError = gataerrors.NewGataError("wrapped handle does not support Truncate")
+	faultyFileHandleSnapshotError            = gataerrors.NewGataError("unable to copy the contents of the wrapped handle")
+)
+
+// Scripts faults for the handles it wraps, for testing how the storage layer
+// Survives crashes. Writes and reads are counted across every handle so a
+// Crash can be placed at any write to any of the files of a database
+type FaultInjector struct {
+	// Fail the nth write counted from 1, 0 never fails a write
+	FailWrite int
+	// How many bytes of the failed write still reach the handle, tearing it
+	TornWriteBytes int
+	// The error the failed write returns, such as syscall.ENOSPC to simulate a
+	// Full disk, nil returns FaultInjectedError
+	WriteError error
+	// Fail every write, sync and truncate after the failed write, as if the
+	// Process had crashed
+	CrashOnFailure bool
+	// Flip a bit in the data returned by the nth read counted from 1, 0 never
+	// Flips a bit
+	FlipReadBit int
+	writes  int
+	reads   int
+	crashed bool
+	handles []*FaultyFileHandle
+}
+
+// Wraps a handle, injecting the faults its FaultInjector is scripted with and
+// Remembering what was last synced so a power loss can be simulated
+type FaultyFileHandle struct {
+	Handle   io.ReadWriteSeeker
+	injector *FaultInjector
+	synced   []byte
+}
+
+// Wrap handle so faults can be injected into it, the contents it has now are
+// Treated as already synced
+func (injector *FaultInjector) Wrap(handle io.ReadWriteSeeker) (*FaultyFileHandle, error) {
+	synced, err := readAllFrom(handle)
+
+	if err != nil {
+		return nil, err
+	}
+
+	faulty := &FaultyFileHandle{Handle: handle, injector: injector, synced: synced}
+	injector.handles = append(injector.handles, faulty)
+
+	return faulty, nil
+}
+
+// The number of writes made through every handle
+func (injector *FaultInjector) Writes() (int) {
+	return injector.writes
+}
+
+// Whether a write has failed with CrashOnFailure set
+func (injector *FaultInjector) Crashed() (bool) {
+	return injector.crashed
+}
+
+// Drop everything written to every handle since it was last synced, as if
+// Power was lost. The injector stops failing writes so the handles can be
+// Used to recover
+func (injector *FaultInjector) PowerLoss() (error) {
+	for _, handle := range injector.handles {
+		err := handle.PowerLoss()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	injector.FailWrite = 0
+	injector.crashed = false
+
+	return nil
+}
+
+// Read from the wrapped handle, flipping a bit if scripted to
+func (handle *FaultyFileHandle) Read(p []byte) (n int, err error) {
+	n, err = handle.Handle.Read(p)
+	handle.injector.reads++
+
+	if n > 0 && handle.injector.reads == handle.injector.FlipReadBit {
+		p[n/2] ^= 1
+	}
+
+	return n, err
+}
+
+// Write to the wrapped handle, failing or tearing the write if scripted to
+func (handle *FaultyFileHandle) Write(p []byte) (n int, err error) {
+	if handle.injector.crashed {
+		return 0, FaultInjectedError.SetUnderlying(fmt.Errorf("crashed before write %d", handle.injector.writes+1))
+	}
+
+	handle.injector.writes++
+
+	if handle.injector.writes != handle.injector.FailWrite {
+		return handle.Handle.Write(p)
+	}
+
+	handle.injector.crashed = handle.injector.CrashOnFailure
+	torn := handle.injector.TornWriteBytes
+
+	if torn > len(p) {
+		torn = len(p)
+	}
+
+	if torn > 0 {
+		n, err = handle.Handle.Write(p[:torn])
+
+		if err != nil {
+			return n, err
+		}
+	}
+
+	if handle.injector.WriteError != nil {
+		return n, handle.injector.WriteError
+	}
+
+	return n, FaultInjectedError.SetUnderlying(fmt.Errorf("failed write %d after %d of %d bytes", handle.injector.writes, n, len(p)))
+}
+
+// Seek the wrapped handle
+func (handle *FaultyFileHandle) Seek(offset int64, whence int) (int64, error) {
+	return handle.Handle.Seek(offset, whence)
+}
+
+// Sync the wrapped handle if it can be and remember its contents as durable
+func (handle *FaultyFileHandle) Sync() (error) {
+	if handle.injector.crashed {
+		return FaultInjectedError.SetUnderlying(fmt.Errorf("crashed before sync"))
+	}
+
+	if syncer, ok := handle.Handle.(Syncer); ok {
+		err := syncer.Sync()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	synced, err := readAllFrom(handle.Handle)
+
+	if err != nil {
+		return err
+	}
+
+	handle.synced = synced
+
+	return nil
+}
+
+// Truncate the wrapped handle if it can be
+func (handle *FaultyFileHandle) Truncate(size int64) (error) {
+	if handle.injector.crashed {
+		return FaultInjectedError.SetUnderlying(fmt.Errorf("crashed before truncate"))
+	}
+
+	truncater, ok := handle.Handle.(Truncater)
+
+	if !ok {
+		return FaultyFileHandleTruncateUnsupportedError
+	}
+
+	return truncater.Truncate(size)
+}
+
+// Put back the contents the wrapped handle had when last synced
+func (handle *FaultyFileHandle) PowerLoss() (error) {
+	truncater, ok := handle.Handle.(Truncater)
+
+	if !ok {
+		return FaultyFileHandleTruncateUnsupportedError
+	}
+
+	err := truncater.Truncate(int64(len(handle.synced)))
+
+	if err != nil {
+		return err
+	}
+
+	_, err = handle.Handle.Seek(0, io.SeekStart)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = handle.Handle.Write(handle.synced)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = handle.Handle.Seek(0, io.SeekStart)
+
+	return err
+}
+
+// Read the whole of handle, leaving its pointer where it was
+func readAllFrom(handle io.ReadSeeker) ([]byte, error) {
+	pointer, err := handle.Seek(0, io.SeekCurrent)
+
+	if err != nil {
+		return nil, faultyFileHandleSnapshotError.SetUnderlying(err)
+	}
+
+	size, err := handle.Seek(0, io.SeekEnd)
+
+	if err != nil {
+		return nil, faultyFileHandleSnapshotError.SetUnderlying(err)
+	}
+
+	_, err = handle.Seek(0, io.SeekStart)
+
+	if err != nil {
+		return nil, faultyFileHandleSnapshotError.SetUnderlying(err)
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(handle, data)
+
+	if err != nil {
+		return nil, faultyFileHandleSnapshotError.SetUnderlying(err)
+	}
+
+	_, err = handle.Seek(pointer, io.SeekStart)
+
+	if err != nil {
+		return nil, faultyFileHandleSnapshotError.SetUnderlying(err)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"io"
+	"testing"
+)
+
+func TestFaultyFileHandle(t *testing.T) {
+	injector := &FaultInjector{FailWrite: 2, TornWriteBytes: 3, CrashOnFailure: true}
+	memory := NewMemoryFileHandle([]byte("synced"))
+
+	handle, err := injector.Wrap(memory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handle.Seek(0, io.SeekEnd)
+
+	_, err = handle.Write([]byte(" first"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	n, err := handle.Write([]byte(" second"))
+	if !FaultInjectedError.IsSame(err) || n != 3 || string(memory.data) != "synced first se" {
+		t.Error("expected the second write to be torn after 3 bytes, got:", n, string(memory.data), err)
+	}
+
+	_, err = handle.Write([]byte(" third"))
+	if !FaultInjectedError.IsSame(err) || !injector.Crashed() {
+		t.Error("expected writes after the crash to fail, got:", err)
+	}
+
+	err = handle.Sync()
+	if !FaultInjectedError.IsSame(err) {
+		t.Error("expected syncing after the crash to fail, got:", err)
+	}
+
+	// Only what was synced survives losing power
+	err = injector.PowerLoss()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(memory.data) != "synced" || injector.Crashed() {
+		t.Error("expected only the synced data after power loss, got:", string(memory.data))
+	}
+
+	handle.Seek(0, io.SeekEnd)
+
+	_, err = handle.Write([]byte(" again"))
+	if err != nil {
+		t.Error("expected writes to work again after power loss, got:", err)
+	}
+
+	err = handle.Sync()
+	if err != nil {
+		t.Error(err)
+	}
+
+	handle.Write([]byte(" lost"))
+	handle.PowerLoss()
+
+	if string(memory.data) != "synced again" || injector.Writes() != 4 {
+		t.Error("expected the unsynced write to be dropped, got:", string(memory.data), injector.Writes())
+	}
+
+	// Bits are flipped in what is read, not in what is stored
+	injector.FlipReadBit = 1
+	read := make([]byte, 12)
+
+	handle.Seek(0, io.SeekStart)
+	io.ReadFull(handle, read)
+
+	if string(read) == "synced again" || string(memory.data) != "synced again" {
+		t.Error("expected a bit to be flipped in the first read only, got:", string(read), string(memory.data))
+	}
+
+	handle.Seek(0, io.SeekStart)
+	io.ReadFull(handle, read)
+
+	if string(read) != "synced again" {
+		t.Error("expected later reads to be untouched, got:", string(read))
+	}
+
+	_, err = (&FaultInjector{}).Wrap(struct{ io.ReadWriteSeeker }{memory})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// Insert keys into a btree with a write ahead log through handles which fail
+// At a scripted write, returning the keys which were acknowledged
+func crashBTree(t *testing.T, injector *FaultInjector, index *MemoryFileHandle, wal *MemoryFileHandle, keys int64) ([]int64) {
+	faultyIndex, err := injector.Wrap(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	faultyWal, err := injector.Wrap(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree := NewBTree(faultyIndex, 16, true)
+	tree.WriteAheadLogCheckpointSize = 1 << 30
+	tree.Durability = SyncAlways
+
+	acknowledged := make([]int64, 0)
+
+	err = tree.EnableWriteAheadLog(faultyWal)
+	if err != nil {
+		return acknowledged
+	}
+
+	for key := int64(0); key < keys; key++ {
+		err = tree.Insert(key, key*10)
+		if err != nil {
+			break
+		}
+
+		acknowledged = append(acknowledged, key)
+	}
+
+	return acknowledged
+}
+
+// Reopen a crashed btree and check every acknowledged key survived and the
+// Tree can still be written to
+func recoverBTree(t *testing.T, scenario string, index *MemoryFileHandle, wal *MemoryFileHandle, acknowledged []int64, keys int64) {
+	index.Seek(0, io.SeekStart)
+	wal.Seek(0, io.SeekStart)
+
+	recovered := NewBTree(index, 16, true)
+
+	err := recovered.EnableWriteAheadLog(wal)
+	if err != nil {
+		t.Error(scenario, "unable to replay the write ahead log:", err)
+		return
+	}
+
+	for _, key := range acknowledged {
+		location, err := recovered.Find(key)
+		if err != nil || location != key*10 {
+			t.Error(scenario, "lost acknowledged key", key, location, err)
+		}
+	}
+
+	err = recovered.Insert(keys, keys*10)
+	if err != nil {
+		t.Error(scenario, "unable to insert after recovering:", err)
+	}
+
+	location, err := recovered.Find(keys)
+	if err != nil || location != keys*10 {
+		t.Error(scenario, "did not find the key inserted after recovering", location, err)
+	}
+}
+
+func TestBTree_CrashRecovery(t *testing.T) {
+	keys := int64(12)
+
+	// Count the writes a clean run makes so a crash can be placed at each
+	clean := &FaultInjector{}
+	crashBTree(t, clean, &MemoryFileHandle{}, &MemoryFileHandle{}, keys)
+
+	if clean.Writes() == 0 {
+		t.Fatal("expected the btree to write through the faulty handles")
+	}
+
+	for write := 1; write <= clean.Writes(); write++ {
+		for _, torn := range []int{0, 1, 7} {
+			// The process dies mid write, everything written before survives
+			injector := &FaultInjector{FailWrite: write, TornWriteBytes: torn, CrashOnFailure: true}
+			index := &MemoryFileHandle{}
+			wal := &MemoryFileHandle{}
+			acknowledged := crashBTree(t, injector, index, wal, keys)
+
+			recoverBTree(t, "crash", index, wal, acknowledged, keys)
+
+			// Power is lost mid write, only what was synced survives
+			injector = &FaultInjector{FailWrite: write, TornWriteBytes: torn, CrashOnFailure: true}
+			index = &MemoryFileHandle{}
+			wal = &MemoryFileHandle{}
+			acknowledged = crashBTree(t, injector, index, wal, keys)
+
+			err := injector.PowerLoss()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recoverBTree(t, "power loss", index, wal, acknowledged, keys)
+		}
+	}
+}
+
+func TestBTree_CrashRecoveryFailedWrite(t *testing.T) {
+	keys := int64(12)
+
+	clean := &FaultInjector{}
+	crashBTree(t, clean, &MemoryFileHandle{}, &MemoryFileHandle{}, keys)
+
+	// A single write fails but the process carries on, later inserts must
+	// Not lose the keys already acknowledged
+	for write := 1; write <= clean.Writes(); write++ {
+		injector := &FaultInjector{FailWrite: write, TornWriteBytes: 5}
+		index := &MemoryFileHandle{}
+		wal := &MemoryFileHandle{}
+
+		faultyIndex, err := injector.Wrap(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		faultyWal, err := injector.Wrap(wal)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tree := NewBTree(faultyIndex, 16, true)
+		tree.WriteAheadLogCheckpointSize = 1 << 30
+		tree.Durability = SyncAlways
+		acknowledged := make([]int64, 0)
+
+		err = tree.EnableWriteAheadLog(faultyWal)
+		if err != nil {
+			t.Error(err)
+		}
+
+		for key := int64(0); key < keys; key++ {
+			if tree.Insert(key, key*10) == nil {
+				acknowledged = append(acknowledged, key)
+			}
+		}
+
+		recoverBTree(t, "failed write", index, wal, acknowledged, keys)
+	}
+}
+
+func TestBTree_BitFlipOnRead(t *testing.T) {
+	index := &MemoryFileHandle{}
+	tree := NewBTree(index, 16, true)
+
+	for key := int64(0); key < 8; key++ {
+		err := tree.Insert(key, key*10)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// A flipped bit must never be returned as a different location
+	for read := 1; read <= 8; read++ {
+		injector := &FaultInjector{FlipReadBit: read}
+
+		faulty, err := injector.Wrap(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reopened := NewBTree(faulty, 16, true)
+
+		for key := int64(0); key < 8; key++ {
+			location, err := reopened.Find(key)
+			if err == nil && location != key*10 {
+				t.Error("read", read, "returned the wrong location for key", key, location)
+			}
+		}
+	}
+}
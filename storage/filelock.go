@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+const (
+	// Name of the file locked in a directory of segments or runs
+	DirectoryLockFileName = "LOCK"
+)
+
+var (
+	FileLockInUseError = gataerrors.NewGataError("database is already in use by another process")
+	fileLockOpenError  = gataerrors.NewGataError("unable to open lock file")
+	fileLockError      = gataerrors.NewGataError("unable to lock file")
+)
+
+// An advisory flock held on a lock file for as long as a database is open.
+// Writers hold an exclusive lock while any number of readers can share one,
+// So a second writer or a writer and a reader cannot open the same files.
+// Platforms without flock do not enforce the lock
+type FileLock struct {
+	Path      string
+	Exclusive bool
+	file      *os.File
+}
+
+// Take a lock on the file at path, creating it if it does not exist. Returns
+// FileLockInUseError straight away rather than waiting if another process
+// Holds a conflicting lock
+func LockFile(path string, exclusive bool) (*FileLock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+
+	if err != nil {
+		return nil, fileLockOpenError.SetUnderlying(err)
+	}
+
+	inUse, err := flockFile(file, exclusive)
+
+	if inUse {
+		file.Close()
+		mode := "shared"
+
+		if exclusive {
+			mode = "exclusive"
+		}
+
+		return nil, FileLockInUseError.SetUnderlying(fmt.Errorf("unable to take %s lock on %s", mode, path))
+	}
+
+	if err != nil {
+		file.Close()
+		return nil, fileLockError.SetUnderlying(err)
+	}
+
+	return &FileLock{Path: path, Exclusive: exclusive, file: file}, nil
+}
+
+// Lock a directory of files, such as the directory of a FileSegmentStore or
+// FileLSMRunStore, which should be held for as long as the store is used
+func LockDirectory(directory string, exclusive bool) (*FileLock, error) {
+	return LockFile(filepath.Join(directory, DirectoryLockFileName), exclusive)
+}
+
+// Release the lock so the files can be opened by another process
+func (lock *FileLock) Unlock() (error) {
+	if lock.file == nil {
+		return nil
+	}
+
+	err := funlockFile(lock.file)
+	closeErr := lock.file.Close()
+	lock.file = nil
+
+	if err != nil {
+		return fileLockError.SetUnderlying(err)
+	}
+
+	return closeErr
+}
@@ -0,0 +1,31 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// Take a non blocking flock on the file, returning true if it is held by
+// Another open of the file
+func flockFile(file *os.File, exclusive bool) (bool, error) {
+	how := syscall.LOCK_SH
+
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+
+	if err == syscall.EWOULDBLOCK {
+		return true, err
+	}
+
+	return false, err
+}
+
+// Release a flock taken by flockFile
+func funlockFile(file *os.File) (error) {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
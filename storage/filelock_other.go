@@ -0,0 +1,19 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package storage
+
+import (
+	"os"
+)
+
+// Platforms without flock, such as windows, solaris and plan9, cannot lock
+// Files so the lock is always taken and nothing stops two processes opening
+// The same database
+func flockFile(file *os.File, exclusive bool) (bool, error) {
+	return false, nil
+}
+
+// Nothing was locked so there is nothing to release
+func funlockFile(file *os.File) (error) {
+	return nil
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestLockFile(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("file locking is only supported on linux")
+	}
+
+	directory, err := ioutil.TempDir("", "gatabase-filelock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "data.lock")
+
+	// Locks are held per open file so a second open in the same process
+	// Conflicts just like another process would
+	writer, err := LockFile(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LockFile(path, true)
+	if !FileLockInUseError.IsSame(err) {
+		t.Error("expected FileLockInUseError taking a second exclusive lock, got:", err)
+	}
+
+	_, err = LockFile(path, false)
+	if !FileLockInUseError.IsSame(err) {
+		t.Error("expected FileLockInUseError taking a shared lock while exclusively locked, got:", err)
+	}
+
+	err = writer.Unlock()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = writer.Unlock()
+	if err != nil {
+		t.Error("expected unlocking twice to do nothing, got:", err)
+	}
+
+	first, err := LockFile(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := LockFile(path, false)
+	if err != nil {
+		t.Error("expected shared locks to be taken together, got:", err)
+	}
+
+	_, err = LockFile(path, true)
+	if !FileLockInUseError.IsSame(err) {
+		t.Error("expected FileLockInUseError taking an exclusive lock while shared, got:", err)
+	}
+
+	first.Unlock()
+	second.Unlock()
+
+	lock, err := LockDirectory(directory, true)
+	if err != nil || lock.Path != filepath.Join(directory, DirectoryLockFileName) {
+		t.Error("expected the directory's lock file to be locked, got:", err)
+	}
+
+	_, err = LockDirectory(directory, false)
+	if !FileLockInUseError.IsSame(err) {
+		t.Error("expected FileLockInUseError locking a locked directory, got:", err)
+	}
+
+	lock.Unlock()
+}
+
+func TestNewImmutableFile_Locked(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("file locking is only supported on linux")
+	}
+
+	directory, err := ioutil.TempDir("", "gatabase-filelock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "data")
+
+	_, err = OpenImmutableFileReadOnly(path)
+	if !OSFileHandleNotFoundError.IsSame(err) {
+		t.Error("expected OSFileHandleNotFoundError opening a missing file read only, got:", err)
+	}
+
+	writer, err := NewImmutableFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	location, err := writer.Append([]byte("record"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = NewImmutableFile(path)
+	if !FileLockInUseError.IsSame(err) {
+		t.Error("expected FileLockInUseError opening a file twice for writing, got:", err)
+	}
+
+	_, err = OpenImmutableFileReadOnly(path)
+	if !FileLockInUseError.IsSame(err) {
+		t.Error("expected FileLockInUseError reading a file open for writing, got:", err)
+	}
+
+	writer.Close()
+
+	reader, err := OpenImmutableFileReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	another, err := OpenImmutableFileReadOnly(path)
+	if err != nil {
+		t.Fatal("expected readers to share the file, got:", err)
+	}
+
+	record, err := another.ReadAt(location)
+	if err != nil || string(record) != "record" {
+		t.Error("did not read the record back read only, got:", string(record), err)
+	}
+
+	_, err = reader.Append([]byte("another"))
+	if !ImmutableFileSealedError.IsSame(err) {
+		t.Error("expected ImmutableFileSealedError appending to a read only file, got:", err)
+	}
+
+	_, err = NewImmutableFile(path)
+	if !FileLockInUseError.IsSame(err) {
+		t.Error("expected FileLockInUseError writing a file open for reading, got:", err)
+	}
+
+	reader.Close()
+	another.Close()
+
+	writer, err = NewImmutableFile(path)
+	if err != nil {
+		t.Error("expected to open the file for writing once the readers closed, got:", err)
+	}
+
+	writer.Close()
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+var (
+	// Returned by every FileSystem when a file does not exist
+	FileSystemNotFoundError = OSFileHandleNotFoundError
+	fileSystemError         = gataerrors.NewGataError("unable to change the filesystem")
+)
+
+// The files the storage layer is kept in, so a whole database can run on disk
+// Or purely in memory
+type FileSystem interface {
+	// Create a file, truncating it if it already exists
+	Create(path string) (FileHandle, error)
+	// Open a file with flag, as used by os.OpenFile
+	OpenFile(path string, flag int) (FileHandle, error)
+	// Move a file, replacing any file already at to
+	Rename(from string, to string) error
+	Remove(path string) error
+	// The names of the files directly inside directory, sorted
+	List(directory string) ([]string, error)
+	// Cut a file down to size bytes, or grow it with zeroes
+	Truncate(path string, size int64) error
+	// Take a lock on path, returning FileLockInUseError if it conflicts with
+	// A lock already held
+	Lock(path string, exclusive bool) (FileSystemLock, error)
+}
+
+// A lock taken by FileSystem.Lock
+type FileSystemLock interface {
+	Unlock() error
+}
+
+// A FileSystem of files on disk
+type OSFileSystem struct{}
+
+// Create a file on disk, truncating it if it already exists
+func (fileSystem OSFileSystem) Create(path string) (FileHandle, error) {
+	return fileSystem.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+}
+
+// Open a file on disk
+func (fileSystem OSFileSystem) OpenFile(path string, flag int) (FileHandle, error) {
+	handle, err := OpenOSFileHandle(path, flag)
+
+	// Avoid returning a nil *OSFileHandle as a non nil FileHandle
+	if err != nil {
+		return nil, err
+	}
+
+	return handle, nil
+}
+
+// Move a file on disk
+func (fileSystem OSFileSystem) Rename(from string, to string) (error) {
+	err := os.Rename(from, to)
+
+	if os.IsNotExist(err) {
+		return FileSystemNotFoundError.SetUnderlying(err)
+	}
+
+	if err != nil {
+		return fileSystemError.SetUnderlying(err)
+	}
+
+	return nil
+}
+
+// Remove a file from disk
+func (fileSystem OSFileSystem) Remove(path string) (error) {
+	err := os.Remove(path)
+
+	if os.IsNotExist(err) {
+		return FileSystemNotFoundError.SetUnderlying(err)
+	}
+
+	if err != nil {
+		return fileSystemError.SetUnderlying(err)
+	}
+
+	return nil
+}
+
+// The names of the files in a directory on disk, directories are left out
+func (fileSystem OSFileSystem) List(directory string) ([]string, error) {
+	infos, err := ioutil.ReadDir(directory)
+
+	if os.IsNotExist(err) {
+		return nil, FileSystemNotFoundError.SetUnderlying(err)
+	}
+
+	if err != nil {
+		return nil, fileSystemError.SetUnderlying(err)
+	}
+
+	names := make([]string, 0, len(infos))
+
+	for _, info := range infos {
+		if !info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Truncate a file on disk
+func (fileSystem OSFileSystem) Truncate(path string, size int64) (error) {
+	err := os.Truncate(path, size)
+
+	if os.IsNotExist(err) {
+		return FileSystemNotFoundError.SetUnderlying(err)
+	}
+
+	if err != nil {
+		return fileSystemError.SetUnderlying(err)
+	}
+
+	return nil
+}
+
+// Take a flock on a file on disk
+func (fileSystem OSFileSystem) Lock(path string, exclusive bool) (FileSystemLock, error) {
+	lock, err := LockFile(path, exclusive)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return lock, nil
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOSFileSystem(t *testing.T) {
+	directory, err := ioutil.TempDir("", "gatabase-filesystem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	var fileSystem FileSystem = OSFileSystem{}
+	path := filepath.Join(directory, "data")
+
+	_, err = fileSystem.OpenFile(path, os.O_RDWR)
+	if !FileSystemNotFoundError.IsSame(err) {
+		t.Error("expected FileSystemNotFoundError opening a missing file, got:", err)
+	}
+
+	handle, err := fileSystem.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = handle.Write([]byte("hello world"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	handle.Close()
+
+	err = fileSystem.Truncate(path, 5)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = fileSystem.Rename(path, path+".renamed")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = os.Mkdir(filepath.Join(directory, "nested"), 0777)
+	if err != nil {
+		t.Error(err)
+	}
+
+	names, err := fileSystem.List(directory)
+	if err != nil || !reflect.DeepEqual(names, []string{"data.renamed"}) {
+		t.Error("expected to list only the files in the directory, got:", names, err)
+	}
+
+	contents, err := ioutil.ReadFile(path + ".renamed")
+	if err != nil || string(contents) != "hello" {
+		t.Error("expected the truncated contents to be renamed, got:", string(contents), err)
+	}
+
+	err = fileSystem.Remove(path + ".renamed")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = fileSystem.Remove(path + ".renamed")
+	if !FileSystemNotFoundError.IsSame(err) {
+		t.Error("expected FileSystemNotFoundError removing a missing file, got:", err)
+	}
+}
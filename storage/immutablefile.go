@@ -2,69 +2,250 @@ package storage
 
 import (
 	"io"
-	"errors"
 	"os"
+	"github.com/codingbeard/gatabase/gataerrors"
 )
 
-// An immutable ReaderWriterSeeker
+const (
+	// Extension added to the path of the data file for its index
+	ImmutableFileIndexExtension = ".index"
+	// Extension added to the path of the data file for the file locked while
+	// It is open
+	ImmutableFileLockExtension = ".lock"
+)
+
+var (
+	ImmutableFileEmptyPathError = gataerrors.NewGataError("empty path supplied")
+	ImmutableFileOverwriteError = gataerrors.NewGataError("unable to overwrite bytes already written to an immutable file")
+	ImmutableFileWriteGapError  = gataerrors.NewGataError("unable to write past the end of an immutable file")
+	ImmutableFileSealedError    = gataerrors.NewGataError("unable to write to a sealed immutable file")
+)
+
+// An append only ReaderWriterSeeker, bytes can only be added to the end of the
+// Data and once sealed nothing more can be written. The index handle is left
+// For the owner of the file to manage
 type ImmutableFile struct {
 	DataHandle io.ReadWriteSeeker
 	IndexHandle io.ReadWriteSeeker
+	// Optional handle the data is read through instead of the DataHandle,
+	// Such as an MmapFileHandle of the data file
+	ReadHandle io.ReadSeeker
+	// Compresses records added with Append, nil stores them as they are
+	Codec Codec
+	// When writes are synced to stable storage
+	Durability SyncPolicy
+	// Limits how much can be written, shared with the database's other files
+	Quota *Quota
+	durability durabilityState
+	sealed bool
+	encryption *fileEncryption
+	lock FileSystemLock
 }
 
 // Constructor for an os based immutable file
 // Creates the file if it doesn't exist
 // Will also create a path + ".index" file if it doesn't exist
+// Holds an exclusive lock on path + ".lock" until closed, returning
+// FileLockInUseError if another process has the file open
 func NewImmutableFile(path string) (ImmutableFile, error) {
-	file := ImmutableFile{}
+	return OpenImmutableFile(OSFileSystem{}, path, false)
+}
+
+// Open an existing os based immutable file for reading only. The file is
+// Sealed and holds a shared lock on path + ".lock" so any number of readers
+// Can open it, but not while a writer has it open
+func OpenImmutableFileReadOnly(path string) (ImmutableFile, error) {
+	return OpenImmutableFile(OSFileSystem{}, path, true)
+}
+
+// Open an immutable file in fileSystem, creating it for writing or opening an
+// Existing file read only and sealing it. The lock on path + ".lock" is taken
+// Through fileSystem so only conflicts with other users of the same one
+func OpenImmutableFile(fileSystem FileSystem, path string, readOnly bool) (ImmutableFile, error) {
+	file := ImmutableFile{durability: newDurabilityState()}
 
 	if len(path) == 0 {
-		return file, errors.New("empty path supplied")
+		return file, ImmutableFileEmptyPathError
 	}
 
-	var fileHandle *os.File
-	var err error
+	flag := os.O_RDWR | os.O_CREATE
 
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		fileHandle, err = os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0666)
-	} else {
-		fileHandle, err = os.Open(path)
+	if readOnly {
+		flag = os.O_RDONLY
 	}
 
+	lock, err := fileSystem.Lock(path+ImmutableFileLockExtension, !readOnly)
+
 	if err != nil {
-		panic(err)
+		return file, err
 	}
 
-	file.DataHandle = fileHandle
-
-	indexPath := path + ".index"
+	dataHandle, err := fileSystem.OpenFile(path, flag)
 
-	if _, err := os.Stat(indexPath); os.IsNotExist(err) {
-		fileHandle, err = os.OpenFile(indexPath, os.O_RDONLY|os.O_CREATE, 0666)
-	} else {
-		fileHandle, err = os.Open(indexPath)
+	if err != nil {
+		lock.Unlock()
+		return file, err
 	}
 
+	indexHandle, err := fileSystem.OpenFile(path+ImmutableFileIndexExtension, flag)
+
 	if err != nil {
-		panic(err)
+		dataHandle.Close()
+		lock.Unlock()
+		return file, err
 	}
 
-	file.DataHandle = fileHandle
+	file.DataHandle = dataHandle
+	file.IndexHandle = indexHandle
+	file.ReadHandle = openImmutableFileReadHandle(fileSystem, path)
+	file.lock = lock
+
+	if readOnly {
+		file.Seal()
+	}
 
 	return file, nil
 }
 
+// Memory map the data file for reading, returning nil so reads use the data
+// Handle if it cannot be opened or is not on disk
+func openImmutableFileReadHandle(fileSystem FileSystem, path string) (io.ReadSeeker) {
+	if _, ok := fileSystem.(OSFileSystem); !ok {
+		return nil
+	}
+
+	handle, err := NewMmapFileHandle(path)
+
+	if err != nil {
+		return nil
+	}
+
+	return handle
+}
+
 // Read bytes from the file after the current pointer
 func (file *ImmutableFile) Read(p []byte) (n int, err error) {
-	return file.DataHandle.Read(p)
+	return file.reader().Read(p)
 }
 
-// Write bytes to the file at the current pointer
+// Write bytes to the end of the file wherever the pointer is, leaving the
+// Pointer after them. Returns StorageFullError without writing anything if
+// There is no room for them, and a write which fails part way is cut off
 func (file *ImmutableFile) Write(p []byte) (n int, err error) {
-	return file.DataHandle.Write(p)
+	if file.sealed {
+		return 0, ImmutableFileSealedError
+	}
+
+	end, err := file.DataHandle.Seek(0, io.SeekEnd)
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = reserveSpace(file.Quota, file.DataHandle, int64(len(p)))
+
+	if err != nil {
+		return 0, err
+	}
+
+	n, err = file.DataHandle.Write(p)
+
+	if err != nil {
+		rollbackAppend(file.Quota, file.DataHandle, end, int64(len(p)))
+		return 0, wrapWriteError(err, nil)
+	}
+
+	return n, file.durability.afterWrite(file.Durability, file.DataHandle)
 }
 
-// Seek the pointer to a new location
+// Write bytes at offset, which must be the end of the file as bytes already
+// Written cannot be overwritten
+func (file *ImmutableFile) WriteAt(p []byte, offset int64) (n int, err error) {
+	if file.sealed {
+		return 0, ImmutableFileSealedError
+	}
+
+	size, err := file.DataHandle.Seek(0, io.SeekEnd)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if offset < size {
+		return 0, ImmutableFileOverwriteError
+	}
+
+	if offset > size {
+		return 0, ImmutableFileWriteGapError
+	}
+
+	return file.Write(p)
+}
+
+// Seal the file so nothing more can be written to it
+func (file *ImmutableFile) Seal() {
+	file.sealed = true
+}
+
+// Whether the file has been sealed
+func (file *ImmutableFile) IsSealed() (bool) {
+	return file.sealed
+}
+
+// Seek the read pointer to a new location
 func (file *ImmutableFile) Seek(offset int64, whence int) (int64, error) {
-	return file.DataHandle.Seek(offset, whence)
+	return file.reader().Seek(offset, whence)
+}
+
+// The handle the data is read through
+func (file *ImmutableFile) reader() (io.ReadSeeker) {
+	if file.ReadHandle != nil {
+		return file.ReadHandle
+	}
+
+	return file.DataHandle
+}
+
+// Sync the data and index to stable storage regardless of the Durability policy
+func (file *ImmutableFile) Sync() (error) {
+	return file.durability.sync(file.DataHandle, file.IndexHandle)
+}
+
+// Get the fsync latency metrics of the file
+func (file *ImmutableFile) SyncStats() (SyncStats) {
+	return file.durability.syncStats()
+}
+
+// Close the read, data and index handles and release the lock, the file
+// Cannot be used afterwards. Batched writes not yet synced are synced first
+func (file *ImmutableFile) Close() (error) {
+	firstErr := file.durability.stop()
+
+	for _, handle := range []interface{}{file.ReadHandle, file.DataHandle, file.IndexHandle} {
+		closer, ok := handle.(io.Closer)
+
+		if !ok {
+			continue
+		}
+
+		err := closer.Close()
+
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if file.lock != nil {
+		err := file.lock.Unlock()
+
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		file.lock = nil
+	}
+
+	file.sealed = true
+
+	return firstErr
 }
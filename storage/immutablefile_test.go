@@ -3,6 +3,9 @@ package storage
 import (
 	"testing"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -112,8 +115,8 @@ func TestImmutableFile_Seek(t *testing.T) {
 		t.Error("Did not seek to pointer position 100, got: ", pointerPosition)
 	}
 
-	// Test seeking to 10 bytes from the current position
-	pointerPosition, err = file.Seek(10, io.SeekEnd)
+	// Test seeking to 10 bytes back from the end
+	pointerPosition, err = file.Seek(-10, io.SeekEnd)
 
 	if err != nil {
 		t.Error(err)
@@ -184,14 +187,13 @@ func TestImmutableFile_Write(t *testing.T) {
 		t.Error("read bytes did not match written bytes, expected '", content, "' got: ", string(readBytes))
 	}
 
-	// Set the pointer so we can write half way through
+	// Set the pointer half way through, writes still go to the end
 	_, err = file.Seek(10, io.SeekStart)
 
 	if err != nil {
 		t.Error(err)
 	}
 
-	// Test writing in the middle of the file
 	bytesWritten, err = file.Write([]byte("en words  "))
 
 	if err != nil {
@@ -202,6 +204,25 @@ func TestImmutableFile_Write(t *testing.T) {
 		t.Error("did not write expected 10 bytes, wrote:", bytesWritten)
 	}
 
+	// Overwriting the middle of the file is refused
+	bytesWritten, err = file.WriteAt([]byte("en words  "), 10)
+
+	if !ImmutableFileOverwriteError.IsSame(err) || bytesWritten != 0 {
+		t.Error("expected ImmutableFileOverwriteError when overwriting, got:", err)
+	}
+
+	bytesWritten, err = file.WriteAt([]byte("!"), 31)
+
+	if !ImmutableFileWriteGapError.IsSame(err) || bytesWritten != 0 {
+		t.Error("expected ImmutableFileWriteGapError when writing past the end, got:", err)
+	}
+
+	bytesWritten, err = file.WriteAt([]byte("!"), 30)
+
+	if err != nil || bytesWritten != 1 {
+		t.Error("did not write at the end of the file", err)
+	}
+
 	// Reset the pointer so we can read the written bytes
 	_, err = file.Seek(0, io.SeekStart)
 
@@ -210,7 +231,7 @@ func TestImmutableFile_Write(t *testing.T) {
 	}
 
 	// Test reading the written content
-	readBytes = make([]byte, 20)
+	readBytes = make([]byte, 31)
 
 	bytesRead, err = file.Read(readBytes)
 
@@ -218,11 +239,129 @@ func TestImmutableFile_Write(t *testing.T) {
 		t.Error(err)
 	}
 
-	if bytesRead != 20 {
-		t.Error("did not read expected 20 bytes, read:", bytesRead)
+	if bytesRead != 31 {
+		t.Error("did not read expected 31 bytes, read:", bytesRead)
+	}
+
+	if string(readBytes) != "Some written contenten words  !" {
+		t.Error("read bytes did not match written bytes, expected 'Some written contenten words  !' got: ", string(readBytes))
+	}
+}
+
+func TestImmutableFile_Seal(t *testing.T) {
+	file, err := NewMemoryImmutableFile([]byte("sealed"), make([]byte, 0))
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if file.IsSealed() {
+		t.Error("new file should not be sealed")
+	}
+
+	file.Seal()
+
+	if !file.IsSealed() {
+		t.Error("file was not sealed")
+	}
+
+	_, err = file.Write([]byte("more"))
+
+	if !ImmutableFileSealedError.IsSame(err) {
+		t.Error("expected ImmutableFileSealedError writing to a sealed file, got:", err)
+	}
+
+	_, err = file.Append([]byte("more"))
+
+	if !ImmutableFileSealedError.IsSame(err) {
+		t.Error("expected ImmutableFileSealedError appending to a sealed file, got:", err)
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	read := make([]byte, 6)
+	_, err = file.Read(read)
+
+	if err != nil || string(read) != "sealed" {
+		t.Error("sealed file could not be read", err)
+	}
+}
+
+func TestNewImmutableFile(t *testing.T) {
+	_, err := NewImmutableFile("")
+
+	if !ImmutableFileEmptyPathError.IsSame(err) {
+		t.Error("expected ImmutableFileEmptyPathError, got:", err)
 	}
 
-	if string(readBytes) != "Some written words  " {
-		t.Error("read bytes did not match written bytes, expected 'Some written words  ' got: ", string(readBytes))
+	directory, err := ioutil.TempDir("", "gatabase-immutablefile")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "data")
+	file, err := NewImmutableFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if file.IndexHandle == nil || file.IndexHandle == file.DataHandle {
+		t.Error("index handle was not opened separately from the data handle")
+	}
+
+	if file.ReadHandle == nil {
+		t.Error("data file was not opened for memory mapped reads")
+	}
+
+	location, err := file.Append([]byte("record"))
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = file.IndexHandle.Write([]byte("index"))
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = file.Close()
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = os.Stat(path + ImmutableFileIndexExtension)
+
+	if err != nil {
+		t.Error("index file was not created", err)
+	}
+
+	reopened, err := NewImmutableFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer reopened.Close()
+
+	record, err := reopened.ReadAt(location)
+
+	if err != nil || string(record) != "record" {
+		t.Error("did not read record back after reopening, got:", string(record), err)
+	}
+
+	_, err = reopened.Append([]byte("another"))
+
+	if err != nil {
+		t.Error("could not append after reopening", err)
 	}
 }
@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+const (
+	// Flags, length and the checksum of the flags, length and record
+	immutableFileRecordHeaderLength = 1 + 4 + 4
+	// The record is stored as it was appended
+	immutableFileRecordFlagNone = byte(0)
+	// The low bits of the flags are the id of the codec which compressed the
+	// Record, zero if it is not compressed
+	immutableFileRecordCodecMask = byte(0x0f)
+	// The record's payload is encrypted with the file's key
+	immutableFileRecordFlagEncrypted = byte(0x10)
+	// The record holds the file's encryption header rather than data, it is
+	// Always the first record of an encrypted file
+	immutableFileRecordFlagEncryptionHeader = byte(0x20)
+	// The largest payload a record's length can hold, after compression and
+	// Encryption
+	MaxImmutableFileRecordSize = int64(math.MaxUint32)
+)
+
+var (
+	ImmutableFileRecordReadError     = gataerrors.NewGataError("unable to read record from the immutable file")
+	ImmutableFileRecordCorruptError  = gataerrors.NewGataError("record in the immutable file is torn or corrupt")
+	ImmutableFileRecordTooLargeError = gataerrors.NewGataError("record is larger than MaxImmutableFileRecordSize")
+	immutableFileRecordWriteError    = gataerrors.NewGataError("unable to append record to the immutable file")
+)
+
+// Append a record to the end of the data file, returning the location it can
+// Be read back from with ReadAt. Records are framed with a flags byte, their
+// Length and a crc32 so a torn or corrupted record is detected when read. The
+// Record is compressed with the file's Codec if that makes it smaller, returns
+// ImmutableFileRecordTooLargeError if it is still over
+// MaxImmutableFileRecordSize
+func (file *ImmutableFile) Append(record []byte) (int64, error) {
+	flags, payload, err := encodeImmutableFileRecord(file.Codec, record)
+
+	if err != nil {
+		return 0, err
+	}
+
+	location, _, err := file.appendEncoded(flags, payload)
+
+	return location, err
+}
+
+// Read the record appended at location
+func (file *ImmutableFile) ReadAt(location int64) ([]byte, error) {
+	flags, payload, err := file.readFramed(location)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return file.decodeRecord(flags, payload)
+}
+
+// Encrypt records appended from now on with key, and decrypt records read.
+// The encryption header is written if the file is empty, otherwise it is read
+// And EncryptionWrongKeyError is returned if the file was encrypted with a
+// Different key or EncryptionNotEnabledError if it was never encrypted
+func (file *ImmutableFile) Encrypt(key []byte) (error) {
+	size, err := file.DataHandle.Seek(0, io.SeekEnd)
+
+	if err != nil {
+		return ImmutableFileRecordReadError.SetUnderlying(err)
+	}
+
+	if size == 0 {
+		if file.sealed {
+			return ImmutableFileSealedError
+		}
+
+		encryption, err := newFileEncryption(key)
+
+		if err != nil {
+			return err
+		}
+
+		_, _, err = file.appendFramed(immutableFileRecordFlagEncryptionHeader, encryption.header())
+
+		if err != nil {
+			return err
+		}
+
+		file.encryption = encryption
+
+		return nil
+	}
+
+	flags, header, err := file.readFramed(0)
+
+	if err != nil {
+		return err
+	}
+
+	if flags != immutableFileRecordFlagEncryptionHeader {
+		return EncryptionNotEnabledError
+	}
+
+	encryption, err := openFileEncryption(key, header)
+
+	if err != nil {
+		return err
+	}
+
+	file.encryption = encryption
+
+	return nil
+}
+
+// Whether records appended to the file are encrypted
+func (file *ImmutableFile) IsEncrypted() (bool) {
+	return file.encryption != nil
+}
+
+// Where the first data record is, after the encryption header if there is one
+func (file *ImmutableFile) dataStart() (int64) {
+	if file.encryption == nil {
+		return 0
+	}
+
+	return immutableFileRecordHeaderLength + encryptionHeaderSize
+}
+
+// Encrypt a compressed record if the file is encrypted then append it,
+// Returning its location and framed length
+func (file *ImmutableFile) appendEncoded(flags byte, payload []byte) (int64, int64, error) {
+	if file.encryption != nil {
+		sealed, err := file.encryption.seal(payload)
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		flags |= immutableFileRecordFlagEncrypted
+		payload = sealed
+	}
+
+	return file.appendFramed(flags, payload)
+}
+
+// Decrypt and decompress a record read by readFramed
+func (file *ImmutableFile) decodeRecord(flags byte, payload []byte) ([]byte, error) {
+	if flags&immutableFileRecordFlagEncrypted != 0 {
+		if file.encryption == nil {
+			return nil, EncryptionKeyRequiredError
+		}
+
+		plaintext, err := file.encryption.open(payload)
+
+		if err != nil {
+			return nil, err
+		}
+
+		flags &^= immutableFileRecordFlagEncrypted
+		payload = plaintext
+	}
+
+	return decodeImmutableFileRecord(flags, payload)
+}
+
+// Append an encoded record, returning its location and framed length
+func (file *ImmutableFile) appendFramed(flags byte, payload []byte) (int64, int64, error) {
+	if file.sealed {
+		return 0, 0, ImmutableFileSealedError
+	}
+
+	// The length would be truncated and the record read back short
+	if int64(len(payload)) > MaxImmutableFileRecordSize {
+		return 0, 0, ImmutableFileRecordTooLargeError
+	}
+
+	location, err := file.DataHandle.Seek(0, io.SeekEnd)
+
+	if err != nil {
+		return 0, 0, immutableFileRecordWriteError.SetUnderlying(err)
+	}
+
+	n, err := file.Write(serialiseImmutableFileRecord(flags, payload))
+
+	if err != nil {
+		return 0, 0, wrapWriteError(err, immutableFileRecordWriteError)
+	}
+
+	return location, int64(n), nil
+}
+
+// Read and verify the flags and payload of the record at location, without
+// Decoding the payload
+func (file *ImmutableFile) readFramed(location int64) (byte, []byte, error) {
+	reader := file.reader()
+	size, err := reader.Seek(0, io.SeekEnd)
+
+	if err != nil {
+		return 0, nil, ImmutableFileRecordReadError.SetUnderlying(err)
+	}
+
+	if location < 0 || location+immutableFileRecordHeaderLength > size {
+		return 0, nil, ImmutableFileRecordCorruptError
+	}
+
+	_, err = reader.Seek(location, io.SeekStart)
+
+	if err != nil {
+		return 0, nil, ImmutableFileRecordReadError.SetUnderlying(err)
+	}
+
+	header := make([]byte, immutableFileRecordHeaderLength)
+	_, err = io.ReadFull(reader, header)
+
+	if err != nil {
+		return 0, nil, ImmutableFileRecordReadError.SetUnderlying(err)
+	}
+
+	length := int64(binary.BigEndian.Uint32(header[1:5]))
+
+	// Checked before allocating so a corrupt length cannot ask for gigabytes
+	if location+immutableFileRecordHeaderLength+length > size {
+		return 0, nil, ImmutableFileRecordCorruptError
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+
+	if err != nil {
+		return 0, nil, ImmutableFileRecordReadError.SetUnderlying(err)
+	}
+
+	if immutableFileRecordChecksum(header, payload) != binary.BigEndian.Uint32(header[5:9]) {
+		return 0, nil, ImmutableFileRecordCorruptError
+	}
+
+	return header[0], payload, nil
+}
+
+// Compress a record with codec, returning the flags to store it with. The
+// Record is kept as it is if there is no codec or compressing does not help
+func encodeImmutableFileRecord(codec Codec, record []byte) (byte, []byte, error) {
+	if codec == nil {
+		return immutableFileRecordFlagNone, record, nil
+	}
+
+	// Records written with an unregistered codec could never be read back
+	if _, ok := registeredCodec(codec.CodecId()); !ok {
+		return 0, nil, CodecNotRegisteredError
+	}
+
+	compressed, err := codec.Compress(record)
+
+	if err != nil {
+		return 0, nil, CodecCompressError.SetUnderlying(err)
+	}
+
+	if len(compressed) >= len(record) {
+		return immutableFileRecordFlagNone, record, nil
+	}
+
+	return codec.CodecId() & immutableFileRecordCodecMask, compressed, nil
+}
+
+// Decompress a record's payload with the codec recorded in its flags
+func decodeImmutableFileRecord(flags byte, payload []byte) ([]byte, error) {
+	id := flags & immutableFileRecordCodecMask
+
+	if id == immutableFileRecordFlagNone {
+		return payload, nil
+	}
+
+	codec, ok := registeredCodec(id)
+
+	if !ok {
+		return nil, CodecNotRegisteredError
+	}
+
+	record, err := codec.Decompress(payload)
+
+	if err != nil {
+		return nil, CodecDecompressError.SetUnderlying(err)
+	}
+
+	return record, nil
+}
+
+// Frame a record's payload with its flags, length and checksum
+func serialiseImmutableFileRecord(flags byte, payload []byte) ([]byte) {
+	serialised := make([]byte, immutableFileRecordHeaderLength, immutableFileRecordHeaderLength+len(payload))
+	serialised[0] = flags
+	binary.BigEndian.PutUint32(serialised[1:5], uint32(len(payload)))
+	binary.BigEndian.PutUint32(serialised[5:9], immutableFileRecordChecksum(serialised, payload))
+
+	return append(serialised, payload...)
+}
+
+// The crc32 of a record's flags, length and payload
+func immutableFileRecordChecksum(header []byte, payload []byte) (uint32) {
+	checksum := crc32.ChecksumIEEE(header[0:5])
+
+	return crc32.Update(checksum, crc32.IEEETable, payload)
+}
@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestImmutableFile_AppendReadAt(t *testing.T) {
+	file, err := NewMemoryImmutableFile(make([]byte, 0), make([]byte, 0))
+	if err != nil {
+		t.Error(err)
+	}
+
+	records := [][]byte{[]byte(`{"name":"first"}`), {}, bytes.Repeat([]byte("x"), 10000)}
+	locations := make([]int64, 0)
+
+	for _, record := range records {
+		location, err := file.Append(record)
+		if err != nil {
+			t.Error(err)
+		}
+
+		locations = append(locations, location)
+	}
+
+	if locations[0] != 0 || locations[1] != int64(immutableFileRecordHeaderLength+len(records[0])) {
+		t.Error("records were not appended one after another, got locations:", locations)
+	}
+
+	// Read out of order to check ReadAt does not rely on the pointer
+	for _, i := range []int{2, 0, 1} {
+		read, err := file.ReadAt(locations[i])
+		if err != nil {
+			t.Error(err)
+		}
+
+		if !bytes.Equal(read, records[i]) {
+			t.Error("did not read back record", i)
+		}
+	}
+}
+
+func TestImmutableFile_AppendTooLarge(t *testing.T) {
+	if testing.Short() {
+		t.Skip("reserves more than 4GiB of address space")
+	}
+
+	file, err := NewMemoryImmutableFile(make([]byte, 0), make([]byte, 0))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Never written to, so the pages are not touched
+	_, err = file.Append(make([]byte, MaxImmutableFileRecordSize+1))
+	if !ImmutableFileRecordTooLargeError.IsSame(err) {
+		t.Error("expected ImmutableFileRecordTooLargeError, got:", err)
+	}
+
+	size, _ := file.DataHandle.Seek(0, io.SeekEnd)
+	if size != 0 {
+		t.Error("expected nothing to be written for a record which is too large, got:", size)
+	}
+}
+
+func TestImmutableFile_ReadAtCorrupt(t *testing.T) {
+	file, err := NewMemoryImmutableFile(make([]byte, 0), make([]byte, 0))
+	if err != nil {
+		t.Error(err)
+	}
+
+	location, err := file.Append([]byte("some record"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	data := file.DataHandle.(*MemoryFileHandle)
+
+	// A flipped bit in the record
+	data.data[len(data.data)-1] ^= 1
+
+	_, err = file.ReadAt(location)
+	if !ImmutableFileRecordCorruptError.IsSame(err) {
+		t.Error("expected ImmutableFileRecordCorruptError for a flipped bit, got:", err)
+	}
+
+	data.data[len(data.data)-1] ^= 1
+
+	// A length running past the end of the file, as a torn append leaves
+	data.data[1] = 0xff
+
+	_, err = file.ReadAt(location)
+	if !ImmutableFileRecordCorruptError.IsSame(err) {
+		t.Error("expected ImmutableFileRecordCorruptError for a torn record, got:", err)
+	}
+
+	_, err = file.ReadAt(int64(len(data.data)))
+	if !ImmutableFileRecordCorruptError.IsSame(err) {
+		t.Error("expected ImmutableFileRecordCorruptError reading past the end, got:", err)
+	}
+}
+
+func TestImmutableFile_AppendCompressed(t *testing.T) {
+	file, err := NewMemoryImmutableFile(make([]byte, 0), make([]byte, 0))
+	if err != nil {
+		t.Error(err)
+	}
+
+	compressible := bytes.Repeat([]byte(`{"name":"gatabase"}`), 100)
+	records := [][]byte{compressible, compressible, []byte("tiny"), compressible}
+	codecs := []Codec{nil, GzipCodec{}, GzipCodec{}, DeflateCodec{}}
+	// The tiny record is stored as it is because compressing it does not help
+	flags := []byte{immutableFileRecordFlagNone, GzipCodecId, immutableFileRecordFlagNone, DeflateCodecId}
+	locations := make([]int64, 0)
+
+	// A file can mix records compressed with different codecs
+	for i, record := range records {
+		file.Codec = codecs[i]
+
+		location, err := file.Append(record)
+		if err != nil {
+			t.Error(err)
+		}
+
+		locations = append(locations, location)
+	}
+
+	data := file.DataHandle.(*MemoryFileHandle)
+
+	for i, location := range locations {
+		if data.data[location] != flags[i] {
+			t.Error("expected record", i, "to have flags", flags[i], "got:", data.data[location])
+		}
+
+		read, err := file.ReadAt(location)
+		if err != nil || !bytes.Equal(read, records[i]) {
+			t.Error("did not read back record", i, err)
+		}
+	}
+
+	if locations[2]-locations[1] >= int64(len(compressible)) {
+		t.Error("compressed record was not smaller than the original")
+	}
+
+	file.Codec = testUnregisteredCodec{}
+
+	_, err = file.Append(compressible)
+	if !CodecNotRegisteredError.IsSame(err) {
+		t.Error("expected CodecNotRegisteredError appending with an unregistered codec, got:", err)
+	}
+
+	// A record compressed by a codec which is no longer known
+	data.data[locations[1]] = MaxCodecId
+	binary.BigEndian.PutUint32(data.data[locations[1]+5:], immutableFileRecordChecksum(data.data[locations[1]:], data.data[locations[1]+immutableFileRecordHeaderLength:locations[2]]))
+
+	_, err = file.ReadAt(locations[1])
+	if !CodecNotRegisteredError.IsSame(err) {
+		t.Error("expected CodecNotRegisteredError reading with an unknown codec, got:", err)
+	}
+}
+
+// A codec which is never registered
+type testUnregisteredCodec struct {
+	GzipCodec
+}
+
+func (codec testUnregisteredCodec) CodecId() (byte) {
+	return MaxCodecId
+}
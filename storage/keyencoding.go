@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+const (
+	// Marks the end of a tuple, it sorts before every other tag so a tuple
+	// Sorts before any longer tuple it is a prefix of
+	keyEncodingTupleEnd = byte(0x00)
+	keyEncodingInt      = byte(0x01)
+	keyEncodingString   = byte(0x02)
+	keyEncodingBytes    = byte(0x03)
+	keyEncodingDate     = byte(0x04)
+	keyEncodingTuple    = byte(0x05)
+	// Followed by the type id and the escaped bytes of a custom Key
+	keyEncodingCustom   = byte(0x06)
+	// Zero bytes inside strings are escaped as zero followed by this
+	keyEncodingEscape = byte(0xff)
+	// Strings are terminated by a zero followed by this, which sorts before an
+	// Escaped zero so a string sorts before any longer string it prefixes
+	keyEncodingTerminator = byte(0x01)
+)
+
+var (
+	EncodeKeyUnsupportedTypeError = gataerrors.NewGataError("key must be an int64, string, []byte, time.Time, Tuple or Key")
+	DecodeKeyInvalidError         = gataerrors.NewGataError("unable to decode key, it was not written by EncodeKey")
+)
+
+// A key made up of several keys, tuples sort by their first key, then their
+// Second and so on, with a tuple sorting before any longer tuple it prefixes
+type Tuple []interface{}
+
+// Encode a key so the encoded keys sort with bytes.Compare in the same order
+// As the keys themselves. Ints are big endian with the sign bit flipped so
+// Negative numbers sort first, strings and byte slices have zero bytes escaped
+// And are terminated, dates are their Unix seconds and nanoseconds and tuples
+// Are their encoded keys followed by an end marker. Keys of different types
+// Sort by type. Custom keys are their type id and escaped Encode bytes, they
+// Only sort by bytes.Compare if Encode preserves their order
+func EncodeKey(key interface{}) ([]byte, error) {
+	return appendEncodedKey(make([]byte, 0, 16), key)
+}
+
+// Decode a key written by EncodeKey, dates are returned in UTC
+func DecodeKey(encoded []byte) (interface{}, error) {
+	key, rest, err := decodeKey(encoded)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rest) != 0 {
+		return nil, DecodeKeyInvalidError
+	}
+
+	return key, nil
+}
+
+// Append the encoding of key to encoded
+func appendEncodedKey(encoded []byte, key interface{}) ([]byte, error) {
+	switch typed := key.(type) {
+	case int64:
+		encoded = append(encoded, keyEncodingInt)
+		return appendEncodedUint64(encoded, uint64(typed)^(1<<63)), nil
+	case string:
+		encoded = append(encoded, keyEncodingString)
+		return appendEscapedBytes(encoded, []byte(typed)), nil
+	case []byte:
+		encoded = append(encoded, keyEncodingBytes)
+		return appendEscapedBytes(encoded, typed), nil
+	case time.Time:
+		encoded = append(encoded, keyEncodingDate)
+		encoded = appendEncodedUint64(encoded, uint64(typed.Unix())^(1<<63))
+		return appendEncodedUint32(encoded, uint32(typed.Nanosecond())), nil
+	case Tuple:
+		encoded = append(encoded, keyEncodingTuple)
+
+		for _, element := range typed {
+			var err error
+			encoded, err = appendEncodedKey(encoded, element)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return append(encoded, keyEncodingTupleEnd), nil
+	case Key:
+		encoded = append(encoded, keyEncodingCustom, byte(typed.KeyTypeId()))
+		return appendEscapedBytes(encoded, typed.Encode()), nil
+	}
+
+	return nil, EncodeKeyUnsupportedTypeError
+}
+
+// Decode the key at the start of encoded, returning what follows it
+func decodeKey(encoded []byte) (interface{}, []byte, error) {
+	if len(encoded) == 0 {
+		return nil, nil, DecodeKeyInvalidError
+	}
+
+	tag, encoded := encoded[0], encoded[1:]
+
+	switch tag {
+	case keyEncodingInt:
+		if len(encoded) < 8 {
+			return nil, nil, DecodeKeyInvalidError
+		}
+
+		return int64(binary.BigEndian.Uint64(encoded) ^ (1 << 63)), encoded[8:], nil
+	case keyEncodingString, keyEncodingBytes:
+		unescaped, rest, err := decodeEscapedBytes(encoded)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if tag == keyEncodingString {
+			return string(unescaped), rest, nil
+		}
+
+		return unescaped, rest, nil
+	case keyEncodingDate:
+		if len(encoded) < 12 {
+			return nil, nil, DecodeKeyInvalidError
+		}
+
+		seconds := int64(binary.BigEndian.Uint64(encoded) ^ (1 << 63))
+		nanoseconds := int64(binary.BigEndian.Uint32(encoded[8:]))
+
+		return time.Unix(seconds, nanoseconds).UTC(), encoded[12:], nil
+	case keyEncodingTuple:
+		tuple := make(Tuple, 0)
+
+		for {
+			if len(encoded) == 0 {
+				return nil, nil, DecodeKeyInvalidError
+			}
+
+			if encoded[0] == keyEncodingTupleEnd {
+				return tuple, encoded[1:], nil
+			}
+
+			var element interface{}
+			var err error
+			element, encoded, err = decodeKey(encoded)
+
+			if err != nil {
+				return nil, nil, err
+			}
+
+			tuple = append(tuple, element)
+		}
+	case keyEncodingCustom:
+		if len(encoded) == 0 {
+			return nil, nil, DecodeKeyInvalidError
+		}
+
+		unescaped, rest, err := decodeEscapedBytes(encoded[1:])
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		key, err := decodeCustomKey(int8(encoded[0]), unescaped)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return key, rest, nil
+	}
+
+	return nil, nil, DecodeKeyInvalidError
+}
+
+// Append a big endian uint64
+func appendEncodedUint64(encoded []byte, value uint64) ([]byte) {
+	buffer := make([]byte, 8)
+	binary.BigEndian.PutUint64(buffer, value)
+
+	return append(encoded, buffer...)
+}
+
+// Append a big endian uint32
+func appendEncodedUint32(encoded []byte, value uint32) ([]byte) {
+	buffer := make([]byte, 4)
+	binary.BigEndian.PutUint32(buffer, value)
+
+	return append(encoded, buffer...)
+}
+
+// Append data with its zero bytes escaped, followed by the terminator
+func appendEscapedBytes(encoded []byte, data []byte) ([]byte) {
+	for _, b := range data {
+		encoded = append(encoded, b)
+
+		if b == 0 {
+			encoded = append(encoded, keyEncodingEscape)
+		}
+	}
+
+	return append(encoded, 0, keyEncodingTerminator)
+}
+
+// Unescape bytes written by appendEscapedBytes, returning what follows them
+func decodeEscapedBytes(encoded []byte) ([]byte, []byte, error) {
+	unescaped := make([]byte, 0, len(encoded))
+
+	for {
+		zero := bytes.IndexByte(encoded, 0)
+
+		if zero < 0 || zero+1 >= len(encoded) {
+			return nil, nil, DecodeKeyInvalidError
+		}
+
+		unescaped = append(unescaped, encoded[:zero]...)
+
+		switch encoded[zero+1] {
+		case keyEncodingTerminator:
+			return unescaped, encoded[zero+2:], nil
+		case keyEncodingEscape:
+			unescaped = append(unescaped, 0)
+			encoded = encoded[zero+2:]
+		default:
+			return nil, nil, DecodeKeyInvalidError
+		}
+	}
+}
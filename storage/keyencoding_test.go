@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEncodeKey_Order(t *testing.T) {
+	date := time.Date(2018, 5, 26, 15, 31, 17, 0, time.UTC)
+
+	// Every key sorts before the one after it
+	keys := []interface{}{
+		int64(-1 << 63),
+		int64(-1),
+		int64(0),
+		int64(1),
+		int64(1<<62) + 1,
+		int64(1<<62) + 3,
+		int64(1<<63 - 1),
+		"",
+		"a",
+		"a\x00",
+		"a\x00\x00",
+		"a\x01",
+		"aa",
+		"b",
+		[]byte{},
+		[]byte{0},
+		[]byte{0, 0xff},
+		[]byte{1},
+		time.Date(1969, 12, 31, 23, 59, 59, 0, time.UTC),
+		date,
+		date.Add(time.Nanosecond),
+		date.Add(time.Second),
+		Tuple{},
+		Tuple{int64(1)},
+		Tuple{int64(1), "a"},
+		Tuple{int64(1), "b"},
+		Tuple{int64(2)},
+		Tuple{"a", Tuple{int64(1)}},
+		Tuple{"a", Tuple{int64(1), int64(1)}},
+	}
+
+	previous := []byte(nil)
+
+	for i, key := range keys {
+		encoded, err := EncodeKey(key)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if i > 0 && bytes.Compare(previous, encoded) >= 0 {
+			t.Error("key", keys[i-1], "did not encode before key", key)
+		}
+
+		previous = encoded
+	}
+}
+
+func TestDecodeKey(t *testing.T) {
+	date := time.Date(2018, 5, 26, 15, 31, 17, 123, time.FixedZone("UTC+1", 3600))
+
+	keys := []interface{}{
+		int64(-42),
+		"with\x00zero",
+		[]byte{0, 1, 0xff},
+		Tuple{int64(1), "a", []byte{0}, Tuple{"nested"}},
+	}
+
+	for _, key := range keys {
+		encoded, err := EncodeKey(key)
+		if err != nil {
+			t.Error(err)
+		}
+
+		decoded, err := DecodeKey(encoded)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if !reflect.DeepEqual(decoded, key) {
+			t.Error("expected to decode", key, "got:", decoded)
+		}
+	}
+
+	encoded, err := EncodeKey(date)
+	if err != nil {
+		t.Error(err)
+	}
+
+	decoded, err := DecodeKey(encoded)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if decodedDate, ok := decoded.(time.Time); !ok || !decodedDate.Equal(date) {
+		t.Error("expected to decode", date, "got:", decoded)
+	}
+
+	_, err = EncodeKey(3.14)
+	if !EncodeKeyUnsupportedTypeError.IsSame(err) {
+		t.Error("expected EncodeKeyUnsupportedTypeError, got:", err)
+	}
+
+	_, err = EncodeKey(Tuple{int64(1), 3.14})
+	if !EncodeKeyUnsupportedTypeError.IsSame(err) {
+		t.Error("expected EncodeKeyUnsupportedTypeError for a tuple holding a float, got:", err)
+	}
+
+	for _, invalid := range [][]byte{{}, {0x99}, {keyEncodingInt, 1}, {keyEncodingString, 'a'}, {keyEncodingString, 'a', 0, 7}, {keyEncodingTuple}, append(encoded, 0)} {
+		_, err = DecodeKey(invalid)
+		if !DecodeKeyInvalidError.IsSame(err) {
+			t.Error("expected DecodeKeyInvalidError for", invalid, "got:", err)
+		}
+	}
+}
+
+func TestBTree_InsertEncodedKeyTypes(t *testing.T) {
+	keys := map[int8][]interface{}{
+		btreeElementTypeBytes: {[]byte{2}, []byte{0}, []byte{1, 0}},
+		btreeElementTypeTuple: {Tuple{"b", int64(1)}, Tuple{"a", int64(2)}, Tuple{"a", int64(1)}},
+	}
+
+	for keyType, typeKeys := range keys {
+		tree := NewBTree(&MemoryFileHandle{}, 4, true)
+
+		for i, key := range typeKeys {
+			err := tree.Insert(key, int64(i))
+			if err != nil {
+				t.Error(err)
+			}
+		}
+
+		for i, key := range typeKeys {
+			location, err := tree.Find(key)
+			if err != nil || location != int64(i) {
+				t.Error("key type", keyType, "did not find key", key, "got:", location, err)
+			}
+		}
+
+		ranged := make([]interface{}, 0)
+
+		err := tree.Range(nil, nil, func(key interface{}, value []byte) bool {
+			ranged = append(ranged, key)
+			return true
+		})
+		if err != nil {
+			t.Error(err)
+		}
+
+		expected := []interface{}{typeKeys[1], typeKeys[2], typeKeys[0]}
+
+		if keyType == btreeElementTypeTuple {
+			expected = []interface{}{typeKeys[2], typeKeys[1], typeKeys[0]}
+		}
+
+		if !reflect.DeepEqual(ranged, expected) {
+			t.Error("key type", keyType, "did not range in encoded order, got:", ranged)
+		}
+	}
+}
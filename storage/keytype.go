@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+const (
+	// Type ids below this are reserved for the built in key types
+	MinCustomKeyTypeId = int8(16)
+)
+
+var (
+	KeyTypeIdReservedError        = gataerrors.NewGataError("custom key type ids must be at least MinCustomKeyTypeId")
+	KeyTypeAlreadyRegisteredError = gataerrors.NewGataError("a different key type is already registered with this type id")
+	KeyTypeNotRegisteredError     = gataerrors.NewGataError("no key type is registered with this type id")
+	keyTypesMutex                 = sync.RWMutex{}
+	keyTypes                      = make(map[int8]Key)
+)
+
+// A custom key type such as an IP address or version number. Once registered
+// With RegisterKeyType keys of the type can be used anywhere the built in key
+// Types can. The type id is stored in the index so must never change
+type Key interface {
+	// The id registered for the type, at least MinCustomKeyTypeId
+	KeyTypeId() int8
+	// Returns -1, 0 or 1 if the key is less than, equal to or more than other,
+	// Which is always a key of the same type
+	Compare(other Key) int
+	// Encode the key to bytes
+	Encode() []byte
+	// Decode a key written by Encode
+	Decode(encoded []byte) (Key, error)
+}
+
+// Register a custom key type so its keys can be decoded, prototype can be any
+// Key of the type. Registering the same type again does nothing
+func RegisterKeyType(prototype Key) (error) {
+	id := prototype.KeyTypeId()
+
+	if id < MinCustomKeyTypeId {
+		return KeyTypeIdReservedError
+	}
+
+	keyTypesMutex.Lock()
+	defer keyTypesMutex.Unlock()
+
+	if registered, ok := keyTypes[id]; ok && reflect.TypeOf(registered) != reflect.TypeOf(prototype) {
+		return KeyTypeAlreadyRegisteredError
+	}
+
+	keyTypes[id] = prototype
+
+	return nil
+}
+
+// Get the prototype registered for a type id
+func registeredKeyType(id int8) (Key, bool) {
+	keyTypesMutex.RLock()
+	defer keyTypesMutex.RUnlock()
+
+	prototype, ok := keyTypes[id]
+
+	return prototype, ok
+}
+
+// Decode the payload of a custom key with its registered type
+func decodeCustomKey(id int8, encoded []byte) (Key, error) {
+	prototype, ok := registeredKeyType(id)
+
+	if !ok {
+		return nil, KeyTypeNotRegisteredError
+	}
+
+	key, err := prototype.Decode(encoded)
+
+	if err != nil {
+		return nil, DecodeKeyInvalidError.SetUnderlying(err)
+	}
+
+	return key, nil
+}
+
+// Compare two keys encoded with EncodeKey. Custom keys of the same type are
+// Decoded and compared with their Compare method, everything else, including
+// Custom keys inside a Tuple, is compared by its encoding
+func compareEncodedKeys(a []byte, b []byte) (int) {
+	if len(a) > 1 && len(b) > 1 && a[0] == keyEncodingCustom && b[0] == keyEncodingCustom && a[1] == b[1] {
+		keyA, errA := DecodeKey(a)
+		keyB, errB := DecodeKey(b)
+
+		if errA == nil && errB == nil {
+			return keyA.(Key).Compare(keyB.(Key))
+		}
+	}
+
+	return bytes.Compare(a, b)
+}
@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// An IPv4 or IPv6 address, encoded as 16 bytes so it sorts by bytes
+type ipAddressKey struct {
+	ip net.IP
+}
+
+func (key ipAddressKey) KeyTypeId() (int8) {
+	return 16
+}
+
+func (key ipAddressKey) Compare(other Key) (int) {
+	return bytes.Compare(key.ip.To16(), other.(ipAddressKey).ip.To16())
+}
+
+func (key ipAddressKey) Encode() ([]byte) {
+	return key.ip.To16()
+}
+
+func (key ipAddressKey) Decode(encoded []byte) (Key, error) {
+	if len(encoded) != net.IPv6len {
+		return nil, errors.New("ip address must be 16 bytes")
+	}
+
+	return ipAddressKey{ip: net.IP(encoded)}, nil
+}
+
+// A major.minor.patch version, encoded as text which does not sort by bytes
+type versionKey struct {
+	major, minor, patch int64
+}
+
+func (key versionKey) KeyTypeId() (int8) {
+	return 17
+}
+
+func (key versionKey) Compare(other Key) (int) {
+	o := other.(versionKey)
+
+	for _, pair := range [][2]int64{{key.major, o.major}, {key.minor, o.minor}, {key.patch, o.patch}} {
+		if pair[0] < pair[1] {
+			return -1
+		} else if pair[0] > pair[1] {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+func (key versionKey) Encode() ([]byte) {
+	return []byte(strconv.FormatInt(key.major, 10) + "." + strconv.FormatInt(key.minor, 10) + "." + strconv.FormatInt(key.patch, 10))
+}
+
+func (key versionKey) Decode(encoded []byte) (Key, error) {
+	parts := strings.Split(string(encoded), ".")
+
+	if len(parts) != 3 {
+		return nil, errors.New("version must have three parts")
+	}
+
+	numbers := make([]int64, 3)
+
+	for i, part := range parts {
+		number, err := strconv.ParseInt(part, 10, 64)
+
+		if err != nil {
+			return nil, err
+		}
+
+		numbers[i] = number
+	}
+
+	return versionKey{major: numbers[0], minor: numbers[1], patch: numbers[2]}, nil
+}
+
+// Claims a reserved id
+type reservedKey struct {
+	versionKey
+}
+
+func (key reservedKey) KeyTypeId() (int8) {
+	return btreeElementTypeString
+}
+
+// Claims the id already used by versionKey
+type clashingKey struct {
+	versionKey
+}
+
+func TestRegisterKeyType(t *testing.T) {
+	for _, prototype := range []Key{ipAddressKey{}, versionKey{}, versionKey{}} {
+		err := RegisterKeyType(prototype)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	err := RegisterKeyType(reservedKey{})
+	if !KeyTypeIdReservedError.IsSame(err) {
+		t.Error("expected KeyTypeIdReservedError, got:", err)
+	}
+
+	err = RegisterKeyType(clashingKey{})
+	if !KeyTypeAlreadyRegisteredError.IsSame(err) {
+		t.Error("expected KeyTypeAlreadyRegisteredError, got:", err)
+	}
+
+	key := versionKey{major: 1, minor: 10}
+
+	encoded, err := EncodeKey(key)
+	if err != nil {
+		t.Error(err)
+	}
+
+	decoded, err := DecodeKey(encoded)
+	if err != nil || decoded != key {
+		t.Error("expected to decode", key, "got:", decoded, err)
+	}
+}
+
+func TestBTree_InsertCustomKeyTypes(t *testing.T) {
+	err := RegisterKeyType(ipAddressKey{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = RegisterKeyType(versionKey{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	index := &MemoryFileHandle{}
+	tree, err := OpenBTree(index, 8, true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	versions := []versionKey{{1, 10, 0}, {1, 2, 0}, {1, 9, 1}, {0, 1, 0}}
+
+	for i, version := range versions {
+		err = tree.Insert(version, int64(i))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	err = tree.Insert(ipAddressKey{ip: net.ParseIP("10.0.0.1")}, int64(9))
+	if !BTreeKeyTypeMismatchError.IsSame(err) {
+		t.Error("expected BTreeKeyTypeMismatchError inserting an ip into a version tree, got:", err)
+	}
+
+	reopened, err := OpenBTree(index, 8, true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	location, err := reopened.Find(versionKey{1, 9, 1})
+	if err != nil || location != 2 {
+		t.Error("did not find version after reopening, got:", location, err)
+	}
+
+	// Ordered by Compare rather than by the encoded text
+	ranged := make([]interface{}, 0)
+
+	err = reopened.Range(versionKey{1, 0, 0}, nil, func(key interface{}, value []byte) bool {
+		ranged = append(ranged, key)
+		return true
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	expected := []interface{}{versionKey{1, 2, 0}, versionKey{1, 9, 1}, versionKey{1, 10, 0}}
+
+	if !reflect.DeepEqual(ranged, expected) {
+		t.Error("did not range versions in order, got:", ranged)
+	}
+
+	// A tree of a type this process has not registered cannot be opened
+	table, err := reopened.pageTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table.keyType = 99
+
+	err = reopened.commitPageTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenBTree(index, 8, true)
+	if !KeyTypeNotRegisteredError.IsSame(err) {
+		t.Error("expected KeyTypeNotRegisteredError, got:", err)
+	}
+}
+
+func TestBTree_InsertUnregisteredKeyType(t *testing.T) {
+	tree := NewBTree(&MemoryFileHandle{}, 4, true)
+
+	err := tree.Insert(reservedKey{}, int64(1))
+	if !BTreeUnsupportedKeyTypeError.IsSame(err) {
+		t.Error("expected BTreeUnsupportedKeyTypeError for an unregistered key type, got:", err)
+	}
+}
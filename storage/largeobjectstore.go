@@ -0,0 +1,397 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+const (
+	// The default size of the chunks large objects are split into
+	largeObjectDefaultChunkSize = 64 * 1024
+	// Size, chunk size and chunk count at the start of a chunk index
+	largeObjectChunkIndexHeaderLength = 8 + 8 + 8
+	// Location and SHA-256 hash of each chunk in a chunk index
+	largeObjectChunkIndexEntryLength = 8 + sha256.Size
+)
+
+var (
+	LargeObjectNotFoundError     = gataerrors.NewGataError("no large object exists with this id")
+	LargeObjectChunkCorruptError = gataerrors.NewGataError("chunk of large object does not match its hash")
+	LargeObjectClosedError       = gataerrors.NewGataError("large object has already been closed")
+	LargeObjectChunkSizeError    = gataerrors.NewGataError("large object chunk size must be more than zero")
+	LargeObjectSeekNegativeError = gataerrors.NewGataError("unable to seek before the start of a large object")
+	largeObjectWriteError        = gataerrors.NewGataError("unable to write large object")
+	largeObjectReadError         = gataerrors.NewGataError("unable to read large object")
+	largeObjectChunkIndexError   = gataerrors.NewGataError("chunk index of large object is invalid")
+)
+
+// A store of objects too large to hold in memory at once, written and read as
+// Streams. Objects are split into chunks which are appended to the data file
+// As they are written, then a chunk index listing the location and hash of
+// Each chunk is appended and indexed by the object's id once it is closed
+type LargeObjectStore struct {
+	Data  *ImmutableFile
+	Index *BTree
+	// The size of the chunks new objects are split into, which must be more
+	// Than zero
+	ChunkSize int
+	nextId    int64
+	idsLoaded bool
+}
+
+// Writes a large object a chunk at a time
+type LargeObjectWriter struct {
+	store  *LargeObjectStore
+	id     int64
+	buffer []byte
+	index  largeObjectChunkIndex
+	closed bool
+}
+
+// Reads a large object, holding at most one chunk in memory
+type LargeObjectReader struct {
+	store   *LargeObjectStore
+	index   largeObjectChunkIndex
+	pointer int64
+	chunk   []byte
+	current int
+	closed  bool
+}
+
+// Where an object's chunks are and how to check them
+type largeObjectChunkIndex struct {
+	Size      int64
+	ChunkSize int64
+	Chunks    []largeObjectChunk
+}
+
+// The location and hash of a chunk
+type largeObjectChunk struct {
+	Location int64
+	Hash     [sha256.Size]byte
+}
+
+// Construct a large object store appending chunks to data and indexing each
+// Object's id in index, which should have int64 keys
+func NewLargeObjectStore(data *ImmutableFile, index *BTree) (*LargeObjectStore) {
+	return &LargeObjectStore{
+		Data:      data,
+		Index:     index,
+		ChunkSize: largeObjectDefaultChunkSize,
+	}
+}
+
+// Start writing a new object, returning the writer and the id the object can
+// Be opened with once the writer is closed
+func (store *LargeObjectStore) CreateBlob() (*LargeObjectWriter, int64, error) {
+	if store.ChunkSize <= 0 {
+		return nil, 0, LargeObjectChunkSizeError
+	}
+
+	id, err := store.allocateId()
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &LargeObjectWriter{
+		store:  store,
+		id:     id,
+		buffer: make([]byte, 0, store.ChunkSize),
+		index:  largeObjectChunkIndex{ChunkSize: int64(store.ChunkSize), Chunks: make([]largeObjectChunk, 0)},
+	}, id, nil
+}
+
+// Open an object for reading
+func (store *LargeObjectStore) OpenBlob(id int64) (*LargeObjectReader, error) {
+	location, err := store.Index.Find(id)
+
+	if BTreeKeyNotFoundError.IsSame(err) {
+		return nil, LargeObjectNotFoundError
+	}
+
+	if err != nil {
+		return nil, largeObjectReadError.SetUnderlying(err)
+	}
+
+	serialised, err := store.Data.ReadAt(location)
+
+	if err != nil {
+		return nil, largeObjectReadError.SetUnderlying(err)
+	}
+
+	index, err := deserialiseLargeObjectChunkIndex(serialised)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &LargeObjectReader{store: store, index: index, current: -1}, nil
+}
+
+// Pick the id after the highest one already indexed
+func (store *LargeObjectStore) allocateId() (int64, error) {
+	if !store.idsLoaded {
+		err := store.Index.Range(nil, nil, func(key interface{}, value []byte) bool {
+			if id, ok := key.(int64); ok && id >= store.nextId {
+				store.nextId = id + 1
+			}
+
+			return true
+		})
+
+		if err != nil {
+			return 0, largeObjectReadError.SetUnderlying(err)
+		}
+
+		store.idsLoaded = true
+	}
+
+	id := store.nextId
+	store.nextId++
+
+	return id, nil
+}
+
+// Write bytes to the object, appending each chunk as it fills
+func (writer *LargeObjectWriter) Write(p []byte) (n int, err error) {
+	if writer.closed {
+		return 0, LargeObjectClosedError
+	}
+
+	for len(p) > 0 {
+		space := int(writer.index.ChunkSize) - len(writer.buffer)
+
+		if space > len(p) {
+			space = len(p)
+		}
+
+		writer.buffer = append(writer.buffer, p[:space]...)
+		p = p[space:]
+		n += space
+
+		if len(writer.buffer) == int(writer.index.ChunkSize) {
+			err = writer.flush()
+
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// Append the last chunk and the chunk index, after which the object can be
+// Opened by its id. The object cannot be opened if indexing it fails
+func (writer *LargeObjectWriter) Close() (error) {
+	if writer.closed {
+		return LargeObjectClosedError
+	}
+
+	writer.closed = true
+
+	if len(writer.buffer) > 0 {
+		err := writer.flush()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	location, err := writer.store.Data.Append(writer.index.serialise())
+
+	if err != nil {
+		return largeObjectWriteError.SetUnderlying(err)
+	}
+
+	err = writer.store.Index.Insert(writer.id, location)
+
+	if err != nil {
+		return largeObjectWriteError.SetUnderlying(err)
+	}
+
+	return nil
+}
+
+// The id the object can be opened with once closed
+func (writer *LargeObjectWriter) Id() (int64) {
+	return writer.id
+}
+
+// Append the buffered bytes as a chunk
+func (writer *LargeObjectWriter) flush() (error) {
+	location, err := writer.store.Data.Append(writer.buffer)
+
+	if err != nil {
+		return largeObjectWriteError.SetUnderlying(err)
+	}
+
+	writer.index.Chunks = append(writer.index.Chunks, largeObjectChunk{
+		Location: location,
+		Hash:     sha256.Sum256(writer.buffer),
+	})
+	writer.index.Size += int64(len(writer.buffer))
+	writer.buffer = writer.buffer[:0]
+
+	return nil
+}
+
+// Read from the object after the current pointer location
+func (reader *LargeObjectReader) Read(p []byte) (n int, err error) {
+	n, err = reader.ReadAt(p, reader.pointer)
+	reader.pointer += int64(n)
+
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+
+	return n, err
+}
+
+// Read len(p) bytes from offset without moving the pointer, only the chunks
+// Covering the range are read
+func (reader *LargeObjectReader) ReadAt(p []byte, offset int64) (n int, err error) {
+	if reader.closed {
+		return 0, LargeObjectClosedError
+	}
+
+	if offset < 0 {
+		return 0, largeObjectReadError.SetUnderlying(errors.New(fmt.Sprintf("invalid offset supplied %d", offset)))
+	}
+
+	for n < len(p) {
+		position := offset + int64(n)
+
+		if position >= reader.index.Size {
+			return n, io.EOF
+		}
+
+		chunk, err := reader.readChunk(int(position / reader.index.ChunkSize))
+
+		if err != nil {
+			return n, err
+		}
+
+		n += copy(p[n:], chunk[position%reader.index.ChunkSize:])
+	}
+
+	return n, nil
+}
+
+// Seek the pointer to a new location
+func (reader *LargeObjectReader) Seek(offset int64, whence int) (int64, error) {
+	var pointer int64
+
+	switch whence {
+	case io.SeekStart:
+		pointer = offset
+	case io.SeekCurrent:
+		pointer = reader.pointer + offset
+	case io.SeekEnd:
+		pointer = reader.index.Size + offset
+	default:
+		return 0, errors.New(fmt.Sprintf("invalid whence supplied %d", whence))
+	}
+
+	// The pointer is left where it was
+	if pointer < 0 {
+		return reader.pointer, LargeObjectSeekNegativeError
+	}
+
+	reader.pointer = pointer
+
+	return reader.pointer, nil
+}
+
+// The size of the object in bytes
+func (reader *LargeObjectReader) Size() (int64) {
+	return reader.index.Size
+}
+
+// Release the chunk held in memory, the reader cannot be used afterwards
+func (reader *LargeObjectReader) Close() (error) {
+	if reader.closed {
+		return LargeObjectClosedError
+	}
+
+	reader.closed = true
+	reader.chunk = nil
+
+	return nil
+}
+
+// Read and verify a chunk, keeping it for the next read
+func (reader *LargeObjectReader) readChunk(i int) ([]byte, error) {
+	if i == reader.current {
+		return reader.chunk, nil
+	}
+
+	chunk, err := reader.store.Data.ReadAt(reader.index.Chunks[i].Location)
+
+	if err != nil {
+		return nil, largeObjectReadError.SetUnderlying(err)
+	}
+
+	if sha256.Sum256(chunk) != reader.index.Chunks[i].Hash {
+		return nil, LargeObjectChunkCorruptError
+	}
+
+	reader.chunk = chunk
+	reader.current = i
+
+	return chunk, nil
+}
+
+// Serialise the size, chunk size and chunks
+func (index largeObjectChunkIndex) serialise() ([]byte) {
+	serialised := make([]byte, largeObjectChunkIndexHeaderLength, largeObjectChunkIndexHeaderLength+len(index.Chunks)*largeObjectChunkIndexEntryLength)
+	binary.BigEndian.PutUint64(serialised[0:8], uint64(index.Size))
+	binary.BigEndian.PutUint64(serialised[8:16], uint64(index.ChunkSize))
+	binary.BigEndian.PutUint64(serialised[16:24], uint64(len(index.Chunks)))
+
+	for _, chunk := range index.Chunks {
+		location := make([]byte, 8)
+		binary.BigEndian.PutUint64(location, uint64(chunk.Location))
+		serialised = append(serialised, location...)
+		serialised = append(serialised, chunk.Hash[:]...)
+	}
+
+	return serialised
+}
+
+// Deserialise and sanity check a chunk index written by serialise
+func deserialiseLargeObjectChunkIndex(serialised []byte) (largeObjectChunkIndex, error) {
+	index := largeObjectChunkIndex{}
+
+	if len(serialised) < largeObjectChunkIndexHeaderLength {
+		return index, largeObjectChunkIndexError
+	}
+
+	index.Size = int64(binary.BigEndian.Uint64(serialised[0:8]))
+	index.ChunkSize = int64(binary.BigEndian.Uint64(serialised[8:16]))
+	count := binary.BigEndian.Uint64(serialised[16:24])
+
+	if uint64(len(serialised)-largeObjectChunkIndexHeaderLength) != count*largeObjectChunkIndexEntryLength {
+		return index, largeObjectChunkIndexError
+	}
+
+	// Every chunk but the last is full
+	if index.Size < 0 || index.ChunkSize <= 0 || (index.Size+index.ChunkSize-1)/index.ChunkSize != int64(count) {
+		return index, largeObjectChunkIndexError
+	}
+
+	index.Chunks = make([]largeObjectChunk, count)
+
+	for i := range index.Chunks {
+		entry := serialised[largeObjectChunkIndexHeaderLength+i*largeObjectChunkIndexEntryLength:]
+		index.Chunks[i].Location = int64(binary.BigEndian.Uint64(entry[0:8]))
+		copy(index.Chunks[i].Hash[:], entry[8:largeObjectChunkIndexEntryLength])
+	}
+
+	return index, nil
+}
@@ -0,0 +1,275 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestLargeObjectStore_CreateOpenBlob(t *testing.T) {
+	data, err := NewMemoryImmutableFile(make([]byte, 0), make([]byte, 0))
+	if err != nil {
+		t.Error(err)
+	}
+
+	index, err := OpenBTree(&MemoryFileHandle{}, 16, true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	store := NewLargeObjectStore(&data, &index)
+	store.ChunkSize = 1024
+
+	object := make([]byte, 10000)
+	for i := range object {
+		object[i] = byte(i * 7)
+	}
+
+	var writer io.WriteCloser
+	writer, id, err := store.CreateBlob()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes which do not line up with the chunks
+	for start := 0; start < len(object); start += 700 {
+		end := start + 700
+		if end > len(object) {
+			end = len(object)
+		}
+
+		_, err = writer.Write(object[start:end])
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	_, err = store.OpenBlob(id)
+	if !LargeObjectNotFoundError.IsSame(err) {
+		t.Error("expected LargeObjectNotFoundError before the writer is closed, got:", err)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = writer.Write([]byte("more"))
+	if !LargeObjectClosedError.IsSame(err) {
+		t.Error("expected LargeObjectClosedError writing after Close, got:", err)
+	}
+
+	empty, emptyId, err := store.CreateBlob()
+	if err != nil || emptyId != id+1 {
+		t.Error("expected the next id to be allocated, got:", emptyId, err)
+	}
+
+	err = empty.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// A store reopened over the same files carries on from the highest id
+	reopened := NewLargeObjectStore(&data, &index)
+
+	_, nextId, err := reopened.CreateBlob()
+	if err != nil || nextId != emptyId+1 {
+		t.Error("expected ids to carry on after reopening, got:", nextId, err)
+	}
+
+	var reader io.ReadSeekCloser
+	blob, err := reopened.OpenBlob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader = blob
+
+	if blob.Size() != int64(len(object)) || len(blob.index.Chunks) != 10 {
+		t.Error("expected 10000 bytes in 10 chunks, got:", blob.Size(), len(blob.index.Chunks))
+	}
+
+	read, err := ioutil.ReadAll(reader)
+	if err != nil || !bytes.Equal(read, object) {
+		t.Error("did not read back the object", err)
+	}
+
+	// A ranged read across a chunk boundary
+	_, err = reader.Seek(1000, io.SeekStart)
+	if err != nil {
+		t.Error(err)
+	}
+
+	ranged := make([]byte, 100)
+
+	_, err = io.ReadFull(reader, ranged)
+	if err != nil || !bytes.Equal(ranged, object[1000:1100]) {
+		t.Error("did not read the range across a chunk boundary", err)
+	}
+
+	// Seeking before the start fails and leaves the pointer where it was
+	for _, seek := range [][2]int64{{-1, io.SeekStart}, {-1101, io.SeekCurrent}, {-int64(len(object)) - 1, io.SeekEnd}} {
+		position, err := reader.Seek(seek[0], int(seek[1]))
+		if !LargeObjectSeekNegativeError.IsSame(err) || position != 1100 {
+			t.Error("expected LargeObjectSeekNegativeError seeking before the start, got:", position, err)
+		}
+	}
+
+	n, err := blob.ReadAt(ranged, int64(len(object)-10))
+	if n != 10 || err != io.EOF || !bytes.Equal(ranged[:n], object[len(object)-10:]) {
+		t.Error("expected a short read at the end of the object, got:", n, err)
+	}
+
+	emptyReader, err := reopened.OpenBlob(emptyId)
+	if err != nil {
+		t.Error(err)
+	}
+
+	read, err = ioutil.ReadAll(emptyReader)
+	if err != nil || len(read) != 0 {
+		t.Error("expected the empty object to be empty, got:", len(read), err)
+	}
+
+	// Corrupt a chunk without breaking its record checksum
+	chunk := blob.index.Chunks[3]
+	memory := data.DataHandle.(*MemoryFileHandle)
+	memory.data[chunk.Location+immutableFileRecordHeaderLength] ^= 1
+	record := memory.data[chunk.Location : chunk.Location+immutableFileRecordHeaderLength+1024]
+	binary.BigEndian.PutUint32(record[5:9], immutableFileRecordChecksum(record, record[immutableFileRecordHeaderLength:]))
+
+	_, err = blob.ReadAt(ranged, 3*1024)
+	if !LargeObjectChunkCorruptError.IsSame(err) {
+		t.Error("expected LargeObjectChunkCorruptError, got:", err)
+	}
+
+	// Chunks not covering the range are not read
+	_, err = blob.ReadAt(ranged, 5*1024)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = reader.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = reader.Read(ranged)
+	if !LargeObjectClosedError.IsSame(err) {
+		t.Error("expected LargeObjectClosedError reading after Close, got:", err)
+	}
+}
+
+func TestLargeObjectStore_ChunkSize(t *testing.T) {
+	data, err := NewMemoryImmutableFile(make([]byte, 0), make([]byte, 0))
+	if err != nil {
+		t.Error(err)
+	}
+
+	index, err := OpenBTree(&MemoryFileHandle{}, 16, true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	store := NewLargeObjectStore(&data, &index)
+
+	for _, size := range []int{0, -1} {
+		store.ChunkSize = size
+
+		_, _, err = store.CreateBlob()
+		if !LargeObjectChunkSizeError.IsSame(err) {
+			t.Error("expected LargeObjectChunkSizeError for chunk size", size, "got:", err)
+		}
+	}
+
+	// Changing the chunk size does not affect objects already being written
+	store.ChunkSize = 4
+
+	writer, id, err := store.CreateBlob()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.ChunkSize = 0
+
+	_, err = writer.Write([]byte("0123456789"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	reader, err := store.OpenBlob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := ioutil.ReadAll(reader)
+	if err != nil || string(read) != "0123456789" {
+		t.Error("did not read back the object, got:", string(read), err)
+	}
+}
+
+func TestLargeObjectStore_CloseIndexError(t *testing.T) {
+	data, err := NewMemoryImmutableFile(make([]byte, 0), make([]byte, 0))
+	if err != nil {
+		t.Error(err)
+	}
+
+	index, err := OpenBTree(&MemoryFileHandle{}, 4, true)
+	if err != nil {
+		t.Error(err)
+	}
+
+	store := NewLargeObjectStore(&data, &index)
+	ids := make([]int64, 0)
+
+	// More objects than fit in one node of the index
+	for i := 0; i < 10; i++ {
+		writer, id, err := store.CreateBlob()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = writer.Write([]byte{byte(i)})
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = writer.Close()
+		if err != nil {
+			t.Error(err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	for i, id := range ids {
+		reader, err := store.OpenBlob(id)
+		if err != nil {
+			t.Error("could not open object", i, err)
+			continue
+		}
+
+		read, err := ioutil.ReadAll(reader)
+		if err != nil || len(read) != 1 || read[0] != byte(i) {
+			t.Error("did not read back object", i, read, err)
+		}
+	}
+
+	// Failing to index the object is returned rather than losing it
+	index.Quota = NewQuota(0)
+
+	writer, _, err := store.CreateBlob()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = writer.Close()
+	if !largeObjectWriteError.IsSame(err) {
+		t.Error("expected largeObjectWriteError when the index cannot be written, got:", err)
+	}
+}
@@ -0,0 +1,611 @@
+package storage
+
+import (
+	"io"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+const (
+	lsmDefaultMaxMemtableEntries      = 4096
+	lsmDefaultEntriesPerBlock         = 128
+	lsmDefaultLevel0CompactionTrigger = 4
+	lsmDefaultLevelSizeMultiplier     = 10
+	lsmDefaultBloomFalsePositiveRate  = 0.01
+)
+
+var (
+	LSMKeyNotFoundError        = gataerrors.NewGataError("unable to find key in lsm tree")
+	LSMUnsupportedKeyTypeError = gataerrors.NewGataError("key must be an int64, string, time.Time, []byte, Tuple or registered Key")
+	LSMKeyTypeMismatchError    = gataerrors.NewGataError("key type does not match the keys already in the lsm tree")
+	LSMManifestReadError       = gataerrors.NewGataError("unable to read lsm manifest")
+	LSMOpenRunError            = gataerrors.NewGataError("unable to open a sorted run listed in the lsm manifest")
+	lsmManifestWriteError      = gataerrors.NewGataError("unable to write lsm manifest")
+	lsmFlushError              = gataerrors.NewGataError("unable to flush memtable to a sorted run")
+	lsmCompactionError         = gataerrors.NewGataError("unable to compact sorted runs")
+)
+
+// The runs making up each level, appended to the manifest every time it changes
+type lsmManifest struct {
+	NextRunId int64
+	KeyType   int8
+	Levels    [][]int64
+}
+
+// Log structured merge tree index
+// Inserts go into an in-memory memtable which is flushed to an immutable sorted
+// Run in level 0 once full. When level 0 has Level0CompactionTrigger runs they
+// Are merged into level 1, and each deeper level holds a single run which is
+// Merged into the next once it grows LevelSizeMultiplier times larger than the
+// Level above. The memtable is not durable until Flush is called
+type LSMTree struct {
+	Manifest                io.ReadWriteSeeker
+	Runs                    LSMRunStore
+	MaxMemtableEntries      int
+	EntriesPerBlock         int
+	Level0CompactionTrigger int
+	LevelSizeMultiplier     int
+	BloomFalsePositiveRate  float64
+	// Compresses the blocks of new runs, nil stores them as they are
+	Codec                   Codec
+	// When new runs and the manifest are synced to stable storage
+	Durability              SyncPolicy
+	durability              durabilityState
+	memtable                *lsmMemtable
+	levels                  [][]*lsmRun
+	nextRunId               int64
+	keyType                 int8
+}
+
+// Construct an lsm tree, opening the runs listed in manifest from runs
+func NewLSMTree(manifest io.ReadWriteSeeker, runs LSMRunStore) (LSMTree, error) {
+	tree := LSMTree{
+		Manifest:                manifest,
+		Runs:                    runs,
+		MaxMemtableEntries:      lsmDefaultMaxMemtableEntries,
+		EntriesPerBlock:         lsmDefaultEntriesPerBlock,
+		Level0CompactionTrigger: lsmDefaultLevel0CompactionTrigger,
+		LevelSizeMultiplier:     lsmDefaultLevelSizeMultiplier,
+		BloomFalsePositiveRate:  lsmDefaultBloomFalsePositiveRate,
+		memtable:                newLSMMemtable(),
+		levels:                  make([][]*lsmRun, 1),
+		keyType:                 btreeElementTypeUnset,
+		durability:              newDurabilityState(),
+	}
+
+	saved, found, err := tree.readManifest()
+
+	if err != nil || !found {
+		return tree, err
+	}
+
+	// Keys of a custom type cannot be read without their decoder
+	if saved.KeyType >= MinCustomKeyTypeId {
+		if _, ok := registeredKeyType(saved.KeyType); !ok {
+			return tree, KeyTypeNotRegisteredError
+		}
+	}
+
+	tree.nextRunId = saved.NextRunId
+	tree.keyType = saved.KeyType
+	tree.levels = make([][]*lsmRun, len(saved.Levels))
+
+	for level, ids := range saved.Levels {
+		for _, id := range ids {
+			file, err := runs.Open(id)
+
+			if err != nil {
+				return tree, LSMOpenRunError.SetUnderlying(err)
+			}
+
+			run, err := openLSMRun(id, file)
+
+			if err != nil {
+				return tree, LSMOpenRunError.SetUnderlying(err)
+			}
+
+			tree.levels[level] = append(tree.levels[level], run)
+		}
+	}
+
+	if len(tree.levels) == 0 {
+		tree.levels = make([][]*lsmRun, 1)
+	}
+
+	return tree, nil
+}
+
+// Insert a key-location pair, replacing any existing location for the key
+func (tree *LSMTree) Insert(key interface{}, location int64) (error) {
+	return tree.put(key, location, false)
+}
+
+// Delete a key, older entries for it are hidden until compacted away
+func (tree *LSMTree) Delete(key interface{}) (error) {
+	return tree.put(key, 0, true)
+}
+
+// Find the location of a key
+func (tree *LSMTree) Find(key interface{}) (int64, error) {
+	entry, found := tree.memtable.Get(key)
+
+	for level := 0; !found && level < len(tree.levels); level++ {
+		for _, run := range tree.levels[level] {
+			var err error
+			entry, found, err = run.Get(key)
+
+			if err != nil {
+				return 0, err
+			}
+
+			if found {
+				break
+			}
+		}
+	}
+
+	if !found || entry.Deleted {
+		return 0, LSMKeyNotFoundError
+	}
+
+	return entry.Location, nil
+}
+
+// Call callback in key order with the key and location of every live entry
+// Between start and end inclusive, a nil start or end leaves that side open
+// Returning false from the callback stops the scan
+func (tree *LSMTree) Range(start interface{}, end interface{}, callback func(key interface{}, location int64) bool) (error) {
+	cursors := []*lsmCursor{newLSMMemtableCursor(tree.memtable, start)}
+
+	for _, runs := range tree.levels {
+		for _, run := range runs {
+			cursors = append(cursors, newLSMRunCursor(run, start))
+		}
+	}
+
+	return mergeLSMCursors(cursors, start, end, func(entry LSMEntry) (bool, error) {
+		if entry.Deleted {
+			return true, nil
+		}
+
+		return callback(entry.GetKey(), entry.Location), nil
+	})
+}
+
+// Write the memtable to a new level 0 run and compact if needed
+func (tree *LSMTree) Flush() (error) {
+	if tree.memtable.Len() == 0 {
+		return nil
+	}
+
+	id := tree.nextRunId
+	tree.nextRunId++
+
+	file, err := tree.Runs.Create(id)
+
+	if err != nil {
+		return lsmFlushError.SetUnderlying(err)
+	}
+
+	file.Codec = tree.Codec
+
+	writer := newLSMRunWriter(id, file, uint64(tree.memtable.Len()), tree.EntriesPerBlock, tree.BloomFalsePositiveRate)
+
+	for _, entry := range tree.memtable.Entries() {
+		err = writer.Add(entry)
+
+		if err != nil {
+			tree.discardRun(id, file)
+			return lsmFlushError.SetUnderlying(err)
+		}
+	}
+
+	run, err := writer.Finish()
+
+	if err != nil {
+		tree.discardRun(id, file)
+		return lsmFlushError.SetUnderlying(err)
+	}
+
+	// Newest runs are kept first so they are searched first. The run is only
+	// Added once the manifest refers to it and the memtable is kept until
+	// Then, so a failed flush can be retried without writing it twice
+	levels := append([][]*lsmRun{}, tree.levels...)
+	levels[0] = append([]*lsmRun{run}, levels[0]...)
+
+	err = tree.writeManifest(run, levels)
+
+	if err != nil {
+		tree.discardRun(id, file)
+		return err
+	}
+
+	tree.levels = levels
+	tree.memtable = newLSMMemtable()
+
+	return tree.compact()
+}
+
+// The number of runs in each level
+func (tree *LSMTree) RunCounts() ([]int) {
+	counts := make([]int, len(tree.levels))
+
+	for level, runs := range tree.levels {
+		counts[level] = len(runs)
+	}
+
+	return counts
+}
+
+// Add an entry to the memtable, flushing it once full
+func (tree *LSMTree) put(key interface{}, location int64, deleted bool) (error) {
+	keyType, ok := keyTypeOf(key)
+
+	if !ok {
+		return LSMUnsupportedKeyTypeError
+	}
+
+	if tree.keyType == btreeElementTypeUnset {
+		tree.keyType = keyType
+	} else if tree.keyType != keyType {
+		return LSMKeyTypeMismatchError
+	}
+
+	tree.memtable.Put(NewLSMEntry(key, location, deleted))
+
+	if tree.memtable.Len() >= tree.MaxMemtableEntries {
+		return tree.Flush()
+	}
+
+	return nil
+}
+
+// Merge levels which have outgrown their size into the level below
+func (tree *LSMTree) compact() (error) {
+	if len(tree.levels[0]) >= tree.Level0CompactionTrigger {
+		err := tree.compactLevel(0)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	capacity := int64(tree.MaxMemtableEntries) * int64(tree.Level0CompactionTrigger)
+
+	for level := 1; level < len(tree.levels); level++ {
+		capacity *= int64(tree.LevelSizeMultiplier)
+
+		var entries int64
+
+		for _, run := range tree.levels[level] {
+			entries += run.index.EntryCount
+		}
+
+		if entries > capacity {
+			err := tree.compactLevel(level)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Merge every run in level and the level below into a single run in the level
+// Below. Tombstones are dropped once nothing older can be hidden by them
+func (tree *LSMTree) compactLevel(level int) (error) {
+	if level+1 >= len(tree.levels) {
+		tree.levels = append(tree.levels, make([]*lsmRun, 0))
+	}
+
+	sources := append(append([]*lsmRun{}, tree.levels[level]...), tree.levels[level+1]...)
+	cursors := make([]*lsmCursor, len(sources))
+
+	var expectedEntries uint64
+
+	for i, run := range sources {
+		cursors[i] = newLSMRunCursor(run, nil)
+		expectedEntries += uint64(run.index.EntryCount)
+	}
+
+	dropTombstones := true
+
+	for deeper := level + 2; deeper < len(tree.levels); deeper++ {
+		if len(tree.levels[deeper]) > 0 {
+			dropTombstones = false
+		}
+	}
+
+	id := tree.nextRunId
+	tree.nextRunId++
+
+	file, err := tree.Runs.Create(id)
+
+	if err != nil {
+		return lsmCompactionError.SetUnderlying(err)
+	}
+
+	file.Codec = tree.Codec
+
+	writer := newLSMRunWriter(id, file, expectedEntries, tree.EntriesPerBlock, tree.BloomFalsePositiveRate)
+
+	err = mergeLSMCursors(cursors, nil, nil, func(entry LSMEntry) (bool, error) {
+		if entry.Deleted && dropTombstones {
+			return true, nil
+		}
+
+		return true, writer.Add(entry)
+	})
+
+	if err != nil {
+		tree.discardRun(id, file)
+		return lsmCompactionError.SetUnderlying(err)
+	}
+
+	run, err := writer.Finish()
+
+	if err != nil {
+		tree.discardRun(id, file)
+		return lsmCompactionError.SetUnderlying(err)
+	}
+
+	levels := append([][]*lsmRun{}, tree.levels...)
+	levels[level] = make([]*lsmRun, 0)
+	levels[level+1] = make([]*lsmRun, 0)
+
+	if run != nil {
+		levels[level+1] = append(levels[level+1], run)
+	}
+
+	// Only remove the old runs once the manifest no longer refers to them
+	err = tree.writeManifest(run, levels)
+
+	if err != nil {
+		tree.discardRun(id, file)
+		return err
+	}
+
+	tree.levels = levels
+
+	if run == nil {
+		tree.discardRun(id, file)
+	}
+
+	for _, source := range sources {
+		source.file.Close()
+		err = tree.Runs.Remove(source.Id)
+
+		if err != nil {
+			return lsmCompactionError.SetUnderlying(err)
+		}
+	}
+
+	return nil
+}
+
+// Append levels to the manifest, syncing the new run before the manifest which
+// Refers to it when the Durability policy says to. The manifest is cut back
+// To where it was if this fails, so it never names a run the caller discards
+func (tree *LSMTree) writeManifest(run *lsmRun, levels [][]*lsmRun) (error) {
+	sync := tree.durability.due(tree.Durability)
+
+	if sync && run != nil {
+		err := tree.durability.sync(run.file.DataHandle, run.file.IndexHandle)
+
+		if err != nil {
+			return lsmManifestWriteError.SetUnderlying(err)
+		}
+	}
+
+	manifest := lsmManifest{
+		NextRunId: tree.nextRunId,
+		KeyType:   tree.keyType,
+		Levels:    make([][]int64, len(levels)),
+	}
+
+	for level, runs := range levels {
+		manifest.Levels[level] = make([]int64, len(runs))
+
+		for i, run := range runs {
+			manifest.Levels[level][i] = run.Id
+		}
+	}
+
+	serialised, err := serialiseLSMRecord(manifest)
+
+	if err != nil {
+		return lsmManifestWriteError.SetUnderlying(err)
+	}
+
+	end, err := tree.Manifest.Seek(0, io.SeekEnd)
+
+	if err != nil {
+		return lsmManifestWriteError.SetUnderlying(err)
+	}
+
+	_, err = tree.Manifest.Write(serialised)
+
+	if err != nil {
+		rollbackAppend(nil, tree.Manifest, end, 0)
+		return lsmManifestWriteError.SetUnderlying(err)
+	}
+
+	if sync {
+		err = tree.durability.sync(tree.Manifest)
+
+		if err != nil {
+			rollbackAppend(nil, tree.Manifest, end, 0)
+			return lsmManifestWriteError.SetUnderlying(err)
+		}
+	}
+
+	return nil
+}
+
+// Close and remove a run the manifest does not refer to
+func (tree *LSMTree) discardRun(id int64, file ImmutableFile) {
+	file.Close()
+	tree.Runs.Remove(id)
+}
+
+// Get the fsync latency metrics of the tree
+func (tree *LSMTree) SyncStats() (SyncStats) {
+	return tree.durability.syncStats()
+}
+
+// Read the last complete manifest, a torn final write is ignored
+func (tree *LSMTree) readManifest() (lsmManifest, bool, error) {
+	_, err := tree.Manifest.Seek(0, io.SeekStart)
+
+	if err != nil {
+		return lsmManifest{}, false, LSMManifestReadError.SetUnderlying(err)
+	}
+
+	var latest lsmManifest
+	found := false
+
+	for {
+		manifest := lsmManifest{}
+
+		if deserialiseLSMRecord(tree.Manifest, &manifest) != nil {
+			return latest, found, nil
+		}
+
+		latest = manifest
+		found = true
+	}
+}
+
+// Walks the entries of the memtable or a run in key order
+type lsmCursor struct {
+	run      *lsmRun
+	// The memtable node under the cursor, nil once the memtable is walked
+	node     *lsmMemtableNode
+	entries  []LSMEntry
+	position int
+	block    int
+}
+
+// Construct a cursor over the memtable starting at the first key >= start
+func newLSMMemtableCursor(memtable *lsmMemtable, start interface{}) (*lsmCursor) {
+	var encoded []byte
+
+	if start != nil {
+		encoded, _ = EncodeKey(start)
+	}
+
+	return &lsmCursor{node: memtable.search(encoded)}
+}
+
+// Construct a cursor over a run starting at the block which may hold start
+func newLSMRunCursor(run *lsmRun, start interface{}) (*lsmCursor) {
+	cursor := &lsmCursor{run: run}
+
+	if start != nil {
+		encoded, _ := EncodeKey(start)
+
+		for cursor.block+1 < len(run.index.Blocks) && run.index.Blocks[cursor.block+1].FirstKey.compareEncodedKey(encoded) <= 0 {
+			cursor.block++
+		}
+	}
+
+	return cursor
+}
+
+// The entry under the cursor, nil once every entry has been visited
+func (cursor *lsmCursor) current() (*LSMEntry, error) {
+	if cursor.node != nil {
+		return &cursor.node.entry, nil
+	}
+
+	for cursor.position >= len(cursor.entries) {
+		if cursor.run == nil || cursor.block >= len(cursor.run.index.Blocks) {
+			return nil, nil
+		}
+
+		entries, err := cursor.run.readBlock(cursor.block)
+
+		if err != nil {
+			return nil, err
+		}
+
+		cursor.entries = entries
+		cursor.position = 0
+		cursor.block++
+	}
+
+	return &cursor.entries[cursor.position], nil
+}
+
+// Move to the next entry
+func (cursor *lsmCursor) next() {
+	if cursor.node != nil {
+		cursor.node = cursor.node.next[0]
+		return
+	}
+
+	cursor.position++
+}
+
+// Call callback in key order with the newest entry for each key between start
+// And end inclusive. Cursors must be ordered newest first
+func mergeLSMCursors(cursors []*lsmCursor, start interface{}, end interface{}, callback func(entry LSMEntry) (bool, error)) (error) {
+	var encodedStart, encodedEnd []byte
+
+	if start != nil {
+		encodedStart, _ = EncodeKey(start)
+	}
+
+	if end != nil {
+		encodedEnd, _ = EncodeKey(end)
+	}
+
+	for {
+		var smallest *LSMEntry
+
+		for _, cursor := range cursors {
+			entry, err := cursor.current()
+
+			for err == nil && entry != nil && start != nil && entry.compareEncodedKey(encodedStart) < 0 {
+				cursor.next()
+				entry, err = cursor.current()
+			}
+
+			if err != nil {
+				return err
+			}
+
+			// Strictly less than so the newest cursor wins ties
+			if entry != nil && (smallest == nil || entry.compareEncodedKey(smallest.EncodedKey()) < 0) {
+				smallest = entry
+			}
+		}
+
+		if smallest == nil || (end != nil && smallest.compareEncodedKey(encodedEnd) > 0) {
+			return nil
+		}
+
+		// Copy before moving on as advancing a cursor can replace its block
+		entry := *smallest
+		key := entry.EncodedKey()
+
+		for _, cursor := range cursors {
+			current, err := cursor.current()
+
+			if err != nil {
+				return err
+			}
+
+			if current != nil && current.compareEncodedKey(key) == 0 {
+				cursor.next()
+			}
+		}
+
+		carryOn, err := callback(entry)
+
+		if err != nil || !carryOn {
+			return err
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package storage
+
+import (
+	"testing"
+	"reflect"
+)
+
+func newTestLSMTree(t *testing.T, manifest *MemoryFileHandle, store LSMRunStore) (LSMTree) {
+	tree, err := NewLSMTree(manifest, store)
+	if err != nil {
+		t.Error(err)
+	}
+
+	tree.MaxMemtableEntries = 4
+	tree.EntriesPerBlock = 2
+	tree.Level0CompactionTrigger = 2
+	tree.LevelSizeMultiplier = 2
+
+	return tree
+}
+
+func TestLSMTree_InsertFind(t *testing.T) {
+	tree := newTestLSMTree(t, &MemoryFileHandle{}, NewMemoryLSMRunStore())
+
+	for key := int64(0); key < 50; key++ {
+		err := tree.Insert(key, key*10)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	for key := int64(0); key < 50; key++ {
+		location, err := tree.Find(key)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if location != key*10 {
+			t.Error("did not get expected location", key*10, "for key", key, "got:", location)
+		}
+	}
+
+	_, err := tree.Find(int64(50))
+	if !LSMKeyNotFoundError.IsSame(err) {
+		t.Error("did not get expected error when finding a missing key")
+	}
+
+	// Runs should have been compacted out of level 0
+	counts := tree.RunCounts()
+
+	if counts[0] >= tree.Level0CompactionTrigger {
+		t.Error("level 0 was not compacted, run counts:", counts)
+	}
+
+	if len(counts) < 3 {
+		t.Error("expected compaction to reach level 2, run counts:", counts)
+	}
+
+	err = tree.Insert("string", int64(1))
+	if !LSMKeyTypeMismatchError.IsSame(err) {
+		t.Error("did not get expected error when inserting a key of a different type")
+	}
+
+	err = tree.Insert(int32(1), int64(1))
+	if !LSMUnsupportedKeyTypeError.IsSame(err) {
+		t.Error("did not get expected error when inserting an unsupported key type")
+	}
+}
+
+func TestLSMTree_DeleteAndOverwrite(t *testing.T) {
+	tree := newTestLSMTree(t, &MemoryFileHandle{}, NewMemoryLSMRunStore())
+
+	for key := int64(0); key < 20; key++ {
+		err := tree.Insert(key, key*10)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Newer entries in the memtable and level 0 must hide older runs
+	err := tree.Delete(int64(3))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = tree.Insert(int64(5), int64(500))
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = tree.Find(int64(3))
+	if !LSMKeyNotFoundError.IsSame(err) {
+		t.Error("deleted key was still found")
+	}
+
+	location, err := tree.Find(int64(5))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if location != 500 {
+		t.Error("overwritten key returned old location:", location)
+	}
+
+	// Push the changes through compaction
+	for key := int64(100); key < 140; key++ {
+		err = tree.Insert(key, key)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	_, err = tree.Find(int64(3))
+	if !LSMKeyNotFoundError.IsSame(err) {
+		t.Error("deleted key was found after compaction")
+	}
+
+	location, err = tree.Find(int64(5))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if location != 500 {
+		t.Error("overwritten key returned old location after compaction:", location)
+	}
+}
+
+func TestLSMTree_Range(t *testing.T) {
+	tree := newTestLSMTree(t, &MemoryFileHandle{}, NewMemoryLSMRunStore())
+
+	for _, key := range []string{"d", "a", "f", "c", "e", "b", "h", "g"} {
+		err := tree.Insert(key, int64(key[0]))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	err := tree.Delete("c")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = tree.Insert("e", int64(1))
+	if err != nil {
+		t.Error(err)
+	}
+
+	keys := make([]string, 0)
+	locations := make([]int64, 0)
+
+	err = tree.Range("b", "f", func(key interface{}, location int64) bool {
+		keys = append(keys, key.(string))
+		locations = append(locations, location)
+		return true
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !reflect.DeepEqual(keys, []string{"b", "d", "e", "f"}) {
+		t.Error("did not get expected keys b, d, e, f, got:", keys)
+	}
+
+	if locations[2] != 1 {
+		t.Error("range did not return the newest location for e, got:", locations[2])
+	}
+
+	keys = make([]string, 0)
+
+	err = tree.Range(nil, nil, func(key interface{}, location int64) bool {
+		keys = append(keys, key.(string))
+		return len(keys) < 3
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !reflect.DeepEqual(keys, []string{"a", "b", "d"}) {
+		t.Error("did not stop after 3 keys, got:", keys)
+	}
+}
+
+func TestNewLSMTree_Reopen(t *testing.T) {
+	manifest := &MemoryFileHandle{}
+	store := NewMemoryLSMRunStore()
+	tree := newTestLSMTree(t, manifest, store)
+
+	for key := int64(0); key < 10; key++ {
+		err := tree.Insert(key, key*10)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	err := tree.Flush()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Simulate a torn manifest write after the last good one
+	manifest.Seek(0, 2)
+	manifest.Write([]byte("00000000000000001000"))
+
+	reopened := newTestLSMTree(t, manifest, store)
+
+	if !reflect.DeepEqual(reopened.RunCounts(), tree.RunCounts()) {
+		t.Error("reopened tree has different runs, expected:", tree.RunCounts(), "got:", reopened.RunCounts())
+	}
+
+	for key := int64(0); key < 10; key++ {
+		location, err := reopened.Find(key)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if location != key*10 {
+			t.Error("did not get expected location", key*10, "for key", key, "after reopening, got:", location)
+		}
+	}
+
+	err = reopened.Insert("string", int64(1))
+	if !LSMKeyTypeMismatchError.IsSame(err) {
+		t.Error("key type was not restored from the manifest")
+	}
+}
+
+func TestLSMTree_FlushManifestFails(t *testing.T) {
+	injector := &FaultInjector{}
+	manifest, err := injector.Wrap(&MemoryFileHandle{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewMemoryLSMRunStore()
+	tree, err := NewLSMTree(manifest, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key := int64(0); key < 3; key++ {
+		err = tree.Insert(key, key*10)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	injector.FailWrite = injector.Writes() + 1
+
+	err = tree.Flush()
+	if err == nil {
+		t.Error("expected the flush to fail when the manifest cannot be written")
+	}
+
+	// The run is neither added nor left behind and the memtable is kept
+	if !reflect.DeepEqual(tree.RunCounts(), []int{0}) || len(store.runs) != 0 || tree.memtable.Len() != 3 {
+		t.Error("expected a failed flush to leave no run behind, got:", tree.RunCounts(), len(store.runs), tree.memtable.Len())
+	}
+
+	err = tree.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(tree.RunCounts(), []int{1}) || len(store.runs) != 1 || tree.memtable.Len() != 0 {
+		t.Error("expected the retried flush to write a single run, got:", tree.RunCounts(), len(store.runs), tree.memtable.Len())
+	}
+
+	reopened, err := NewLSMTree(manifest, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key := int64(0); key < 3; key++ {
+		location, err := reopened.Find(key)
+		if err != nil || location != key*10 {
+			t.Error("did not find key", key, "after reopening, got:", location, err)
+		}
+	}
+}
+
+func TestLSMTree_Codec(t *testing.T) {
+	store := NewMemoryLSMRunStore()
+	tree := newTestLSMTree(t, &MemoryFileHandle{}, store)
+	tree.Codec = DeflateCodec{}
+
+	for key := int64(0); key < 20; key++ {
+		err := tree.Insert(key, key*10)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	err := tree.Flush()
+	if err != nil {
+		t.Error(err)
+	}
+
+	for key := int64(0); key < 20; key++ {
+		location, err := tree.Find(key)
+		if err != nil || location != key*10 {
+			t.Error("did not find key", key, "in a compressed run, got:", location, err)
+		}
+	}
+
+	compressed := false
+
+	for _, file := range store.runs {
+		data := file.DataHandle.(*MemoryFileHandle)
+
+		if len(data.data) > 0 && data.data[0] == DeflateCodecId {
+			compressed = true
+		}
+	}
+
+	if !compressed {
+		t.Error("expected the blocks of the runs to be compressed")
+	}
+}
@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	// The most levels a memtable node can have, each level holds about a
+	// Quarter of the nodes of the one below so this is plenty for any memtable
+	lsmMemtableMaxLevel = 16
+)
+
+// A key-location pair held by the lsm tree, Deleted marks a tombstone which
+// Hides older entries for the same key until it is compacted away
+type LSMEntry struct {
+	KeyType   int8
+	KeyInt    int64
+	KeyString string
+	KeyDate   time.Time
+	KeyBytes  []byte
+	Location  int64
+	Deleted   bool
+	// The key encoded with EncodeKey, kept the first time it is needed as
+	// Every comparison uses it
+	encodedKey []byte
+}
+
+// Construct a new LSMEntry, key must be an int64, string, time.Time, []byte,
+// Tuple or Key
+func NewLSMEntry(key interface{}, location int64, deleted bool) (LSMEntry) {
+	entry := LSMEntry{Location: location, Deleted: deleted}
+
+	switch typed := key.(type) {
+	case int64:
+		entry.KeyType = btreeElementTypeInt
+		entry.KeyInt = typed
+	case string:
+		entry.KeyType = btreeElementTypeString
+		entry.KeyString = typed
+	case time.Time:
+		entry.KeyType = btreeElementTypeDate
+		entry.KeyDate = typed
+	case []byte:
+		entry.KeyType = btreeElementTypeBytes
+		entry.KeyBytes = typed
+	case Tuple:
+		encoded, err := EncodeKey(typed)
+
+		if err != nil {
+			entry.KeyType = btreeElementTypeUnset
+			break
+		}
+
+		entry.KeyType = btreeElementTypeTuple
+		entry.KeyBytes = encoded
+	case Key:
+		entry.KeyType = typed.KeyTypeId()
+		entry.KeyBytes = typed.Encode()
+	default:
+		entry.KeyType = btreeElementTypeUnset
+	}
+
+	return entry
+}
+
+// Get the entry's key as whichever type it was constructed with
+func (entry *LSMEntry) GetKey() (interface{}) {
+	switch entry.KeyType {
+	case btreeElementTypeInt:
+		return entry.KeyInt
+	case btreeElementTypeString:
+		return entry.KeyString
+	case btreeElementTypeDate:
+		return entry.KeyDate
+	case btreeElementTypeBytes:
+		return entry.KeyBytes
+	case btreeElementTypeTuple:
+		key, _ := DecodeKey(entry.KeyBytes)
+		return key
+	}
+
+	if entry.KeyType >= MinCustomKeyTypeId {
+		key, err := decodeCustomKey(entry.KeyType, entry.KeyBytes)
+
+		if err == nil {
+			return key
+		}
+	}
+
+	return nil
+}
+
+// Get the entry's key encoded with EncodeKey
+func (entry *LSMEntry) EncodedKey() ([]byte) {
+	if entry.KeyType == btreeElementTypeTuple {
+		return entry.KeyBytes
+	}
+
+	if entry.encodedKey == nil {
+		entry.encodedKey, _ = EncodeKey(entry.GetKey())
+	}
+
+	return entry.encodedKey
+}
+
+// Compare the entry's key with the supplied key
+func (entry *LSMEntry) CompareKey(key interface{}) (int) {
+	encoded, _ := EncodeKey(key)
+
+	return entry.compareEncodedKey(encoded)
+}
+
+// Compare the entry's key with a key already encoded with EncodeKey, so a key
+// Compared with many entries is only encoded once
+func (entry *LSMEntry) compareEncodedKey(encoded []byte) (int) {
+	return compareEncodedKeys(entry.EncodedKey(), encoded)
+}
+
+// A node of the memtable's skiplist, linked to the node after it at each of
+// Its levels
+type lsmMemtableNode struct {
+	entry LSMEntry
+	next  []*lsmMemtableNode
+}
+
+// The in-memory sorted table new entries are written to before being flushed.
+// Entries are kept in a skiplist so writes stay logarithmic as it fills
+type lsmMemtable struct {
+	head   *lsmMemtableNode
+	level  int
+	length int
+	random *rand.Rand
+}
+
+// Construct an empty memtable
+func newLSMMemtable() (*lsmMemtable) {
+	return &lsmMemtable{
+		head:   &lsmMemtableNode{next: make([]*lsmMemtableNode, lsmMemtableMaxLevel)},
+		level:  1,
+		random: rand.New(rand.NewSource(1)),
+	}
+}
+
+// Add an entry, replacing any existing entry for the same key
+func (memtable *lsmMemtable) Put(entry LSMEntry) {
+	key := entry.EncodedKey()
+	previous := make([]*lsmMemtableNode, lsmMemtableMaxLevel)
+	node := memtable.head
+
+	for level := memtable.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].entry.compareEncodedKey(key) < 0 {
+			node = node.next[level]
+		}
+
+		previous[level] = node
+	}
+
+	if next := node.next[0]; next != nil && next.entry.compareEncodedKey(key) == 0 {
+		next.entry = entry
+		return
+	}
+
+	height := memtable.randomHeight()
+
+	for memtable.level < height {
+		previous[memtable.level] = memtable.head
+		memtable.level++
+	}
+
+	inserted := &lsmMemtableNode{entry: entry, next: make([]*lsmMemtableNode, height)}
+
+	for level := 0; level < height; level++ {
+		inserted.next[level] = previous[level].next[level]
+		previous[level].next[level] = inserted
+	}
+
+	memtable.length++
+}
+
+// Get the entry for a key, including tombstones
+func (memtable *lsmMemtable) Get(key interface{}) (LSMEntry, bool) {
+	encoded, _ := EncodeKey(key)
+	node := memtable.search(encoded)
+
+	if node != nil && node.entry.compareEncodedKey(encoded) == 0 {
+		return node.entry, true
+	}
+
+	return LSMEntry{}, false
+}
+
+// The number of entries in the memtable
+func (memtable *lsmMemtable) Len() (int) {
+	return memtable.length
+}
+
+// Every entry in key order
+func (memtable *lsmMemtable) Entries() ([]LSMEntry) {
+	entries := make([]LSMEntry, 0, memtable.length)
+
+	for node := memtable.head.next[0]; node != nil; node = node.next[0] {
+		entries = append(entries, node.entry)
+	}
+
+	return entries
+}
+
+// The first node with a key not less than the encoded key, nil if there is
+// None. A nil key finds the first node
+func (memtable *lsmMemtable) search(encoded []byte) (*lsmMemtableNode) {
+	node := memtable.head
+
+	for level := memtable.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].entry.compareEncodedKey(encoded) < 0 {
+			node = node.next[level]
+		}
+	}
+
+	return node.next[0]
+}
+
+// Pick the height of a new node, each level is a quarter as likely as the one
+// Below it
+func (memtable *lsmMemtable) randomHeight() (int) {
+	height := 1
+
+	for height < lsmMemtableMaxLevel && memtable.random.Intn(4) == 0 {
+		height++
+	}
+
+	return height
+}
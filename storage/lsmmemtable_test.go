@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestNewLSMEntry(t *testing.T) {
+	entry := NewLSMEntry("key", int64(10), true)
+
+	if entry.KeyType != btreeElementTypeString || entry.KeyString != "key" {
+		t.Error("key not injected correctly")
+	}
+
+	if entry.Location != 10 || !entry.Deleted {
+		t.Error("location or deleted flag not injected correctly")
+	}
+
+	if entry.GetKey() != "key" {
+		t.Error("GetKey did not return the string key, got:", entry.GetKey())
+	}
+
+	entry = NewLSMEntry(int32(1), int64(10), false)
+
+	if entry.KeyType != btreeElementTypeUnset {
+		t.Error("unsupported key type was not left unset")
+	}
+}
+
+func TestLSMMemtable_PutGet(t *testing.T) {
+	memtable := newLSMMemtable()
+
+	for _, key := range []int64{5, 1, 3, 2, 4} {
+		memtable.Put(NewLSMEntry(key, key*10, false))
+	}
+
+	if memtable.Len() != 5 {
+		t.Error("expected 5 entries, got:", memtable.Len())
+	}
+
+	for i, entry := range memtable.Entries() {
+		if entry.KeyInt != int64(i+1) {
+			t.Error("memtable entries are not sorted, found", entry.KeyInt, "at", i)
+		}
+	}
+
+	// Replacing a key should not add a new entry
+	memtable.Put(NewLSMEntry(int64(3), int64(0), true))
+
+	if memtable.Len() != 5 {
+		t.Error("replacing an entry changed the length to:", memtable.Len())
+	}
+
+	entry, found := memtable.Get(int64(3))
+
+	if !found || !entry.Deleted {
+		t.Error("did not get the replacement tombstone for key 3")
+	}
+
+	_, found = memtable.Get(int64(6))
+
+	if found {
+		t.Error("found a key which was never added")
+	}
+}
+
+func TestLSMMemtable_PutManyKeys(t *testing.T) {
+	memtable := newLSMMemtable()
+	keys := rand.New(rand.NewSource(7)).Perm(10000)
+
+	for _, key := range keys {
+		memtable.Put(NewLSMEntry(int64(key), int64(key)*10, false))
+	}
+
+	if memtable.Len() != len(keys) || memtable.level < 2 {
+		t.Error("expected every key in a skiplist of several levels, got:", memtable.Len(), memtable.level)
+	}
+
+	for i, entry := range memtable.Entries() {
+		if entry.KeyInt != int64(i) {
+			t.Fatal("memtable entries are not sorted, found", entry.KeyInt, "at", i)
+		}
+	}
+
+	for _, key := range keys {
+		entry, found := memtable.Get(int64(key))
+		if !found || entry.Location != int64(key)*10 {
+			t.Error("did not get key", key, "got:", entry, found)
+		}
+	}
+
+	encoded, _ := EncodeKey(int64(5000))
+	node := memtable.search(encoded)
+	if node == nil || node.entry.KeyInt != 5000 || memtable.search(nil) != memtable.head.next[0] {
+		t.Error("search did not find the first node at or after the key")
+	}
+}
+
+func TestLSMEntry_EncodedKey(t *testing.T) {
+	entry := NewLSMEntry("abc", int64(10), false)
+
+	encoded, err := EncodeKey("abc")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if compareEncodedKeys(entry.EncodedKey(), encoded) != 0 {
+		t.Error("did not encode the entry's key")
+	}
+
+	if entry.encodedKey == nil {
+		t.Error("encoded key was not kept for the next comparison")
+	}
+
+	if entry.CompareKey("abd") != -1 || entry.CompareKey("abc") != 0 || entry.CompareKey("abb") != 1 {
+		t.Error("did not compare the entry's key by its encoding")
+	}
+}
@@ -0,0 +1,429 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+var (
+	LSMRunReadError          = gataerrors.NewGataError("unable to read sorted run")
+	LSMRunDeserialiseError   = gataerrors.NewGataError("unable to deserialise sorted run")
+	LSMRunStoreNotFoundError = gataerrors.NewGataError("sorted run does not exist in the run store")
+	lsmRunWriteError         = gataerrors.NewGataError("unable to write sorted run")
+	lsmRunStoreError         = gataerrors.NewGataError("unable to access sorted run file")
+)
+
+// Where an lsm tree creates, opens and removes the files of its sorted runs
+// Each run is an ImmutableFile, entries go in the data handle and the sparse
+// Index and bloom filter go in the index handle. A store may encrypt the files
+// It returns, which encrypts the index handle as well as the entries
+type LSMRunStore interface {
+	Create(id int64) (ImmutableFile, error)
+	Open(id int64) (ImmutableFile, error)
+	Remove(id int64) error
+}
+
+// An entry in a run's sparse index, the first key of a block and its location
+type lsmRunBlock struct {
+	FirstKey LSMEntry
+	Location int64
+}
+
+// The contents of a run's index handle
+type lsmRunIndex struct {
+	Blocks     []lsmRunBlock
+	LastKey    LSMEntry
+	EntryCount int64
+	Bloom      []byte
+}
+
+// An immutable sorted run of entries written by a flush or compaction
+type lsmRun struct {
+	Id    int64
+	file  ImmutableFile
+	index lsmRunIndex
+	bloom *BloomFilter
+}
+
+// Writes sorted entries into a new run a block at a time
+type lsmRunWriter struct {
+	id              int64
+	file            ImmutableFile
+	entriesPerBlock int
+	block           []LSMEntry
+	index           lsmRunIndex
+	bloom           *BloomFilter
+}
+
+// Construct a writer for a new run in file, expectedEntries sizes the bloom
+// Filter and may be an over estimate
+func newLSMRunWriter(id int64, file ImmutableFile, expectedEntries uint64, entriesPerBlock int, falsePositiveRate float64) (*lsmRunWriter) {
+	return &lsmRunWriter{
+		id:              id,
+		file:            file,
+		entriesPerBlock: entriesPerBlock,
+		block:           make([]LSMEntry, 0, entriesPerBlock),
+		index:           lsmRunIndex{Blocks: make([]lsmRunBlock, 0)},
+		bloom:           NewBloomFilter(expectedEntries, falsePositiveRate),
+	}
+}
+
+// Add the next entry, entries must be added in key order
+func (writer *lsmRunWriter) Add(entry LSMEntry) (error) {
+	writer.block = append(writer.block, entry)
+	writer.bloom.Add(bloomKey(entry.GetKey()))
+	writer.index.LastKey = entry
+	writer.index.EntryCount++
+
+	if len(writer.block) >= writer.entriesPerBlock {
+		return writer.writeBlock()
+	}
+
+	return nil
+}
+
+// Write any remaining entries and the index, returns nil if no entries were
+// Added as there is nothing worth keeping
+func (writer *lsmRunWriter) Finish() (*lsmRun, error) {
+	err := writer.writeBlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if writer.index.EntryCount == 0 {
+		return nil, nil
+	}
+
+	writer.index.Bloom = writer.bloom.Serialise()
+
+	serialised, err := serialiseLSMRecord(writer.index)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The sparse index holds keys and the bloom filter can confirm them, so
+	// They are encrypted along with the blocks
+	if writer.file.encryption != nil {
+		serialised, err = writer.file.encryption.seal(serialised)
+
+		if err != nil {
+			return nil, lsmRunWriteError.SetUnderlying(err)
+		}
+	}
+
+	_, err = writer.file.IndexHandle.Write(serialised)
+
+	if err != nil {
+		return nil, lsmRunWriteError.SetUnderlying(err)
+	}
+
+	// Runs are never written to once finished
+	writer.file.Seal()
+
+	return &lsmRun{
+		Id:    writer.id,
+		file:  writer.file,
+		index: writer.index,
+		bloom: writer.bloom,
+	}, nil
+}
+
+// Write the buffered entries as a block and add it to the sparse index
+func (writer *lsmRunWriter) writeBlock() (error) {
+	if len(writer.block) == 0 {
+		return nil
+	}
+
+	serialised, err := serialiseLSMRecord(writer.block)
+
+	if err != nil {
+		return err
+	}
+
+	// Blocks are appended as records so they are checksummed and compressed
+	// With the file's Codec
+	location, err := writer.file.Append(serialised)
+
+	if err != nil {
+		return lsmRunWriteError.SetUnderlying(err)
+	}
+
+	writer.index.Blocks = append(writer.index.Blocks, lsmRunBlock{
+		FirstKey: writer.block[0],
+		Location: location,
+	})
+
+	writer.block = make([]LSMEntry, 0, writer.entriesPerBlock)
+
+	return nil
+}
+
+// Open a run previously written to file
+func openLSMRun(id int64, file ImmutableFile) (*lsmRun, error) {
+	_, err := file.IndexHandle.Seek(0, io.SeekStart)
+
+	if err != nil {
+		return nil, LSMRunReadError.SetUnderlying(err)
+	}
+
+	file.Seal()
+	run := &lsmRun{Id: id, file: file}
+	var reader io.Reader = file.IndexHandle
+
+	if file.encryption != nil {
+		sealed, err := ioutil.ReadAll(file.IndexHandle)
+
+		if err != nil {
+			return nil, LSMRunReadError.SetUnderlying(err)
+		}
+
+		serialised, err := file.encryption.open(sealed)
+
+		if err != nil {
+			return nil, LSMRunDeserialiseError.SetUnderlying(err)
+		}
+
+		reader = bytes.NewReader(serialised)
+	}
+
+	err = deserialiseLSMRecord(reader, &run.index)
+
+	if err != nil {
+		return nil, err
+	}
+
+	run.bloom, err = DeserialiseBloomFilter(bytes.NewReader(run.index.Bloom))
+
+	if err != nil {
+		return nil, LSMRunDeserialiseError.SetUnderlying(err)
+	}
+
+	return run, nil
+}
+
+// Get the entry for a key, including tombstones
+func (run *lsmRun) Get(key interface{}) (LSMEntry, bool, error) {
+	if !run.bloom.MayContain(bloomKey(key)) {
+		return LSMEntry{}, false, nil
+	}
+
+	encoded, _ := EncodeKey(key)
+
+	// The last block whose first key is not more than the key
+	block := sort.Search(len(run.index.Blocks), func(i int) bool {
+		return run.index.Blocks[i].FirstKey.compareEncodedKey(encoded) > 0
+	}) - 1
+
+	if block < 0 || run.index.LastKey.compareEncodedKey(encoded) < 0 {
+		return LSMEntry{}, false, nil
+	}
+
+	entries, err := run.readBlock(block)
+
+	if err != nil {
+		return LSMEntry{}, false, err
+	}
+
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].compareEncodedKey(encoded) >= 0
+	})
+
+	if i < len(entries) && entries[i].compareEncodedKey(encoded) == 0 {
+		return entries[i], true, nil
+	}
+
+	return LSMEntry{}, false, nil
+}
+
+// Read the entries of a block
+func (run *lsmRun) readBlock(block int) ([]LSMEntry, error) {
+	serialised, err := run.file.ReadAt(run.index.Blocks[block].Location)
+
+	if err != nil {
+		return nil, LSMRunReadError.SetUnderlying(err)
+	}
+
+	entries := make([]LSMEntry, 0)
+
+	err = deserialiseLSMRecord(bytes.NewReader(serialised), &entries)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// Gob encode a value prefixed with its padded length
+func serialiseLSMRecord(value interface{}) ([]byte, error) {
+	buffer := bytes.Buffer{}
+	err := gob.NewEncoder(&buffer).Encode(value)
+
+	if err != nil {
+		return nil, lsmRunWriteError.SetUnderlying(err)
+	}
+
+	serialised := []byte(fmt.Sprintf("%0"+strconv.Itoa(btreeNodeLengthLocationPadLength)+"d", buffer.Len()))
+	serialised = append(serialised, buffer.Bytes()...)
+
+	return serialised, nil
+}
+
+// Decode a record written by serialiseLSMRecord from the current position
+func deserialiseLSMRecord(reader io.Reader, value interface{}) (error) {
+	lengthString := make([]byte, btreeNodeLengthLocationPadLength)
+	_, err := io.ReadFull(reader, lengthString)
+
+	if err != nil {
+		return LSMRunReadError.SetUnderlying(err)
+	}
+
+	length, err := strconv.ParseInt(string(lengthString), 10, 64)
+
+	if err != nil {
+		return LSMRunDeserialiseError.SetUnderlying(err)
+	}
+
+	serialised := make([]byte, length)
+	_, err = io.ReadFull(reader, serialised)
+
+	if err != nil {
+		return LSMRunReadError.SetUnderlying(err)
+	}
+
+	err = gob.NewDecoder(bytes.NewReader(serialised)).Decode(value)
+
+	if err != nil {
+		return LSMRunDeserialiseError.SetUnderlying(err)
+	}
+
+	return nil
+}
+
+// A run store which keeps every run in memory
+type MemoryLSMRunStore struct {
+	runs map[int64]ImmutableFile
+}
+
+// Construct an empty in-memory run store
+func NewMemoryLSMRunStore() (*MemoryLSMRunStore) {
+	return &MemoryLSMRunStore{runs: make(map[int64]ImmutableFile)}
+}
+
+// Create an empty in-memory run
+func (store *MemoryLSMRunStore) Create(id int64) (ImmutableFile, error) {
+	file, err := NewMemoryImmutableFile(make([]byte, 0), make([]byte, 0))
+
+	if err != nil {
+		return file, err
+	}
+
+	store.runs[id] = file
+
+	return file, nil
+}
+
+// Open an existing in-memory run
+func (store *MemoryLSMRunStore) Open(id int64) (ImmutableFile, error) {
+	file, ok := store.runs[id]
+
+	if !ok {
+		return file, LSMRunStoreNotFoundError
+	}
+
+	return file, nil
+}
+
+// Remove an in-memory run
+func (store *MemoryLSMRunStore) Remove(id int64) (error) {
+	delete(store.runs, id)
+
+	return nil
+}
+
+// A run store which keeps each run as a pair of files in a directory
+type FileLSMRunStore struct {
+	Directory string
+	// The filesystem the directory is in, nil for the one on disk
+	FileSystem FileSystem
+}
+
+// Construct a run store in directory, which must already exist
+func NewFileLSMRunStore(directory string) (*FileLSMRunStore) {
+	return &FileLSMRunStore{Directory: directory}
+}
+
+// Create the files for a new run
+func (store *FileLSMRunStore) Create(id int64) (ImmutableFile, error) {
+	return store.open(id, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+}
+
+// Open the files of an existing run
+func (store *FileLSMRunStore) Open(id int64) (ImmutableFile, error) {
+	return store.open(id, os.O_RDWR)
+}
+
+// Remove the files of a run
+func (store *FileLSMRunStore) Remove(id int64) (error) {
+	for _, path := range []string{store.path(id), store.path(id) + ImmutableFileIndexExtension} {
+		err := store.fileSystem().Remove(path)
+
+		if err != nil && !FileSystemNotFoundError.IsSame(err) {
+			return lsmRunStoreError.SetUnderlying(err)
+		}
+	}
+
+	return nil
+}
+
+// Open the data and index file of a run with flag
+func (store *FileLSMRunStore) open(id int64, flag int) (ImmutableFile, error) {
+	file := ImmutableFile{durability: newDurabilityState()}
+
+	dataHandle, err := store.fileSystem().OpenFile(store.path(id), flag)
+
+	if FileSystemNotFoundError.IsSame(err) {
+		return file, LSMRunStoreNotFoundError.SetUnderlying(err)
+	}
+
+	if err != nil {
+		return file, lsmRunStoreError.SetUnderlying(err)
+	}
+
+	indexHandle, err := store.fileSystem().OpenFile(store.path(id)+ImmutableFileIndexExtension, flag)
+
+	if err != nil {
+		dataHandle.Close()
+		return file, lsmRunStoreError.SetUnderlying(err)
+	}
+
+	file.DataHandle = dataHandle
+	file.IndexHandle = indexHandle
+	file.ReadHandle = openImmutableFileReadHandle(store.fileSystem(), store.path(id))
+
+	return file, nil
+}
+
+// The filesystem the runs are kept in
+func (store *FileLSMRunStore) fileSystem() (FileSystem) {
+	if store.FileSystem == nil {
+		return OSFileSystem{}
+	}
+
+	return store.FileSystem
+}
+
+// The path of a run's data file
+func (store *FileLSMRunStore) path(id int64) (string) {
+	return filepath.Join(store.Directory, fmt.Sprintf("%020d.run", id))
+}
@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"testing"
+	"io/ioutil"
+	"os"
+)
+
+func TestLSMRunWriter(t *testing.T) {
+	store := NewMemoryLSMRunStore()
+
+	file, err := store.Create(1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	writer := newLSMRunWriter(1, file, 10, 3, 0.01)
+
+	for key := int64(0); key < 10; key++ {
+		err = writer.Add(NewLSMEntry(key*2, key*20, key == 4))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	run, err := writer.Finish()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(run.index.Blocks) != 4 {
+		t.Error("expected 4 blocks of 3 entries, got:", len(run.index.Blocks))
+	}
+
+	if run.index.EntryCount != 10 {
+		t.Error("expected 10 entries, got:", run.index.EntryCount)
+	}
+
+	// Reopen the run from the store
+	file, err = store.Open(1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	opened, err := openLSMRun(1, file)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for key := int64(0); key < 10; key++ {
+		entry, found, err := opened.Get(key * 2)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if !found || entry.Location != key*20 {
+			t.Error("did not find expected location", key*20, "for key", key*2)
+		}
+
+		if entry.Deleted != (key == 4) {
+			t.Error("deleted flag not persisted for key", key*2)
+		}
+
+		_, found, err = opened.Get(key*2 + 1)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if found {
+			t.Error("found key", key*2+1, "which was never written")
+		}
+	}
+
+	// A writer with no entries should not produce a run
+	file, err = store.Create(2)
+	if err != nil {
+		t.Error(err)
+	}
+
+	run, err = newLSMRunWriter(2, file, 10, 3, 0.01).Finish()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if run != nil {
+		t.Error("empty writer produced a run")
+	}
+}
+
+func TestMemoryLSMRunStore(t *testing.T) {
+	store := NewMemoryLSMRunStore()
+
+	_, err := store.Open(1)
+	if !LSMRunStoreNotFoundError.IsSame(err) {
+		t.Error("did not get expected error when opening a missing run")
+	}
+
+	_, err = store.Create(1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = store.Open(1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = store.Remove(1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = store.Open(1)
+	if !LSMRunStoreNotFoundError.IsSame(err) {
+		t.Error("run was not removed")
+	}
+}
+
+func TestFileLSMRunStore(t *testing.T) {
+	directory, err := ioutil.TempDir("", "gatabase")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(directory)
+
+	store := NewFileLSMRunStore(directory)
+
+	_, err = store.Open(1)
+	if !LSMRunStoreNotFoundError.IsSame(err) {
+		t.Error("did not get expected error when opening a missing run")
+	}
+
+	file, err := store.Create(1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	writer := newLSMRunWriter(1, file, 1, 3, 0.01)
+
+	err = writer.Add(NewLSMEntry("key", int64(10), false))
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = writer.Finish()
+	if err != nil {
+		t.Error(err)
+	}
+
+	file, err = store.Open(1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	run, err := openLSMRun(1, file)
+	if err != nil {
+		t.Error(err)
+	}
+
+	entry, found, err := run.Get("key")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !found || entry.Location != 10 {
+		t.Error("did not read back the entry written to the run file")
+	}
+
+	err = store.Remove(1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = store.Open(1)
+	if !LSMRunStoreNotFoundError.IsSame(err) {
+		t.Error("run files were not removed")
+	}
+}
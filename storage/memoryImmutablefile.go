@@ -4,17 +4,19 @@ import (
 	"io"
 	"errors"
 	"fmt"
+	"sync"
 )
 
-// A memory based file handle
+// A memory based file handle, safe to use from several goroutines
 type MemoryFileHandle struct {
 	data    []byte
 	pointer int64
+	mutex   sync.RWMutex
 }
 
 // Construct a in-memory immutable file
 func NewMemoryImmutableFile(content []byte, index []byte) (ImmutableFile, error) {
-	file := ImmutableFile{}
+	file := ImmutableFile{durability: newDurabilityState()}
 
 	file.DataHandle = NewMemoryFileHandle(content)
 	file.IndexHandle = NewMemoryFileHandle(index)
@@ -29,6 +31,9 @@ func NewMemoryFileHandle(content []byte) (*MemoryFileHandle) {
 
 // Read from the memory handle after the current pointer location
 func (handle *MemoryFileHandle) Read(p []byte) (n int, err error) {
+	handle.mutex.Lock()
+	defer handle.mutex.Unlock()
+
 	// Ask for nothing get nothing
 	if len(p) == 0 {
 		return 0, nil
@@ -48,7 +53,7 @@ func (handle *MemoryFileHandle) Read(p []byte) (n int, err error) {
 	var end int64
 
 	if int(int64(len(handle.data))-handle.pointer) < len(p) {
-		end = int64(len(handle.data)) - handle.pointer
+		end = int64(len(handle.data))
 	} else {
 		end = handle.pointer + int64(len(p))
 	}
@@ -67,26 +72,28 @@ func (handle *MemoryFileHandle) Read(p []byte) (n int, err error) {
 
 // Write to the memory handle after the current pointer location
 func (handle *MemoryFileHandle) Write(p []byte) (n int, err error) {
+	handle.mutex.Lock()
+	defer handle.mutex.Unlock()
 
 	// If the capacity of the internal data structure needs to grow to
-	// accommodate the new data, increase the capacity
-	if handle.pointer + int64(len(p)) > int64(cap(handle.data)) {
-		newData := make([]byte, handle.pointer + int64(len(p)))
-		copy(newData, handle.data)
-		handle.data = newData
+	// accommodate the new data, increase the capacity. append grows it in
+	// proportion to its size so appending many records stays linear
+	if handle.pointer + int64(len(p)) > int64(len(handle.data)) {
+		handle.data = append(handle.data, make([]byte, handle.pointer+int64(len(p))-int64(len(handle.data)))...)
 	}
 
 	// Write the bytes to the handle's data structure
-	for n = 0; n < len(p); n++ {
-		handle.data[handle.pointer] = p[n]
-		handle.pointer += 1
-	}
+	n = copy(handle.data[handle.pointer:], p)
+	handle.pointer += int64(n)
 
 	return n, nil
 }
 
 // Seek the memory handle's pointer to a new location
 func (handle *MemoryFileHandle) Seek(offset int64, whence int) (int64, error) {
+	handle.mutex.Lock()
+	defer handle.mutex.Unlock()
+
 	switch whence {
 	case io.SeekStart:
 		// From beginning
@@ -95,11 +102,95 @@ func (handle *MemoryFileHandle) Seek(offset int64, whence int) (int64, error) {
 		// From current pointer location
 		handle.pointer += offset
 	case io.SeekEnd:
-		// Back from end
-		handle.pointer = int64(len(handle.data)) - offset
+		// Relative to the end, negative offsets move back into the data
+		handle.pointer = int64(len(handle.data)) + offset
 	default:
 		return 0, errors.New(fmt.Sprintf("invalid whence supplied %d", whence))
 	}
 
 	return handle.pointer, nil
 }
+
+// Cut the memory handle's data down to size bytes, or grow it with zeroes
+func (handle *MemoryFileHandle) Truncate(size int64) (error) {
+	handle.mutex.Lock()
+	defer handle.mutex.Unlock()
+
+	if size < 0 {
+		return errors.New(fmt.Sprintf("invalid truncate size supplied %d", size))
+	}
+
+	if size <= int64(len(handle.data)) {
+		handle.data = handle.data[:size]
+	} else {
+		newData := make([]byte, size)
+		copy(newData, handle.data)
+		handle.data = newData
+	}
+
+	return nil
+}
+
+// Memory is never durable so there is nothing to sync
+func (handle *MemoryFileHandle) Sync() (error) {
+	return nil
+}
+
+// Read len(p) bytes from offset without moving the pointer, returning io.EOF
+// If there are fewer
+func (handle *MemoryFileHandle) ReadAt(p []byte, offset int64) (n int, err error) {
+	if offset < 0 {
+		return 0, errors.New(fmt.Sprintf("invalid offset supplied %d", offset))
+	}
+
+	handle.mutex.RLock()
+	defer handle.mutex.RUnlock()
+
+	if offset >= int64(len(handle.data)) {
+		if len(p) == 0 {
+			return 0, nil
+		}
+
+		return 0, io.EOF
+	}
+
+	n = copy(p, handle.data[offset:])
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// Write p at offset without moving the pointer, growing the data with zeroes
+// If offset is past the end
+func (handle *MemoryFileHandle) WriteAt(p []byte, offset int64) (n int, err error) {
+	if offset < 0 {
+		return 0, errors.New(fmt.Sprintf("invalid offset supplied %d", offset))
+	}
+
+	handle.mutex.Lock()
+	defer handle.mutex.Unlock()
+
+	if offset+int64(len(p)) > int64(len(handle.data)) {
+		newData := make([]byte, offset+int64(len(p)))
+		copy(newData, handle.data)
+		handle.data = newData
+	}
+
+	return copy(handle.data[offset:], p), nil
+}
+
+// The number of bytes in the handle
+func (handle *MemoryFileHandle) Size() (int64) {
+	handle.mutex.RLock()
+	defer handle.mutex.RUnlock()
+
+	return int64(len(handle.data))
+}
+
+// The data stays in memory so there is nothing to release
+func (handle *MemoryFileHandle) Close() (error) {
+	return nil
+}
@@ -104,8 +104,8 @@ func TestMemoryFileHandle_Seek(t *testing.T) {
 		t.Error("Did not seek to pointer position 100, got: ", pointerPosition)
 	}
 
-	// Test seeking to 10 bytes from the current position
-	pointerPosition, err = file.Seek(10, io.SeekEnd)
+	// Test seeking to 10 bytes back from the end
+	pointerPosition, err = file.Seek(-10, io.SeekEnd)
 
 	if err != nil {
 		t.Error(err)
@@ -214,3 +214,75 @@ func TestMemoryFileHandle_Write(t *testing.T) {
 		t.Error("read bytes did not match written bytes, expected 'Some written words  ' got: ", string(readBytes))
 	}
 }
+
+func TestMemoryFileHandle_Truncate(t *testing.T) {
+	file := NewMemoryFileHandle([]byte("some content to truncate"))
+
+	err := file.Truncate(4)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(file.data) != "some" {
+		t.Error("did not truncate to 'some', got:", string(file.data))
+	}
+
+	// Writing past the end after truncating should grow the data again
+	_, err = file.Seek(4, io.SeekStart)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = file.Write([]byte(" more"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(file.data) != "some more" {
+		t.Error("did not write after truncating, got:", string(file.data))
+	}
+
+	err = file.Truncate(12)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(file.data) != 12 {
+		t.Error("did not grow to 12 bytes, got:", len(file.data))
+	}
+
+	err = file.Truncate(-1)
+	if err == nil {
+		t.Error("did not get an error when truncating to a negative size")
+	}
+}
+
+func TestMemoryFileHandle_ReadAtWriteAt(t *testing.T) {
+	file := NewMemoryFileHandle([]byte("some content"))
+
+	_, err := file.WriteAt([]byte("more"), 10)
+	if err != nil {
+		t.Error(err)
+	}
+
+	read := make([]byte, 9)
+
+	n, err := file.ReadAt(read, 5)
+	if err != nil || n != 9 || string(read) != "contemore" {
+		t.Error("did not read after writing at an offset, got:", n, string(read), err)
+	}
+
+	n, err = file.ReadAt(read, 10)
+	if err != io.EOF || n != 4 {
+		t.Error("expected a short read to return io.EOF, got:", n, err)
+	}
+
+	pointer, err := file.Seek(0, io.SeekCurrent)
+	if err != nil || pointer != 0 {
+		t.Error("expected ReadAt and WriteAt not to move the pointer, got:", pointer, err)
+	}
+
+	if file.Size() != 14 {
+		t.Error("expected the data to grow to 14 bytes, got:", file.Size())
+	}
+}
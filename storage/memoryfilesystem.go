@@ -0,0 +1,379 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+var (
+	MemoryFileSystemExistsError   = gataerrors.NewGataError("file already exists")
+	MemoryFileSystemClosedError   = gataerrors.NewGataError("file handle has already been closed")
+	MemoryFileSystemReadOnlyError = gataerrors.NewGataError("file handle was opened read only")
+	memoryFileSystemSnapshotError = gataerrors.NewGataError("unable to snapshot memory filesystem")
+)
+
+// A FileSystem held entirely in memory, for tests and ephemeral databases.
+// Directories are implied by the paths of the files in them so never need to
+// Be created
+type MemoryFileSystem struct {
+	files map[string]*MemoryFileHandle
+	locks map[string]*memoryFileSystemLockState
+	mutex sync.Mutex
+}
+
+// A handle to a file in a MemoryFileSystem, each handle has its own pointer
+// While the contents are shared with every other handle to the file
+type memoryFileSystemHandle struct {
+	file     *MemoryFileHandle
+	pointer  int64
+	readOnly bool
+	closed   bool
+}
+
+// The locks held on a path
+type memoryFileSystemLockState struct {
+	exclusive bool
+	shared    int
+}
+
+// A lock held on a path of a MemoryFileSystem
+type memoryFileSystemLock struct {
+	fileSystem *MemoryFileSystem
+	path       string
+	exclusive  bool
+	released   bool
+}
+
+// Construct an empty memory filesystem
+func NewMemoryFileSystem() (*MemoryFileSystem) {
+	return &MemoryFileSystem{
+		files: make(map[string]*MemoryFileHandle),
+		locks: make(map[string]*memoryFileSystemLockState),
+	}
+}
+
+// Load every file below directory on disk into a new memory filesystem, with
+// The paths of the files relative to directory
+func LoadMemoryFileSystem(directory string) (*MemoryFileSystem, error) {
+	fileSystem := NewMemoryFileSystem()
+
+	err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		relative, err := filepath.Rel(directory, path)
+
+		if err != nil {
+			return err
+		}
+
+		data, err := ioutil.ReadFile(path)
+
+		if err != nil {
+			return err
+		}
+
+		fileSystem.files[filepath.Clean(relative)] = NewMemoryFileHandle(data)
+
+		return nil
+	})
+
+	if os.IsNotExist(err) {
+		return nil, FileSystemNotFoundError.SetUnderlying(err)
+	}
+
+	if err != nil {
+		return nil, memoryFileSystemSnapshotError.SetUnderlying(err)
+	}
+
+	return fileSystem, nil
+}
+
+// Create a file, truncating it if it already exists
+func (fileSystem *MemoryFileSystem) Create(path string) (FileHandle, error) {
+	return fileSystem.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+}
+
+// Open a file with flag, supporting os.O_CREATE, os.O_EXCL, os.O_TRUNC and
+// os.O_RDONLY
+func (fileSystem *MemoryFileSystem) OpenFile(path string, flag int) (FileHandle, error) {
+	fileSystem.mutex.Lock()
+	defer fileSystem.mutex.Unlock()
+
+	path = filepath.Clean(path)
+	file, exists := fileSystem.files[path]
+
+	if exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+		return nil, MemoryFileSystemExistsError.SetUnderlying(errors.New(path))
+	}
+
+	if !exists {
+		if flag&os.O_CREATE == 0 {
+			return nil, FileSystemNotFoundError.SetUnderlying(errors.New(path))
+		}
+
+		file = NewMemoryFileHandle(make([]byte, 0))
+		fileSystem.files[path] = file
+	}
+
+	readOnly := flag&(os.O_WRONLY|os.O_RDWR) == 0
+
+	if flag&os.O_TRUNC != 0 && !readOnly {
+		file.Truncate(0)
+	}
+
+	return &memoryFileSystemHandle{file: file, readOnly: readOnly}, nil
+}
+
+// Move a file, handles already open keep referring to it
+func (fileSystem *MemoryFileSystem) Rename(from string, to string) (error) {
+	fileSystem.mutex.Lock()
+	defer fileSystem.mutex.Unlock()
+
+	from = filepath.Clean(from)
+	file, exists := fileSystem.files[from]
+
+	if !exists {
+		return FileSystemNotFoundError.SetUnderlying(errors.New(from))
+	}
+
+	delete(fileSystem.files, from)
+	fileSystem.files[filepath.Clean(to)] = file
+
+	return nil
+}
+
+// Remove a file, handles already open can still use it
+func (fileSystem *MemoryFileSystem) Remove(path string) (error) {
+	fileSystem.mutex.Lock()
+	defer fileSystem.mutex.Unlock()
+
+	path = filepath.Clean(path)
+
+	if _, exists := fileSystem.files[path]; !exists {
+		return FileSystemNotFoundError.SetUnderlying(errors.New(path))
+	}
+
+	delete(fileSystem.files, path)
+
+	return nil
+}
+
+// The names of the files directly inside directory, sorted
+func (fileSystem *MemoryFileSystem) List(directory string) ([]string, error) {
+	fileSystem.mutex.Lock()
+	defer fileSystem.mutex.Unlock()
+
+	directory = filepath.Clean(directory)
+	names := make([]string, 0)
+
+	for path := range fileSystem.files {
+		if filepath.Dir(path) == directory {
+			names = append(names, filepath.Base(path))
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Cut a file down to size bytes, or grow it with zeroes
+func (fileSystem *MemoryFileSystem) Truncate(path string, size int64) (error) {
+	fileSystem.mutex.Lock()
+	defer fileSystem.mutex.Unlock()
+
+	path = filepath.Clean(path)
+	file, exists := fileSystem.files[path]
+
+	if !exists {
+		return FileSystemNotFoundError.SetUnderlying(errors.New(path))
+	}
+
+	return file.Truncate(size)
+}
+
+// Take a lock on path, which works like a flock but only between users of
+// This filesystem. The path does not need to be a file
+func (fileSystem *MemoryFileSystem) Lock(path string, exclusive bool) (FileSystemLock, error) {
+	fileSystem.mutex.Lock()
+	defer fileSystem.mutex.Unlock()
+
+	path = filepath.Clean(path)
+	state, exists := fileSystem.locks[path]
+
+	if !exists {
+		state = &memoryFileSystemLockState{}
+		fileSystem.locks[path] = state
+	}
+
+	if state.exclusive || (exclusive && state.shared > 0) {
+		return nil, FileLockInUseError.SetUnderlying(fmt.Errorf("unable to lock %s", path))
+	}
+
+	if exclusive {
+		state.exclusive = true
+	} else {
+		state.shared++
+	}
+
+	return &memoryFileSystemLock{fileSystem: fileSystem, path: path, exclusive: exclusive}, nil
+}
+
+// Write every file to the same path below directory on disk, creating any
+// Directories needed. The snapshot can be loaded with LoadMemoryFileSystem
+func (fileSystem *MemoryFileSystem) Snapshot(directory string) (error) {
+	fileSystem.mutex.Lock()
+	defer fileSystem.mutex.Unlock()
+
+	for path, file := range fileSystem.files {
+		destination := filepath.Join(directory, path)
+		err := os.MkdirAll(filepath.Dir(destination), 0777)
+
+		if err != nil {
+			return memoryFileSystemSnapshotError.SetUnderlying(err)
+		}
+
+		file.mutex.RLock()
+		err = ioutil.WriteFile(destination, file.data, 0666)
+		file.mutex.RUnlock()
+
+		if err != nil {
+			return memoryFileSystemSnapshotError.SetUnderlying(err)
+		}
+	}
+
+	return nil
+}
+
+// Release the lock
+func (lock *memoryFileSystemLock) Unlock() (error) {
+	lock.fileSystem.mutex.Lock()
+	defer lock.fileSystem.mutex.Unlock()
+
+	if lock.released {
+		return nil
+	}
+
+	lock.released = true
+	state := lock.fileSystem.locks[lock.path]
+
+	if lock.exclusive {
+		state.exclusive = false
+	} else {
+		state.shared--
+	}
+
+	if !state.exclusive && state.shared == 0 {
+		delete(lock.fileSystem.locks, lock.path)
+	}
+
+	return nil
+}
+
+// Read from the file after the handle's pointer
+func (handle *memoryFileSystemHandle) Read(p []byte) (n int, err error) {
+	if handle.closed {
+		return 0, MemoryFileSystemClosedError
+	}
+
+	n, err = handle.file.ReadAt(p, handle.pointer)
+	handle.pointer += int64(n)
+
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+
+	return n, err
+}
+
+// Write to the file at the handle's pointer
+func (handle *memoryFileSystemHandle) Write(p []byte) (n int, err error) {
+	n, err = handle.WriteAt(p, handle.pointer)
+	handle.pointer += int64(n)
+
+	return n, err
+}
+
+// Seek the handle's pointer to a new location
+func (handle *memoryFileSystemHandle) Seek(offset int64, whence int) (int64, error) {
+	if handle.closed {
+		return 0, MemoryFileSystemClosedError
+	}
+
+	switch whence {
+	case io.SeekStart:
+		handle.pointer = offset
+	case io.SeekCurrent:
+		handle.pointer += offset
+	case io.SeekEnd:
+		handle.pointer = handle.file.Size() + offset
+	default:
+		return 0, errors.New(fmt.Sprintf("invalid whence supplied %d", whence))
+	}
+
+	return handle.pointer, nil
+}
+
+// Read from offset without moving the pointer
+func (handle *memoryFileSystemHandle) ReadAt(p []byte, offset int64) (n int, err error) {
+	if handle.closed {
+		return 0, MemoryFileSystemClosedError
+	}
+
+	return handle.file.ReadAt(p, offset)
+}
+
+// Write at offset without moving the pointer
+func (handle *memoryFileSystemHandle) WriteAt(p []byte, offset int64) (n int, err error) {
+	if handle.closed {
+		return 0, MemoryFileSystemClosedError
+	}
+
+	if handle.readOnly {
+		return 0, MemoryFileSystemReadOnlyError
+	}
+
+	return handle.file.WriteAt(p, offset)
+}
+
+// Cut the file down to size bytes, or grow it with zeroes
+func (handle *memoryFileSystemHandle) Truncate(size int64) (error) {
+	if handle.closed {
+		return MemoryFileSystemClosedError
+	}
+
+	if handle.readOnly {
+		return MemoryFileSystemReadOnlyError
+	}
+
+	return handle.file.Truncate(size)
+}
+
+// Memory is never durable so there is nothing to sync
+func (handle *memoryFileSystemHandle) Sync() (error) {
+	if handle.closed {
+		return MemoryFileSystemClosedError
+	}
+
+	return nil
+}
+
+// Close the handle, the file stays in the filesystem
+func (handle *memoryFileSystemHandle) Close() (error) {
+	if handle.closed {
+		return MemoryFileSystemClosedError
+	}
+
+	handle.closed = true
+
+	return nil
+}
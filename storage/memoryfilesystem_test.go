@@ -0,0 +1,323 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMemoryFileSystem(t *testing.T) {
+	var fileSystem FileSystem = NewMemoryFileSystem()
+
+	_, err := fileSystem.OpenFile("/db/missing", os.O_RDWR)
+	if !FileSystemNotFoundError.IsSame(err) {
+		t.Error("expected FileSystemNotFoundError opening a missing file, got:", err)
+	}
+
+	writer, err := fileSystem.Create("/db/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = writer.Write([]byte("hello world"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = fileSystem.OpenFile("/db/data", os.O_RDWR|os.O_CREATE|os.O_EXCL)
+	if !MemoryFileSystemExistsError.IsSame(err) {
+		t.Error("expected MemoryFileSystemExistsError creating an existing file exclusively, got:", err)
+	}
+
+	// Handles share the contents but each has its own pointer
+	reader, err := fileSystem.OpenFile("/db/data", os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := make([]byte, 5)
+
+	_, err = reader.ReadAt(read, 6)
+	if err != nil || string(read) != "world" {
+		t.Error("did not read at an offset, got:", string(read), err)
+	}
+
+	end, err := reader.Seek(-5, io.SeekEnd)
+	if err != nil || end != 6 {
+		t.Error("expected to seek 5 bytes back from the end to 6, got:", end, err)
+	}
+
+	_, err = reader.Write([]byte("nope"))
+	if !MemoryFileSystemReadOnlyError.IsSame(err) {
+		t.Error("expected MemoryFileSystemReadOnlyError writing a read only handle, got:", err)
+	}
+
+	_, err = writer.WriteAt([]byte("HELLO"), 0)
+	if err != nil {
+		t.Error(err)
+	}
+
+	read = make([]byte, 11)
+
+	_, err = reader.ReadAt(read, 0)
+	if err != nil || string(read) != "HELLO world" {
+		t.Error("did not see the write through another handle, got:", string(read), err)
+	}
+
+	n, err := reader.ReadAt(read, 6)
+	if n != 5 || err != io.EOF {
+		t.Error("expected a short read to return io.EOF, got:", n, err)
+	}
+
+	err = fileSystem.Truncate("/db/data", 5)
+	if err != nil {
+		t.Error(err)
+	}
+
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil || len(contents) != 0 {
+		t.Error("expected nothing after the pointer once truncated, got:", string(contents), err)
+	}
+
+	err = fileSystem.Rename("/db/data", "/db/renamed")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = fileSystem.Create("/db/other")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = fileSystem.Create("/db/nested/file")
+	if err != nil {
+		t.Error(err)
+	}
+
+	names, err := fileSystem.List("/db/")
+	if err != nil || !reflect.DeepEqual(names, []string{"other", "renamed"}) {
+		t.Error("expected to list the files directly in the directory, got:", names, err)
+	}
+
+	err = fileSystem.Remove("/db/other")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = fileSystem.Remove("/db/other")
+	if !FileSystemNotFoundError.IsSame(err) {
+		t.Error("expected FileSystemNotFoundError removing a missing file, got:", err)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = writer.Write([]byte("closed"))
+	if !MemoryFileSystemClosedError.IsSame(err) {
+		t.Error("expected MemoryFileSystemClosedError writing a closed handle, got:", err)
+	}
+}
+
+func TestMemoryFileSystem_Lock(t *testing.T) {
+	fileSystem := NewMemoryFileSystem()
+
+	first, err := fileSystem.Lock("/db/data.lock", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := fileSystem.Lock("/db/data.lock", false)
+	if err != nil {
+		t.Error("expected shared locks to be taken together, got:", err)
+	}
+
+	_, err = fileSystem.Lock("/db/data.lock", true)
+	if !FileLockInUseError.IsSame(err) {
+		t.Error("expected FileLockInUseError taking an exclusive lock while shared, got:", err)
+	}
+
+	first.Unlock()
+	first.Unlock()
+
+	_, err = fileSystem.Lock("/db/data.lock", true)
+	if !FileLockInUseError.IsSame(err) {
+		t.Error("expected the second shared lock to still be held, got:", err)
+	}
+
+	second.Unlock()
+
+	exclusive, err := fileSystem.Lock("/db/data.lock", true)
+	if err != nil {
+		t.Error("expected an exclusive lock once every shared lock was released, got:", err)
+	}
+
+	_, err = fileSystem.Lock("/db/data.lock", false)
+	if !FileLockInUseError.IsSame(err) {
+		t.Error("expected FileLockInUseError taking a shared lock while exclusive, got:", err)
+	}
+
+	exclusive.Unlock()
+}
+
+func TestMemoryFileSystem_Snapshot(t *testing.T) {
+	directory, err := ioutil.TempDir("", "gatabase-memoryfilesystem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	fileSystem := NewMemoryFileSystem()
+
+	file, err := OpenImmutableFile(fileSystem, "db/data", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	location, err := file.Append([]byte("record"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	file.Close()
+
+	err = fileSystem.Snapshot(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The snapshot can be opened on disk
+	onDisk, err := NewImmutableFile(filepath.Join(directory, "db", "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := onDisk.ReadAt(location)
+	if err != nil || string(record) != "record" {
+		t.Error("did not read the record from the snapshot on disk, got:", string(record), err)
+	}
+
+	onDisk.Close()
+
+	loaded, err := LoadMemoryFileSystem(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err = OpenImmutableFile(loaded, "db/data", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	record, err = file.ReadAt(location)
+	if err != nil || string(record) != "record" {
+		t.Error("did not read the record from the loaded snapshot, got:", string(record), err)
+	}
+
+	_, err = LoadMemoryFileSystem(filepath.Join(directory, "missing"))
+	if !FileSystemNotFoundError.IsSame(err) {
+		t.Error("expected FileSystemNotFoundError loading a missing directory, got:", err)
+	}
+}
+
+func TestMemoryFileSystem_Database(t *testing.T) {
+	fileSystem := NewMemoryFileSystem()
+
+	file, err := OpenImmutableFile(fileSystem, "/db/data", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenImmutableFile(fileSystem, "/db/data", true)
+	if !FileLockInUseError.IsSame(err) {
+		t.Error("expected FileLockInUseError reading a file open for writing, got:", err)
+	}
+
+	index, err := OpenBTree(file.IndexHandle, 16, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key := int64(0); key < 10; key++ {
+		location, err := file.Append([]byte{byte(key)})
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = index.Insert(key, location)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	file.Close()
+
+	reopened, err := OpenImmutableFile(fileSystem, "/db/data", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	reopenedIndex, err := OpenBTree(reopened.IndexHandle, 16, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	location, err := reopenedIndex.Find(int64(7))
+	if err != nil {
+		t.Error(err)
+	}
+
+	record, err := reopened.ReadAt(location)
+	if err != nil || len(record) != 1 || record[0] != 7 {
+		t.Error("did not read the record back after reopening, got:", record, err)
+	}
+
+	segments, err := OpenSegmentedFile(&FileSegmentStore{Directory: "/db/segments", FileSystem: fileSystem}, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		_, err = segments.Append([]byte("a segmented record"))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	segments.Close()
+
+	names, err := fileSystem.List("/db/segments")
+	if err != nil || len(names) < 2 {
+		t.Error("expected the segments to roll over in memory, got:", names, err)
+	}
+
+	tree := newTestLSMTree(t, &MemoryFileHandle{}, &FileLSMRunStore{Directory: "/db/runs", FileSystem: fileSystem})
+
+	for key := int64(0); key < 10; key++ {
+		err = tree.Insert(key, key*10)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	err = tree.Flush()
+	if err != nil {
+		t.Error(err)
+	}
+
+	location, err = tree.Find(int64(3))
+	if err != nil || location != 30 {
+		t.Error("did not find the key in a run kept in memory, got:", location, err)
+	}
+
+	names, err = fileSystem.List("/db/runs")
+	if err != nil || len(names) == 0 {
+		t.Error("expected the runs to be written in memory, got:", names, err)
+	}
+}
@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"errors"
+	"fmt"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+var (
+	MmapFileHandleNegativeOffsetError = gataerrors.NewGataError("unable to read before the start of a memory mapped file")
+	mmapFileHandleStatError           = gataerrors.NewGataError("unable to get the size of a memory mapped file")
+	mmapFileHandleUnmapError          = gataerrors.NewGataError("unable to unmap a memory mapped file")
+)
+
+// A handle which can only read a file
+type ReadHandle interface {
+	io.ReadSeeker
+	io.ReaderAt
+	io.Closer
+}
+
+// A reader which can return the next bytes without copying them
+type sliceReader interface {
+	Slice(length int64) ([]byte, error)
+}
+
+// A read only handle to a file which is memory mapped where the platform
+// Supports it, saving a syscall for every read. The mapping grows as the file
+// Is appended to through another handle. When the file cannot be mapped reads
+// Fall back to the regular file handle
+type MmapFileHandle struct {
+	file    *os.File
+	data    []byte
+	pointer int64
+	// Set when mapping fails so reads stop trying and use the file
+	unmappable bool
+}
+
+// Open the file at path for memory mapped reads
+func NewMmapFileHandle(path string) (*MmapFileHandle, error) {
+	handle, err := OpenOSFileHandle(path, os.O_RDONLY)
+
+	if err != nil {
+		return nil, err
+	}
+
+	mmapHandle := &MmapFileHandle{file: handle.File}
+	mmapHandle.mapped(0)
+
+	return mmapHandle, nil
+}
+
+// Whether reads are being served from a memory mapping
+func (handle *MmapFileHandle) IsMapped() (bool) {
+	return handle.data != nil
+}
+
+// Read from the handle after the current pointer location
+func (handle *MmapFileHandle) Read(p []byte) (n int, err error) {
+	n, err = handle.ReadAt(p, handle.pointer)
+	handle.pointer += int64(n)
+
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+
+	return n, err
+}
+
+// Read len(p) bytes from offset without moving the pointer
+func (handle *MmapFileHandle) ReadAt(p []byte, offset int64) (n int, err error) {
+	if offset < 0 {
+		return 0, MmapFileHandleNegativeOffsetError
+	}
+
+	if !handle.mapped(offset + int64(len(p))) {
+		return handle.file.ReadAt(p, offset)
+	}
+
+	return copy(p, handle.data[offset:]), nil
+}
+
+// Return the next length bytes and move the pointer after them. When the file
+// Is mapped the bytes are the mapping itself, so they must not be modified and
+// Are only valid until the next read or Close
+func (handle *MmapFileHandle) Slice(length int64) ([]byte, error) {
+	if handle.pointer >= 0 && length >= 0 && handle.mapped(handle.pointer+length) {
+		slice := handle.data[handle.pointer : handle.pointer+length]
+		handle.pointer += length
+
+		return slice, nil
+	}
+
+	slice := make([]byte, length)
+	_, err := io.ReadFull(handle, slice)
+
+	return slice, err
+}
+
+// Seek the handle's pointer to a new location
+func (handle *MmapFileHandle) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		handle.pointer = offset
+	case io.SeekCurrent:
+		handle.pointer += offset
+	case io.SeekEnd:
+		size, err := handle.size()
+
+		if err != nil {
+			return 0, err
+		}
+
+		handle.pointer = size + offset
+	default:
+		return 0, errors.New(fmt.Sprintf("invalid whence supplied %d", whence))
+	}
+
+	return handle.pointer, nil
+}
+
+// Unmap and close the file, the handle cannot be used afterwards
+func (handle *MmapFileHandle) Close() (error) {
+	err := handle.unmap()
+	closeErr := handle.file.Close()
+
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
+
+// Check the mapping covers up to end, remapping the whole file if it has grown
+// Since it was mapped. Returns false if reads must use the file instead
+func (handle *MmapFileHandle) mapped(end int64) (bool) {
+	if handle.data != nil && end <= int64(len(handle.data)) {
+		return true
+	}
+
+	if handle.unmappable {
+		return false
+	}
+
+	size, err := handle.size()
+
+	// An empty file cannot be mapped and an unchanged one needs no remapping
+	if err != nil || size == 0 || size == int64(len(handle.data)) {
+		return false
+	}
+
+	if handle.unmap() != nil {
+		return false
+	}
+
+	data, err := mmapFile(handle.file, size)
+
+	if err != nil {
+		handle.unmappable = true
+		return false
+	}
+
+	handle.data = data
+
+	return end <= size
+}
+
+// Remove the mapping, reads use the file until it is mapped again
+func (handle *MmapFileHandle) unmap() (error) {
+	if handle.data == nil {
+		return nil
+	}
+
+	err := munmapFile(handle.data)
+
+	if err != nil {
+		return mmapFileHandleUnmapError.SetUnderlying(err)
+	}
+
+	handle.data = nil
+
+	return nil
+}
+
+// The current size of the file
+func (handle *MmapFileHandle) size() (int64, error) {
+	info, err := handle.file.Stat()
+
+	if err != nil {
+		return 0, mmapFileHandleStatError.SetUnderlying(err)
+	}
+
+	return info.Size(), nil
+}
@@ -0,0 +1,18 @@
+//go:build linux
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// Map the first size bytes of the file read only
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// Remove a mapping made by mmapFile
+func munmapFile(data []byte) (error) {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package storage
+
+import (
+	"os"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+var (
+	mmapFileHandleUnsupportedError = gataerrors.NewGataError("memory mapping is not supported on this platform")
+)
+
+// Files are never mapped so every read falls back to the file
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, mmapFileHandleUnsupportedError
+}
+
+// Nothing is ever mapped so there is nothing to remove
+func munmapFile(data []byte) (error) {
+	return nil
+}
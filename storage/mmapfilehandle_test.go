@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestMmapFileHandle(t *testing.T) {
+	directory, err := ioutil.TempDir("", "gatabase-mmapfilehandle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "data")
+
+	_, err = NewMmapFileHandle(path)
+	if !OSFileHandleNotFoundError.IsSame(err) {
+		t.Error("expected OSFileHandleNotFoundError for a missing file, got:", err)
+	}
+
+	writer, err := NewOSFileHandle(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	var handle ReadHandle
+	mmapHandle, err := NewMmapFileHandle(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle = mmapHandle
+
+	// An empty file cannot be mapped so reads use the file
+	if mmapHandle.IsMapped() {
+		t.Error("empty file should not be mapped")
+	}
+
+	read := make([]byte, 5)
+
+	_, err = handle.Read(read)
+	if err != io.EOF {
+		t.Error("expected io.EOF reading an empty file, got:", err)
+	}
+
+	_, err = writer.Write([]byte("hello"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = handle.ReadAt(read, 0)
+	if err != nil || string(read) != "hello" {
+		t.Error("did not read what was written, got:", string(read), err)
+	}
+
+	if mmapHandle.IsMapped() != (runtime.GOOS == "linux") {
+		t.Error("expected the file to be mapped only on linux, mapped:", mmapHandle.IsMapped())
+	}
+
+	// The mapping grows as the file is appended to
+	_, err = writer.Write([]byte(" world"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	end, err := handle.Seek(0, io.SeekEnd)
+	if err != nil || end != 11 {
+		t.Error("expected to seek to the end at 11, got:", end, err)
+	}
+
+	_, err = handle.Seek(6, io.SeekStart)
+	if err != nil {
+		t.Error(err)
+	}
+
+	slice, err := mmapHandle.Slice(5)
+	if err != nil || string(slice) != "world" {
+		t.Error("did not slice the appended bytes, got:", string(slice), err)
+	}
+
+	_, err = handle.Read(read)
+	if err != io.EOF {
+		t.Error("expected io.EOF reading at the end, got:", err)
+	}
+
+	// A read running past the end returns what there is
+	n, err := handle.ReadAt(read, 8)
+	if n != 3 || err != io.EOF || string(read[:n]) != "rld" {
+		t.Error("expected a short read with io.EOF, got:", n, string(read[:n]), err)
+	}
+
+	_, err = handle.ReadAt(read, -1)
+	if !MmapFileHandleNegativeOffsetError.IsSame(err) {
+		t.Error("expected MmapFileHandleNegativeOffsetError, got:", err)
+	}
+
+	err = handle.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if mmapHandle.IsMapped() {
+		t.Error("file was still mapped after Close")
+	}
+}
+
+func TestBTree_MmapReadHandle(t *testing.T) {
+	directory, err := ioutil.TempDir("", "gatabase-mmapfilehandle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "btree.index")
+
+	index, err := NewOSFileHandle(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	readHandle, err := NewMmapFileHandle(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readHandle.Close()
+
+	tree, err := OpenBTree(index, 16, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree.ReadHandle = readHandle
+	tree.MaxInlineKeySize = 8
+
+	keys := []string{"apple", "banana", "cherry", "a much longer key moved to overflow", "damson", "elderberry", "fig", "grape"}
+
+	for i, key := range keys {
+		err = tree.Insert(key, int64(i))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	for i, key := range keys {
+		location, err := tree.Find(key)
+		if err != nil || location != int64(i) {
+			t.Error("did not find key through the read handle", key, location, err)
+		}
+	}
+
+	if readHandle.IsMapped() != (runtime.GOOS == "linux") {
+		t.Error("expected the index to be mapped only on linux, mapped:", readHandle.IsMapped())
+	}
+}
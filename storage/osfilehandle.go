@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+const (
+	// How long a measurement of the free space on disk is relied on, appends
+	// In the meantime are taken off it rather than measuring again
+	osFileHandleFreeSpaceInterval = time.Second
+	// The free space of a disk which could not be measured
+	osFileHandleFreeSpaceUnknown = int64(-1)
+)
+
+var (
+	OSFileHandleNotFoundError = gataerrors.NewGataError("file does not exist")
+	OSFileHandleOpenError     = gataerrors.NewGataError("unable to open file")
+)
+
+// A handle to a file which can be read and written at the pointer or at an
+// Offset, synced to stable storage and closed
+type FileHandle interface {
+	io.ReadWriteSeeker
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Sync() error
+}
+
+// A FileHandle backed by a file on disk
+type OSFileHandle struct {
+	*os.File
+	// The free space on disk when it was last measured, less the space
+	// Reserved since
+	free      int64
+	measured  time.Time
+	freeMutex sync.Mutex
+}
+
+// Open the file at path for reading and writing, creating it if it does not
+// Exist
+func NewOSFileHandle(path string) (*OSFileHandle, error) {
+	return OpenOSFileHandle(path, os.O_RDWR|os.O_CREATE)
+}
+
+// Open the file at path with flag, as used by os.OpenFile
+func OpenOSFileHandle(path string, flag int) (*OSFileHandle, error) {
+	file, err := os.OpenFile(path, flag, 0666)
+
+	if os.IsNotExist(err) {
+		return nil, OSFileHandleNotFoundError.SetUnderlying(err)
+	}
+
+	if err != nil {
+		return nil, OSFileHandleOpenError.SetUnderlying(err)
+	}
+
+	return &OSFileHandle{File: file}, nil
+}
+
+// The bytes free on the disk the file is on
+func (handle *OSFileHandle) FreeSpace() (int64, error) {
+	return freeDiskSpace(handle.Name())
+}
+
+// Take bytes off the free space on disk, returning StorageFullError if there
+// Is not enough. The disk is only measured again once the last measurement is
+// Older than osFileHandleFreeSpaceInterval or looks too small, so appends do
+// Not each pay for measuring it. Space which cannot be measured is left for
+// The write to find out
+func (handle *OSFileHandle) reserveFreeSpace(bytes int64) (error) {
+	handle.freeMutex.Lock()
+	defer handle.freeMutex.Unlock()
+
+	if time.Since(handle.measured) > osFileHandleFreeSpaceInterval || (handle.free != osFileHandleFreeSpaceUnknown && handle.free < bytes) {
+		free, err := handle.FreeSpace()
+
+		if err != nil {
+			free = osFileHandleFreeSpaceUnknown
+		}
+
+		handle.free = free
+		handle.measured = time.Now()
+	}
+
+	if handle.free == osFileHandleFreeSpaceUnknown {
+		return nil
+	}
+
+	if handle.free < bytes {
+		return StorageFullError.SetUnderlying(fmt.Errorf("%d bytes free on disk, %d needed", handle.free, bytes))
+	}
+
+	handle.free -= bytes
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewOSFileHandle(t *testing.T) {
+	directory, err := ioutil.TempDir("", "gatabase-osfilehandle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "handle")
+
+	_, err = OpenOSFileHandle(path, os.O_RDWR)
+	if !OSFileHandleNotFoundError.IsSame(err) {
+		t.Error("expected OSFileHandleNotFoundError opening a missing file, got:", err)
+	}
+
+	var handle FileHandle
+	handle, err = NewOSFileHandle(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = handle.WriteAt([]byte("hello world"), 0)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = handle.WriteAt([]byte("there"), 6)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = handle.Sync()
+	if err != nil {
+		t.Error(err)
+	}
+
+	read := make([]byte, 5)
+
+	_, err = handle.ReadAt(read, 6)
+	if err != nil || string(read) != "there" {
+		t.Error("did not read back what was written at an offset, got:", string(read), err)
+	}
+
+	err = handle.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Opening again keeps the contents
+	reopened, err := NewOSFileHandle(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	read = make([]byte, 11)
+
+	_, err = reopened.Read(read)
+	if err != nil || string(read) != "hello there" {
+		t.Error("contents were not kept when reopening, got:", string(read), err)
+	}
+}
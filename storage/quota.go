@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+var (
+	StorageFullError = gataerrors.NewGataError("out of space, the disk or the database's quota is full")
+)
+
+// A limit on how many bytes the files of a database can take up, shared by
+// Every file of the database. Appends reserve space before they are written
+// And return StorageFullError rather than go over the limit
+type Quota struct {
+	Limit int64
+	used  int64
+	mutex sync.Mutex
+}
+
+// A handle which can check there is free space left on the disk it is on
+type freeSpaceReserver interface {
+	reserveFreeSpace(bytes int64) error
+}
+
+// Construct a quota of limit bytes
+func NewQuota(limit int64) (*Quota) {
+	return &Quota{Limit: limit}
+}
+
+// Count bytes which are already used regardless of the limit, such as the size
+// Of files which existed before the quota was set up
+func (quota *Quota) Use(bytes int64) {
+	if quota == nil {
+		return
+	}
+
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+
+	quota.used += bytes
+}
+
+// Reserve bytes for a write, returning StorageFullError if they would take
+// The database over its limit. A nil quota has no limit
+func (quota *Quota) Reserve(bytes int64) (error) {
+	if quota == nil {
+		return nil
+	}
+
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+
+	if quota.used+bytes > quota.Limit {
+		return StorageFullError.SetUnderlying(fmt.Errorf("%d of %d bytes used, %d more needed", quota.used, quota.Limit, bytes))
+	}
+
+	quota.used += bytes
+
+	return nil
+}
+
+// Give back bytes which were reserved but not written, or have been removed
+func (quota *Quota) Release(bytes int64) {
+	if quota == nil {
+		return
+	}
+
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+
+	quota.used -= bytes
+
+	if quota.used < 0 {
+		quota.used = 0
+	}
+}
+
+// The number of bytes used
+func (quota *Quota) Used() (int64) {
+	if quota == nil {
+		return 0
+	}
+
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+
+	return quota.used
+}
+
+// Check there is room for bytes to be appended to handle before writing any
+// Of them, both on the disk and in the quota
+func reserveSpace(quota *Quota, handle interface{}, bytes int64) (error) {
+	err := quota.Reserve(bytes)
+
+	if err != nil {
+		return err
+	}
+
+	if reserver, ok := handle.(freeSpaceReserver); ok {
+		err = reserver.reserveFreeSpace(bytes)
+
+		if err != nil {
+			quota.Release(bytes)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Cut handle back to end after an append failed part way through, so nothing
+// Is left of it, and give back the space reserved for it
+func rollbackAppend(quota *Quota, handle io.Seeker, end int64, reserved int64) {
+	quota.Release(reserved)
+
+	if truncater, ok := handle.(Truncater); ok {
+		truncater.Truncate(end)
+	}
+
+	handle.Seek(end, io.SeekStart)
+}
+
+// Surface a failed write as StorageFullError if it was caused by running out
+// Of space, so callers can tell a full disk or quota apart from other
+// Failures, otherwise wrap it in wrap
+func wrapWriteError(err error, wrap *gataerrors.GataError) (error) {
+	if StorageFullError.IsSame(err) {
+		return err
+	}
+
+	if isOutOfSpaceError(err) {
+		return StorageFullError.SetUnderlying(err)
+	}
+
+	if wrap == nil {
+		return err
+	}
+
+	return wrap.SetUnderlying(err)
+}
@@ -0,0 +1,25 @@
+//go:build linux
+
+package storage
+
+import (
+	"errors"
+	"syscall"
+)
+
+// The bytes free for unprivileged users on the filesystem holding path
+func freeDiskSpace(path string) (int64, error) {
+	stat := syscall.Statfs_t{}
+	err := syscall.Statfs(path, &stat)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// Whether a write failed because the disk or the user's disk quota is full
+func isOutOfSpaceError(err error) (bool) {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package storage
+
+import (
+	"errors"
+	"syscall"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+var (
+	freeDiskSpaceUnsupportedError = gataerrors.NewGataError("free disk space cannot be measured on this platform")
+)
+
+// Free space is never measured so writes find out when the disk is full
+func freeDiskSpace(path string) (int64, error) {
+	return 0, freeDiskSpaceUnsupportedError
+}
+
+// Whether a write failed because the disk is full
+func isOutOfSpaceError(err error) (bool) {
+	return errors.Is(err, syscall.ENOSPC)
+}
@@ -0,0 +1,374 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func TestQuota(t *testing.T) {
+	quota := NewQuota(100)
+	quota.Use(40)
+
+	err := quota.Reserve(60)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = quota.Reserve(1)
+	if !StorageFullError.IsSame(err) {
+		t.Error("expected StorageFullError going over the limit, got:", err)
+	}
+
+	quota.Release(30)
+
+	if quota.Used() != 70 {
+		t.Error("expected 70 bytes used, got:", quota.Used())
+	}
+
+	// A nil quota has no limit
+	var unlimited *Quota
+
+	if unlimited.Reserve(1<<40) != nil || unlimited.Used() != 0 {
+		t.Error("expected a nil quota to allow anything")
+	}
+
+	unlimited.Release(1)
+}
+
+func TestImmutableFile_Quota(t *testing.T) {
+	file, err := NewMemoryImmutableFile(make([]byte, 0), make([]byte, 0))
+	if err != nil {
+		t.Error(err)
+	}
+
+	file.Quota = NewQuota(50)
+
+	location, err := file.Append([]byte("fits in the quota"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	size := file.Quota.Used()
+
+	_, err = file.Append([]byte("does not fit in the quota"))
+	if !StorageFullError.IsSame(err) {
+		t.Error("expected StorageFullError, got:", err)
+	}
+
+	if end, _ := file.DataHandle.Seek(0, io.SeekEnd); end != size || file.Quota.Used() != size {
+		t.Error("expected nothing to be written or reserved for the record which did not fit, got:", end, file.Quota.Used())
+	}
+
+	record, err := file.ReadAt(location)
+	if err != nil || string(record) != "fits in the quota" {
+		t.Error("did not read back the record written before the quota filled, got:", string(record), err)
+	}
+
+	// The disk fills up part way through a write
+	memory := NewMemoryFileHandle(make([]byte, 0))
+	injector := &FaultInjector{FailWrite: 2, TornWriteBytes: 5, WriteError: &os.PathError{Op: "write", Path: "data", Err: syscall.ENOSPC}}
+
+	faulty, err := injector.Wrap(memory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file = ImmutableFile{DataHandle: faulty, IndexHandle: &MemoryFileHandle{}}
+
+	location, err = file.Append([]byte("first"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	size = memory.Size()
+
+	_, err = file.Append([]byte("torn"))
+	if !StorageFullError.IsSame(err) {
+		t.Error("expected StorageFullError when the disk is full, got:", err)
+	}
+
+	if memory.Size() != size {
+		t.Error("expected the torn record to be cut off, got:", memory.Size(), "bytes instead of", size)
+	}
+
+	location, err = file.Append([]byte("after"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	record, err = file.ReadAt(location)
+	if err != nil || string(record) != "after" {
+		t.Error("did not read back the record appended once space was freed, got:", string(record), err)
+	}
+}
+
+func TestBTree_Quota(t *testing.T) {
+	index := &MemoryFileHandle{}
+	tree := NewBTree(index, 16, true)
+	tree.Quota = NewQuota(2000)
+
+	inserted := int64(0)
+
+	for ; inserted < 16; inserted++ {
+		err := tree.Insert(inserted, inserted*10)
+		if StorageFullError.IsSame(err) {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if inserted == 16 {
+		t.Fatal("expected the quota to fill up")
+	}
+
+	if index.Size() != tree.Quota.Used() {
+		t.Error("expected the quota to count every byte of the index, got:", tree.Quota.Used(), "of", index.Size())
+	}
+
+	for key := int64(0); key < inserted; key++ {
+		location, err := tree.Find(key)
+		if err != nil || location != key*10 {
+			t.Error("lost key", key, "once the quota filled up", location, err)
+		}
+	}
+
+	// Raising the limit lets writes carry on
+	tree.Quota.Limit = 1 << 20
+
+	err := tree.Insert(inserted, inserted*10)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBTree_QuotaLogAndBloomFilter(t *testing.T) {
+	index := &MemoryFileHandle{}
+	wal := &MemoryFileHandle{}
+	bloomIndex := &MemoryFileHandle{}
+	tree := NewBTree(index, 16, true)
+	tree.Quota = NewQuota(1 << 20)
+	// Keep the log around to count it
+	tree.WriteAheadLogCheckpointSize = 1 << 30
+
+	err := tree.EnableWriteAheadLog(wal)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = tree.EnableBloomFilter(bloomIndex, 100, 0.01)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for key := int64(0); key < 4; key++ {
+		err = tree.Insert(key, key*10)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	if tree.Quota.Used() != index.Size()+wal.Size()+bloomIndex.Size() {
+		t.Error("expected the quota to count the index, log and bloom filter, got:", tree.Quota.Used(), "of", index.Size()+wal.Size()+bloomIndex.Size())
+	}
+
+	// Checkpointing empties the log and gives its space back
+	err = tree.Checkpoint()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if wal.Size() != 0 || tree.Quota.Used() != index.Size()+bloomIndex.Size() {
+		t.Error("expected the log's space to be released on checkpoint, got:", tree.Quota.Used(), "of", index.Size()+bloomIndex.Size())
+	}
+
+	// A log record which does not fit is refused before anything is written
+	tree.Quota.Limit = tree.Quota.Used()
+	size := index.Size()
+
+	err = tree.Insert(int64(4), int64(40))
+	if !StorageFullError.IsSame(err) {
+		t.Error("expected StorageFullError once the log could not grow, got:", err)
+	}
+
+	if wal.Size() != 0 || index.Size() != size {
+		t.Error("expected nothing to be written when the log could not grow, got:", wal.Size(), index.Size())
+	}
+
+	// A bloom filter which cannot be rebuilt past the quota
+	full := NewBTree(&MemoryFileHandle{}, 16, true)
+	full.Quota = NewQuota(10)
+
+	err = full.EnableBloomFilter(&MemoryFileHandle{}, 100, 0.01)
+	if !StorageFullError.IsSame(err) {
+		t.Error("expected StorageFullError writing a bloom filter past the quota, got:", err)
+	}
+}
+
+func TestOSFileHandle_reserveFreeSpace(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("free space is only measured on linux")
+	}
+
+	directory, err := ioutil.TempDir("", "gatabase-quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	handle, err := NewOSFileHandle(directory + "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+
+	err = handle.reserveFreeSpace(100)
+	if err != nil {
+		t.Error(err)
+	}
+
+	measured := handle.measured
+	free := handle.free
+
+	// Reserving again soon after takes the space off the last measurement
+	err = handle.reserveFreeSpace(100)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if handle.measured != measured || handle.free != free-100 {
+		t.Error("expected the disk not to be measured again, got:", handle.measured, handle.free)
+	}
+
+	// A measurement which looks too small is checked before refusing
+	handle.free = 10
+
+	err = handle.reserveFreeSpace(100)
+	if err != nil {
+		t.Error("expected the disk to be measured again rather than refuse, got:", err)
+	}
+
+	if handle.measured == measured {
+		t.Error("expected the disk to be measured again")
+	}
+
+	err = handle.reserveFreeSpace(1 << 62)
+	if !StorageFullError.IsSame(err) {
+		t.Error("expected StorageFullError reserving more than is free, got:", err)
+	}
+}
+
+func TestBTree_DiskFull(t *testing.T) {
+	clean := &FaultInjector{}
+	crashBTree(t, clean, &MemoryFileHandle{}, &MemoryFileHandle{}, 12)
+
+	for write := 1; write <= clean.Writes(); write++ {
+		injector := &FaultInjector{FailWrite: write, TornWriteBytes: 3, WriteError: &os.PathError{Op: "write", Path: "index", Err: syscall.ENOSPC}}
+		index := &MemoryFileHandle{}
+		wal := &MemoryFileHandle{}
+
+		faultyIndex, err := injector.Wrap(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		faultyWal, err := injector.Wrap(wal)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tree := NewBTree(faultyIndex, 16, true)
+		tree.WriteAheadLogCheckpointSize = 1 << 30
+
+		err = tree.EnableWriteAheadLog(faultyWal)
+		if err != nil {
+			t.Error(err)
+		}
+
+		acknowledged := make([]int64, 0)
+
+		for key := int64(0); key < 12; key++ {
+			err = tree.Insert(key, key*10)
+			if err == nil {
+				acknowledged = append(acknowledged, key)
+				continue
+			}
+
+			if !StorageFullError.IsSame(err) {
+				t.Error("write", write, "expected StorageFullError when the disk is full, got:", err)
+			}
+		}
+
+		recoverBTree(t, "disk full", index, wal, acknowledged, 12)
+	}
+}
+
+func TestSegmentedFile_Quota(t *testing.T) {
+	file, err := OpenSegmentedFile(NewMemorySegmentStore(), 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.Quota = NewQuota(100)
+
+	for i := 0; i < 3; i++ {
+		_, err = file.Append([]byte("a record of 20 bytes"))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	_, err = file.Append([]byte("a record of 20 bytes"))
+	if !StorageFullError.IsSame(err) {
+		t.Error("expected StorageFullError once the quota is full, got:", err)
+	}
+
+	// Compacting and removing a segment gives its space back
+	_, err = file.CompactSegment(0, func(location int64) bool { return false })
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = file.RemoveSegment(0)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = file.Append([]byte("a record of 20 bytes"))
+	if err != nil {
+		t.Error("expected to append once a segment was compacted, got:", err)
+	}
+}
+
+func TestOSFileHandle_FreeSpace(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("free space is only measured on linux")
+	}
+
+	directory, err := ioutil.TempDir("", "gatabase-quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	handle, err := NewOSFileHandle(directory + "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+
+	free, err := handle.FreeSpace()
+	if err != nil || free <= 0 {
+		t.Error("expected to measure the free space on disk, got:", free, err)
+	}
+
+	if !isOutOfSpaceError(&os.PathError{Op: "write", Path: "data", Err: syscall.ENOSPC}) || isOutOfSpaceError(io.ErrShortWrite) {
+		t.Error("did not recognise an out of space error")
+	}
+}
@@ -0,0 +1,651 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+const (
+	// The low bits of a segmented location are the offset in the segment and
+	// The high bits the segment, so each segment can hold up to 1TiB
+	segmentLocationOffsetBits = 40
+	segmentLocationOffsetMask = int64(1)<<segmentLocationOffsetBits - 1
+	// The highest segment id which can be encoded in a location
+	MaxSegmentId = int64(1)<<(63-segmentLocationOffsetBits) - 1
+	// Extension of the files in a FileSegmentStore
+	SegmentFileExtension = ".segment"
+)
+
+var (
+	SegmentStoreNotFoundError             = gataerrors.NewGataError("segment does not exist in the segment store")
+	SegmentedFileSegmentNotFoundError     = gataerrors.NewGataError("location refers to a segment which does not exist")
+	SegmentedFileActiveSegmentError       = gataerrors.NewGataError("unable to compact the segment being appended to")
+	SegmentedFileTooManySegmentsError     = gataerrors.NewGataError("no more segment ids can be encoded in a location")
+	SegmentedFileRecordTooLargeError      = gataerrors.NewGataError("record is larger than a segment can hold")
+	SegmentedFileSegmentSizeError         = gataerrors.NewGataError("max segment size must be positive and fit in a location's offset")
+	SegmentedFileTruncateUnsupportedError = gataerrors.NewGataError("the active segment's handle cannot be truncated to remove a torn record")
+	segmentedFileWriteError               = gataerrors.NewGataError("unable to append record to the segmented file")
+	segmentedFileCompactError             = gataerrors.NewGataError("unable to compact segment")
+	segmentStoreError                     = gataerrors.NewGataError("unable to access segment file")
+)
+
+// Where a segmented file creates, opens, lists and removes its segments. Each
+// Segment is an ImmutableFile whose index handle is not used
+type SegmentStore interface {
+	Create(id int64) (ImmutableFile, error)
+	Open(id int64) (ImmutableFile, error)
+	Remove(id int64) error
+	List() ([]int64, error)
+}
+
+// A log of records spread over numbered segments. Records are appended to the
+// Newest segment until it reaches MaxSegmentSize, then it is sealed and a new
+// Segment is started. Sealed segments are read only and can be compacted to
+// Reclaim the space of records which are no longer needed
+type SegmentedFile struct {
+	Store SegmentStore
+	// Size after which appends roll over to a new segment
+	MaxSegmentSize int64
+	// Compresses records added with Append, nil stores them as they are
+	Codec Codec
+	// When appends are synced to stable storage
+	Durability SyncPolicy
+	// Limits how much can be appended, compacted segments give their space back
+	Quota      *Quota
+	durability durabilityState
+	segments   map[int64]*ImmutableFile
+	active     int64
+	activeSize int64
+	// The key new segments are encrypted with, nil if they are not
+	key []byte
+}
+
+// Encode a segment and the offset of a record in it as a single location, as
+// Stored in BTreeElement.Location
+func EncodeSegmentLocation(segment int64, offset int64) (int64) {
+	return segment<<segmentLocationOffsetBits | offset&segmentLocationOffsetMask
+}
+
+// Split a location made by EncodeSegmentLocation into its segment and offset
+func DecodeSegmentLocation(location int64) (int64, int64) {
+	return location >> segmentLocationOffsetBits, location & segmentLocationOffsetMask
+}
+
+// Open the segments in store, the newest is appended to and the rest are
+// Sealed. The first segment is created if the store is empty
+func OpenSegmentedFile(store SegmentStore, maxSegmentSize int64) (*SegmentedFile, error) {
+	// Every offset in a segment has to fit in the low bits of a location
+	if maxSegmentSize <= 0 || maxSegmentSize > segmentLocationOffsetMask+1 {
+		return nil, SegmentedFileSegmentSizeError
+	}
+
+	file := &SegmentedFile{
+		Store:          store,
+		MaxSegmentSize: maxSegmentSize,
+		segments:       make(map[int64]*ImmutableFile),
+		durability:     newDurabilityState(),
+	}
+
+	ids, err := store.List()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ids) == 0 {
+		return file, file.createSegment(0)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	// The newest segment is the only one which can still be appended to
+	file.active = ids[len(ids)-1]
+
+	for _, id := range ids {
+		segment, err := store.Open(id)
+
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		if id != file.active {
+			segment.Seal()
+		}
+
+		file.segments[id] = &segment
+	}
+
+	file.activeSize, err = file.recoverActiveSegment()
+
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// Append a record to the newest segment, rolling over to a new segment first
+// If the record would take it past MaxSegmentSize. Returns the encoded location
+// The record can be read back from with ReadAt
+func (file *SegmentedFile) Append(record []byte) (int64, error) {
+	flags, payload, err := encodeImmutableFileRecord(file.Codec, record)
+
+	if err != nil {
+		return 0, err
+	}
+
+	size := int64(immutableFileRecordHeaderLength + len(payload))
+
+	if file.key != nil {
+		size += encryptionOverhead
+	}
+
+	if size > segmentLocationOffsetMask {
+		return 0, SegmentedFileRecordTooLargeError
+	}
+
+	// A record larger than MaxSegmentSize is given a segment of its own
+	if file.activeSize > file.segments[file.active].dataStart() && file.activeSize+size > file.MaxSegmentSize {
+		err := file.Rollover()
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// The offset would be masked into one which aliases another record
+	if file.activeSize+size > segmentLocationOffsetMask+1 {
+		return 0, SegmentedFileRecordTooLargeError
+	}
+
+	active := file.segments[file.active]
+	active.Quota = file.Quota
+	offset, written, err := active.appendEncoded(flags, payload)
+
+	if err != nil {
+		return 0, err
+	}
+
+	file.activeSize = offset + written
+
+	err = file.durability.afterWrite(file.Durability, active.DataHandle)
+
+	if err != nil {
+		return 0, segmentedFileWriteError.SetUnderlying(err)
+	}
+
+	return EncodeSegmentLocation(file.active, offset), nil
+}
+
+// Read the record appended at location
+func (file *SegmentedFile) ReadAt(location int64) ([]byte, error) {
+	id, offset := DecodeSegmentLocation(location)
+	segment, ok := file.segments[id]
+
+	if !ok {
+		return nil, SegmentedFileSegmentNotFoundError
+	}
+
+	return segment.ReadAt(offset)
+}
+
+// Encrypt new records with key. Each existing segment is read with whichever
+// Of key and previousKeys it was encrypted with, and segments written before
+// Encryption was enabled are read as they are. If the newest segment is not
+// Encrypted with key it is rolled over, so compacting every older segment
+// Re-encrypts all of the records with key
+func (file *SegmentedFile) Encrypt(key []byte, previousKeys ...[]byte) (error) {
+	keys := append([][]byte{key}, previousKeys...)
+	rollover := false
+	var err error
+
+	for _, id := range file.Segments() {
+		var match int
+		match, err = encryptSegment(file.segments[id], keys)
+
+		if id == file.active && EncryptionNotEnabledError.IsSame(err) {
+			rollover = true
+			continue
+		}
+
+		if id != file.active && (EncryptionNotEnabledError.IsSame(err) || ImmutableFileSealedError.IsSame(err)) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if id == file.active {
+			rollover = match != 0
+		}
+	}
+
+	file.key = key
+
+	if rollover {
+		return file.Rollover()
+	}
+
+	// The header may have just been written to an empty segment
+	file.activeSize, err = file.segments[file.active].DataHandle.Seek(0, io.SeekEnd)
+
+	if err != nil {
+		return segmentStoreError.SetUnderlying(err)
+	}
+
+	return nil
+}
+
+// Encrypt a segment with the first of keys it was encrypted with, returning
+// The index of the key
+func encryptSegment(segment *ImmutableFile, keys [][]byte) (int, error) {
+	for i, key := range keys {
+		err := segment.Encrypt(key)
+
+		if EncryptionWrongKeyError.IsSame(err) {
+			continue
+		}
+
+		return i, err
+	}
+
+	return 0, EncryptionWrongKeyError
+}
+
+// Seal and sync the newest segment and start appending to a new one
+func (file *SegmentedFile) Rollover() (error) {
+	if file.active >= MaxSegmentId {
+		return SegmentedFileTooManySegmentsError
+	}
+
+	active := file.segments[file.active]
+
+	// A sealed segment is never written again so it is always made durable
+	err := file.durability.sync(active.DataHandle)
+
+	if err != nil {
+		return segmentedFileWriteError.SetUnderlying(err)
+	}
+
+	active.Seal()
+
+	return file.createSegment(file.active + 1)
+}
+
+// The ids of every segment, oldest first
+func (file *SegmentedFile) Segments() ([]int64) {
+	ids := make([]int64, 0, len(file.segments))
+
+	for id := range file.segments {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	return ids
+}
+
+// The id of the segment being appended to
+func (file *SegmentedFile) ActiveSegment() (int64) {
+	return file.active
+}
+
+// Copy the records of a sealed segment which live reports are still needed to
+// The newest segment and sync them. Records are compressed and encrypted again
+// As they are copied, so compaction moves them to the current codec and key.
+// Returns the new location of each copied record keyed by its old location.
+// The segment is left in place so the old locations can still be read until
+// The caller has committed the new ones, then removes it with RemoveSegment
+func (file *SegmentedFile) CompactSegment(id int64, live func(location int64) bool) (map[int64]int64, error) {
+	if id == file.active {
+		return nil, SegmentedFileActiveSegmentError
+	}
+
+	segment, ok := file.segments[id]
+
+	if !ok {
+		return nil, SegmentedFileSegmentNotFoundError
+	}
+
+	size, err := segment.reader().Seek(0, io.SeekEnd)
+
+	if err != nil {
+		return nil, segmentedFileCompactError.SetUnderlying(err)
+	}
+
+	moved := make(map[int64]int64)
+
+	for offset := int64(0); offset < size; {
+		flags, payload, err := segment.readFramed(offset)
+
+		if err != nil {
+			return nil, segmentedFileCompactError.SetUnderlying(err)
+		}
+
+		location := EncodeSegmentLocation(id, offset)
+		offset += int64(immutableFileRecordHeaderLength + len(payload))
+
+		if flags == immutableFileRecordFlagEncryptionHeader || !live(location) {
+			continue
+		}
+
+		record, err := segment.decodeRecord(flags, payload)
+
+		if err != nil {
+			return nil, segmentedFileCompactError.SetUnderlying(err)
+		}
+
+		moved[location], err = file.Append(record)
+
+		if err != nil {
+			return nil, segmentedFileCompactError.SetUnderlying(err)
+		}
+	}
+
+	// The copies must be durable before the only other copy is removed
+	err = file.durability.sync(file.segments[file.active].DataHandle)
+
+	if err != nil {
+		return nil, segmentedFileCompactError.SetUnderlying(err)
+	}
+
+	return moved, nil
+}
+
+// Remove a sealed segment, giving its space back to the Quota. Once a segment
+// Has been compacted it should only be removed after every reference to its
+// Records has been moved to the locations CompactSegment returned
+func (file *SegmentedFile) RemoveSegment(id int64) (error) {
+	if id == file.active {
+		return SegmentedFileActiveSegmentError
+	}
+
+	segment, ok := file.segments[id]
+
+	if !ok {
+		return SegmentedFileSegmentNotFoundError
+	}
+
+	size, err := segment.reader().Seek(0, io.SeekEnd)
+
+	if err != nil {
+		return segmentedFileCompactError.SetUnderlying(err)
+	}
+
+	segment.Close()
+	delete(file.segments, id)
+
+	err = file.Store.Remove(id)
+
+	if err != nil {
+		return segmentedFileCompactError.SetUnderlying(err)
+	}
+
+	file.Quota.Release(size)
+
+	return nil
+}
+
+// Sync the newest segment to stable storage regardless of the Durability policy
+func (file *SegmentedFile) Sync() (error) {
+	return file.durability.sync(file.segments[file.active].DataHandle)
+}
+
+// Get the fsync latency metrics of the file
+func (file *SegmentedFile) SyncStats() (SyncStats) {
+	return file.durability.syncStats()
+}
+
+// Close every segment, the file cannot be used afterwards. Batched writes
+// Not yet synced are synced first
+func (file *SegmentedFile) Close() (error) {
+	firstErr := file.durability.stop()
+
+	for _, segment := range file.segments {
+		err := segment.Close()
+
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// Truncate the newest segment after its last whole record, returning its size.
+// A crash part way through an append can leave a torn record at the end which
+// Appends made after reopening would otherwise be written after
+func (file *SegmentedFile) recoverActiveSegment() (int64, error) {
+	segment := file.segments[file.active]
+	size, err := segment.DataHandle.Seek(0, io.SeekEnd)
+
+	if err != nil {
+		return 0, segmentStoreError.SetUnderlying(err)
+	}
+
+	end := int64(0)
+
+	for end < size {
+		_, payload, err := segment.readFramed(end)
+
+		if ImmutableFileRecordCorruptError.IsSame(err) {
+			break
+		}
+
+		if err != nil {
+			return 0, segmentStoreError.SetUnderlying(err)
+		}
+
+		end += int64(immutableFileRecordHeaderLength + len(payload))
+	}
+
+	if end == size {
+		return size, nil
+	}
+
+	truncater, ok := segment.DataHandle.(Truncater)
+
+	if !ok {
+		return 0, SegmentedFileTruncateUnsupportedError
+	}
+
+	err = truncater.Truncate(end)
+
+	if err != nil {
+		return 0, segmentStoreError.SetUnderlying(err)
+	}
+
+	_, err = segment.DataHandle.Seek(end, io.SeekStart)
+
+	if err != nil {
+		return 0, segmentStoreError.SetUnderlying(err)
+	}
+
+	return end, nil
+}
+
+// Create a new segment and make it the one appended to
+func (file *SegmentedFile) createSegment(id int64) (error) {
+	segment, err := file.Store.Create(id)
+
+	if err != nil {
+		return err
+	}
+
+	segment.Quota = file.Quota
+
+	if file.key != nil {
+		err = segment.Encrypt(file.key)
+
+		if err != nil {
+			segment.Close()
+			return err
+		}
+	}
+
+	file.segments[id] = &segment
+	file.active = id
+	file.activeSize = segment.dataStart()
+
+	return nil
+}
+
+// A segment store which keeps every segment in memory
+type MemorySegmentStore struct {
+	segments map[int64]ImmutableFile
+}
+
+// Construct an empty in-memory segment store
+func NewMemorySegmentStore() (*MemorySegmentStore) {
+	return &MemorySegmentStore{segments: make(map[int64]ImmutableFile)}
+}
+
+// Create an empty in-memory segment
+func (store *MemorySegmentStore) Create(id int64) (ImmutableFile, error) {
+	file, err := NewMemoryImmutableFile(make([]byte, 0), make([]byte, 0))
+
+	if err != nil {
+		return file, err
+	}
+
+	store.segments[id] = file
+
+	return file, nil
+}
+
+// Open an existing in-memory segment
+func (store *MemorySegmentStore) Open(id int64) (ImmutableFile, error) {
+	file, ok := store.segments[id]
+
+	if !ok {
+		return file, SegmentStoreNotFoundError
+	}
+
+	return file, nil
+}
+
+// Remove an in-memory segment
+func (store *MemorySegmentStore) Remove(id int64) (error) {
+	delete(store.segments, id)
+
+	return nil
+}
+
+// The ids of the in-memory segments
+func (store *MemorySegmentStore) List() ([]int64, error) {
+	ids := make([]int64, 0, len(store.segments))
+
+	for id := range store.segments {
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// A segment store which keeps each segment as a file in a directory
+type FileSegmentStore struct {
+	Directory string
+	// The filesystem the directory is in, nil for the one on disk
+	FileSystem FileSystem
+}
+
+// Construct a segment store in directory, which must already exist
+func NewFileSegmentStore(directory string) (*FileSegmentStore) {
+	return &FileSegmentStore{Directory: directory}
+}
+
+// Create the file for a new segment
+func (store *FileSegmentStore) Create(id int64) (ImmutableFile, error) {
+	return store.open(id, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+}
+
+// Open the file of an existing segment
+func (store *FileSegmentStore) Open(id int64) (ImmutableFile, error) {
+	return store.open(id, os.O_RDWR)
+}
+
+// Remove the file of a segment
+func (store *FileSegmentStore) Remove(id int64) (error) {
+	err := store.fileSystem().Remove(store.path(id))
+
+	if err != nil && !FileSystemNotFoundError.IsSame(err) {
+		return segmentStoreError.SetUnderlying(err)
+	}
+
+	return nil
+}
+
+// The ids of the segment files in the directory
+func (store *FileSegmentStore) List() ([]int64, error) {
+	names, err := store.fileSystem().List(store.Directory)
+
+	if err != nil {
+		return nil, segmentStoreError.SetUnderlying(err)
+	}
+
+	ids := make([]int64, 0, len(names))
+
+	for _, name := range names {
+		if !strings.HasSuffix(name, SegmentFileExtension) {
+			continue
+		}
+
+		id, err := strconv.ParseInt(strings.TrimSuffix(name, SegmentFileExtension), 10, 64)
+
+		// Not a file this store created
+		if err != nil {
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// Open the file of a segment with flag
+func (store *FileSegmentStore) open(id int64, flag int) (ImmutableFile, error) {
+	file := ImmutableFile{durability: newDurabilityState()}
+
+	handle, err := store.fileSystem().OpenFile(store.path(id), flag)
+
+	if FileSystemNotFoundError.IsSame(err) {
+		return file, SegmentStoreNotFoundError.SetUnderlying(err)
+	}
+
+	if err != nil {
+		return file, segmentStoreError.SetUnderlying(err)
+	}
+
+	file.DataHandle = handle
+	file.ReadHandle = openImmutableFileReadHandle(store.fileSystem(), store.path(id))
+
+	return file, nil
+}
+
+// The filesystem the segments are kept in
+func (store *FileSegmentStore) fileSystem() (FileSystem) {
+	if store.FileSystem == nil {
+		return OSFileSystem{}
+	}
+
+	return store.FileSystem
+}
+
+// The path of a segment's file
+func (store *FileSegmentStore) path(id int64) (string) {
+	return filepath.Join(store.Directory, fmt.Sprintf("%020d%s", id, SegmentFileExtension))
+}
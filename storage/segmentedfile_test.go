@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestEncodeSegmentLocation(t *testing.T) {
+	for _, test := range [][2]int64{{0, 0}, {0, 12345}, {1, 0}, {7, segmentLocationOffsetMask}, {MaxSegmentId, 99}} {
+		segment, offset := DecodeSegmentLocation(EncodeSegmentLocation(test[0], test[1]))
+
+		if segment != test[0] || offset != test[1] {
+			t.Error("expected segment and offset", test, "got:", segment, offset)
+		}
+	}
+
+	if EncodeSegmentLocation(MaxSegmentId, segmentLocationOffsetMask) < 0 {
+		t.Error("the highest location should not be negative")
+	}
+}
+
+func TestSegmentedFile_Rollover(t *testing.T) {
+	// Two 20 byte records fit in each segment
+	file, err := OpenSegmentedFile(NewMemorySegmentStore(), 2*(immutableFileRecordHeaderLength+20))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locations := make([]int64, 0)
+
+	for i := 0; i < 5; i++ {
+		location, err := file.Append([]byte(fmt.Sprintf("record %013d", i)))
+		if err != nil {
+			t.Error(err)
+		}
+
+		locations = append(locations, location)
+	}
+
+	segments := file.Segments()
+	if len(segments) != 3 || file.ActiveSegment() != 2 {
+		t.Error("expected 3 segments with the last active, got:", segments, file.ActiveSegment())
+	}
+
+	segment, offset := DecodeSegmentLocation(locations[3])
+	if segment != 1 || offset != immutableFileRecordHeaderLength+20 {
+		t.Error("expected the fourth record second in segment 1, got:", segment, offset)
+	}
+
+	for i, location := range locations {
+		record, err := file.ReadAt(location)
+		if err != nil || string(record) != fmt.Sprintf("record %013d", i) {
+			t.Error("did not read back record", i, string(record), err)
+		}
+	}
+
+	if !file.segments[0].IsSealed() || !file.segments[1].IsSealed() || file.segments[2].IsSealed() {
+		t.Error("expected every segment but the active one to be sealed")
+	}
+
+	// A record larger than a segment gets one of its own
+	location, err := file.Append(make([]byte, 100))
+	if err != nil {
+		t.Error(err)
+	}
+
+	segment, offset = DecodeSegmentLocation(location)
+	if segment != 3 || offset != 0 {
+		t.Error("expected the large record at the start of segment 3, got:", segment, offset)
+	}
+
+	_, err = file.ReadAt(EncodeSegmentLocation(10, 0))
+	if !SegmentedFileSegmentNotFoundError.IsSame(err) {
+		t.Error("expected SegmentedFileSegmentNotFoundError, got:", err)
+	}
+}
+
+func TestSegmentedFile_Reopen(t *testing.T) {
+	directory, err := ioutil.TempDir("", "gatabase-segmentedfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	store := NewFileSegmentStore(directory)
+
+	file, err := OpenSegmentedFile(store, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locations := make([]int64, 0)
+
+	for i := 0; i < 5; i++ {
+		location, err := file.Append([]byte(fmt.Sprintf("record %013d", i)))
+		if err != nil {
+			t.Error(err)
+		}
+
+		locations = append(locations, location)
+	}
+
+	err = file.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	reopened, err := OpenSegmentedFile(store, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	if len(reopened.Segments()) != 3 || reopened.ActiveSegment() != 2 {
+		t.Error("expected 3 segments with the last active after reopening, got:", reopened.Segments(), reopened.ActiveSegment())
+	}
+
+	if !reopened.segments[1].IsSealed() || reopened.segments[2].IsSealed() {
+		t.Error("expected only the newest segment to be appendable after reopening")
+	}
+
+	for i, location := range locations {
+		record, err := reopened.ReadAt(location)
+		if err != nil || string(record) != fmt.Sprintf("record %013d", i) {
+			t.Error("did not read back record after reopening", i, string(record), err)
+		}
+	}
+
+	// Appends continue after the records already in the active segment
+	location, err := reopened.Append([]byte(fmt.Sprintf("record %013d", 5)))
+	if err != nil {
+		t.Error(err)
+	}
+
+	segment, offset := DecodeSegmentLocation(location)
+	if segment != 2 || offset != immutableFileRecordHeaderLength+20 {
+		t.Error("expected the appended record second in segment 2, got:", segment, offset)
+	}
+}
+
+func TestSegmentedFile_ReopenTornRecord(t *testing.T) {
+	store := NewMemorySegmentStore()
+
+	file, err := OpenSegmentedFile(store, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := file.Append([]byte("whole record"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = file.Append([]byte("torn record"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cut the second record short as a crash part way through writing it would
+	handle := file.segments[0].DataHandle.(*MemoryFileHandle)
+	size, _ := handle.Seek(0, io.SeekEnd)
+	handle.Truncate(size - 3)
+
+	reopened, err := OpenSegmentedFile(store, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, whole := DecodeSegmentLocation(first)
+	end, _ := reopened.segments[0].DataHandle.Seek(0, io.SeekEnd)
+	if end != whole+immutableFileRecordHeaderLength+12 {
+		t.Error("expected the torn record to be truncated, got size:", end)
+	}
+
+	location, err := reopened.Append([]byte("next record"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, offset := DecodeSegmentLocation(location)
+	if offset != end {
+		t.Error("expected the next record where the torn one started, got:", offset)
+	}
+
+	for expected, location := range map[string]int64{"whole record": first, "next record": location} {
+		record, err := reopened.ReadAt(location)
+		if err != nil || string(record) != expected {
+			t.Error("did not read back record after recovering the torn one", expected, string(record), err)
+		}
+	}
+}
+
+func TestOpenSegmentedFile_SegmentSize(t *testing.T) {
+	for _, size := range []int64{0, -1, segmentLocationOffsetMask + 2} {
+		_, err := OpenSegmentedFile(NewMemorySegmentStore(), size)
+		if !SegmentedFileSegmentSizeError.IsSame(err) {
+			t.Error("expected SegmentedFileSegmentSizeError for max segment size", size, "got:", err)
+		}
+	}
+
+	_, err := OpenSegmentedFile(NewMemorySegmentStore(), segmentLocationOffsetMask+1)
+	if err != nil {
+		t.Error("expected a segment the size of the offset space to be allowed, got:", err)
+	}
+}
+
+func TestSegmentedFile_CompactSegment(t *testing.T) {
+	store := NewMemorySegmentStore()
+
+	file, err := OpenSegmentedFile(store, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locations := make([]int64, 0)
+
+	for i := 0; i < 4; i++ {
+		location, err := file.Append([]byte(fmt.Sprintf("record %d", i)))
+		if err != nil {
+			t.Error(err)
+		}
+
+		locations = append(locations, location)
+	}
+
+	_, err = file.CompactSegment(0, func(location int64) bool { return true })
+	if !SegmentedFileActiveSegmentError.IsSame(err) {
+		t.Error("expected SegmentedFileActiveSegmentError compacting the active segment, got:", err)
+	}
+
+	err = file.Rollover()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Only the even records are still needed
+	moved, err := file.CompactSegment(0, func(location int64) bool {
+		return location == locations[0] || location == locations[2]
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(moved) != 2 {
+		t.Error("expected 2 records to be moved, got:", moved)
+	}
+
+	for _, i := range []int{0, 2} {
+		record, err := file.ReadAt(moved[locations[i]])
+		if err != nil || string(record) != fmt.Sprintf("record %d", i) {
+			t.Error("did not read back moved record", i, string(record), err)
+		}
+	}
+
+	// The old locations stay readable until the segment is removed
+	record, err := file.ReadAt(locations[1])
+	if err != nil || string(record) != "record 1" {
+		t.Error("did not read the compacted segment before removing it", string(record), err)
+	}
+
+	err = file.RemoveSegment(1)
+	if !SegmentedFileActiveSegmentError.IsSame(err) {
+		t.Error("expected SegmentedFileActiveSegmentError removing the active segment, got:", err)
+	}
+
+	err = file.RemoveSegment(0)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = file.ReadAt(locations[0])
+	if !SegmentedFileSegmentNotFoundError.IsSame(err) {
+		t.Error("expected the removed segment to be gone, got:", err)
+	}
+
+	if ids, _ := store.List(); len(ids) != 1 || ids[0] != 1 {
+		t.Error("expected the compacted segment to be removed from the store, got:", ids)
+	}
+}
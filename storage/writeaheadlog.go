@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"github.com/codingbeard/gatabase/gataerrors"
+)
+
+const (
+	// Extension added to the path of the index file for its write ahead log
+	WriteAheadLogExtension = ".wal"
+	// Length and checksum of the record
+	writeAheadLogRecordHeaderLength = 4 + 4
+)
+
+var (
+	WriteAheadLogReadError                = gataerrors.NewGataError("unable to read the write ahead log")
+	WriteAheadLogTruncateUnsupportedError = gataerrors.NewGataError("write ahead log handle does not support Truncate")
+	writeAheadLogWriteError               = gataerrors.NewGataError("unable to append to the write ahead log")
+	writeAheadLogTruncateError            = gataerrors.NewGataError("unable to truncate the write ahead log")
+)
+
+// A handle which can be cut down to size
+type Truncater interface {
+	Truncate(size int64) error
+}
+
+// An append only log of checksummed records
+// Each record is its length and crc32 followed by the record itself, a record
+// Which does not match its checksum marks the end of the log as it can only be
+// The result of a torn write
+type WriteAheadLog struct {
+	Handle io.ReadWriteSeeker
+	// Limits how much the log can grow, space already used by an existing log
+	// Should be counted with Quota.Use as it is released by Truncate
+	Quota *Quota
+}
+
+// Construct a write ahead log stored in handle
+func NewWriteAheadLog(handle io.ReadWriteSeeker) (*WriteAheadLog) {
+	return &WriteAheadLog{Handle: handle}
+}
+
+// Append a record to the end of the log. If the write fails the log is cut
+// Back to the end of the last record, as a torn record followed by later ones
+// Would hide them from ReadAll
+func (log *WriteAheadLog) Append(record []byte) (error) {
+	end, err := log.Handle.Seek(0, io.SeekEnd)
+
+	if err != nil {
+		return writeAheadLogWriteError.SetUnderlying(err)
+	}
+
+	framed := make([]byte, writeAheadLogRecordHeaderLength, writeAheadLogRecordHeaderLength+len(record))
+	binary.BigEndian.PutUint32(framed[0:4], uint32(len(record)))
+	binary.BigEndian.PutUint32(framed[4:8], crc32.ChecksumIEEE(record))
+	framed = append(framed, record...)
+
+	err = reserveSpace(log.Quota, log.Handle, int64(len(framed)))
+
+	if err != nil {
+		return err
+	}
+
+	_, err = log.Handle.Write(framed)
+
+	if err != nil {
+		rollbackAppend(log.Quota, log.Handle, end, int64(len(framed)))
+		return wrapWriteError(err, writeAheadLogWriteError)
+	}
+
+	return nil
+}
+
+// Read every complete record in the log, stopping at the first torn record
+func (log *WriteAheadLog) ReadAll() ([][]byte, error) {
+	_, err := log.Handle.Seek(0, io.SeekStart)
+
+	if err != nil {
+		return nil, WriteAheadLogReadError.SetUnderlying(err)
+	}
+
+	records := make([][]byte, 0)
+	header := make([]byte, writeAheadLogRecordHeaderLength)
+
+	for {
+		_, err = io.ReadFull(log.Handle, header)
+
+		if err != nil {
+			return records, nil
+		}
+
+		record := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+		_, err = io.ReadFull(log.Handle, record)
+
+		if err != nil || crc32.ChecksumIEEE(record) != binary.BigEndian.Uint32(header[4:8]) {
+			return records, nil
+		}
+
+		records = append(records, record)
+	}
+}
+
+// The size of the log in bytes
+func (log *WriteAheadLog) Size() (int64, error) {
+	size, err := log.Handle.Seek(0, io.SeekEnd)
+
+	if err != nil {
+		return 0, WriteAheadLogReadError.SetUnderlying(err)
+	}
+
+	return size, nil
+}
+
+// Remove every record from the log
+func (log *WriteAheadLog) Truncate() (error) {
+	truncater, ok := log.Handle.(Truncater)
+
+	if !ok {
+		return WriteAheadLogTruncateUnsupportedError
+	}
+
+	size, err := log.Handle.Seek(0, io.SeekEnd)
+
+	if err != nil {
+		return writeAheadLogTruncateError.SetUnderlying(err)
+	}
+
+	err = truncater.Truncate(0)
+
+	if err != nil {
+		return writeAheadLogTruncateError.SetUnderlying(err)
+	}
+
+	log.Quota.Release(size)
+
+	_, err = log.Handle.Seek(0, io.SeekStart)
+
+	if err != nil {
+		return writeAheadLogTruncateError.SetUnderlying(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"testing"
+	"io"
+)
+
+func TestWriteAheadLog_AppendReadAll(t *testing.T) {
+	handle := &MemoryFileHandle{}
+	log := NewWriteAheadLog(handle)
+
+	records, err := log.ReadAll()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(records) != 0 {
+		t.Error("expected no records in an empty log, got:", len(records))
+	}
+
+	for _, record := range []string{"first", "second", "third"} {
+		err = log.Append([]byte(record))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	records, err = log.ReadAll()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(records) != 3 || string(records[0]) != "first" || string(records[2]) != "third" {
+		t.Error("did not read back the appended records, got:", records)
+	}
+
+	// Tear the last record
+	_, err = handle.Seek(-2, io.SeekCurrent)
+	if err != nil {
+		t.Error(err)
+	}
+
+	handle.data = handle.data[:len(handle.data)-2]
+
+	records, err = log.ReadAll()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(records) != 2 {
+		t.Error("torn record was not ignored, got records:", len(records))
+	}
+
+	// Corrupt the first record's contents
+	handle.data[writeAheadLogRecordHeaderLength] = 'F'
+
+	records, err = log.ReadAll()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(records) != 0 {
+		t.Error("record which failed its checksum was not treated as the end of the log")
+	}
+}
+
+func TestWriteAheadLog_Truncate(t *testing.T) {
+	handle := &MemoryFileHandle{}
+	log := NewWriteAheadLog(handle)
+
+	err := log.Append([]byte("record"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = log.Truncate()
+	if err != nil {
+		t.Error(err)
+	}
+
+	size, err := log.Size()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if size != 0 {
+		t.Error("log was not truncated, size:", size)
+	}
+
+	err = log.Append([]byte("after"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	records, err := log.ReadAll()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(records) != 1 || string(records[0]) != "after" {
+		t.Error("did not read the record appended after truncating, got:", records)
+	}
+
+	log = NewWriteAheadLog(&ImmutableFile{DataHandle: &MemoryFileHandle{}})
+
+	err = log.Truncate()
+	if !WriteAheadLogTruncateUnsupportedError.IsSame(err) {
+		t.Error("did not get expected error when truncating a handle without Truncate")
+	}
+}
+
+func TestWriteAheadLog_AppendTorn(t *testing.T) {
+	handle := &MemoryFileHandle{}
+	injector := &FaultInjector{FailWrite: 2, TornWriteBytes: 6}
+
+	faulty, err := injector.Wrap(handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := NewWriteAheadLog(faulty)
+
+	for _, record := range []string{"first", "second", "third"} {
+		log.Append([]byte(record))
+	}
+
+	records, err := log.ReadAll()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// The torn record is cut off so the one after it can still be read
+	if len(records) != 2 || string(records[0]) != "first" || string(records[1]) != "third" {
+		t.Error("expected the records either side of the torn one, got:", len(records))
+	}
+}